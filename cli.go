@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"filippo.io/age"
 	"fmt"
 	"github.com/jessevdk/go-flags"
 	"github.com/tkellen/cli"
@@ -11,14 +15,22 @@ import (
 	"github.com/tkellen/memorybox/internal/lambda"
 	"github.com/tkellen/memorybox/pkg/archive"
 	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/grpc"
 	"github.com/tkellen/memorybox/pkg/localdiskstore"
 	"github.com/tkellen/memorybox/pkg/objectstore"
+	"github.com/tkellen/memorybox/pkg/watch"
+	"golang.org/x/mod/semver"
+	"google.golang.org/grpc/credentials"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -29,16 +41,53 @@ type ctx struct {
 	background context.Context
 	config     *config.Config
 	logger     *archive.Logger
+	tempFiles  *fetch.TempFileRegistry
 	flag       flag
 }
 
 // flag describes options that are globally available for all command.
 type flag struct {
-	Debugging  bool   `short:"d" long:"debug"`
-	ConfigPath string `short:"c" long:"config" default:"~/.memorybox/config"`
-	Max        int    `short:"m" long:"max" default:"10"`
-	Target     string `short:"t" long:"target" default:"default"`
-	Lambda     bool   `short:"l" long:"lambda"`
+	Debugging     bool     `short:"d" long:"debug"`
+	ConfigPath    string   `short:"c" long:"config" default:"~/.memorybox/config"`
+	Max           int      `short:"m" long:"max" default:"10"`
+	Target        string   `short:"t" long:"target" default:"default"`
+	Lambda        bool     `short:"l" long:"lambda"`
+	LambdaAsync   bool     `long:"lambda-async"`
+	FixEncoding   bool     `long:"fix-encoding"`
+	Recursive     bool     `long:"recursive"`
+	Depth         int      `long:"depth" default:"1"`
+	Since         string   `long:"since"`
+	SinceLastRun  bool     `long:"since-last-run"`
+	StateFile     string   `long:"state-file"`
+	All           bool     `long:"all"`
+	CacheIndex    bool     `long:"cache-index"`
+	DB            string   `long:"db"`
+	Sort          string   `long:"sort" default:"date"`
+	Short         bool     `long:"short"`
+	Watch         bool     `long:"watch"`
+	Streaming     bool     `long:"streaming"`
+	Decompress    bool     `long:"decompress"`
+	Output        string   `short:"o" long:"output" default:"text"`
+	Merge         bool     `long:"merge"`
+	Force         bool     `long:"force"`
+	From          string   `long:"from"`
+	To            string   `long:"to"`
+	Cross         bool     `long:"cross"`
+	Meta          []string `long:"meta"`
+	Tag           []string `long:"tag"`
+	OnlyMeta      bool     `long:"only-meta"`
+	OnlyData      bool     `long:"only-data"`
+	DryRun        bool     `long:"dry-run"`
+	IncludeMeta   bool     `long:"include-metafiles"`
+	IncludeData   bool     `long:"include-datafiles"`
+	Report        bool     `long:"report"`
+	Check         bool     `long:"check"`
+	Protocol      string   `long:"protocol" default:"grpc"`
+	Listen        string   `long:"listen" default:"127.0.0.1:9090"`
+	TLSCert       string   `long:"tls-cert"`
+	TLSKey        string   `long:"tls-key"`
+	Version       string   `long:"version"`
+	EncryptConfig string   `long:"encrypt-config"`
 }
 
 // String pretty prints the content of all program options for debugging.
@@ -61,9 +110,13 @@ func Run(args []string, stdout io.Writer, stderr io.Writer) int {
 			Verbose: log.New(ioutil.Discard, "", 0),
 		},
 		background: background,
+		tempFiles:  &fetch.TempFileRegistry{},
 	}
+	// Ensure no temporary files outlive the command, even those fetch was
+	// asked to keep after an error.
+	defer ctx.tempFiles.Cleanup(false)
 	// Start goroutine to capture user requesting early shutdown (CTRL+C).
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -79,20 +132,41 @@ func Run(args []string, stdout io.Writer, stderr io.Writer) int {
 		ctx.logger.Stderr.Print(err)
 		return 1
 	}
-	// Enable verbose debugging to error stream if user has requested it.
-	if ctx.flag.Debugging {
-		ctx.logger.Verbose.SetOutput(ctx.logger.Stderr.Writer())
+	switch ctx.flag.Output {
+	case "text":
+		// Enable verbose debugging to error stream if user has requested it.
+		if ctx.flag.Debugging {
+			ctx.logger.Verbose.SetOutput(ctx.logger.Stderr.Writer())
+		}
+	case "json":
+		// Results stay on stdout; only messages about the work done become
+		// json records on stderr.
+		ctx.logger = newJSONLogger(stdout, stderr, ctx.flag.Debugging)
+	default:
+		ctx.logger.Stderr.Printf("unknown output format %s", ctx.flag.Output)
+		return 1
 	}
-	// Get configuration file from environment variable or disk.
+	file.SetPartialReadLogger(ctx.logger.Verbose)
+	// Get configuration file from environment variable or disk, asking for
+	// the identity to decrypt it with if it is encrypted and none is set.
+	config.Identity = ctx.promptIdentity
 	cfg, configErr := config.NewFromEnvOrFile(ctx.flag.ConfigPath, "MEMORYBOX_CONFIG")
 	if configErr != nil {
 		ctx.logger.Stderr.Print(configErr)
 		return 1
 	}
+	if ctx.flag.EncryptConfig != "" {
+		recipient, err := age.ParseX25519Recipient(ctx.flag.EncryptConfig)
+		if err != nil {
+			ctx.logger.Stderr.Printf("--encrypt-config: %s", err)
+			return 1
+		}
+		cfg.EncryptTo(recipient)
+	}
 	ctx.config = cfg
 	ctx.logger.Verbose.Printf("%s", ctx.flag)
 	// Run command in lambda if requested and not already doing so.
-	if ctx.flag.Lambda && os.Getenv("MEMORYBOX_LAMBDA_MODE") == "" {
+	if (ctx.flag.Lambda || ctx.flag.LambdaAsync) && os.Getenv("MEMORYBOX_LAMBDA_MODE") == "" {
 		code, err := RunLambda(ctx, args)
 		if err != nil {
 			ctx.logger.Stderr.Print(err)
@@ -103,11 +177,39 @@ func Run(args []string, stdout io.Writer, stderr io.Writer) int {
 		if ctx.background.Err() == nil {
 			ctx.logger.Stderr.Print(err)
 		}
+		var exit *exitError
+		if errors.As(err, &exit) {
+			return exit.code
+		}
 		return 1
 	}
 	return 0
 }
 
+// exitError is returned by commands which exit with a code other than 1 when
+// they fail.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// promptIdentity reads the age identity for an encrypted configuration file
+// from the environment, or asks for it on stdin if it is not set there.
+func (ctx *ctx) promptIdentity() (age.Identity, error) {
+	if os.Getenv(config.IdentityEnv) != "" {
+		return config.IdentityFromEnv()
+	}
+	ctx.logger.Stderr.Printf("%s is encrypted, enter the age identity to decrypt it:", ctx.flag.ConfigPath)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, fmt.Errorf("read age identity: %w", err)
+	}
+	return age.ParseX25519Identity(strings.TrimSpace(line))
+}
+
 func RunLambda(ctx *ctx, args []string) (int, error) {
 	var stdin io.Reader
 	fi, _ := os.Stdin.Stat()
@@ -116,7 +218,13 @@ func RunLambda(ctx *ctx, args []string) (int, error) {
 	} else {
 		stdin = os.Stdin
 	}
-	stdout, stderr, code, runErr := lambda.Run(ctx.background, ctx.config.String(), args, stdin)
+	if ctx.flag.LambdaAsync {
+		if err := lambda.RunAsync(ctx.background, ctx.config.Flatten().String(), args, stdin); err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+	stdout, stderr, code, runErr := lambda.Run(ctx.background, ctx.config.Flatten().String(), args, stdin)
 	if runErr != nil {
 		return 1, runErr
 	}
@@ -152,57 +260,161 @@ func (ctx *ctx) command() *cli.Tree {
 			"lambda": cli.Tree{
 				Fn: ctx.help,
 				SubCommands: cli.Map{
-					"create": ctx.lambdaCreate,
-					"delete": ctx.lambdaDelete,
+					"create":     ctx.lambdaCreate,
+					"delete":     ctx.lambdaDelete,
+					"iam-policy": ctx.lambdaIAMPolicy,
 				},
 			},
 			"check": cli.Tree{
 				Fn: cli.Fn{Fn: ctx.check, MinArgs: 1, Help: ctx.help},
 			},
+			"config": cli.Tree{
+				Fn: ctx.help,
+				SubCommands: cli.Map{
+					"clone": cli.Fn{Fn: ctx.configClone, MinArgs: 2, Help: ctx.help},
+				},
+			},
 			"meta": cli.Tree{
 				Fn: cli.Fn{Fn: ctx.metaGet, MinArgs: 1, Help: ctx.help},
 				SubCommands: cli.Map{
 					"set":    cli.Fn{Fn: ctx.metaSet, MinArgs: 3, Help: ctx.help},
 					"delete": cli.Fn{Fn: ctx.metaDelete, MinArgs: 2, Help: ctx.help},
+					"tag":    cli.Fn{Fn: ctx.metaTag, MinArgs: 3, Help: ctx.help},
 				},
 			},
+			"migrate-hashing": cli.Fn{Fn: ctx.migrateHashing, MinArgs: 2, Help: ctx.help},
+			"dedupe":          ctx.dedupe,
+			"gc":              ctx.gc,
+			"defrag":          ctx.defrag,
+			"compact":         ctx.compact,
+			"restore":         cli.Fn{Fn: ctx.restore, MinArgs: 1, Help: ctx.help},
+			"serve":           ctx.serve,
+			"watch":           ctx.watch,
 		},
 	}
 }
 
 const usageTemplate = `Usage:
-  %[1]s version
-  %[1]s hash <input>...
-  %[1]s [-cdt] get <ref>
-  %[1]s [-cdmt] put <path-or-url>...
-  %[1]s [-cdmt] delete <ref>
-  %[1]s [-cdmt] meta <ref> [set <key> <value> | delete <key>]
-  %[1]s [-cdmt] index [update]
+  %[1]s [-c] version [--check]
+  %[1]s hash [--short] <input>...
+  %[1]s [-cdt] get [--decompress] <ref>
+  %[1]s [-cdmt] put [--recursive [--depth=<num>]] [--since=<time> | --since-last-run] [--meta=<key>=<value>...] [--tag=<tag>...] <path-or-url>...
+  %[1]s [-cdmt] put --watch <dir>
+  %[1]s [-cdmt] put --streaming <path-or-url>...
+  %[1]s [-cdmt] delete (<ref> | --all <ref>...)
+  %[1]s [-cdmt] meta <ref> [set <key> <value> | delete <key> | tag <key> <value>]
+  %[1]s [-cdmt] index [--cache-index] [--sort=<key>]
+  %[1]s [-cdmt] index --db=<path>
+  %[1]s [-cdmt] index update [--merge] [--force] [<input>]
   %[1]s [-cdmt] import <name> <input>
-  %[1]s [-cdmt] check (pairing | metafiles | datafiles)
-  %[1]s [-cdmt] sync (metafiles | datafiles | all) <sourceTarget> <destTarget>
-  %[1]s [-cdmt] diff <sourceTarget> <destTarget>
-  %[1]s [-cdmt] lambda (create | delete)
+  %[1]s [-cdmt] check (pairing | names | metafiles [--fix-encoding] | datafiles)
+  %[1]s [-cdm] check --cross <target> <target>...
+  %[1]s [-cdmt] sync [--report] (metafiles | datafiles | all) <sourceTarget> <destTarget>
+  %[1]s [-cdmt] diff [--only-meta | --only-data] <sourceTarget> <destTarget>
+  %[1]s [-cdm] migrate-hashing [--from=<algo>] --to=<algo> <sourceTarget> <destTarget>
+  %[1]s [-cdmt] dedupe
+  %[1]s [-cdmt] gc [--dry-run] [--include-metafiles] [--include-datafiles]
+  %[1]s [-cdt] defrag
+  %[1]s [-cdt] compact
+  %[1]s [-cdt] restore <name> [--version=<id>]
+  %[1]s [-cdt] serve [--protocol=grpc] [--listen=<address>] [--tls-cert=<path> --tls-key=<path>]
+  %[1]s [-cdt] watch [<prefix>]
+  %[1]s [-c] config clone <sourceTarget> <destTarget>
+  %[1]s [-cdmt] lambda (create | delete | iam-policy)
 
 Options:
-  -c --config=<path>       Path to config file [default: ~/.memorybox/config].
+  -c --config=<path>       Path to config file or directory [default: ~/.memorybox/config].
   -l --lambda              Run in lambda.
-  -d --debug               Show debugging output [default: false].  
+  --lambda-async           Run in lambda without waiting for the result.
+  -d --debug               Show debugging output [default: false].
+  -o --output=<format>     Log as text or json [default: text].
+  --all                    Delete every supplied ref.
+  --cache-index            Reuse unchanged metafiles from the last index.
+  --sort=<key>             Order the index by name, size or date [default: date].
+  --db=<path>              Write the index to a SQLite database instead of stdout.
+  --short                  Print hashes without their algorithm suffix.
+  --fix-encoding           Rewrite non-canonical or outdated metafiles.
+  --cross                  Compare the content of several targets.
+  --only-meta              Only compare metafiles.
+  --only-data              Only compare datafiles.
+  --dry-run                Report what gc would delete without deleting it.
+  --include-metafiles      Let gc delete metafiles without a datafile.
+  --include-datafiles      Let gc delete datafiles without a metafile.
+  --report                 Print a json summary of what sync changed.
+  --check                  Check if a newer release is available.
+  --protocol=<name>        Protocol to serve the target with [default: grpc].
+  --listen=<address>       Address to serve the target on [default: 127.0.0.1:9090].
+                           Other addresses need TLS. Clients must send the token in
+                           MEMORYBOX_GRPC_TOKEN if it is set.
+  --tls-cert=<path>        Certificate to serve the target over TLS with.
+  --tls-key=<path>         Private key of the TLS certificate.
+  --version=<id>           Version of an object to restore.
+  --encrypt-config=<key>   Encrypt the config file to an age public key when it is saved.
+  --merge                  Merge updates into existing metafiles.
+  --force                  Write metafiles even if they are unchanged.
+  --from=<algo>            Only migrate datafiles hashed with this algorithm.
+  --to=<algo>              Algorithm to rehash datafiles with.
+  --recursive              Fetch same-host links and images from html pages.
+  --depth=<num>            Max links to follow from a page [default: 1].
+  --since=<time>           Only put files modified after an RFC3339 time.
+  --since-last-run         Only put files modified since the last put.
+  --state-file=<path>      Where the last put time is recorded [default: $TMPDIR/.memorybox-last-run].
+  --meta=<key>=<value>     Add a key to the metadata of new files.
+  --tag=<tag>              Tag new files.
+  --watch                  Put files as they appear in a directory until stopped.
+  --streaming              Hash content while reading it instead of beforehand.
+  --decompress             Decompress gzip, bzip2 or zstd content when getting it.
   -m --max=<num>           Max concurrent operations [default: 10].
   -t --target=<name>       Target store [default: default].
 `
 
+// printJSON writes the result of a command to stdout as a single line of
+// json.
+func (ctx *ctx) printJSON(result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	ctx.logger.Stdout.Printf("%s", data)
+	return nil
+}
+
 func (ctx *ctx) withStore(target string, fn func(archive.Store) error) error {
 	t, targetErr := ctx.config.Target(target)
 	if targetErr != nil {
 		return targetErr
 	}
+	if dirs := t.Get("trusted_hasher_dirs"); dirs != "" {
+		file.SetTrustedHasherDirs(filepath.SplitList(dirs))
+	}
 	var store archive.Store
+	// Apply defaults to a copy so they are not persisted to the config file.
+	resolved := (&config.Target{}).Merge(*t)
 	switch backend := t.Get("backend"); backend {
 	case localdiskstore.Name:
-		store = localdiskstore.New(t.Get("path"))
+		localDiskStore, err := localdiskstore.NewFromConfig(*resolved.WithDefaults(localdiskstore.Defaults))
+		if err != nil {
+			return err
+		}
+		store = localDiskStore
 	case objectstore.Name:
-		store = objectstore.NewFromConfig(*t)
+		objectStore, err := objectstore.NewFromConfig(*resolved.WithDefaults(objectstore.Defaults))
+		if err != nil {
+			return err
+		}
+		if ctx.flag.Debugging {
+			objectStore = objectStore.WithProgress(func(uploaded int64) {
+				ctx.logger.Verbose.Printf("%d bytes uploaded", uploaded)
+			})
+		}
+		objectStore.Verbose = ctx.logger.Verbose
+		store = objectStore
+	case grpc.Name:
+		client, err := grpc.NewFromConfig(*resolved)
+		if err != nil {
+			return err
+		}
+		store = client
 	default:
 		return fmt.Errorf("unknown backend %s", backend)
 	}
@@ -212,17 +424,89 @@ func (ctx *ctx) withStore(target string, fn func(archive.Store) error) error {
 	}()
 }
 
+// releaseURL is where the latest release of memorybox is described.
+var releaseURL = "https://api.github.com/repos/tkellen/memorybox/releases/latest"
+
 func (ctx *ctx) version(_ []string) error {
-	ctx.logger.Stdout.Print(version)
+	if !ctx.flag.Check {
+		ctx.logger.Stdout.Print(version)
+		return nil
+	}
+	if version == "dev" {
+		ctx.logger.Stderr.Print("skipping update check for development build")
+		return nil
+	}
+	var token string
+	if t, err := ctx.config.Target(ctx.flag.Target); err == nil {
+		token = t.Get("github_token")
+	}
+	latest, err := latestRelease(ctx.background, token)
+	if err != nil {
+		return err
+	}
+	current := canonicalVersion(version)
+	if !semver.IsValid(current) {
+		return fmt.Errorf("%w: version %s", os.ErrInvalid, version)
+	}
+	if semver.Compare(current, latest) < 0 {
+		ctx.logger.Stderr.Printf("Update available: %s (current: %s)", latest, current)
+		return nil
+	}
+	ctx.logger.Stdout.Print("Up to date")
 	return nil
 }
 
+// latestRelease finds the version of the most recent memorybox release. A
+// github token is used to authenticate the request if one is supplied.
+func latestRelease(ctx context.Context, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, releaseURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("checking latest release: %s", resp.Status)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", err
+	}
+	latest := canonicalVersion(release.TagName)
+	if !semver.IsValid(latest) {
+		return "", fmt.Errorf("%w: latest release %q", os.ErrInvalid, release.TagName)
+	}
+	return latest, nil
+}
+
+// canonicalVersion adds the "v" prefix semver comparisons require if a version
+// does not have one.
+func canonicalVersion(input string) string {
+	if strings.HasPrefix(input, "v") {
+		return input
+	}
+	return "v" + input
+}
+
 func (ctx *ctx) help(_ []string) error {
 	return fmt.Errorf(usageTemplate, ctx.name)
 }
 
 func (ctx *ctx) hash(args []string) error {
-	return fetch.Do(ctx.background, args, ctx.flag.Max, false, func(innerCtx context.Context, _ int, file *file.File) error {
+	return fetch.Do(ctx.background, args, fetch.Options{Concurrency: ctx.flag.Max, TempFiles: ctx.tempFiles}, func(innerCtx context.Context, _ int, file *file.File) error {
+		if ctx.flag.Short {
+			ctx.logger.Stdout.Println(file.Digest())
+			return nil
+		}
 		ctx.logger.Stdout.Println(file.Name)
 		return nil
 	})
@@ -230,30 +514,171 @@ func (ctx *ctx) hash(args []string) error {
 
 func (ctx *ctx) get(args []string) error {
 	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
-		file, getErr := archive.GetDataByPrefix(ctx.background, store, args[0])
+		f, getErr := archive.GetDataByPrefix(ctx.background, store, args[0])
 		if getErr != nil {
 			return getErr
 		}
-		_, err := io.Copy(ctx.logger.Stdout.Writer(), file)
+		defer f.Close()
+		if ctx.flag.Decompress {
+			if algo := f.CompressedAlgo(); algo != "" {
+				decompressed, err := f.Decompress(algo)
+				if err != nil {
+					return err
+				}
+				defer decompressed.Close()
+				f = decompressed
+			}
+		}
+		_, err := io.Copy(ctx.logger.Stdout.Writer(), f)
 		return err
 	})
 }
 
 func (ctx *ctx) put(args []string) error {
+	started := time.Now()
+	since, sinceErr := ctx.modifiedAfter()
+	if sinceErr != nil {
+		return sinceErr
+	}
+	opts, optsErr := ctx.metaFileOptions()
+	if optsErr != nil {
+		return optsErr
+	}
 	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
-		return fetch.Do(ctx.background, args, ctx.flag.Max, true, func(innerCtx context.Context, index int, file *file.File) error {
-			fileInStore, err := archive.Put(innerCtx, store, file, "")
+		if ctx.flag.Watch {
+			watcher := &watch.Watcher{
+				Logger: ctx.logger,
+				OnPut: func(f *file.File) {
+					ctx.logger.Stdout.Print(f.Meta)
+				},
+			}
+			return watcher.Start(ctx.background, args[0], store)
+		}
+		if ctx.flag.Streaming {
+			return ctx.putStreaming(store, args)
+		}
+		err := fetch.Do(ctx.background, args, fetch.Options{
+			Concurrency:         ctx.flag.Max,
+			TraverseDirectories: true,
+			Recursive:           ctx.flag.Recursive,
+			MaxDepth:            ctx.flag.Depth,
+			ModifiedAfter:       since,
+			TempFiles:           ctx.tempFiles,
+			SSH:                 ctx.sshOptions(),
+			Logger:              ctx.logger.Stderr,
+		}, func(innerCtx context.Context, index int, file *file.File) error {
+			fileInStore, err := archive.Put(innerCtx, store, file, "", opts)
 			if err != nil {
 				return err
 			}
 			ctx.logger.Stdout.Print(fileInStore.Meta)
 			return nil
 		})
+		if err != nil {
+			return err
+		}
+		// Record when this run started so the next run can pick up anything
+		// modified while it was in progress.
+		return ioutil.WriteFile(ctx.stateFile(), []byte(started.UTC().Format(time.RFC3339Nano)), 0644)
 	})
 }
 
+// sshOptions determines how to connect to sftp servers from the sftp_key_path
+// and sftp_known_hosts values of the current target.
+func (ctx *ctx) sshOptions() fetch.SSHOptions {
+	var opts fetch.SSHOptions
+	if t, err := ctx.config.Target(ctx.flag.Target); err == nil {
+		opts.KeyPath = t.Get("sftp_key_path")
+		opts.KnownHosts = t.Get("sftp_known_hosts")
+	}
+	return opts
+}
+
+// metaFileOptions collects the metadata supplied with --meta and --tag.
+func (ctx *ctx) metaFileOptions() (file.MetaFileOptions, error) {
+	opts := file.MetaFileOptions{Tags: ctx.flag.Tag}
+	if t, err := ctx.config.Target(ctx.flag.Target); err == nil {
+		opts.Thumbnail = t.Get("generate_thumbnails") == "true"
+	}
+	for _, pair := range ctx.flag.Meta {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return opts, fmt.Errorf("%w: meta must be supplied as <key>=<value>, got %q", os.ErrInvalid, pair)
+		}
+		if opts.ExtraKeys == nil {
+			opts.ExtraKeys = map[string]string{}
+		}
+		opts.ExtraKeys[parts[0]] = parts[1]
+	}
+	return opts, nil
+}
+
+// putStreaming persists each request by hashing it as it is read, avoiding a
+// separate pass over the content to name it.
+func (ctx *ctx) putStreaming(store archive.Store, args []string) error {
+	for _, arg := range args {
+		source, err := fetch.Stream(ctx.background, arg)
+		if err != nil {
+			return err
+		}
+		name := arg
+		if arg == "-" {
+			name = "stdin"
+		}
+		fileInStore, putErr := archive.PutStreaming(ctx.background, store, name, file.NewSha256StreamingHasher(source), "")
+		source.Close()
+		if putErr != nil {
+			return putErr
+		}
+		ctx.logger.Stdout.Print(fileInStore.Meta)
+	}
+	return nil
+}
+
+// indexCacheFile determines where the index cache for a store is kept.
+func (ctx *ctx) indexCacheFile(store archive.Store) string {
+	key, _, _ := file.Sha256(strings.NewReader(ctx.flag.Target + store.String()))
+	return filepath.Join(os.TempDir(), fmt.Sprintf(".memorybox-index-%s", key[:16]))
+}
+
+// stateFile returns the path where the time of the last successful put is
+// recorded.
+func (ctx *ctx) stateFile() string {
+	if ctx.flag.StateFile != "" {
+		return ctx.flag.StateFile
+	}
+	return filepath.Join(os.TempDir(), ".memorybox-last-run")
+}
+
+// modifiedAfter determines the time, if any, that files must be modified after
+// in order to be put.
+func (ctx *ctx) modifiedAfter() (*time.Time, error) {
+	since := ctx.flag.Since
+	if ctx.flag.SinceLastRun {
+		lastRun, err := ioutil.ReadFile(ctx.stateFile())
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		since = strings.TrimSpace(string(lastRun))
+	}
+	if since == "" {
+		return nil, nil
+	}
+	result, err := time.Parse(time.RFC3339Nano, since)
+	if err != nil {
+		return nil, fmt.Errorf("since: %w", err)
+	}
+	return &result, nil
+}
+
 func (ctx *ctx) delete(args []string) error {
 	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
+		if ctx.flag.All {
+			return archive.BulkDelete(ctx.background, ctx.logger, store, ctx.flag.Max, args)
+		}
 		return archive.Delete(ctx.background, store, args[0])
 	})
 }
@@ -261,7 +686,7 @@ func (ctx *ctx) delete(args []string) error {
 func (ctx *ctx) importFn(args []string) error {
 	name, importFile := args[0], args[1]
 	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
-		return fetch.Do(ctx.background, []string{importFile}, ctx.flag.Max, false, func(innerCtx context.Context, _ int, f *file.File) error {
+		return fetch.Do(ctx.background, []string{importFile}, fetch.Options{Concurrency: ctx.flag.Max, TempFiles: ctx.tempFiles, SSH: ctx.sshOptions()}, func(innerCtx context.Context, _ int, f *file.File) error {
 			return archive.Import(innerCtx, ctx.logger, store, ctx.flag.Max, name, f)
 		})
 	})
@@ -269,8 +694,25 @@ func (ctx *ctx) importFn(args []string) error {
 
 func (ctx *ctx) index(_ []string) error {
 	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
-		index, err := archive.Index(ctx.background, store, ctx.flag.Max)
-		if err != nil {
+		if ctx.flag.DB != "" {
+			return archive.IndexToSQLite(ctx.background, store, ctx.flag.Max, ctx.flag.DB)
+		}
+		var index [][]byte
+		var err error
+		opts := archive.IndexOptions{SortKey: ctx.flag.Sort}
+		if ctx.flag.CacheIndex {
+			cache, cacheErr := archive.NewIndexCache(ctx.indexCacheFile(store))
+			if cacheErr != nil {
+				return cacheErr
+			}
+			if index, err = cache.Index(ctx.background, store, ctx.flag.Max, opts); err != nil {
+				return err
+			}
+			ctx.logger.Verbose.Printf("index cache: %d hits, %d misses", cache.Hits, cache.Misses)
+			if err := cache.Save(); err != nil {
+				return err
+			}
+		} else if index, err = archive.Index(ctx.background, store, ctx.flag.Max, opts); err != nil {
 			return err
 		}
 		for _, line := range index {
@@ -295,33 +737,302 @@ func (ctx *ctx) indexUpdate(args []string) error {
 				return err
 			}
 		}
-		return archive.IndexUpdate(ctx.background, ctx.logger, store, ctx.flag.Max, input)
+		stats, err := archive.IndexUpdate(ctx.background, ctx.logger, store, ctx.flag.Max, input, ctx.flag.Merge, ctx.flag.Force)
+		if err != nil {
+			return err
+		}
+		ctx.logger.Verbose.Printf("%d metafiles updated, %d unchanged", stats.Updated, stats.Skipped)
+		return nil
 	})
 }
 
 func (ctx *ctx) check(args []string) error {
+	if ctx.flag.Cross {
+		return ctx.crossCheck(args)
+	}
 	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
-		result, err := archive.Check(ctx.background, store, ctx.flag.Max, args[0])
-		if err == nil {
+		result, err := archive.Check(ctx.background, store, ctx.flag.Max, args[0], ctx.flag.FixEncoding)
+		if err != nil {
+			return err
+		}
+		if ctx.flag.Output == "json" {
+			if err := ctx.printJSON(result); err != nil {
+				return err
+			}
+		} else {
 			ctx.logger.Stdout.Printf("%s", result)
-			return nil
 		}
-		return err
+		if result.Code != 0 {
+			return &exitError{code: result.Code, err: fmt.Errorf("check found %d issues", len(result.Issues))}
+		}
+		return nil
 	})
 }
 
+func (ctx *ctx) crossCheck(targets []string) error {
+	if len(targets) < 2 {
+		return fmt.Errorf("at least two targets are required")
+	}
+	var stores []archive.Store
+	var compare func(remaining []string) error
+	compare = func(remaining []string) error {
+		if len(remaining) == 0 {
+			report, err := archive.CrossStoreCheck(ctx.background, stores, ctx.flag.Max, true)
+			if err != nil {
+				return err
+			}
+			ctx.logger.Stdout.Printf("%s", report)
+			if len(report.MissingFromStores) > 0 || len(report.HashMismatches) > 0 {
+				return fmt.Errorf("stores differ")
+			}
+			return nil
+		}
+		return ctx.withStore(remaining[0], func(store archive.Store) error {
+			stores = append(stores, store)
+			return compare(remaining[1:])
+		})
+	}
+	return compare(targets)
+}
+
 func (ctx *ctx) sync(args []string) error {
 	return ctx.withStore(args[1], func(srcStore archive.Store) error {
 		return ctx.withStore(args[2], func(destStore archive.Store) error {
-			return archive.Sync(ctx.background, ctx.logger, srcStore, destStore, args[0], ctx.flag.Max)
+			report, err := archive.Sync(ctx.background, ctx.logger, srcStore, destStore, args[0], ctx.flag.Max)
+			// The report is printed even when the sync fails so the files
+			// which were copied, and those which could not be, are known.
+			if ctx.flag.Output == "json" || ctx.flag.Report {
+				if printErr := ctx.printJSON(report); printErr != nil {
+					return printErr
+				}
+				return err
+			}
+			ctx.logger.Stdout.Printf("Copied %s across %d files, skipped %d in %s", humanBytes(report.BytesTransferred), report.FilesCopied, report.FilesSkipped, report.Duration.Round(time.Millisecond))
+			for _, failure := range report.Errors {
+				ctx.logger.Stderr.Printf("%s", failure)
+			}
+			return err
+		})
+	})
+}
+
+func (ctx *ctx) migrateHashing(args []string) error {
+	if ctx.flag.To == "" {
+		return fmt.Errorf("--to is required")
+	}
+	hash, err := file.HasherByNameWithContext(ctx.background, ctx.flag.To)
+	if err != nil {
+		return err
+	}
+	return ctx.withStore(args[0], func(srcStore archive.Store) error {
+		return ctx.withStore(args[1], func(destStore archive.Store) error {
+			return archive.RehashStore(ctx.background, ctx.logger, srcStore, destStore, ctx.flag.From, hash, ctx.flag.Max)
+		})
+	})
+}
+
+// watch prints changes to objects in the store as they happen until the
+// program is interrupted.
+func (ctx *ctx) watch(args []string) error {
+	prefix := ""
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
+		watcher, ok := store.(archive.Watcher)
+		if !ok {
+			return fmt.Errorf("%w: %s does not support watching", os.ErrInvalid, store)
+		}
+		events := make(chan archive.StoreEvent)
+		watchErr := make(chan error, 1)
+		go func() {
+			watchErr <- watcher.Watch(ctx.background, prefix, events)
+		}()
+		for {
+			select {
+			case event := <-events:
+				ctx.logger.Stdout.Printf("%s %s", event.Type, event.Name)
+			case err := <-watchErr:
+				return err
+			}
+		}
+	})
+}
+
+func (ctx *ctx) dedupe(_ []string) error {
+	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
+		groups, err := archive.Dedupe(ctx.background, store, ctx.flag.Max)
+		if err != nil {
+			return err
+		}
+		details, err := archive.DedupeDetails(ctx.background, store, groups)
+		if err != nil {
+			return err
+		}
+		for index, group := range details {
+			if index > 0 {
+				ctx.logger.Stdout.Print("")
+			}
+			for _, entry := range group {
+				ctx.logger.Stdout.Printf("%s\t%d\t%s", entry.Name, entry.Size, entry.Source)
+			}
+		}
+		return nil
+	})
+}
+
+func (ctx *ctx) gc(_ []string) error {
+	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
+		report, err := archive.GarbageCollect(ctx.background, ctx.logger, store, ctx.flag.Max, archive.GCOptions{
+			DryRun:    ctx.flag.DryRun,
+			Metafiles: ctx.flag.IncludeMeta,
+			Datafiles: ctx.flag.IncludeData,
 		})
+		if err != nil {
+			return err
+		}
+		if ctx.flag.Output == "json" {
+			return ctx.printJSON(report)
+		}
+		verb := "Freed"
+		if report.DryRun {
+			verb = "Would free"
+		}
+		for _, name := range report.Orphans {
+			ctx.logger.Stdout.Print(name)
+		}
+		ctx.logger.Stdout.Printf("%s %s across %d files", verb, humanBytes(report.TotalBytesFreeable), len(report.Orphans))
+		return nil
+	})
+}
+
+func (ctx *ctx) defrag(_ []string) error {
+	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
+		localDiskStore, ok := store.(*localdiskstore.Store)
+		if !ok {
+			return fmt.Errorf("%w: defrag is only supported by %s targets", os.ErrInvalid, localdiskstore.Name)
+		}
+		saved, err := localDiskStore.DefragWithProgress(func(name string, saved int64) {
+			ctx.logger.Verbose.Printf("%s (defragmented, %d bytes saved)", name, saved)
+		})
+		if err != nil {
+			return err
+		}
+		ctx.logger.Stdout.Printf("Saved %s", humanBytes(saved))
+		return nil
+	})
+}
+
+func (ctx *ctx) compact(_ []string) error {
+	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
+		compactor, ok := store.(archive.Compactor)
+		if !ok {
+			return fmt.Errorf("%w: %s cannot be compacted", os.ErrInvalid, store)
+		}
+		report, err := compactor.Compact(ctx.background)
+		if err != nil {
+			return err
+		}
+		if ctx.flag.Output == "json" {
+			return ctx.printJSON(report)
+		}
+		ctx.logger.Stdout.Printf("Aborted %d incomplete uploads, freed %s", report.AbortedUploads, humanBytes(report.FreedBytes))
+		return nil
 	})
 }
 
+func (ctx *ctx) restore(args []string) error {
+	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
+		versioner, ok := store.(archive.Versioner)
+		if !ok {
+			return fmt.Errorf("%w: %s does not keep versions", os.ErrInvalid, store)
+		}
+		if ctx.flag.Version == "" {
+			versions, err := versioner.ListVersions(ctx.background, args[0])
+			if err != nil {
+				return err
+			}
+			for _, version := range versions {
+				ctx.logger.Stdout.Print(version)
+			}
+			return nil
+		}
+		if err := versioner.RestoreVersion(ctx.background, args[0], ctx.flag.Version); err != nil {
+			return err
+		}
+		ctx.logger.Verbose.Printf("%s (restored version %s)", args[0], ctx.flag.Version)
+		return nil
+	})
+}
+
+func (ctx *ctx) serve(_ []string) error {
+	if ctx.flag.Protocol != "grpc" {
+		return fmt.Errorf("%w: unknown protocol %s", os.ErrInvalid, ctx.flag.Protocol)
+	}
+	opts := grpc.ServeOptions{Token: os.Getenv(grpc.TokenEnv)}
+	if ctx.flag.TLSCert != "" || ctx.flag.TLSKey != "" {
+		creds, err := credentials.NewServerTLSFromFile(ctx.flag.TLSCert, ctx.flag.TLSKey)
+		if err != nil {
+			return err
+		}
+		opts.Credentials = creds
+	}
+	return ctx.withStore(ctx.flag.Target, func(store archive.Store) error {
+		listener, err := net.Listen("tcp", ctx.flag.Listen)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		ctx.logger.Stderr.Printf("serving %s over %s on %s", store, ctx.flag.Protocol, listener.Addr())
+		return grpc.Serve(ctx.background, listener, store, opts)
+	})
+}
+
+// humanBytes formats a number of bytes using decimal units.
+func humanBytes(size int64) string {
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "kMGTPE"[exp])
+}
+
+func (ctx *ctx) configClone(args []string) error {
+	if err := ctx.config.CloneTarget(args[0], args[1]); err != nil {
+		return err
+	}
+	return ctx.config.Save()
+}
+
 func (ctx *ctx) diff(args []string) error {
+	mode := "all"
+	switch {
+	case ctx.flag.OnlyMeta && ctx.flag.OnlyData:
+		return fmt.Errorf("%w: --only-meta and --only-data cannot be used together", os.ErrInvalid)
+	case ctx.flag.OnlyMeta:
+		mode = "metafiles"
+	case ctx.flag.OnlyData:
+		mode = "datafiles"
+	}
 	return ctx.withStore(args[0], func(srcStore archive.Store) error {
 		return ctx.withStore(args[1], func(destStore archive.Store) error {
-			return archive.Diff(ctx.background, srcStore, destStore)
+			result, err := archive.Compare(ctx.background, srcStore, destStore, mode)
+			if err != nil {
+				return err
+			}
+			if ctx.flag.Output == "json" {
+				if err := ctx.printJSON(result); err != nil {
+					return err
+				}
+				return result.Err()
+			}
+			ctx.logger.Stdout.Printf("comparing %s", mode)
+			return result.Err()
 		})
 	})
 }
@@ -336,18 +1047,38 @@ func (ctx *ctx) withMeta(name string, fn func(*file.File, archive.Store) error)
 	})
 }
 
+// invalidateIndexCache removes a metafile from the index cache, if one is in
+// use, so the next index reflects changes made to it.
+func (ctx *ctx) invalidateIndexCache(store archive.Store, name string) error {
+	if !ctx.flag.CacheIndex {
+		return nil
+	}
+	cache, err := archive.NewIndexCache(ctx.indexCacheFile(store))
+	if err != nil {
+		return err
+	}
+	cache.Invalidate(name)
+	return cache.Save()
+}
+
 func (ctx *ctx) metaGet(args []string) error {
 	return ctx.withMeta(args[0], func(f *file.File, _ archive.Store) error {
-		ctx.logger.Stdout.Print(f.Meta)
-		return nil
+		return f.WriteMetaStream(ctx.logger.Stdout.Writer())
 	})
 }
 
 func (ctx *ctx) metaSet(args []string) error {
 	return ctx.withMeta(args[0], func(f *file.File, store archive.Store) error {
-		f.Meta.Set(args[1], args[2])
+		if args[1] == file.MetaKeyTags {
+			f.Meta.SetTags(file.ParseTags(args[2]))
+		} else {
+			f.Meta.Set(args[1], args[2])
+		}
 		ctx.logger.Stdout.Print(f.Meta)
-		return store.Put(ctx.background, bytes.NewReader(*f.Meta), f.Name, time.Now())
+		if err := archive.PutMeta(ctx.background, store, f.Name, *f.Meta); err != nil {
+			return err
+		}
+		return ctx.invalidateIndexCache(store, f.Name)
 	})
 }
 
@@ -355,7 +1086,31 @@ func (ctx *ctx) metaDelete(args []string) error {
 	return ctx.withMeta(args[0], func(f *file.File, store archive.Store) error {
 		f.Meta.Delete(args[1])
 		ctx.logger.Stdout.Print(f.Meta)
-		return store.Put(ctx.background, bytes.NewReader(*f.Meta), f.Name, time.Now())
+		if err := archive.PutMeta(ctx.background, store, f.Name, *f.Meta); err != nil {
+			return err
+		}
+		return ctx.invalidateIndexCache(store, f.Name)
+	})
+}
+
+// metaTag labels a datafile with a tag kept by the store rather than in its
+// metafile.
+func (ctx *ctx) metaTag(args []string) error {
+	return ctx.withMeta(args[0], func(f *file.File, store archive.Store) error {
+		tagger, ok := store.(archive.Tagger)
+		if !ok {
+			return fmt.Errorf("%w: %s does not support tagging", os.ErrInvalid, store)
+		}
+		name := file.DataNameFrom(f.Name)
+		if err := tagger.Tag(ctx.background, name, map[string]string{args[1]: args[2]}); err != nil {
+			return err
+		}
+		tags, err := tagger.GetTags(ctx.background, name)
+		if err != nil {
+			return err
+		}
+		ctx.logger.Stdout.Print(tags)
+		return nil
 	})
 }
 
@@ -376,3 +1131,12 @@ func (ctx *ctx) lambdaDelete(_ []string) error {
 	ctx.logger.Stdout.Print(script)
 	return nil
 }
+
+func (ctx *ctx) lambdaIAMPolicy(_ []string) error {
+	policy, err := lambda.IAMPolicy(ctx.config, ctx.flag.Target)
+	if err != nil {
+		return err
+	}
+	ctx.logger.Stdout.Print(policy)
+	return nil
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"github.com/tkellen/memorybox/pkg/archive"
 	"github.com/tkellen/memorybox/pkg/file"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
@@ -59,30 +63,60 @@ func TestRunner(t *testing.T) {
 	table := map[int][]string{
 		0: {
 			"-d -c {{configPath}} -t test hash {{tempFile}}",
+			"-d -c {{configPath}} -t test hash --short {{tempFile}}",
 			"-d -c {{configPath}} -t test version",
+			"-d -o json -c {{configPath}} -t test put {{tempFile}}",
 			"-d -c {{configPath}} -t test put {{tempFile}}",
+			"-d -c {{configPath}} -t test put --streaming {{tempFile}}",
+			"-d -c {{configPath}} -t test put --meta title=test --tag a --tag b {{tempFile}}",
+			"-d -c {{configPath}} -t test put --since 2000-01-01T00:00:00Z {{tempFile}}",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test put --since-last-run {{tempFile}}",
 			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test get {{hash}}",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test get --decompress {{hash}}",
 			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test meta {{hash}}",
 			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test meta {{hash}} set key value",
 			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test meta {{hash}} delete key value",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test meta {{hash}} set tags a,b,c",
 			"-d -c {{configPath}} -t test index",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test index --cache-index && -d -c {{configPath}} -t test --cache-index meta {{hash}} set key value && -d -c {{configPath}} -t test index --cache-index",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test index --db=:memory:",
 			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test index update {{goodIndexUpdateFile}}",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test index update --merge {{goodIndexUpdateFile}}",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test index update --force {{goodIndexUpdateFile}}",
 			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test delete {{hash}}",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test delete --all {{hash}}",
 			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} sync metafiles test alternate",
 			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} sync datafiles test alternate",
 			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} sync all test alternate",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} sync --report all test alternate",
 			"-d -c {{configPath}} -t test import test testdata/good-import-file",
 			"-d -c testdata/config -t valid check pairing",
 			"-d -c testdata/config -t valid check metafiles",
+			"-d -c testdata/config -t valid check metafiles --fix-encoding",
 			"-d -c testdata/config -t valid check datafiles",
+			"-d -c testdata/config -t valid check names",
+			"-d -c testdata/config check --cross valid valid",
+			"-d -c testdata/config -t valid dedupe",
+			"-d -c {{configPath}} config clone test test-copy && -d -c {{configPath}} -t test-copy index",
+			"-d -c testdata/config -t valid gc --dry-run",
+			"-d -c testdata/config -t valid gc --dry-run --include-metafiles",
+			"-d -o json -c testdata/config -t valid gc --dry-run",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test gc",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test gc --include-metafiles --include-datafiles",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test defrag",
 			"-d -c testdata/config diff valid valid",
+			"-d -c testdata/config diff --only-meta valid valid",
+			"-d -o json -c testdata/config diff --only-meta valid valid",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} migrate-hashing --from=sha256 --to=sha256 test alternate",
 			"-d -c {{configPath}} lambda create",
 			"-d -c {{configPath}} lambda delete",
+			"-d -c testdata/config -t object lambda iam-policy",
 		},
 		1: {
 			"",
 			"-d -c testdata/config help",
 			"-d -c testdata/config -badflag",
+			"-d -o yaml -c testdata/config version",
 			"-d -c testdata/config -t missingTarget index",
 			"-d -c testdata/config -t invalid index",
 			"-d -c testdata/config -t valid unknown",
@@ -90,18 +124,44 @@ func TestRunner(t *testing.T) {
 			"-d -c testdata/config -t valid get",
 			"-d -c testdata/config -t valid meta",
 			"-d -c testdata/config -t valid put missing",
+			"-d -c testdata/config -t valid put --since yesterday testdata/file",
+			"-d -c testdata/config -t valid put --streaming missing",
+			"-d -c testdata/config -t valid put --meta title testdata/file",
 			"-d -c testdata/config -t valid get missing",
 			"-d -c testdata/config -t valid delete missing",
+			"-d -c testdata/config -t valid delete --all missing other",
 			"-d -c testdata/config -t valid meta missing",
 			"-d -c /root/cant/write/here/path version",
 			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test index update {{badIndexUpdateFile}}",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} -t test meta {{hash}} tag key value",
 			"-d -c testdata/config -t object index",
+			"-d -c testdata/config -t object defrag",
+			"-d -c {{configPath}} -t test put {{tempFile}} && -d -c {{configPath}} sync metafiles test alternate && -d -c {{configPath}} -t alternate gc --include-metafiles",
+			"-d -c testdata/config -t valid compact",
+			"-d -c testdata/config -t valid restore test --version=1",
+			"-d -c testdata/config --encrypt-config=invalid version",
+			"-d -c testdata/config -t valid serve --protocol=http",
+			"-d -c testdata/config -t valid serve --listen=invalid",
+			"-d -c testdata/config -t valid serve --listen=0.0.0.0:0",
+			"-d -c testdata/config -t valid serve --tls-cert=missing --tls-key=missing",
+			"-d -c testdata/config -t grpc index",
+			"-d -c testdata/config -t grpc watch",
 			"-d -c testdata/config -t valid import test testdata/bad-import-file",
 			"-d -c testdata/config -t datafile-pair-missing check pairing",
 			"-d -c testdata/config -t valid check pairing",
 			"-d -c testdata/config -t datafile-corrupted check datafiles",
 			"-d -c testdata/config -t metafile-corrupted check metafiles",
+			"-d -c testdata/config check --cross valid",
+			"-d -c testdata/config check --cross valid valid-alternate",
 			"-d -c testdata/config diff valid valid-alternate",
+			"-d -c testdata/config diff --only-data valid valid-alternate",
+			"-d -o json -c testdata/config diff valid valid-alternate",
+			"-d -c testdata/config diff --only-meta --only-data valid valid",
+			"-d -c testdata/config migrate-hashing valid valid-alternate",
+			"-d -c testdata/config migrate-hashing --to=missing valid valid-alternate",
+			"-d -c testdata/config -t valid lambda iam-policy",
+			"-d -c testdata/config config clone missing other",
+			"-d -c testdata/config config clone valid valid-alternate",
 		},
 	}
 	for expectedCode, commands := range table {
@@ -134,3 +194,156 @@ func TestRunner(t *testing.T) {
 		}
 	}
 }
+
+func Test_checkExitCodes(t *testing.T) {
+	table := map[string]int{
+		"-c testdata/config -t valid check datafiles":                      0,
+		"-c testdata/config -t datafile-pair-missing check pairing":        1,
+		"-c testdata/config -t datafile-corrupted check datafiles":         2,
+		"-c testdata/config -t metafile-corrupted check metafiles":         3,
+		"-o json -c testdata/config -t metafile-corrupted check metafiles": 3,
+	}
+	for command, expectedCode := range table {
+		command, expectedCode := command, expectedCode
+		t.Run(command, func(t *testing.T) {
+			stdout := bytes.NewBuffer([]byte{})
+			stderr := bytes.NewBuffer([]byte{})
+			if actualCode := Run(strings.Fields("memorybox "+command), stdout, stderr); actualCode != expectedCode {
+				t.Fatalf("expected code %d, got %d\nSTDERR:\n%s\nSTDOUT:\n%s\n", expectedCode, actualCode, stderr, stdout)
+			}
+		})
+	}
+}
+
+func Test_checkAfterPut(t *testing.T) {
+	files := testSetup(t)
+	defer os.RemoveAll(files.storePath)
+	defer os.Remove(files.configPath)
+	defer os.Remove(files.goodIndexUpdateFile)
+	defer os.Remove(files.badIndexUpdateFile)
+	commands := []string{
+		fmt.Sprintf("-c %s -t test put --meta title=test %s", files.configPath, files.configPath),
+		fmt.Sprintf("-c %s -t test meta %s set key value", files.configPath, files.configFileHash),
+		fmt.Sprintf("-c %s -t test meta %s delete title", files.configPath, files.configFileHash),
+		fmt.Sprintf("-c %s -t test check metafiles", files.configPath),
+	}
+	for _, command := range commands {
+		stdout := bytes.NewBuffer([]byte{})
+		stderr := bytes.NewBuffer([]byte{})
+		if code := Run(strings.Fields("memorybox "+command), stdout, stderr); code != 0 {
+			t.Fatalf("%s exited with code %d\nSTDERR:\n%s\nSTDOUT:\n%s\n", command, code, stderr, stdout)
+		}
+		if strings.Contains(stdout.String()+stderr.String(), "not canonically encoded") {
+			t.Fatalf("expected metafiles written by memorybox to be canonical, got\n%s%s", stdout, stderr)
+		}
+	}
+}
+
+func Test_jsonOutput(t *testing.T) {
+	stdout := bytes.NewBuffer([]byte{})
+	stderr := bytes.NewBuffer([]byte{})
+	if code := Run(strings.Fields("memorybox -o json -c testdata/config -t valid check datafiles"), stdout, stderr); code != 0 {
+		t.Fatalf("expected code 0, got %d\nSTDERR:\n%s", code, stderr)
+	}
+	var result archive.CheckResult
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		t.Fatalf("expected a json result on stdout, got %q: %s", stdout, err)
+	}
+	if len(result.Items) == 0 {
+		t.Fatalf("expected checked items in the result, got %q", stdout)
+	}
+	if strings.Contains(stderr.String(), `"items"`) {
+		t.Fatalf("expected the result not to be logged to stderr, got %q", stderr)
+	}
+}
+
+func Test_jsonOutputDiff(t *testing.T) {
+	stdout := bytes.NewBuffer([]byte{})
+	stderr := bytes.NewBuffer([]byte{})
+	if code := Run(strings.Fields("memorybox -o json -c testdata/config diff --only-meta valid valid-alternate"), stdout, stderr); code != 1 {
+		t.Fatalf("expected code 1, got %d\nSTDERR:\n%s", code, stderr)
+	}
+	var result archive.DiffResult
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		t.Fatalf("expected a json result on stdout, got %q: %s", stdout, err)
+	}
+	if result.Mode != "metafiles" {
+		t.Fatalf("expected mode metafiles, got %q", result.Mode)
+	}
+	if len(result.OnlyInSource) != 0 || len(result.OnlyInDest) != 1 {
+		t.Fatalf("expected one metafile only in the destination, got %q", stdout)
+	}
+}
+
+func Test_humanBytes(t *testing.T) {
+	table := map[int64]string{
+		0:          "0 B",
+		999:        "999 B",
+		1000:       "1.0 kB",
+		1400000000: "1.4 GB",
+	}
+	for input, expected := range table {
+		if actual := humanBytes(input); actual != expected {
+			t.Fatalf("expected %d to format as %s, got %s", input, expected, actual)
+		}
+	}
+}
+
+func Test_versionCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tag_name":"v1.2.0"}`)
+	}))
+	defer server.Close()
+	defer func(url string, current string) {
+		releaseURL = url
+		version = current
+	}(releaseURL, version)
+	releaseURL = server.URL
+	files := testSetup(t)
+	defer os.RemoveAll(files.storePath)
+	defer os.Remove(files.configPath)
+	table := map[string]struct {
+		current        string
+		expectedStdout string
+		expectedStderr string
+	}{
+		"older": {
+			current:        "v1.1.0",
+			expectedStderr: "Update available: v1.2.0 (current: v1.1.0)\n",
+		},
+		"older without prefix": {
+			current:        "1.1.0",
+			expectedStderr: "Update available: v1.2.0 (current: v1.1.0)\n",
+		},
+		"equal": {
+			current:        "v1.2.0",
+			expectedStdout: "Up to date\n",
+		},
+		"newer": {
+			current:        "v1.3.0",
+			expectedStdout: "Up to date\n",
+		},
+		"dev": {
+			current:        "dev",
+			expectedStderr: "skipping update check for development build\n",
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			version = test.current
+			stdout := bytes.NewBuffer([]byte{})
+			stderr := bytes.NewBuffer([]byte{})
+			args := []string{"memorybox", "-c", files.configPath, "-t", "test", "version", "--check"}
+			if code := Run(args, stdout, stderr); code != 0 {
+				t.Fatalf("expected exit code 0, got %d: %s", code, stderr)
+			}
+			if stdout.String() != test.expectedStdout {
+				t.Fatalf("expected stdout %q, got %q", test.expectedStdout, stdout)
+			}
+			if stderr.String() != test.expectedStderr {
+				t.Fatalf("expected stderr %q, got %q", test.expectedStderr, stderr)
+			}
+		})
+	}
+}
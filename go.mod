@@ -3,19 +3,33 @@ module github.com/tkellen/memorybox
 go 1.14
 
 require (
+	filippo.io/age v1.0.0-beta5
 	github.com/aws/aws-sdk-go v1.30.29
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gobuffalo/packr v1.30.1
-	github.com/google/go-cmp v0.4.0
+	github.com/golang/protobuf v1.4.3
+	github.com/google/go-cmp v0.5.3
 	github.com/hashicorp/go-retryablehttp v0.6.6
 	github.com/jessevdk/go-flags v1.4.0
+	github.com/jlaffaye/ftp v0.0.0-20201112195030-9aae4d151126
+	github.com/klauspost/compress v1.11.3
 	github.com/mattetti/filebuffer v1.0.1
 	github.com/minio/sha256-simd v0.1.1
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/pkg/sftp v1.12.0
+	github.com/pkg/xattr v0.4.1
 	github.com/tidwall/gjson v1.6.0
 	github.com/tidwall/sjson v1.1.1
 	github.com/tkellen/cli v0.0.0-20200507192129-289b368cfd44
+	github.com/xeipuuv/gojsonschema v1.2.0
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+	golang.org/x/image v0.0.0-20200927104501-e162460cd6b5
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
-	golang.org/x/sync v0.0.0-20200625203802-6e8e738ad208
-	golang.org/x/tools v0.0.0-20200903005429-2364a5e8fdcf // indirect
+	golang.org/x/mod v0.3.0
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	golang.org/x/sync v0.0.0-20201020160332-67f06af15bc9
+	google.golang.org/grpc v1.33.2
+	google.golang.org/protobuf v1.25.0
 	gopkg.in/yaml.v2 v2.2.8
+	modernc.org/sqlite v1.10.6
 )
@@ -2,6 +2,7 @@ package config
 
 import (
 	"bytes"
+	"filippo.io/age"
 	"fmt"
 	"github.com/mitchellh/go-homedir"
 	"gopkg.in/yaml.v2"
@@ -9,15 +10,29 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 )
 
 // Target describes a single target in the configuration file.
 type Target map[string]string
 
-// Config holds configuration data for various targets.
+// Config holds configuration data for various targets. Targets may also be
+// sourced from other files listed under include. Those are never saved back
+// and are shadowed by targets of the same name defined directly.
 type Config struct {
-	Targets map[string]Target `yaml:"targets"`
-	file    *os.File
+	Include  []string          `yaml:"include,omitempty"`
+	Targets  map[string]Target `yaml:"targets"`
+	included map[string]Target
+	file     *os.File
+	// encrypted is set when the configuration was loaded from encrypted
+	// data, and recipients are who it is encrypted to when it is saved.
+	// Without recipients, the ciphertext it was loaded from is written back
+	// as long as the configuration rendered from it has not changed.
+	encrypted  bool
+	recipients []age.Recipient
+	ciphertext []byte
+	rendered   []byte
 }
 
 // New instantiates a config and immediately populates it with the
@@ -38,9 +53,16 @@ func New(data io.Reader) (*Config, error) {
 	return cfg, err
 }
 
+// NewFromFile instantiates a config from a file on disk, creating it if it does
+// not exist. If the location is a directory, every .yaml file within it is
+// loaded in alphabetical order instead. A config loaded from a directory has
+// no underlying file and cannot be saved.
 func NewFromFile(location string) (*Config, error) {
 	// Find full path to configuration file.
 	fullPath, _ := homedir.Expand(location)
+	if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
+		return NewFromDir(fullPath)
+	}
 	// Ensure configuration directory exists.
 	if err := os.MkdirAll(path.Dir(fullPath), 0755); err != nil {
 		return nil, err
@@ -55,6 +77,39 @@ func NewFromFile(location string) (*Config, error) {
 		return nil, err
 	}
 	cfg.file = file
+	absPath, absErr := filepath.Abs(fullPath)
+	if absErr != nil {
+		return nil, absErr
+	}
+	if err := cfg.loadIncludes(filepath.Dir(absPath), map[string]bool{absPath: true}); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// NewFromDir instantiates a config from every .yaml file in a directory. Files
+// are loaded in alphabetical order; targets in later files override those of
+// the same name in earlier ones.
+func NewFromDir(location string) (*Config, error) {
+	fullPath, _ := homedir.Expand(location)
+	files, err := filepath.Glob(filepath.Join(fullPath, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	cfg, err := New(bytes.NewReader(nil))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		part := &Config{}
+		if err := part.LoadFile(file); err != nil {
+			return nil, err
+		}
+		for name, target := range part.allTargets() {
+			cfg.Targets[name] = target
+		}
+	}
 	return cfg, nil
 }
 
@@ -89,9 +144,26 @@ func (config *Config) Target(name string) (*Target, error) {
 	if targeted, ok := targets[name]; ok {
 		return &targeted, nil
 	}
+	if targeted, ok := config.included[name]; ok {
+		return &targeted, nil
+	}
 	return nil, fmt.Errorf("%s target not found", name)
 }
 
+// CloneTarget copies the target named src to a new target named dst. The
+// copies are independent; changing one does not affect the other.
+func (config *Config) CloneTarget(src string, dst string) error {
+	target, err := config.Target(src)
+	if err != nil {
+		return err
+	}
+	if _, err := config.Target(dst); err == nil {
+		return fmt.Errorf("%s target already exists", dst)
+	}
+	config.Targets[dst] = *target.Clone()
+	return nil
+}
+
 // Delete removes a target by name from the configuration struct.
 func (config *Config) Delete(name string) *Config {
 	delete(config.Targets, name)
@@ -99,31 +171,143 @@ func (config *Config) Delete(name string) *Config {
 }
 
 // Load reads a provided data source that is expected to contain yaml that can
-// be directly unmarshalled into File field of Config.
+// be directly unmarshalled into File field of Config. Data encrypted by age is
+// decrypted first using the identity supplied by Identity.
 func (config *Config) Load(data io.Reader) error {
-	bytes, err := ioutil.ReadAll(data)
+	raw, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	if IsEncrypted(raw) {
+		identity, err := Identity()
+		if err != nil {
+			return err
+		}
+		return (&EncryptedConfig{config}).Load(bytes.NewReader(raw), identity)
+	}
+	return config.parse(raw)
+}
+
+// parse unmarshals yaml into the config.
+func (config *Config) parse(data []byte) error {
+	return yaml.Unmarshal(data, &config)
+}
+
+// EncryptTo makes the config encrypted to the supplied recipients whenever it
+// is saved.
+func (config *Config) EncryptTo(recipients ...age.Recipient) *Config {
+	config.encrypted = true
+	config.recipients = recipients
+	return config
+}
+
+// LoadFile reads configuration from a file on disk along with every file it
+// includes, recursively. Relative include paths are resolved against the
+// directory of the file that includes them. Targets from later includes
+// override those of the same name from earlier ones.
+func (config *Config) LoadFile(location string) error {
+	return config.loadFile(location, map[string]bool{})
+}
+
+// loadFile tracks the files currently being loaded in order to detect circular
+// includes. The same file may be included more than once by separate branches.
+func (config *Config) loadFile(location string, loading map[string]bool) error {
+	fullPath, _ := homedir.Expand(location)
+	absPath, err := filepath.Abs(fullPath)
 	if err != nil {
 		return err
 	}
-	if err := yaml.Unmarshal(bytes, &config); err != nil {
+	if loading[absPath] {
+		return fmt.Errorf("%w: circular include of %s", os.ErrInvalid, absPath)
+	}
+	loading[absPath] = true
+	defer delete(loading, absPath)
+	file, err := os.Open(absPath)
+	if err != nil {
 		return err
 	}
+	defer file.Close()
+	if err := config.Load(file); err != nil {
+		return fmt.Errorf("%s: %w", absPath, err)
+	}
+	return config.loadIncludes(filepath.Dir(absPath), loading)
+}
+
+func (config *Config) loadIncludes(dir string, loading map[string]bool) error {
+	if config.included == nil {
+		config.included = map[string]Target{}
+	}
+	for _, include := range config.Include {
+		includePath, _ := homedir.Expand(include)
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(dir, includePath)
+		}
+		part := &Config{}
+		if err := part.loadFile(includePath, loading); err != nil {
+			return err
+		}
+		for name, target := range part.allTargets() {
+			config.included[name] = target
+		}
+	}
 	return nil
 }
 
+// Flatten returns a copy of the config holding every target it knows about,
+// including those sourced from included files.
+func (config *Config) Flatten() *Config {
+	return &Config{Targets: config.allTargets()}
+}
+
+// allTargets merges the targets of a config with those it included.
+func (config *Config) allTargets() map[string]Target {
+	all := map[string]Target{}
+	for name, target := range config.included {
+		all[name] = target
+	}
+	for name, target := range config.Targets {
+		all[name] = target
+	}
+	return all
+}
+
 func (config *Config) Save() error {
 	if config.file == nil {
 		return fmt.Errorf("no underlying file found")
 	}
+	defer config.file.Close()
+	// Render first so a failure does not leave the file truncated.
+	var rendered bytes.Buffer
+	if err := config.SaveFrom(&rendered); err != nil {
+		return err
+	}
 	config.file.Seek(0, io.SeekStart)
 	config.file.Truncate(0)
-	defer config.file.Close()
-	return config.SaveFrom(config.file)
+	_, err := rendered.WriteTo(config.file)
+	return err
 }
 
 // SaveFrom renders the current configuration as YAML and writes it to a
-// consumer specified io.Writer.
+// consumer specified io.Writer. Configuration that has recipients from
+// EncryptTo is encrypted to them. Configuration that was loaded encrypted is
+// never written in plaintext; without recipients it is written back exactly as
+// it was loaded, as the identity used to decrypt it does not reveal who else
+// it was encrypted to, and changes to it cannot be saved.
 func (config *Config) SaveFrom(dest io.Writer) error {
+	if config.encrypted && len(config.recipients) == 0 && config.ciphertext != nil {
+		rendered, err := yaml.Marshal(config)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(rendered, config.rendered) {
+			return fmt.Errorf("%w: configuration is encrypted, recipients are required to save changes to it", os.ErrInvalid)
+		}
+		_, err = dest.Write(config.ciphertext)
+		return err
+	}
+	if config.encrypted {
+		return (&EncryptedConfig{config}).Save(dest, config.recipients...)
+	}
 	yaml, _ := yaml.Marshal(config)
 	// validate number of bytes written too?
 	if _, err := dest.Write(yaml); err != nil {
@@ -144,8 +328,37 @@ func (target *Target) Delete(key string) *Target {
 	return target
 }
 
+// Clone produces a copy of the target which shares no state with it.
+func (target *Target) Clone() *Target {
+	clone := Target{}
+	for key, value := range *target {
+		clone[key] = value
+	}
+	return &clone
+}
+
 // Get retrieves a configuration value from a target without consumers knowing
 // where it was stored.
 func (target *Target) Get(key string) string {
 	return (*target)[key]
 }
+
+// Merge copies every value from other into the target. Values from other take
+// precedence.
+func (target *Target) Merge(other Target) *Target {
+	for key, value := range other {
+		(*target)[key] = value
+	}
+	return target
+}
+
+// WithDefaults copies every value from defaults into the target that it does
+// not already have. Values already in the target take precedence.
+func (target *Target) WithDefaults(defaults Target) *Target {
+	for key, value := range defaults {
+		if _, ok := (*target)[key]; !ok {
+			(*target)[key] = value
+		}
+	}
+	return target
+}
@@ -7,6 +7,9 @@ import (
 	"github.com/tkellen/memorybox/internal/config"
 	"gopkg.in/yaml.v2"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -144,6 +147,64 @@ func TestConfig_Delete(t *testing.T) {
 	}
 }
 
+func TestConfig_CloneTarget(t *testing.T) {
+	newConfig := func() *config.Config {
+		return &config.Config{
+			Targets: map[string]config.Target{
+				"production": {"backend": "objectStore", "bucket": "production"},
+				"existing":   {},
+			},
+		}
+	}
+	table := map[string]struct {
+		src         string
+		dst         string
+		expectedErr bool
+	}{
+		"clone existing target": {
+			src: "production",
+			dst: "staging",
+		},
+		"missing source": {
+			src:         "missing",
+			dst:         "staging",
+			expectedErr: true,
+		},
+		"existing destination": {
+			src:         "production",
+			dst:         "existing",
+			expectedErr: true,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			cfg := newConfig()
+			err := cfg.CloneTarget(test.src, test.dst)
+			if test.expectedErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				if !reflect.DeepEqual(newConfig(), cfg) {
+					t.Fatalf("expected config to be unchanged, got %v", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg.Targets[test.src], cfg.Targets[test.dst]) {
+				t.Fatalf("expected %v, got %v", cfg.Targets[test.src], cfg.Targets[test.dst])
+			}
+			clone := cfg.Targets[test.dst]
+			clone.Set("bucket", "staging")
+			if actual := cfg.Targets[test.src]["bucket"]; actual != "production" {
+				t.Fatalf("expected original to be unaffected by clone, got bucket %s", actual)
+			}
+		})
+	}
+}
+
 func TestConfig_Load(t *testing.T) {
 	goodInput := []byte("targets:\n  test:\n    path: ~/app\n    type: localDisk\n")
 	table := map[string]struct {
@@ -185,6 +246,93 @@ func TestConfig_Load(t *testing.T) {
 	}
 }
 
+// writeConfigFiles creates a temporary directory holding the supplied files.
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	return dir
+}
+
+func TestNewFromFile_Directory(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"a.yaml":   "targets:\n  shared:\n    path: a\n  first:\n    path: a\n",
+		"b.yaml":   "targets:\n  shared:\n    path: b\n  second:\n    path: b\n",
+		"c.yaml":   "targets:\n  shared:\n    path: c\n  third:\n    path: c\n",
+		"skip.yml": "targets:\n  shared:\n    path: skip\n",
+	})
+	defer os.RemoveAll(dir)
+	cfg, err := config.NewFromFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"shared":  "c",
+		"first":   "a",
+		"second":  "b",
+		"third":   "c",
+		"default": "~/memorybox",
+	}
+	for name, path := range expected {
+		target, err := cfg.Target(name)
+		if err != nil {
+			t.Fatalf("expected %s target: %s", name, err)
+		}
+		if target.Get("path") != path {
+			t.Fatalf("expected %s target path %s, got %s", name, path, target.Get("path"))
+		}
+	}
+	if err := cfg.Save(); err == nil {
+		t.Fatal("expected config loaded from a directory not to be saved")
+	}
+}
+
+func TestConfig_LoadFile(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"main.yaml":     "include: [team.yaml, env.yaml]\ntargets:\n  own:\n    path: main\n",
+		"team.yaml":     "targets:\n  shared:\n    path: team\n  team:\n    path: team\n  own:\n    path: team\n",
+		"env.yaml":      "include: [nested.yaml]\ntargets:\n  shared:\n    path: env\n",
+		"nested.yaml":   "targets:\n  nested:\n    path: nested\n",
+		"circular.yaml": "include: [loop.yaml]\n",
+		"loop.yaml":     "include: [circular.yaml]\n",
+	})
+	defer os.RemoveAll(dir)
+	cfg := &config.Config{}
+	if err := cfg.LoadFile(filepath.Join(dir, "main.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"own":    "main",
+		"shared": "env",
+		"team":   "team",
+		"nested": "nested",
+	}
+	for name, path := range expected {
+		target, err := cfg.Target(name)
+		if err != nil {
+			t.Fatalf("expected %s target: %s", name, err)
+		}
+		if target.Get("path") != path {
+			t.Fatalf("expected %s target path %s, got %s", name, path, target.Get("path"))
+		}
+	}
+	if len(cfg.Targets) != 1 {
+		t.Fatalf("expected included targets to be kept out of those saved, got %s", cfg)
+	}
+	if err := (&config.Config{}).LoadFile(filepath.Join(dir, "circular.yaml")); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+	}
+	if err := (&config.Config{}).LoadFile(filepath.Join(dir, "missing.yaml")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+}
+
 /*
 func TestConfig_Save(t *testing.T) {
 	cfg := &config.Config{
@@ -245,6 +393,18 @@ func TestTarget_Set(t *testing.T) {
 	}
 }
 
+func TestTarget_Clone(t *testing.T) {
+	target := &config.Target{"key": "value"}
+	clone := target.Clone()
+	if !reflect.DeepEqual(target, clone) {
+		t.Fatalf("expected %v, got %v", target, clone)
+	}
+	clone.Set("key", "other")
+	if actual := target.Get("key"); actual != "value" {
+		t.Fatalf("expected original to keep value, got %s", actual)
+	}
+}
+
 func TestTarget_Get(t *testing.T) {
 	expected := "value"
 	target := &config.Target{"key": expected}
@@ -260,3 +420,86 @@ func TestTarget_Delete(t *testing.T) {
 		t.Fatal("expected key to be removed.")
 	}
 }
+
+func TestTarget_Merge(t *testing.T) {
+	table := map[string]struct {
+		target   config.Target
+		other    config.Target
+		expected config.Target
+	}{
+		"values from other take precedence": {
+			target:   config.Target{"path": "~/memorybox", "backend": "localDisk"},
+			other:    config.Target{"path": "~/elsewhere"},
+			expected: config.Target{"path": "~/elsewhere", "backend": "localDisk"},
+		},
+		"new values are added": {
+			target:   config.Target{"backend": "objectStore"},
+			other:    config.Target{"bucket": "test"},
+			expected: config.Target{"backend": "objectStore", "bucket": "test"},
+		},
+		"empty other is a no-op": {
+			target:   config.Target{"backend": "localDisk"},
+			other:    config.Target{},
+			expected: config.Target{"backend": "localDisk"},
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			original := config.Target{}
+			for key, value := range test.other {
+				original[key] = value
+			}
+			actual := test.target.Merge(test.other)
+			if actual != &test.target {
+				t.Fatal("expected receiver to be returned")
+			}
+			if !reflect.DeepEqual(test.expected, test.target) {
+				t.Fatalf("expected %v, got %v", test.expected, test.target)
+			}
+			if !reflect.DeepEqual(original, test.other) {
+				t.Fatalf("expected other to be unchanged, got %v", test.other)
+			}
+		})
+	}
+}
+
+func TestTarget_WithDefaults(t *testing.T) {
+	table := map[string]struct {
+		target   config.Target
+		defaults config.Target
+		expected config.Target
+	}{
+		"values in the target take precedence": {
+			target:   config.Target{"path": "~/elsewhere", "backend": "localDisk"},
+			defaults: config.Target{"path": "~/memorybox"},
+			expected: config.Target{"path": "~/elsewhere", "backend": "localDisk"},
+		},
+		"missing values are added": {
+			target:   config.Target{"backend": "localDisk"},
+			defaults: config.Target{"path": "~/memorybox"},
+			expected: config.Target{"path": "~/memorybox", "backend": "localDisk"},
+		},
+		"empty defaults are a no-op": {
+			target:   config.Target{"backend": "localDisk"},
+			defaults: config.Target{},
+			expected: config.Target{"backend": "localDisk"},
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			original := config.Target{}
+			for key, value := range test.defaults {
+				original[key] = value
+			}
+			test.target.WithDefaults(test.defaults)
+			if !reflect.DeepEqual(test.expected, test.target) {
+				t.Fatalf("expected %v, got %v", test.expected, test.target)
+			}
+			if !reflect.DeepEqual(original, test.defaults) {
+				t.Fatalf("expected defaults to be unchanged, got %v", test.defaults)
+			}
+		})
+	}
+}
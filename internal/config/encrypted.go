@@ -0,0 +1,95 @@
+package config
+
+import (
+	"bytes"
+	"filippo.io/age"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ageMagic begins the content of every file encrypted by age.
+var ageMagic = []byte("age-encryption.org")
+
+// IdentityEnv names the environment variable holding the age identity (an
+// AGE-SECRET-KEY-1... string) used to decrypt encrypted configuration.
+const IdentityEnv = "MEMORYBOX_AGE_KEY"
+
+// Identity supplies the age identity used when encrypted configuration is
+// loaded. It defaults to IdentityFromEnv.
+var Identity = IdentityFromEnv
+
+// IdentityFromEnv parses the age identity found in IdentityEnv.
+func IdentityFromEnv() (age.Identity, error) {
+	key := os.Getenv(IdentityEnv)
+	if key == "" {
+		return nil, fmt.Errorf("%w: configuration is encrypted and %s is not set", os.ErrInvalid, IdentityEnv)
+	}
+	return age.ParseX25519Identity(strings.TrimSpace(key))
+}
+
+// IsEncrypted reports if configuration data was encrypted by age.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, ageMagic)
+}
+
+// EncryptedConfig reads and writes a Config encrypted with age so credentials
+// in targets are not stored in plaintext.
+type EncryptedConfig struct {
+	*Config
+}
+
+// Save encrypts the configuration as YAML to each recipient and writes it to
+// dest.
+func (config *EncryptedConfig) Save(dest io.Writer, recipients ...age.Recipient) error {
+	if len(recipients) == 0 {
+		return fmt.Errorf("%w: no recipients to encrypt configuration to", os.ErrInvalid)
+	}
+	data, err := yaml.Marshal(config.Config)
+	if err != nil {
+		return err
+	}
+	writer, err := age.Encrypt(dest, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// Load decrypts configuration data with identity and populates the config
+// with it. The config is not encrypted again when it is saved unless it is
+// given recipients with EncryptTo; until then the encrypted data is written
+// back unchanged.
+func (config *EncryptedConfig) Load(data io.Reader, identity age.Identity) error {
+	var ciphertext bytes.Buffer
+	reader, err := age.Decrypt(io.TeeReader(data, &ciphertext), identity)
+	if err != nil {
+		return fmt.Errorf("decrypt configuration: %w", err)
+	}
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("decrypt configuration: %w", err)
+	}
+	if err := config.parse(decrypted); err != nil {
+		return err
+	}
+	// Decrypting may not consume all of the data, so the rest is read to
+	// keep the complete ciphertext.
+	if _, err := io.Copy(&ciphertext, data); err != nil {
+		return err
+	}
+	rendered, err := yaml.Marshal(config.Config)
+	if err != nil {
+		return err
+	}
+	config.encrypted = true
+	config.ciphertext = ciphertext.Bytes()
+	config.rendered = rendered
+	return nil
+}
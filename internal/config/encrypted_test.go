@@ -0,0 +1,170 @@
+package config_test
+
+import (
+	"bytes"
+	"errors"
+	"filippo.io/age"
+	"github.com/google/go-cmp/cmp"
+	"github.com/tkellen/memorybox/internal/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestIdentity(t *testing.T) *age.X25519Identity {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	return identity
+}
+
+func TestEncryptedConfig(t *testing.T) {
+	identity := newTestIdentity(t)
+	cfg := &config.Config{
+		Targets: map[string]config.Target{
+			"test": {"backend": "objectStore", "secret_access_key": "secret"},
+		},
+	}
+	var encrypted bytes.Buffer
+	if err := (&config.EncryptedConfig{Config: cfg}).Save(&encrypted, identity.Recipient()); err != nil {
+		t.Fatal(err)
+	}
+	if !config.IsEncrypted(encrypted.Bytes()) {
+		t.Fatalf("expected saved config to be encrypted, got %s", encrypted.Bytes())
+	}
+	if strings.Contains(encrypted.String(), "secret") {
+		t.Fatal("expected secrets not to appear in plaintext")
+	}
+	table := map[string]struct {
+		identity    age.Identity
+		expectedErr bool
+	}{
+		"matching identity": {
+			identity: identity,
+		},
+		"other identity": {
+			identity:    newTestIdentity(t),
+			expectedErr: true,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			loaded := &config.EncryptedConfig{Config: &config.Config{}}
+			err := loaded.Load(bytes.NewReader(encrypted.Bytes()), test.identity)
+			if test.expectedErr {
+				if err == nil {
+					t.Fatal("expected decryption to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(cfg.Targets, loaded.Targets); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+	if err := (&config.EncryptedConfig{Config: cfg}).Save(&bytes.Buffer{}); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected saving without recipients to fail with %s, got %v", os.ErrInvalid, err)
+	}
+}
+
+func TestNewFromFile_Encrypted(t *testing.T) {
+	identity := newTestIdentity(t)
+	tempDir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "config")
+	var encrypted bytes.Buffer
+	plain := &config.Config{Targets: map[string]config.Target{"test": {"backend": "localDisk"}}}
+	if err := plain.EncryptTo(identity.Recipient()).SaveFrom(&encrypted); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := ioutil.WriteFile(path, encrypted.Bytes(), 0644); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	os.Unsetenv(config.IdentityEnv)
+	if _, err := config.NewFromFile(path); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected loading without %s to fail with %s, got %v", config.IdentityEnv, os.ErrInvalid, err)
+	}
+	os.Setenv(config.IdentityEnv, identity.String())
+	defer os.Unsetenv(config.IdentityEnv)
+	cfg, err := config.NewFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := cfg.Target("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Get("backend") != "localDisk" {
+		t.Fatalf("expected decrypted target, got %v", target)
+	}
+	cfg.Create("added", "localDisk")
+	if err := cfg.SaveFrom(&bytes.Buffer{}); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected saving changes without recipients to fail with %s, got %v", os.ErrInvalid, err)
+	}
+	if err := cfg.EncryptTo(identity.Recipient()).Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.IsEncrypted(saved) {
+		t.Fatalf("expected config to be saved encrypted, got %s", saved)
+	}
+	reloaded, err := config.NewFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.Target("added"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewFromFile_EncryptedToMany(t *testing.T) {
+	loader := newTestIdentity(t)
+	other := newTestIdentity(t)
+	tempDir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "config")
+	var encrypted bytes.Buffer
+	plain := &config.Config{Targets: map[string]config.Target{"test": {"backend": "localDisk"}}}
+	if err := plain.EncryptTo(loader.Recipient(), other.Recipient()).SaveFrom(&encrypted); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := ioutil.WriteFile(path, encrypted.Bytes(), 0644); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	os.Setenv(config.IdentityEnv, loader.String())
+	defer os.Unsetenv(config.IdentityEnv)
+	cfg, err := config.NewFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &config.EncryptedConfig{Config: &config.Config{}}
+	if err := loaded.Load(bytes.NewReader(saved), other); err != nil {
+		t.Fatalf("expected config to remain decryptable by every recipient: %s", err)
+	}
+	if diff := cmp.Diff(plain.Targets, loaded.Targets); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -2,10 +2,12 @@ package fetch
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/tkellen/memorybox/pkg/file"
+	"golang.org/x/net/html"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 	"io"
@@ -15,29 +17,154 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Options controls how Do locates and processes data.
+type Options struct {
+	// Concurrency is the maximum number of items processed at once.
+	Concurrency int
+	// TraverseDirectories expands requests which are directories to a full
+	// listing of the files they contain.
+	TraverseDirectories bool
+	// Recursive causes html pages fetched from urls to be scanned for links
+	// and images on the same host, which are fetched in turn.
+	Recursive bool
+	// MaxDepth limits how many links away from a requested page a recursive
+	// fetch may go. Defaults to 1.
+	MaxDepth int
+	// ModifiedAfter, when set, causes local files and urls which were last
+	// modified at or before the supplied time to be skipped. It has no effect
+	// on data arriving via stdin.
+	ModifiedAfter *time.Time
+	// TempFiles tracks the temporary files used to buffer data which does
+	// not originate on local disk. If it is not supplied, Do uses its own.
+	TempFiles *TempFileRegistry
+	// KeepTempOnError leaves temporary files in place when processing them
+	// fails so a retry can reuse them instead of fetching the data again.
+	KeepTempOnError bool
+	// SSH controls how files are fetched from sftp servers.
+	SSH SSHOptions
+	// Logger receives failures to fetch or process links found by Recursive,
+	// which are skipped rather than failing the whole request. If it is not
+	// supplied, they are skipped silently.
+	Logger *log.Logger
+}
+
 // Do eases the process of locating data referenced at the command line. It
 // will automatically detect bits arriving via stdin, make requests for urls,
 // and expand local directories recursively to find all of their files. The
-// process callback is invoked once for each item found.
+// process callback is invoked once for each item found along with the index
+// of the request that led to it.
 func Do(
 	ctx context.Context,
 	requests []string,
-	concurrency int,
-	traverseDirectories bool,
+	opts Options,
 	process func(context.Context, int, *file.File) error,
 ) error {
 	// Ensure any requests which are directories are fully traversed and
 	// converted to full file listings. This must not be used during import
 	// operations as each import line is expected to map to exactly one file
 	// and violating this can break how import metadata is mapped.
-	if traverseDirectories {
+	if opts.TraverseDirectories {
 		requests = new(ctx).expand(requests)
 	}
-	sem := semaphore.NewWeighted(int64(concurrency))
+	if opts.MaxDepth < 1 {
+		opts.MaxDepth = 1
+	}
+	if opts.TempFiles == nil {
+		registry := &TempFileRegistry{}
+		defer registry.Cleanup(opts.KeepTempOnError)
+		opts.TempFiles = registry
+	}
+	sem := semaphore.NewWeighted(int64(opts.Concurrency))
 	eg, egCtx := errgroup.WithContext(ctx)
+	visited := sync.Map{}
+	// visit must only be called once a slot in the semaphore is acquired.
+	var visit func(index int, item string, depth int) error
+	visit = func(index int, item string, depth int) error {
+		links, err := func() (_ []string, err error) {
+			defer sem.Release(1)
+			// If the requested input is arriving from a location that does
+			// not originate on the machine where memorybox is running (e.g.
+			// a user instructing memorybox to fetch a URL), fetch stores
+			// the data in a temporary file on local disk. This ensures the
+			// content can be be read multiple times if needed.
+			sys := new(egCtx)
+			sys.SSH = opts.SSH
+			sys.ModifiedAfter = opts.ModifiedAfter
+			if !sys.modifiedAfter(item, opts.ModifiedAfter) {
+				return nil, nil
+			}
+			f, deleteOnClose, fetchErr := sys.fetch(item)
+			if errors.Is(fetchErr, errNotModified) {
+				return nil, nil
+			}
+			if fetchErr != nil {
+				return nil, fetchErr
+			}
+			var partialErr error
+			f.OnPartialRead = func(_ string, read int64, total int64) {
+				partialErr = fmt.Errorf("%s: %w: %d of %d bytes", item, file.ErrPartialRead, read, total)
+			}
+			// If a temp file was created to buffer the file for multiple
+			// reads, delete it after we are done unless it should be kept
+			// around for a retry.
+			if deleteOnClose {
+				// Within this function the body of the file.File is
+				// always an os.File.
+				path := f.Body.(*os.File).Name()
+				opts.TempFiles.Add(path)
+				defer func() {
+					if err == nil || !opts.KeepTempOnError {
+						opts.TempFiles.Remove(path)
+					}
+				}()
+			}
+			// Closing a file again after it is closed below does nothing.
+			defer f.Close()
+			var links []string
+			if opts.Recursive && depth < opts.MaxDepth {
+				links = sys.links(item, f)
+			}
+			if err := process(egCtx, index, f); err != nil {
+				return nil, fmt.Errorf("request %d (%s): %w", index, redact(item), err)
+			}
+			// Closing reports if processing only consumed part of the file.
+			f.Close()
+			return links, partialErr
+		}()
+		if err != nil {
+			// Only the requests made by the caller must succeed; pages often
+			// link to things that cannot be fetched.
+			if depth > 0 && egCtx.Err() == nil {
+				if opts.Logger != nil {
+					opts.Logger.Printf("skipping %s: %s", redact(item), err)
+				}
+				return nil
+			}
+			return err
+		}
+		for _, link := range links {
+			if _, seen := visited.LoadOrStore(link, struct{}{}); seen {
+				continue
+			}
+			link := link // https://golang.org/doc/faq#closures_and_goroutines
+			eg.Go(func() error {
+				if err := sem.Acquire(egCtx, 1); err != nil {
+					return err
+				}
+				return visit(index, link, depth+1)
+			})
+		}
+		return nil
+	}
+	for _, item := range requests {
+		visited.Store(item, struct{}{})
+	}
 	eg.Go(func() error {
 		for index, item := range requests {
 			index, item := index, item // https://golang.org/doc/faq#closures_and_goroutines
@@ -45,25 +172,7 @@ func Do(
 				return err
 			}
 			eg.Go(func() error {
-				defer sem.Release(1)
-				// If the requested input is arriving from a location that does
-				// not originate on the machine where memorybox is running (e.g.
-				// a user instructing memorybox to fetch a URL), fetch stores
-				// the data in a temporary file on local disk. This ensures the
-				// content can be be read multiple times if needed.
-				f, deleteOnClose, fetchErr := new(egCtx).fetch(item)
-				if fetchErr != nil {
-					return fetchErr
-				}
-				// If a temp file was created to buffer the file for multiple
-				// reads, delete it after we are done.
-				if deleteOnClose {
-					defer f.Close()
-					// Within this function the body of the file.File is
-					// always an os.File.
-					defer os.Remove(f.Body.(*os.File).Name())
-				}
-				return process(egCtx, index, f)
+				return visit(index, item, 0)
 			})
 		}
 		return nil
@@ -71,6 +180,41 @@ func Do(
 	return eg.Wait()
 }
 
+// Stream opens the data referenced by a request without buffering it to disk.
+// Requests are interpreted the same way as in Do, except that directories are
+// not traversed.
+func Stream(ctx context.Context, request string) (io.ReadCloser, error) {
+	return new(ctx).stream(request)
+}
+
+func (sys *sys) stream(src string) (io.ReadCloser, error) {
+	if src == "-" {
+		return sys.Stdin, nil
+	}
+	if path, ok := localPath(src); ok {
+		return sys.Open(path)
+	}
+	if u, ok := remoteURL(src); ok {
+		body, _, err := sys.openRemote(u)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: %s", redact(src), errBadRequest, err)
+		}
+		return body, nil
+	}
+	if u, err := url.Parse(src); err == nil && u.Scheme != "" && u.Host != "" {
+		resp, getErr := sys.Get(src)
+		if getErr != nil {
+			return nil, fmt.Errorf("%s: %w: %s", src, errBadRequest, getErr)
+		}
+		if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: %w: %d", src, errBadRequest, resp.StatusCode)
+		}
+		return resp.Body, nil
+	}
+	return sys.Open(src)
+}
+
 // sys defines a set of methods for network and disk io. This is an attempt to
 // make the thinnest possible abstraction to support achieving 100% test
 // coverage without a runtime dependency on a mocking library.
@@ -81,18 +225,31 @@ func Do(
 // https://github.com/golang/go/issues/14106
 // https://github.com/golang/go/issues/21592
 type sys struct {
+	ctx      context.Context
 	Get      func(url string) (*http.Response, error)
 	Open     func(string) (*os.File, error)
 	Stat     func(string) (os.FileInfo, error)
 	Stdin    io.ReadCloser
 	TempFile func(string, string) (*os.File, error)
 	TempDir  string
+	// SSH configures connections to sftp servers.
+	SSH SSHOptions
+	// ModifiedAfter, if set, causes remote files last modified at or before
+	// it to be skipped without fetching their content.
+	ModifiedAfter *time.Time
+	// TLSConfig is used for ftps connections if set.
+	TLSConfig *tls.Config
 }
 
 var errBadRequest = errors.New("bad request")
 
+// errNotModified is returned by fetch for remote files which were not
+// modified after ModifiedAfter.
+var errNotModified = errors.New("not modified")
+
 func new(ctx context.Context) *sys {
 	return &sys{
+		ctx: ctx,
 		Get: func(url string) (*http.Response, error) {
 			client := retryablehttp.NewClient()
 			client.Logger = log.New(ioutil.Discard, "", 0)
@@ -128,6 +285,50 @@ func (sys *sys) expand(requests []string) []string {
 	return result
 }
 
+// modifiedAfter reports if a local file was modified after the supplied time.
+// Anything else (stdin, urls, files which cannot be found) is assumed to be
+// modified after it so the decision can be deferred until it is fetched.
+func (sys *sys) modifiedAfter(src string, after *time.Time) bool {
+	if after == nil || src == "-" {
+		return true
+	}
+	if path, ok := localPath(src); ok {
+		src = path
+	}
+	if u, err := url.Parse(src); err == nil && u.Scheme != "" && u.Host != "" {
+		return true
+	}
+	info, err := sys.Stat(src)
+	if err != nil {
+		return true
+	}
+	return info.ModTime().After(*after)
+}
+
+// stale reports if a remote file last modified at the supplied time should be
+// skipped.
+func (sys *sys) stale(lastModified time.Time) bool {
+	return sys.ModifiedAfter != nil && !lastModified.After(*sys.ModifiedAfter)
+}
+
+// localPath extracts the path on local disk referenced by a file uri such as
+// file:///absolute/path or file://localhost/absolute/path.
+func localPath(src string) (string, bool) {
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme != "file" || (u.Host != "" && u.Host != "localhost") {
+		return "", false
+	}
+	path, err := url.PathUnescape(u.EscapedPath())
+	if err != nil {
+		return "", false
+	}
+	// Windows paths arrive as /C:/path.
+	if runtime.GOOS == "windows" && len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path), true
+}
+
 func (sys *sys) fetch(src string) (*file.File, bool, error) {
 	var f *file.File
 	var err error
@@ -136,6 +337,15 @@ func (sys *sys) fetch(src string) (*file.File, bool, error) {
 		// If the input string is determined to represent stdin (per common
 		// convention ("-") is used for this, buffer it to a temporary file.
 		f, err = sys.fileFromStdin()
+	} else if path, ok := localPath(src); ok {
+		// If the input string is a file uri, fetch the file it names from
+		// local disk.
+		f, err = sys.fileFromDisk(path)
+		deleteOnClose = false
+	} else if u, ok := remoteURL(src); ok {
+		// If the input string is a sftp or ftp url, fetch the file it
+		// names and buffer it to a temporary file.
+		f, err = sys.fileFromRemote(u)
 	} else if u, ok := url.Parse(src); ok == nil && u.Scheme != "" && u.Host != "" {
 		// If the input string is determined to be a URL, attempt a http request
 		// to get the contents and buffer it to a temporary file.
@@ -149,30 +359,28 @@ func (sys *sys) fetch(src string) (*file.File, bool, error) {
 }
 
 func (sys *sys) fileFromStdin() (*file.File, error) {
-	temp, tempErr := sys.bufferToTempFile(sys.Stdin)
-	if tempErr != nil {
-		return nil, tempErr
-	}
-	return file.NewSha256("stdin", temp, time.Now())
+	return sys.fileFromTemp("stdin", sys.Stdin, time.Now())
 }
 
 func (sys *sys) fileFromURL(source string) (*file.File, error) {
 	resp, getErr := sys.Get(source)
 	if getErr != nil {
-		return nil, fmt.Errorf("%w: %s", errBadRequest, getErr)
+		return nil, fmt.Errorf("%s: %w: %s", source, errBadRequest, getErr)
 	}
+	defer resp.Body.Close()
 	if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
-		return nil, fmt.Errorf("%w: %d", errBadRequest, resp.StatusCode)
+		return nil, fmt.Errorf("%s: %w: %d", source, errBadRequest, resp.StatusCode)
 	}
 	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
 	if err != nil {
 		lastModified = time.Now()
 	}
-	temp, tempErr := sys.bufferToTempFile(resp.Body)
-	if tempErr != nil {
-		return nil, tempErr
+	// Urls are only known to be stale once their headers are seen; the body
+	// is not read if they are.
+	if sys.stale(lastModified) {
+		return nil, fmt.Errorf("%s: %w", source, errNotModified)
 	}
-	return file.NewSha256(source, temp, lastModified)
+	return sys.fileFromTemp(source, resp.Body, lastModified)
 }
 
 func (sys *sys) fileFromDisk(source string) (*file.File, error) {
@@ -184,7 +392,66 @@ func (sys *sys) fileFromDisk(source string) (*file.File, error) {
 	if statErr != nil {
 		return nil, statErr
 	}
-	return file.NewSha256(source, f, fileInfo.ModTime())
+	return file.NewWithContext(sys.ctx, source, f, fileInfo.ModTime(), file.Sha256)
+}
+
+// links finds every anchor and image url in a html document fetched from a url
+// which points to the same host. Documents which are not html produce none.
+// The body of the supplied file is rewound before returning.
+func (sys *sys) links(source string, f *file.File) []string {
+	base, err := url.Parse(source)
+	if err != nil || base.Host == "" {
+		return nil
+	}
+	body, ok := f.Body.(io.ReadSeeker)
+	if !ok {
+		return nil
+	}
+	defer body.Seek(0, io.SeekStart)
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(body, sniff)
+	if !strings.HasPrefix(http.DetectContentType(sniff[:n]), "text/html") {
+		return nil
+	}
+	body.Seek(0, io.SeekStart)
+	var result []string
+	tokens := html.NewTokenizer(body)
+	for {
+		switch tokens.Next() {
+		case html.ErrorToken:
+			return result
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokens.Token()
+			attr := map[string]string{"a": "href", "img": "src"}[token.Data]
+			for _, candidate := range token.Attr {
+				if attr == "" || candidate.Key != attr {
+					continue
+				}
+				link, err := base.Parse(candidate.Val)
+				if err != nil || link.Host != base.Host || !strings.HasPrefix(link.Scheme, "http") {
+					continue
+				}
+				link.Fragment = ""
+				result = append(result, link.String())
+			}
+		}
+	}
+}
+
+// fileFromTemp buffers the content of a reader to a temporary file and
+// creates a file from it. The temporary file is removed if that fails.
+func (sys *sys) fileFromTemp(source string, reader io.Reader, lastModified time.Time) (*file.File, error) {
+	temp, tempErr := sys.bufferToTempFile(reader)
+	if tempErr != nil {
+		return nil, tempErr
+	}
+	f, err := file.NewWithContext(sys.ctx, source, temp, lastModified, file.Sha256)
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, err
+	}
+	return f, nil
 }
 
 func (sys *sys) bufferToTempFile(reader io.Reader) (*os.File, error) {
@@ -194,6 +461,7 @@ func (sys *sys) bufferToTempFile(reader io.Reader) (*os.File, error) {
 	}
 	_, copyErr := io.Copy(f, reader)
 	if copyErr != nil {
+		f.Close()
 		os.Remove(f.Name())
 		return nil, copyErr
 	}
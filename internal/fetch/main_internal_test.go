@@ -5,13 +5,17 @@ import (
 	"context"
 	"errors"
 	"github.com/mattetti/filebuffer"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_fetch(t *testing.T) {
@@ -178,31 +182,221 @@ func Test_fetch(t *testing.T) {
 	}
 }
 
+func Test_fetchRemovesTempFileOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sys := new(ctx)
+	sys.TempDir = dir
+	sys.Stdin = ioutil.NopCloser(bytes.NewReader([]byte("test")))
+	if _, _, err := sys.fetch("-"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %s, got %v", context.Canceled, err)
+	}
+	remaining, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 0 {
+		t.Fatalf("expected temp file to be removed, found %d files", len(remaining))
+	}
+}
+
+// unreadable fails the test it belongs to if it is read.
+type unreadable struct{ t *testing.T }
+
+func (u unreadable) Read([]byte) (int, error) {
+	u.t.Fatal("expected body of stale url not to be read")
+	return 0, io.EOF
+}
+
+func Test_fetchSkipsStaleURL(t *testing.T) {
+	cutoff := time.Now()
+	sys := new(context.Background())
+	sys.ModifiedAfter = &cutoff
+	sys.Get = func(url string) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Last-Modified": []string{cutoff.Add(-time.Hour).UTC().Format(http.TimeFormat)}},
+			Body:       ioutil.NopCloser(unreadable{t}),
+		}, nil
+	}
+	if _, _, err := sys.fetch("http://totally.legit"); !errors.Is(err, errNotModified) {
+		t.Fatalf("expected %s, got %v", errNotModified, err)
+	}
+}
+
+func Test_fetchFileURI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"test.txt", "test file.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	base := filepath.ToSlash(dir)
+	if !strings.HasPrefix(base, "/") {
+		base = "/" + base
+	}
+	table := map[string]struct {
+		input    string
+		expected string
+	}{
+		"absolute path": {
+			input:    "file://" + base + "/test.txt",
+			expected: "test.txt",
+		},
+		"localhost": {
+			input:    "file://localhost" + base + "/test.txt",
+			expected: "test.txt",
+		},
+		"percent-encoded path": {
+			input:    "file://" + base + "/test%20file.txt",
+			expected: "test file.txt",
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			f, deleteOnClose, err := new(context.Background()).fetch(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if deleteOnClose {
+				t.Fatal("expected file on local disk to be kept")
+			}
+			actualBytes, readErr := ioutil.ReadAll(f)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			expectedBytes, readErr := ioutil.ReadFile(filepath.Join(dir, test.expected))
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if !bytes.Equal(expectedBytes, actualBytes) {
+				t.Fatalf("expected bytes %s, got %s", expectedBytes, actualBytes)
+			}
+		})
+	}
+}
+
+func Test_stream(t *testing.T) {
+	expectedBytes := []byte("test")
+	respond := func(code int) func(string) (*http.Response, error) {
+		return func(url string) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: code,
+				Body:       ioutil.NopCloser(bytes.NewReader(expectedBytes)),
+			}, nil
+		}
+	}
+	table := map[string]struct {
+		input       string
+		sys         *sys
+		expectedErr error
+	}{
+		"success from stdin": {
+			input: "-",
+			sys: func() *sys {
+				sys := new(context.Background())
+				sys.Stdin = ioutil.NopCloser(bytes.NewReader(expectedBytes))
+				return sys
+			}(),
+		},
+		"success from url": {
+			input: "http://totally.legit",
+			sys: func() *sys {
+				sys := new(context.Background())
+				sys.Get = respond(200)
+				return sys
+			}(),
+		},
+		"fail on non-200 http response from url input": {
+			input: "http://totally.legit",
+			sys: func() *sys {
+				sys := new(context.Background())
+				sys.Get = respond(400)
+				return sys
+			}(),
+			expectedErr: errBadRequest,
+		},
+		"fail on missing file": {
+			input:       "missing",
+			sys:         new(context.Background()),
+			expectedErr: os.ErrNotExist,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			body, err := test.sys.stream(test.input)
+			if err != nil && test.expectedErr == nil {
+				t.Fatal(err)
+			}
+			if test.expectedErr != nil && !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error: %s, got %v", test.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+			defer body.Close()
+			actualBytes, readErr := ioutil.ReadAll(body)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if !bytes.Equal(expectedBytes, actualBytes) {
+				t.Fatalf("expected bytes %s, got %s", expectedBytes, actualBytes)
+			}
+		})
+	}
+}
+
 func Test_expand(t *testing.T) {
-	_, filename, _, _ := runtime.Caller(0)
-	testDir := filepath.Dir(filename)
+	root := filepath.Join("testdata", "expand")
 	table := map[string]struct {
-		rootPath          string
-		expectedFileCount int
+		input    []string
+		expected []string
 	}{
+		"files are unchanged": {
+			input:    []string{filepath.Join(root, "a")},
+			expected: []string{filepath.Join(root, "a")},
+		},
 		"walks inputs which are directories": {
-			rootPath:          testDir,
-			expectedFileCount: 3,
+			input:    []string{filepath.Join(root, "nested", "deeper")},
+			expected: []string{filepath.Join(root, "nested", "deeper", "d")},
 		},
 		"walks directories recursively": {
-			rootPath:          filepath.Join(testDir, ".."),
-			expectedFileCount: 10,
+			input: []string{root},
+			expected: []string{
+				filepath.Join(root, "a"),
+				filepath.Join(root, "b"),
+				filepath.Join(root, "nested", "c"),
+				filepath.Join(root, "nested", "deeper", "d"),
+			},
+		},
+		"files found more than once are listed once": {
+			input: []string{filepath.Join(root, "nested"), filepath.Join(root, "nested", "c")},
+			expected: []string{
+				filepath.Join(root, "nested", "c"),
+				filepath.Join(root, "nested", "deeper", "d"),
+			},
 		},
 	}
 	for name, test := range table {
 		test := test
 		t.Run(name, func(t *testing.T) {
-			files := new(context.Background()).expand([]string{test.rootPath})
-			// pretty shit test
-			if len(files) != test.expectedFileCount {
-				t.Fatalf("found %d files in %s, expected %d", len(files), test.rootPath, test.expectedFileCount)
+			actual := new(context.Background()).expand(test.input)
+			sort.Strings(actual)
+			if !reflect.DeepEqual(test.expected, actual) {
+				t.Fatalf("expected %v, got %v", test.expected, actual)
 			}
 		})
 	}
-
 }
@@ -8,10 +8,18 @@ import (
 	"github.com/tkellen/memorybox/internal/fetch"
 	"github.com/tkellen/memorybox/pkg/file"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func fixtureServer(t *testing.T, expected []byte) (string, func() error) {
@@ -63,7 +71,7 @@ func TestFetch(t *testing.T) {
 	for name, test := range table {
 		test := test
 		t.Run(name, func(t *testing.T) {
-			err := fetch.Do(context.Background(), []string{test.input, test.input, test.input, test.input}, 2, false, func(innerCtx context.Context, index int, src *file.File) error {
+			err := fetch.Do(context.Background(), []string{test.input, test.input, test.input, test.input}, fetch.Options{Concurrency: 2}, func(innerCtx context.Context, index int, src *file.File) error {
 				actualBytes, readErr := ioutil.ReadAll(src.Body)
 				if readErr != nil {
 					t.Fatal(readErr)
@@ -82,3 +90,289 @@ func TestFetch(t *testing.T) {
 		})
 	}
 }
+
+func TestFetchProcessErrorIncludesRequest(t *testing.T) {
+	first, _ := ioutil.TempFile("", "")
+	first.Write([]byte("first"))
+	defer os.Remove(first.Name())
+	tempFile, _ := ioutil.TempFile("", "")
+	tempFile.Write([]byte("test"))
+	defer os.Remove(tempFile.Name())
+	expectedErr := errors.New("failed")
+	err := fetch.Do(context.Background(), []string{first.Name(), tempFile.Name()}, fetch.Options{Concurrency: 1}, func(_ context.Context, index int, _ *file.File) error {
+		if index == 1 {
+			return expectedErr
+		}
+		return nil
+	})
+	if !errors.Is(err, expectedErr) {
+		t.Fatalf("expected error: %s, got %v", expectedErr, err)
+	}
+	expected := fmt.Sprintf("request 1 (%s): failed", tempFile.Name())
+	if err.Error() != expected {
+		t.Fatalf("expected %q, got %q", expected, err)
+	}
+}
+
+func TestFetchRecursive(t *testing.T) {
+	pages := map[string]string{
+		"/":           `<html><body><a href="/a.txt">a</a><img src="b.png"><a href="/page2.html#top">2</a><a href="/">self</a><a href="http://other.invalid/x">x</a></body></html>`,
+		"/a.txt":      "a",
+		"/b.png":      "b",
+		"/page2.html": `<html><body><a href="/c.txt">c</a></body></html>`,
+		"/c.txt":      "c",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := pages[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+	table := map[string]struct {
+		opts     fetch.Options
+		expected []string
+	}{
+		"not recursive": {
+			opts:     fetch.Options{Concurrency: 2},
+			expected: []string{"/"},
+		},
+		"default depth": {
+			opts:     fetch.Options{Concurrency: 2, Recursive: true},
+			expected: []string{"/", "/a.txt", "/b.png", "/page2.html"},
+		},
+		"deeper": {
+			opts:     fetch.Options{Concurrency: 1, Recursive: true, MaxDepth: 2},
+			expected: []string{"/", "/a.txt", "/b.png", "/c.txt", "/page2.html"},
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var actual []string
+			err := fetch.Do(context.Background(), []string{server.URL + "/"}, test.opts, func(_ context.Context, index int, f *file.File) error {
+				if index != 0 {
+					t.Fatalf("expected discovered files to share the index of their request, got %d", index)
+				}
+				content, readErr := ioutil.ReadAll(f)
+				if readErr != nil {
+					return readErr
+				}
+				path := strings.TrimPrefix(f.Source, server.URL)
+				if string(content) != pages[path] {
+					t.Fatalf("expected %s to contain %s, got %s", path, pages[path], content)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				actual = append(actual, path)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(actual)
+			if !reflect.DeepEqual(test.expected, actual) {
+				t.Fatalf("expected %v to be fetched, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestFetchRecursive_BrokenLinks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><a href="/missing.txt">missing</a><a href="/a.txt">a</a></body></html>`))
+		case "/a.txt":
+			w.Write([]byte("a"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	var logged bytes.Buffer
+	var mu sync.Mutex
+	var actual []string
+	opts := fetch.Options{Concurrency: 2, Recursive: true, Logger: log.New(&logged, "", 0)}
+	err := fetch.Do(context.Background(), []string{server.URL + "/"}, opts, func(_ context.Context, _ int, f *file.File) error {
+		mu.Lock()
+		defer mu.Unlock()
+		actual = append(actual, strings.TrimPrefix(f.Source, server.URL))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected broken links to be skipped, got %s", err)
+	}
+	sort.Strings(actual)
+	if expected := []string{"/", "/a.txt"}; !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %v to be fetched, got %v", expected, actual)
+	}
+	if !strings.Contains(logged.String(), "/missing.txt") {
+		t.Fatalf("expected skipped link to be logged, got %q", logged.String())
+	}
+	// Requests made by the caller still fail.
+	if err := fetch.Do(context.Background(), []string{server.URL + "/missing.txt"}, opts, func(_ context.Context, _ int, _ *file.File) error {
+		return nil
+	}); err == nil {
+		t.Fatal("expected a missing request to fail")
+	}
+}
+
+func TestFetchModifiedAfter(t *testing.T) {
+	cutoff := time.Now().Add(-time.Hour)
+	dir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	mtimes := map[string]time.Time{
+		"old":    cutoff.Add(-time.Hour),
+		"exact":  cutoff,
+		"recent": cutoff.Add(time.Minute),
+	}
+	var inputs []string
+	for name, mtime := range mtimes {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		inputs = append(inputs, path)
+	}
+	oldURL, shutdownOld := fixtureServerModified(t, []byte("old-url"), cutoff.Add(-time.Hour))
+	defer shutdownOld()
+	newURL, shutdownNew := fixtureServerModified(t, []byte("new-url"), cutoff.Add(time.Hour))
+	defer shutdownNew()
+	inputs = append(inputs, oldURL, newURL)
+	var mu sync.Mutex
+	var actual []string
+	err = fetch.Do(context.Background(), inputs, fetch.Options{Concurrency: 2, ModifiedAfter: &cutoff}, func(_ context.Context, _ int, f *file.File) error {
+		content, readErr := ioutil.ReadAll(f)
+		if readErr != nil {
+			return readErr
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		actual = append(actual, string(content))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(actual)
+	expected := []string{"new-url", "recent"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+}
+
+func fixtureServerModified(t *testing.T, content []byte, lastModified time.Time) (string, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+		w.Write(content)
+	}))
+	return server.URL + "/" + string(content), server.Close
+}
+
+func TestFetchPartialRead(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	tempFile.Write([]byte("content"))
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	table := map[string]struct {
+		read        int
+		expectedErr error
+	}{
+		"partial reads fail": {
+			read:        3,
+			expectedErr: file.ErrPartialRead,
+		},
+		"complete reads succeed": {
+			read: len("content"),
+		},
+		"unread files succeed": {
+			read: 0,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			err := fetch.Do(context.Background(), []string{tempFile.Name()}, fetch.Options{Concurrency: 1}, func(_ context.Context, _ int, f *file.File) error {
+				_, readErr := f.Read(make([]byte, test.read))
+				return readErr
+			})
+			if test.expectedErr == nil && err != nil {
+				t.Fatal(err)
+			}
+			if test.expectedErr != nil && !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error %s, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestFetchKeepTempOnError(t *testing.T) {
+	url, shutdownServer := fixtureServer(t, []byte("test"))
+	defer shutdownServer()
+	uploadErr := errors.New("upload failed")
+	table := map[string]struct {
+		keepTempOnError bool
+		processErr      error
+		expectedExists  bool
+	}{
+		"temp file is kept after an error": {
+			keepTempOnError: true,
+			processErr:      uploadErr,
+			expectedExists:  true,
+		},
+		"temp file is removed after an error": {
+			keepTempOnError: false,
+			processErr:      uploadErr,
+			expectedExists:  false,
+		},
+		"temp file is removed after success": {
+			keepTempOnError: true,
+			processErr:      nil,
+			expectedExists:  false,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			registry := &fetch.TempFileRegistry{}
+			var tempPath string
+			err := fetch.Do(context.Background(), []string{url}, fetch.Options{
+				Concurrency:     1,
+				TempFiles:       registry,
+				KeepTempOnError: test.keepTempOnError,
+			}, func(_ context.Context, _ int, f *file.File) error {
+				tempPath = f.Body.(*os.File).Name()
+				return test.processErr
+			})
+			if !errors.Is(err, test.processErr) {
+				t.Fatalf("expected error %v, got %v", test.processErr, err)
+			}
+			_, statErr := os.Stat(tempPath)
+			if exists := statErr == nil; exists != test.expectedExists {
+				t.Fatalf("expected temp file to exist: %v, got %v", test.expectedExists, exists)
+			}
+			if test.expectedExists && !reflect.DeepEqual(registry.Paths(), []string{tempPath}) {
+				t.Fatalf("expected registry to track %s, got %v", tempPath, registry.Paths())
+			}
+			if cleanupErr := registry.Cleanup(false); cleanupErr != nil {
+				t.Fatal(cleanupErr)
+			}
+			if _, statErr := os.Stat(tempPath); !os.IsNotExist(statErr) {
+				t.Fatalf("expected cleanup to remove %s", tempPath)
+			}
+		})
+	}
+}
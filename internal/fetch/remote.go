@@ -0,0 +1,232 @@
+package fetch
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/jlaffaye/ftp"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/sftp"
+	"github.com/tkellen/memorybox/pkg/file"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// SSHOptions controls how connections to sftp servers are made.
+type SSHOptions struct {
+	// KeyPath is the private key used to authenticate. Defaults to
+	// ~/.ssh/id_rsa if it exists. A password supplied in the url is also
+	// offered.
+	KeyPath string
+	// KnownHosts is the known_hosts file servers are verified against.
+	// Defaults to ~/.ssh/known_hosts. Connections to servers which cannot be
+	// verified are refused.
+	KnownHosts string
+}
+
+// remoteSchemes are the url schemes fetched over protocols other than http.
+var remoteSchemes = map[string]bool{
+	"sftp": true,
+	"ftp":  true,
+	"ftps": true,
+}
+
+// remoteURL parses a request which names a file on an sftp or ftp server.
+func remoteURL(src string) (*url.URL, bool) {
+	u, err := url.Parse(src)
+	if err != nil || u.Host == "" || !remoteSchemes[u.Scheme] {
+		return nil, false
+	}
+	return u, true
+}
+
+// redact produces a version of a request that is safe to log or record as the
+// source of a file. Passwords in urls are masked.
+func redact(src string) string {
+	u, err := url.Parse(src)
+	if err != nil || u.User == nil {
+		return src
+	}
+	if _, ok := u.User.Password(); !ok {
+		return src
+	}
+	masked := *u
+	masked.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return masked.String()
+}
+
+func (sys *sys) fileFromRemote(u *url.URL) (*file.File, error) {
+	source := redact(u.String())
+	body, lastModified, err := sys.openRemote(u)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", source, errBadRequest, err)
+	}
+	defer body.Close()
+	if sys.stale(lastModified) {
+		return nil, fmt.Errorf("%s: %w", source, errNotModified)
+	}
+	return sys.fileFromTemp(source, body, lastModified)
+}
+
+// openRemote reads a file from an sftp or ftp server. Servers which do not
+// report when the file was last modified produce the current time.
+func (sys *sys) openRemote(u *url.URL) (io.ReadCloser, time.Time, error) {
+	if u.Scheme == "sftp" {
+		return sys.openSFTP(u)
+	}
+	return sys.openFTP(u)
+}
+
+// closers closes several resources, most dependent first.
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var firstErr error
+	for _, closer := range c {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// remoteReader reads from one resource but closes several.
+type remoteReader struct {
+	io.Reader
+	closers
+}
+
+func (sys *sys) openSFTP(u *url.URL) (io.ReadCloser, time.Time, error) {
+	config, err := sys.SSH.clientConfig(u)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(sys.ctx, "tcp", addr)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, time.Time{}, err
+	}
+	sshClient := ssh.NewClient(sshConn, channels, requests)
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, time.Time{}, err
+	}
+	remote, err := client.Open(u.Path)
+	if err != nil {
+		client.Close()
+		sshClient.Close()
+		return nil, time.Time{}, err
+	}
+	lastModified := time.Now()
+	if info, err := remote.Stat(); err == nil {
+		lastModified = info.ModTime()
+	}
+	return remoteReader{remote, closers{remote, client, sshClient}}, lastModified, nil
+}
+
+// clientConfig determines how to authenticate with an sftp server. The user
+// and password are taken from the url if present.
+func (opts SSHOptions) clientConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	knownHostsPath := opts.KnownHosts
+	if knownHostsPath == "" {
+		knownHostsPath = "~/.ssh/known_hosts"
+	}
+	knownHostsPath, _ = homedir.Expand(knownHostsPath)
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("known hosts: %w", err)
+	}
+	var auth []ssh.AuthMethod
+	keyPath := opts.KeyPath
+	if keyPath == "" {
+		keyPath = "~/.ssh/id_rsa"
+	}
+	keyPath, _ = homedir.Expand(keyPath)
+	key, keyErr := ioutil.ReadFile(keyPath)
+	if keyErr == nil {
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyPath, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	} else if opts.KeyPath != "" {
+		return nil, keyErr
+	}
+	user := os.Getenv("USER")
+	if u.User != nil {
+		user = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			auth = append(auth, ssh.Password(password))
+		}
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// ftpConn logs out of an ftp server when it is closed.
+type ftpConn struct {
+	*ftp.ServerConn
+}
+
+func (c ftpConn) Close() error {
+	return c.Quit()
+}
+
+// openFTP reads a file from an ftp server. The ftps scheme upgrades the
+// connection to tls before logging in. Anonymous access is used unless a user
+// is supplied in the url.
+func (sys *sys) openFTP(u *url.URL) (io.ReadCloser, time.Time, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	options := []ftp.DialOption{ftp.DialWithContext(sys.ctx), ftp.DialWithTimeout(30 * time.Second)}
+	if u.Scheme == "ftps" {
+		tlsConfig := &tls.Config{}
+		if sys.TLSConfig != nil {
+			tlsConfig = sys.TLSConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+	}
+	conn, err := ftp.Dial(addr, options...)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	user, password := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if err := conn.Login(user, password); err != nil {
+		conn.Quit()
+		return nil, time.Time{}, err
+	}
+	resp, err := conn.Retr(u.Path)
+	if err != nil {
+		conn.Quit()
+		return nil, time.Time{}, err
+	}
+	return remoteReader{resp, closers{resp, ftpConn{conn}}}, time.Now(), nil
+}
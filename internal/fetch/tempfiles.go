@@ -0,0 +1,64 @@
+package fetch
+
+import (
+	"os"
+	"sort"
+	"sync"
+)
+
+// TempFileRegistry tracks the temporary files created to buffer data which
+// does not originate on local disk. It is safe for concurrent use.
+type TempFileRegistry struct {
+	mu    sync.Mutex
+	paths map[string]struct{}
+}
+
+// Add starts tracking a temporary file.
+func (r *TempFileRegistry) Add(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paths == nil {
+		r.paths = map[string]struct{}{}
+	}
+	r.paths[path] = struct{}{}
+}
+
+// Remove deletes a temporary file and stops tracking it.
+func (r *TempFileRegistry) Remove(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.paths, path)
+	os.Remove(path)
+}
+
+// Paths returns the sorted paths of every temporary file being tracked.
+func (r *TempFileRegistry) Paths() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	paths := make([]string, 0, len(r.paths))
+	for path := range r.paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Cleanup deletes every temporary file still being tracked. Files are only
+// left in place for later retries when they remain after an error, so if
+// keepOnError is true nothing is deleted. Removing a file which no longer
+// exists is not an error.
+func (r *TempFileRegistry) Cleanup(keepOnError bool) error {
+	if keepOnError {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var firstErr error
+	for path := range r.paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+		delete(r.paths, path)
+	}
+	return firstErr
+}
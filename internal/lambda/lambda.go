@@ -12,6 +12,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/gobuffalo/packr"
+	"github.com/tkellen/memorybox/internal/config"
+	"github.com/tkellen/memorybox/pkg/objectstore"
 	"io"
 	"io/ioutil"
 	"os"
@@ -41,28 +43,14 @@ func Run(ctx context.Context, cfg string, args []string, stdin io.Reader) (stdou
 }
 
 func (e Exec) run(ctx context.Context, cfg string, args []string, stdin io.Reader) (stdout string, stderr string, code int, err error) {
-	type payload struct {
-		Config string   `json:"config"`
-		Args   []string `json:"args"`
-		Stdin  string   `json:"stdin,omitempty"`
+	jsonPayload, payloadErr := payload(cfg, args, stdin)
+	if payloadErr != nil {
+		return "", "", 1, payloadErr
 	}
-	input, stdinErr := ioutil.ReadAll(stdin)
-	if stdinErr != nil {
-		return "", "", 1, stdinErr
-	}
-	jsonPayload, marshalErr := json.Marshal(payload{
-		Config: cfg,
-		Args:   args,
-		Stdin:  string(input),
-	})
-	if marshalErr != nil {
-		return "", "", 1, marshalErr
-	}
-	// If json payload gets over 6mb (lambda limit) this will need to
-	// be broken up into chunks and executed in parallel.
 	res, invokeErr := e.client.InvokeWithContext(ctx, &lambda.InvokeInput{
-		FunctionName: aws.String(name),
-		Payload:      jsonPayload,
+		FunctionName:   aws.String(name),
+		InvocationType: aws.String(lambda.InvocationTypeRequestResponse),
+		Payload:        jsonPayload,
 	})
 	if invokeErr != nil {
 		return "", "", 1, invokeErr
@@ -89,6 +77,54 @@ func (e Exec) run(ctx context.Context, cfg string, args []string, stdin io.Reade
 	return stdout, stderr, code, nil
 }
 
+// RunAsync invokes memorybox in lambda without waiting for it to finish. Only
+// failures to start the invocation are reported; the output of the command is
+// not available.
+func RunAsync(ctx context.Context, cfg string, args []string, stdin io.Reader) error {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return err
+	}
+	return (Exec{
+		client: lambda.New(sess),
+	}).runAsync(ctx, cfg, args, stdin)
+}
+
+func (e Exec) runAsync(ctx context.Context, cfg string, args []string, stdin io.Reader) error {
+	jsonPayload, err := payload(cfg, args, stdin)
+	if err != nil {
+		return err
+	}
+	_, err = e.client.InvokeWithContext(ctx, &lambda.InvokeInput{
+		FunctionName:   aws.String(name),
+		InvocationType: aws.String(lambda.InvocationTypeEvent),
+		Payload:        jsonPayload,
+	})
+	return err
+}
+
+// payload encodes a command for the lambda function to run.
+func payload(cfg string, args []string, stdin io.Reader) ([]byte, error) {
+	type payload struct {
+		Config string   `json:"config"`
+		Args   []string `json:"args"`
+		Stdin  string   `json:"stdin,omitempty"`
+	}
+	input, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return nil, err
+	}
+	// If json payload gets over 6mb (lambda limit) this will need to
+	// be broken up into chunks and executed in parallel.
+	return json.Marshal(payload{
+		Config: cfg,
+		Args:   args,
+		Stdin:  string(input),
+	})
+}
+
 func CreateScript(version string) (string, error) {
 	box := packr.NewBox("./scripts")
 	script, err := box.FindString("create.sh")
@@ -116,6 +152,50 @@ func DeleteScript() (string, error) {
 	return script, nil
 }
 
+// IAMPolicy produces a least-privilege policy document for the lambda
+// execution role that grants access to the bucket of the supplied target.
+// HeadObject requests are authorized by s3:GetObject.
+func IAMPolicy(cfg *config.Config, target string) (string, error) {
+	t, err := cfg.Target(target)
+	if err != nil {
+		return "", err
+	}
+	if backend := t.Get("backend"); backend != objectstore.Name {
+		return "", fmt.Errorf("%s target uses %s backend, lambda can only access %s", target, backend, objectstore.Name)
+	}
+	bucket := t.Get("bucket")
+	if bucket == "" {
+		return "", fmt.Errorf("%s target has no bucket", target)
+	}
+	type statement struct {
+		Effect   string   `json:"Effect"`
+		Action   []string `json:"Action"`
+		Resource []string `json:"Resource"`
+	}
+	policy, marshalErr := json.MarshalIndent(struct {
+		Version   string      `json:"Version"`
+		Statement []statement `json:"Statement"`
+	}{
+		Version: "2012-10-17",
+		Statement: []statement{
+			{
+				Effect:   "Allow",
+				Action:   []string{"s3:ListBucket"},
+				Resource: []string{"arn:aws:s3:::" + bucket},
+			},
+			{
+				Effect:   "Allow",
+				Action:   []string{"s3:GetObject", "s3:PutObject", "s3:DeleteObject"},
+				Resource: []string{"arn:aws:s3:::" + bucket + "/*"},
+			},
+		},
+	}, "", "  ")
+	if marshalErr != nil {
+		return "", marshalErr
+	}
+	return string(policy), nil
+}
+
 func read(source map[string]interface{}, key string) (string, error) {
 	raw, decodeErr := base64.StdEncoding.DecodeString(source[key].(string))
 	if decodeErr != nil {
@@ -0,0 +1,109 @@
+package lambda
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"strings"
+	"testing"
+)
+
+type runnerMock struct {
+	invokeWithContext func(aws.Context, *lambda.InvokeInput, ...request.Option) (*lambda.InvokeOutput, error)
+}
+
+func (r *runnerMock) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	return r.invokeWithContext(ctx, input, opts...)
+}
+
+// encode compresses output the way the lambda function does.
+func encode(t *testing.T, output string) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(output)); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestExec_run(t *testing.T) {
+	var input *lambda.InvokeInput
+	response, err := json.Marshal(map[string]interface{}{
+		"stdout": encode(t, "out"),
+		"stderr": encode(t, "err"),
+		"code":   0,
+	})
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	exec := Exec{client: &runnerMock{
+		invokeWithContext: func(_ aws.Context, in *lambda.InvokeInput, _ ...request.Option) (*lambda.InvokeOutput, error) {
+			input = in
+			return &lambda.InvokeOutput{Payload: response}, nil
+		},
+	}}
+	stdout, stderr, code, err := exec.run(context.Background(), "config", []string{"index"}, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != "out" || stderr != "err" || code != 0 {
+		t.Fatalf("expected out, err and 0, got %s, %s and %d", stdout, stderr, code)
+	}
+	if actual := aws.StringValue(input.InvocationType); actual != lambda.InvocationTypeRequestResponse {
+		t.Fatalf("expected invocation type %s, got %s", lambda.InvocationTypeRequestResponse, actual)
+	}
+}
+
+func TestExec_runAsync(t *testing.T) {
+	failure := errors.New("throttled")
+	table := map[string]struct {
+		invokeErr error
+	}{
+		"invocations are not awaited": {},
+		"failures to invoke are returned": {
+			invokeErr: failure,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var input *lambda.InvokeInput
+			exec := Exec{client: &runnerMock{
+				invokeWithContext: func(_ aws.Context, in *lambda.InvokeInput, _ ...request.Option) (*lambda.InvokeOutput, error) {
+					input = in
+					if test.invokeErr != nil {
+						return nil, test.invokeErr
+					}
+					return &lambda.InvokeOutput{StatusCode: aws.Int64(202)}, nil
+				},
+			}}
+			err := exec.runAsync(context.Background(), "config", []string{"put", "-"}, strings.NewReader("stdin"))
+			if !errors.Is(err, test.invokeErr) {
+				t.Fatalf("expected %v, got %v", test.invokeErr, err)
+			}
+			if actual := aws.StringValue(input.InvocationType); actual != lambda.InvocationTypeEvent {
+				t.Fatalf("expected invocation type %s, got %s", lambda.InvocationTypeEvent, actual)
+			}
+			var sent struct {
+				Config string
+				Args   []string
+				Stdin  string
+			}
+			if err := json.Unmarshal(input.Payload, &sent); err != nil {
+				t.Fatal(err)
+			}
+			if sent.Config != "config" || sent.Stdin != "stdin" || strings.Join(sent.Args, " ") != "put -" {
+				t.Fatalf("expected command to be sent, got %+v", sent)
+			}
+		})
+	}
+}
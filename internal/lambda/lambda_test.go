@@ -0,0 +1,98 @@
+package lambda_test
+
+import (
+	"encoding/json"
+	"github.com/tkellen/memorybox/internal/config"
+	"github.com/tkellen/memorybox/internal/lambda"
+	"strings"
+	"testing"
+)
+
+func TestIAMPolicy(t *testing.T) {
+	cfg, err := config.New(strings.NewReader(`targets:
+  object:
+    backend: objectStore
+    bucket: test-bucket
+  local:
+    backend: localDisk
+    path: ~/memorybox
+  nobucket:
+    backend: objectStore`))
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	table := map[string]struct {
+		target      string
+		expectedErr bool
+	}{
+		"object store targets produce a policy": {
+			target: "object",
+		},
+		"local disk targets fail": {
+			target:      "local",
+			expectedErr: true,
+		},
+		"object store targets without a bucket fail": {
+			target:      "nobucket",
+			expectedErr: true,
+		},
+		"missing targets fail": {
+			target:      "missing",
+			expectedErr: true,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			actual, err := lambda.IAMPolicy(cfg, test.target)
+			if test.expectedErr && err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if !test.expectedErr && err != nil {
+				t.Fatal(err)
+			}
+			if err != nil {
+				return
+			}
+			var policy struct {
+				Version   string
+				Statement []struct {
+					Effect   string
+					Action   []string
+					Resource []string
+				}
+			}
+			if err := json.Unmarshal([]byte(actual), &policy); err != nil {
+				t.Fatalf("expected valid json, got %s", err)
+			}
+			if policy.Version != "2012-10-17" {
+				t.Fatalf("expected policy version 2012-10-17, got %s", policy.Version)
+			}
+			actions := map[string]string{}
+			for _, statement := range policy.Statement {
+				if statement.Effect != "Allow" {
+					t.Fatalf("expected only Allow statements, got %s", statement.Effect)
+				}
+				for _, action := range statement.Action {
+					for _, resource := range statement.Resource {
+						actions[action] = resource
+					}
+				}
+			}
+			expected := map[string]string{
+				"s3:ListBucket":   "arn:aws:s3:::test-bucket",
+				"s3:GetObject":    "arn:aws:s3:::test-bucket/*",
+				"s3:PutObject":    "arn:aws:s3:::test-bucket/*",
+				"s3:DeleteObject": "arn:aws:s3:::test-bucket/*",
+			}
+			for action, resource := range expected {
+				if actions[action] != resource {
+					t.Fatalf("expected %s on %s, got %q", action, resource, actions[action])
+				}
+			}
+			if len(actions) != len(expected) {
+				t.Fatalf("expected only %d actions, got %v", len(expected), actions)
+			}
+		})
+	}
+}
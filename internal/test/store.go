@@ -35,6 +35,10 @@ func storePutStatGetDelete(t *testing.T, store archive.Store) {
 	if f, err := store.Get(ctx, "test"); !errors.Is(err, os.ErrNotExist) {
 		t.Fatalf("expected file not to exist, got %#v", f)
 	}
+	// Test exists reporting a missing file without error.
+	if exists, err := store.Exists(ctx, name); exists || err != nil {
+		t.Fatalf("expected %s not to exist without error, got %v, %v", name, exists, err)
+	}
 	// Test put failing when the supplied reader fails to be read.
 	if err := store.Put(ctx, iotest.TimeoutReader(bytes.NewReader([]byte("test"))), "nope", time.Now()); err == nil {
 		t.Fatalf("expected store to fail to put on invalid reader")
@@ -65,6 +69,10 @@ func storePutStatGetDelete(t *testing.T, store archive.Store) {
 	if statErr != nil {
 		t.Fatalf("expected store to stat file by name, got %s", statErr)
 	}
+	// Test exists finding file that was just put.
+	if exists, err := store.Exists(ctx, name); !exists || err != nil {
+		t.Fatalf("expected %s to exist without error, got %v, %v", name, exists, err)
+	}
 	// Test file that was "got" / "stat" has the right attributes.
 	for _, f := range []*file.File{statFile, getFile} {
 		if f.Name != name {
@@ -0,0 +1,56 @@
+//go:build !go1.21
+// +build !go1.21
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newJSONLogger produces a logger that writes results to stdout unchanged and
+// everything else to stderr as json records shaped like those log/slog
+// produces, which is not available before Go 1.21.
+func newJSONLogger(stdout io.Writer, stderr io.Writer, debugging bool) *archive.Logger {
+	mu := &sync.Mutex{}
+	var verbose io.Writer = ioutil.Discard
+	if debugging {
+		verbose = jsonLogWriter{mu: mu, out: stderr, level: "DEBUG"}
+	}
+	return &archive.Logger{
+		Stdout:  log.New(stdout, "", 0),
+		Stderr:  log.New(jsonLogWriter{mu: mu, out: stderr, level: "ERROR"}, "", 0),
+		Verbose: log.New(verbose, "", 0),
+	}
+}
+
+// jsonLogWriter writes each message logged through it as a json record on a
+// line of its own.
+type jsonLogWriter struct {
+	mu    *sync.Mutex
+	out   io.Writer
+	level string
+}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	record, err := json.Marshal(struct {
+		Time  time.Time `json:"time"`
+		Level string    `json:"level"`
+		Msg   string    `json:"msg"`
+	}{time.Now(), w.level, strings.TrimSuffix(string(p), "\n")})
+	if err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.out.Write(append(record, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,23 @@
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"github.com/tkellen/memorybox/pkg/archive"
+	"io"
+	"log"
+	"log/slog"
+)
+
+// newJSONLogger produces a logger that writes results to stdout unchanged and
+// everything else to stderr as json records, using log/slog.
+func newJSONLogger(stdout io.Writer, stderr io.Writer, debugging bool) *archive.Logger {
+	level := slog.LevelInfo
+	if debugging {
+		level = slog.LevelDebug
+	}
+	logger := archive.NewSlogLogger(slog.NewJSONHandler(stderr, &slog.HandlerOptions{Level: level}))
+	logger.Stdout = log.New(stdout, "", 0)
+	return logger
+}
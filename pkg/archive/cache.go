@@ -0,0 +1,48 @@
+package archive
+
+import (
+	"context"
+	"github.com/tkellen/memorybox/pkg/file"
+	"sync"
+)
+
+// FileCache remembers the details of files after they are first read from a
+// store, so repeated lookups need not reach it. Entries are held in their
+// binary encoding; every lookup produces a new stub the caller may modify.
+// The cache is never invalidated by changes to the store, see Forget.
+type FileCache struct {
+	entries sync.Map
+}
+
+// Get finds a file by name, reading it from the store only if it has not been
+// seen before. Datafiles are stats of the object. Metafiles include their
+// metadata.
+func (c *FileCache) Get(ctx context.Context, store Store, name string) (*file.File, error) {
+	if cached, ok := c.entries.Load(name); ok {
+		f := &file.File{}
+		if err := f.UnmarshalBinary(cached.([]byte)); err == nil {
+			return f, nil
+		}
+	}
+	var f *file.File
+	var err error
+	if file.IsMetaFileName(name) {
+		f, err = GetMetaByPrefix(ctx, store, name)
+	} else {
+		f, err = store.Stat(ctx, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := f.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	c.entries.Store(name, encoded)
+	return f, nil
+}
+
+// Forget removes a file from the cache so the next Get reads it again.
+func (c *FileCache) Forget(name string) {
+	c.entries.Delete(name)
+}
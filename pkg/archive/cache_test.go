@@ -0,0 +1,54 @@
+package archive_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"testing"
+	"time"
+)
+
+func TestFileCache(t *testing.T) {
+	ctx := context.Background()
+	f, err := file.NewSha256("test", bytes.NewReader([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	store := NewMemStore(file.List{})
+	if _, err := archive.Put(ctx, store, f, "", file.MetaFileOptions{}); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	statsBefore, getsBefore := store.Calls("Stat"), store.Calls("Get")
+	cache := &archive.FileCache{}
+	metaName := file.MetaNameFrom(f.Name)
+	for i := 0; i < 3; i++ {
+		data, err := cache.Get(ctx, store, f.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.Name != f.Name || data.Size != f.Size {
+			t.Fatalf("expected %s with size %d, got %s with size %d", f.Name, f.Size, data.Name, data.Size)
+		}
+		meta, err := cache.Get(ctx, store, metaName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.MetaGet(file.MetaKeyFileName) != f.Name {
+			t.Fatalf("expected cached metadata to describe %s, got %s", f.Name, meta.MetaBytes())
+		}
+	}
+	if stats, gets := store.Calls("Stat")-statsBefore, store.Calls("Get")-getsBefore; stats != 1 || gets != 1 {
+		t.Fatalf("expected one Stat and one Get, got %d and %d", stats, gets)
+	}
+	cache.Forget(f.Name)
+	if _, err := cache.Get(ctx, store, f.Name); err != nil {
+		t.Fatal(err)
+	}
+	if stats := store.Calls("Stat") - statsBefore; stats != 2 {
+		t.Fatalf("expected forgotten file to be read again, got %d calls to Stat", stats)
+	}
+	if _, err := cache.Get(ctx, store, "missing"); err == nil {
+		t.Fatal("expected missing files to fail")
+	}
+}
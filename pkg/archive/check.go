@@ -1,25 +1,69 @@
 package archive
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"fmt"
-	hash "github.com/minio/sha256-simd"
 	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/hash"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 	"io/ioutil"
 	"strings"
+	"time"
 )
 
 const checkFmt = "%-12s%-8s%-13s%s"
 
-type CheckOutput struct {
-	Items   []CheckItem
-	Details []string
+// CheckIssueType classifies a problem found by Check. The value of each type
+// is the exit code reported for it by the check command.
+type CheckIssueType int
+
+// Types of CheckIssue, in increasing order of severity. Metadata corruption
+// is metadata which cannot be migrated, is invalid or conflicts with the name
+// of its metafile.
+const (
+	IssueTypeMissingPair CheckIssueType = iota + 1
+	IssueTypeHashMismatch
+	IssueTypeMetaCorruption
+	IssueTypeIOError
+)
+
+// CheckIssue is a problem found with a single file by Check.
+type CheckIssue struct {
+	Type    CheckIssueType `json:"type"`
+	Name    string         `json:"name"`
+	Message string         `json:"message"`
+}
+
+// CheckResult describes the outcome of checking a store.
+type CheckResult struct {
+	// Code is zero if no issues were found, otherwise it is the type of the
+	// most severe issue.
+	Code    int          `json:"code"`
+	Issues  []CheckIssue `json:"issues"`
+	Items   []CheckItem  `json:"items"`
+	Details []string     `json:"-"`
+	// FixedFiles holds the name of every file that was rewritten while
+	// checking.
+	FixedFiles []string `json:"fixedFiles"`
+	// Errors holds any failures that occurred while rewriting files.
+	Errors []error `json:"-"`
 }
 
-func (co CheckOutput) String() string {
+// addIssues records issues in the result, raising its code to match the most
+// severe.
+func (co *CheckResult) addIssues(issues ...CheckIssue) {
+	for _, issue := range issues {
+		co.Issues = append(co.Issues, issue)
+		if int(issue.Type) > co.Code {
+			co.Code = int(issue.Type)
+		}
+	}
+}
+
+func (co CheckResult) String() string {
 	output := []string{
 		fmt.Sprintf(checkFmt, "TYPE", "COUNT", "SIGNATURE", "SOURCE"),
 	}
@@ -31,21 +75,35 @@ func (co CheckOutput) String() string {
 			output = append(output, line)
 		}
 	}
+	for _, name := range co.FixedFiles {
+		output = append(output, fmt.Sprintf("%s: fixed", name))
+	}
+	for _, err := range co.Errors {
+		output = append(output, err.Error())
+	}
 	return strings.Join(output, "\n")
 }
 
 type CheckItem struct {
-	Name      string
-	Count     int
-	Signature string
-	Source    string
+	Name      string `json:"name"`
+	Count     int    `json:"count"`
+	Signature string `json:"signature"`
+	Source    string `json:"source"`
 }
 
 func (ci CheckItem) String() string {
 	return fmt.Sprintf(checkFmt, ci.Name, fmt.Sprintf("%d", ci.Count), ci.Signature[:10], ci.Source)
 }
 
-func Check(ctx context.Context, store Store, concurrency int, mode string) (*CheckOutput, error) {
+// Check inspects the content of a store. The "names" mode only ensures every
+// datafile is named by a well formed hash, which needs no content to be read.
+// The "datafiles" mode does the same before rehashing the content of every
+// datafile whose name is valid. Metafiles which are valid but not canonically
+// encoded or not migrated to the current schema version are listed in the
+// details of the result without being reported as issues. When fix is true,
+// they are rewritten in place. Problems found are reported as issues of the
+// result, including failures to read or rewrite individual files.
+func Check(ctx context.Context, store Store, concurrency int, mode string, fix bool) (*CheckResult, error) {
 	var err error
 	var signature string
 	var details []string
@@ -56,7 +114,7 @@ func Check(ctx context.Context, store Store, concurrency int, mode string) (*Che
 	meta := files.Meta()
 	data := files.Data()
 	invalid := files.Invalid()
-	result := &CheckOutput{
+	result := &CheckResult{
 		Items: []CheckItem{
 			{"all", len(files), nameSignature(files), "file names"},
 			{"datafiles", len(data), nameSignature(data), "file names"},
@@ -65,17 +123,32 @@ func Check(ctx context.Context, store Store, concurrency int, mode string) (*Che
 		},
 	}
 	if mode == "pairing" {
-		result.Details = checkPairing(invalid)
+		issues := checkPairing(invalid)
+		result.Details = issueMessages(issues)
+		result.addIssues(issues...)
+		return result, nil
+	}
+	if mode == "names" {
+		valid, issues := checkDataNames(data)
+		result.Details = issueMessages(issues)
+		result.addIssues(issues...)
+		result.Items = append(result.Items, CheckItem{"names", len(valid), nameSignature(valid), "valid names"})
 		return result, nil
 	}
 	var filesChecked file.List
+	var fixed []string
+	var fixErrs []error
+	var issues []CheckIssue
 	if mode == "metafiles" {
 		filesChecked = meta
-		signature, details, err = checkFiles(ctx, store, concurrency, meta)
+		signature, details, issues, fixed, fixErrs, err = checkFiles(ctx, store, concurrency, meta, fix)
 	}
 	if mode == "datafiles" {
-		filesChecked = data
-		signature, details, err = checkFiles(ctx, store, concurrency, data)
+		var nameIssues []CheckIssue
+		filesChecked, nameIssues = checkDataNames(data)
+		signature, details, issues, fixed, fixErrs, err = checkFiles(ctx, store, concurrency, filesChecked, false)
+		details = append(issueMessages(nameIssues), details...)
+		issues = append(nameIssues, issues...)
 	}
 	if filesChecked == nil {
 		return nil, fmt.Errorf("unknown check mode %s", mode)
@@ -84,29 +157,60 @@ func Check(ctx context.Context, store Store, concurrency int, mode string) (*Che
 		return nil, err
 	}
 	result.Details = details
+	result.FixedFiles = fixed
+	result.Errors = fixErrs
+	result.addIssues(issues...)
 	result.Items = append(result.Items, CheckItem{mode, len(filesChecked), signature, "file content"})
 	return result, nil
 }
 
-func checkPairing(files file.List) []string {
-	var errs []string
+// issueMessages lists the message of each issue.
+func issueMessages(issues []CheckIssue) []string {
+	var messages []string
+	for _, issue := range issues {
+		messages = append(messages, issue.Message)
+	}
+	return messages
+}
+
+func checkPairing(files file.List) []CheckIssue {
+	var issues []CheckIssue
 	invalid := files.Invalid()
 	for _, item := range invalid.Data() {
 		name := item.Name
 		pair := file.MetaNameFrom(name)
-		errs = append(errs, fmt.Sprintf("%s missing %s", name, pair))
+		issues = append(issues, CheckIssue{IssueTypeMissingPair, name, fmt.Sprintf("%s missing %s", name, pair)})
 	}
 	for _, item := range invalid.Meta() {
 		name := item.Name
 		pair := file.DataNameFrom(name)
-		errs = append(errs, fmt.Sprintf("%s missing %s", name, pair))
+		issues = append(issues, CheckIssue{IssueTypeMissingPair, name, fmt.Sprintf("%s missing %s", name, pair)})
+	}
+	return issues
+}
+
+// checkDataNames finds datafiles which are not named by a well formed hash,
+// which indicates corruption of the name itself. Their content is not worth
+// rehashing, so only the datafiles with valid names are returned.
+func checkDataNames(files file.List) (valid file.List, issues []CheckIssue) {
+	valid = file.List{}
+	for _, f := range files {
+		if err := file.ValidateDataName(f.Name); err != nil {
+			issues = append(issues, CheckIssue{IssueTypeHashMismatch, f.Name, fmt.Sprintf("%s: corrupted name: %s", f.Name, err)})
+			continue
+		}
+		valid = append(valid, f)
 	}
-	return errs
+	return valid, issues
 }
 
-func checkFiles(ctx context.Context, store Store, concurrency int, files file.List) (signature string, details []string, err error) {
+// checkFiles reads the content of every file to validate it. Files that
+// cannot be read are reported as issues rather than stopping the check.
+func checkFiles(ctx context.Context, store Store, concurrency int, files file.List, fix bool) (signature string, details []string, issues []CheckIssue, fixed []string, fixErrs []error, err error) {
 	signatures := make([]string, len(files))
 	details = make([]string, len(files))
+	found := make([]*CheckIssue, len(files))
+	needsFix := make([]file.Meta, len(files))
 	eg, egCtx := errgroup.WithContext(ctx)
 	sem := semaphore.NewWeighted(int64(concurrency))
 	eg.Go(func() error {
@@ -117,19 +221,25 @@ func checkFiles(ctx context.Context, store Store, concurrency int, files file.Li
 			index, name := index, name
 			eg.Go(func() error {
 				defer sem.Release(1)
-				var f *file.File
 				var err error
-				if f, err = store.Get(egCtx, name); err != nil {
-					return err
-				}
-				defer f.Close()
+				issueType := IssueTypeHashMismatch
 				if file.IsMetaFileName(name) {
-					signatures[index], details[index], err = checkMeta(f)
+					issueType = IssueTypeMetaCorruption
+					signatures[index], details[index], needsFix[index], err = checkMetaByName(egCtx, store, name)
 				} else {
-					signatures[index], details[index], err = checkData(f)
+					signatures[index], details[index], err = checkDataByName(egCtx, store, name)
 				}
 				if err != nil {
-					return err
+					if egCtx.Err() != nil {
+						return egCtx.Err()
+					}
+					issueType = IssueTypeIOError
+					details[index] = fmt.Sprintf("%s: %s", name, err)
+				}
+				// Metafiles which only differ from their canonical form are
+				// reported without failing the check.
+				if details[index] != "" && needsFix[index] == nil {
+					found[index] = &CheckIssue{issueType, name, details[index]}
 				}
 				return nil
 			})
@@ -137,29 +247,86 @@ func checkFiles(ctx context.Context, store Store, concurrency int, files file.Li
 		return nil
 	})
 	if err := eg.Wait(); err != nil {
-		return "", nil, err
+		return "", nil, nil, nil, nil, err
+	}
+	for index, canonical := range needsFix {
+		if canonical == nil || !fix {
+			continue
+		}
+		name := files[index].Name
+		if err := store.Put(ctx, bytes.NewReader(canonical), name, time.Now()); err != nil {
+			fixErrs = append(fixErrs, fmt.Errorf("%s: %w", name, err))
+			found[index] = &CheckIssue{IssueTypeIOError, name, fmt.Sprintf("%s: %s", name, err)}
+			continue
+		}
+		details[index] = ""
+		found[index] = nil
+		fixed = append(fixed, name)
+	}
+	for _, issue := range found {
+		if issue != nil {
+			issues = append(issues, *issue)
+		}
+	}
+	digest := sum256([]byte(strings.Join(signatures, "")))
+	return hex.EncodeToString(digest), details, issues, fixed, fixErrs, nil
+}
+
+// checkMetaByName gets a metafile from the store and validates it.
+func checkMetaByName(ctx context.Context, store Store, name string) (signature string, detail string, canonical file.Meta, err error) {
+	f, err := store.Get(ctx, name)
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer f.Close()
+	return checkMeta(f)
+}
+
+// checkDataByName gets a datafile from the store and validates it.
+func checkDataByName(ctx context.Context, store Store, name string) (signature string, detail string, err error) {
+	f, err := store.Get(ctx, name)
+	if err != nil {
+		return "", "", err
 	}
-	digest := hash.Sum256([]byte(strings.Join(signatures, "")))
-	return hex.EncodeToString(digest[:]), details, nil
+	defer f.Close()
+	return checkData(f)
 }
 
-func checkMeta(f *file.File) (signature string, detail string, err error) {
-	meta, readErr := ioutil.ReadAll(f)
+// checkMeta validates a metafile. If the metafile is valid but not canonically
+// encoded or written in an older schema, the migrated canonical form is
+// returned so it can be rewritten.
+func checkMeta(f *file.File) (signature string, detail string, canonical file.Meta, err error) {
+	raw, readErr := ioutil.ReadAll(f)
 	if readErr != nil {
-		return "", "", readErr
+		return "", "", nil, readErr
+	}
+	digest := sum256(raw)
+	replayed := file.ReplayMeta(raw)
+	meta, migrateErr := file.MigrateMeta(replayed)
+	if migrateErr != nil {
+		return hex.EncodeToString(digest), fmt.Sprintf("%s: %s", f.Name, migrateErr), nil, nil
 	}
-	digest := hash.Sum256(meta)
 	if file.DataNameFrom(f.Name) != file.Meta(meta).DataFileName() {
 		detail = fmt.Sprintf("%s: %s key conflicts with filename", f.Name, file.MetaKeyImportSource)
 	}
 	if err := file.ValidateMeta(meta); err != nil {
 		detail = fmt.Sprintf("%s: %s", f.Name, err)
+	} else if normalized, err := file.Meta(meta).Canonical(); err == nil && detail == "" && !bytes.Equal(raw, normalized) {
+		detail = fmt.Sprintf("%s: not canonically encoded", f.Name)
+		if !bytes.Equal(replayed, meta) {
+			detail = fmt.Sprintf("%s: not migrated to schema version %d", f.Name, file.MetaSchemaVersion)
+		}
+		canonical = normalized
 	}
-	return hex.EncodeToString(digest[:]), detail, nil
+	return hex.EncodeToString(digest), detail, canonical, nil
 }
 
 func checkData(f *file.File) (signature string, detail string, err error) {
-	digest, _, hashErr := file.Sha256(f)
+	hasher, hasherErr := file.HasherFromFileName(f.Name)
+	if hasherErr != nil {
+		return "", fmt.Sprintf("%s: %s", f.Name, hasherErr), nil
+	}
+	digest, _, hashErr := hasher(f)
 	if hashErr != nil {
 		return "", "", hashErr
 	}
@@ -170,7 +337,14 @@ func checkData(f *file.File) (signature string, detail string, err error) {
 	return digest, detail, nil
 }
 
+// sum256 computes the sha256 checksum of data.
+func sum256(data []byte) []byte {
+	digest := hash.NewSha256()
+	digest.Write(data)
+	return digest.Sum(nil)
+}
+
 func nameSignature(input file.List) string {
-	digest := hash.Sum256([]byte(strings.Join(input.Names(), "")))
-	return hex.EncodeToString(digest[:])
+	digest := sum256([]byte(strings.Join(input.Names(), "")))
+	return hex.EncodeToString(digest)
 }
@@ -2,14 +2,20 @@ package archive_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
 	"github.com/tkellen/memorybox/pkg/localdiskstore"
+	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
 )
 
-func TestCheckOutput_String(t *testing.T) {
-	input := archive.CheckOutput{
+func TestCheckResult_String(t *testing.T) {
+	input := archive.CheckResult{
 		Items: []archive.CheckItem{
 			{Name: "all", Count: 2, Signature: "6c40786bb260c4f38bb7dc9611c022c12e72b9c879fe2c5a7a80db1fc2fe12ef", Source: "file names"},
 			{Name: "datafiles", Count: 1, Signature: "4544b50389f946f441cb7e3c107389c5f6d0f07344e748124b4541f55fc17684", Source: "file names"},
@@ -36,7 +42,7 @@ func TestCheck(t *testing.T) {
 	type testCase struct {
 		store       *localdiskstore.Store
 		expectedErr bool
-		expected    *archive.CheckOutput
+		expected    *archive.CheckResult
 		mode        string
 	}
 	table := map[string]testCase{
@@ -44,7 +50,7 @@ func TestCheck(t *testing.T) {
 			mode:        "pairing",
 			store:       localdiskstore.New("../../testdata/valid"),
 			expectedErr: false,
-			expected: &archive.CheckOutput{Items: []archive.CheckItem{
+			expected: &archive.CheckResult{Items: []archive.CheckItem{
 				{Name: "all", Count: 2, Signature: "504150a8c8a0a0efc04e34d08f7617895e5ca96ec35f6c81444092c2bf6fb1bc", Source: "file names"},
 				{Name: "datafiles", Count: 1, Signature: "4544b50389f946f441cb7e3c107389c5f6d0f07344e748124b4541f55fc17684", Source: "file names"},
 				{Name: "metafiles", Count: 1, Signature: "14b8a7aefb9859051b49154aec748a6e393c2b1ce68d194be3c8af6371a2bf05", Source: "file names"},
@@ -55,7 +61,9 @@ func TestCheck(t *testing.T) {
 			mode:        "pairing",
 			store:       localdiskstore.New("../../testdata/metafile-pair-missing"),
 			expectedErr: false,
-			expected: &archive.CheckOutput{Items: []archive.CheckItem{
+			expected: &archive.CheckResult{Code: 1, Issues: []archive.CheckIssue{
+				{Type: archive.IssueTypeMissingPair, Name: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-sha256", Message: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-sha256 missing meta-b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-sha256"},
+			}, Items: []archive.CheckItem{
 				{Name: "all", Count: 1, Signature: "4544b50389f946f441cb7e3c107389c5f6d0f07344e748124b4541f55fc17684", Source: "file names"},
 				{Name: "datafiles", Count: 1, Signature: "4544b50389f946f441cb7e3c107389c5f6d0f07344e748124b4541f55fc17684", Source: "file names"},
 				{Name: "metafiles", Count: 0, Signature: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", Source: "file names"},
@@ -67,7 +75,11 @@ func TestCheck(t *testing.T) {
 			mode:        "pairing",
 			store:       localdiskstore.New("../../testdata/datafile-pair-missing"),
 			expectedErr: false,
-			expected: &archive.CheckOutput{
+			expected: &archive.CheckResult{
+				Code: 1,
+				Issues: []archive.CheckIssue{
+					{Type: archive.IssueTypeMissingPair, Name: "meta-b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-sha256", Message: "meta-b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-sha256 missing b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-sha256"},
+				},
 				Items: []archive.CheckItem{
 					{Name: "all", Count: 1, Signature: "14b8a7aefb9859051b49154aec748a6e393c2b1ce68d194be3c8af6371a2bf05", Source: "file names"},
 					{Name: "datafiles", Count: 0, Signature: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", Source: "file names"},
@@ -81,7 +93,11 @@ func TestCheck(t *testing.T) {
 			mode:        "metafiles",
 			store:       localdiskstore.New("../../testdata/metafile-corrupted"),
 			expectedErr: false,
-			expected: &archive.CheckOutput{
+			expected: &archive.CheckResult{
+				Code: 3,
+				Issues: []archive.CheckIssue{
+					{Type: archive.IssueTypeMetaCorruption, Name: "meta-b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-sha256", Message: "meta-b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-sha256: not json encoded"},
+				},
 				Items: []archive.CheckItem{
 					{Name: "all", Count: 2, Signature: "504150a8c8a0a0efc04e34d08f7617895e5ca96ec35f6c81444092c2bf6fb1bc", Source: "file names"},
 					{Name: "datafiles", Count: 1, Signature: "4544b50389f946f441cb7e3c107389c5f6d0f07344e748124b4541f55fc17684", Source: "file names"},
@@ -96,7 +112,7 @@ func TestCheck(t *testing.T) {
 			mode:        "metafiles",
 			store:       localdiskstore.New("../../testdata/valid"),
 			expectedErr: false,
-			expected: &archive.CheckOutput{
+			expected: &archive.CheckResult{
 				Items: []archive.CheckItem{
 					{Name: "all", Count: 2, Signature: "504150a8c8a0a0efc04e34d08f7617895e5ca96ec35f6c81444092c2bf6fb1bc", Source: "file names"},
 					{Name: "datafiles", Count: 1, Signature: "4544b50389f946f441cb7e3c107389c5f6d0f07344e748124b4541f55fc17684", Source: "file names"},
@@ -111,7 +127,7 @@ func TestCheck(t *testing.T) {
 			mode:        "datafiles",
 			store:       localdiskstore.New("../../testdata/valid"),
 			expectedErr: false,
-			expected: &archive.CheckOutput{
+			expected: &archive.CheckResult{
 				Items: []archive.CheckItem{
 					{Name: "all", Count: 2, Signature: "504150a8c8a0a0efc04e34d08f7617895e5ca96ec35f6c81444092c2bf6fb1bc", Source: "file names"},
 					{Name: "datafiles", Count: 1, Signature: "4544b50389f946f441cb7e3c107389c5f6d0f07344e748124b4541f55fc17684", Source: "file names"},
@@ -126,7 +142,7 @@ func TestCheck(t *testing.T) {
 	for name, test := range table {
 		test := test
 		t.Run(name, func(t *testing.T) {
-			actual, err := archive.Check(context.Background(), test.store, 10, test.mode)
+			actual, err := archive.Check(context.Background(), test.store, 10, test.mode, false)
 			if test.expectedErr && err == nil {
 				t.Fatalf("expected error, got none")
 			}
@@ -141,3 +157,215 @@ func TestCheck(t *testing.T) {
 		})
 	}
 }
+
+func TestCheck_Issues(t *testing.T) {
+	ctx := context.Background()
+	content := "hello world"
+	dataName := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-sha256"
+	mismatched := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824-sha256"
+	metaName := file.MetaNameFrom(dataName)
+	table := map[string]struct {
+		files        map[string]string
+		mode         string
+		getErr       error
+		expectedCode int
+		expectedType archive.CheckIssueType
+	}{
+		"clean": {
+			files: map[string]string{dataName: content},
+			mode:  "datafiles",
+		},
+		"missing pair": {
+			files:        map[string]string{dataName: content},
+			mode:         "pairing",
+			expectedCode: 1,
+			expectedType: archive.IssueTypeMissingPair,
+		},
+		"hash mismatch": {
+			files:        map[string]string{mismatched: content},
+			mode:         "datafiles",
+			expectedCode: 2,
+			expectedType: archive.IssueTypeHashMismatch,
+		},
+		"metadata formatting": {
+			files: map[string]string{metaName: `{"meta":{"memorybox":true,"file":"` + dataName + `"}}`},
+			mode:  "metafiles",
+		},
+		"appended metadata": {
+			files: map[string]string{metaName: `{"meta":{"file":"` + dataName + `","memorybox":true}}` + "\n" + `{"key":"value"}`},
+			mode:  "metafiles",
+		},
+		"metadata corruption": {
+			files:        map[string]string{metaName: "{"},
+			mode:         "metafiles",
+			expectedCode: 3,
+			expectedType: archive.IssueTypeMetaCorruption,
+		},
+		"io error": {
+			files:        map[string]string{dataName: content},
+			mode:         "datafiles",
+			getErr:       errors.New("disk failure"),
+			expectedCode: 4,
+			expectedType: archive.IssueTypeIOError,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			store := NewMemStore(file.List{})
+			for name, data := range test.files {
+				if err := store.Put(ctx, strings.NewReader(data), name, time.Now()); err != nil {
+					t.Fatalf("test setup: %s", err)
+				}
+			}
+			store.GetErrorWith = test.getErr
+			result, err := archive.Check(ctx, store, 10, test.mode, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Code != test.expectedCode {
+				t.Fatalf("expected code %d, got %d", test.expectedCode, result.Code)
+			}
+			if test.expectedCode == 0 {
+				if len(result.Issues) != 0 {
+					t.Fatalf("expected no issues, got %v", result.Issues)
+				}
+				return
+			}
+			if len(result.Issues) != 1 || result.Issues[0].Type != test.expectedType {
+				t.Fatalf("expected one issue of type %d, got %v", test.expectedType, result.Issues)
+			}
+		})
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	ctx := context.Background()
+	valid := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-sha256"
+	truncated := "b94d27b9934d3e08a52e52d7da7dab-sha256"
+	unknown := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-nope"
+	store := NewMemStore(file.List{})
+	for _, name := range []string{valid, truncated, unknown} {
+		if err := store.Put(ctx, strings.NewReader("hello world"), name, time.Now()); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	report, err := archive.Check(ctx, store, 10, "names", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := store.Calls("Get"); calls != 0 {
+		t.Fatalf("expected no content to be read, got %d calls to Get", calls)
+	}
+	names := report.Items[len(report.Items)-1]
+	if names.Name != "names" || names.Count != 1 {
+		t.Fatalf("expected 1 valid name, got %+v", names)
+	}
+	if len(report.Details) != 2 ||
+		!strings.HasPrefix(report.Details[0], truncated+": corrupted name") ||
+		!strings.HasPrefix(report.Details[1], unknown+": corrupted name") {
+		t.Fatalf("expected corrupted names to be reported, got %v", report.Details)
+	}
+	datafiles, err := archive.Check(ctx, store, 10, "datafiles", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := store.Calls("Get"); calls != 1 {
+		t.Fatalf("expected only the validly named datafile to be rehashed, got %d calls to Get", calls)
+	}
+	if diff := cmp.Diff(report.Details, datafiles.Details[:2]); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestCheckFixEncoding(t *testing.T) {
+	ctx := context.Background()
+	canonical := `{"meta":{"file":"test","import":{"at":"2020-05-24T21:14:42Z","source":"<stdin>"},"memorybox":true},"z":1.50}`
+	unordered := "{\"z\":1.50, \"meta\":{\"memorybox\":true,\"import\":{\"source\":\"<stdin>\",\"at\":\"2020-05-24T21:14:42Z\"},\n\"file\":\"test\"}}"
+	metaName := file.MetaNameFrom("test")
+	store := NewMemStore(file.List{})
+	if err := store.Put(ctx, strings.NewReader(unordered), metaName, time.Now()); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := store.Put(ctx, strings.NewReader("test"), "test", time.Now()); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	report, err := archive.Check(ctx, store, 10, "metafiles", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{metaName + ": not canonically encoded"}, report.Details); diff != "" {
+		t.Fatal(diff)
+	}
+	if report.Code != 0 || len(report.Issues) != 0 {
+		t.Fatalf("expected formatting not to be reported as an issue, got code %d with %v", report.Code, report.Issues)
+	}
+	if len(report.FixedFiles) != 0 {
+		t.Fatalf("expected no files to be fixed without fix flag, got %v", report.FixedFiles)
+	}
+	fixed, fixErr := archive.Check(ctx, store, 10, "metafiles", true)
+	if fixErr != nil {
+		t.Fatal(fixErr)
+	}
+	if diff := cmp.Diff([]string{metaName}, fixed.FixedFiles); diff != "" {
+		t.Fatal(diff)
+	}
+	if len(fixed.Errors) != 0 {
+		t.Fatalf("expected no errors, got %v", fixed.Errors)
+	}
+	f, getErr := store.Get(ctx, metaName)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	actual, readErr := ioutil.ReadAll(f)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if diff := cmp.Diff(canonical, string(actual)); diff != "" {
+		t.Fatal(diff)
+	}
+	clean, cleanErr := archive.Check(ctx, store, 10, "metafiles", false)
+	if cleanErr != nil {
+		t.Fatal(cleanErr)
+	}
+	if diff := cmp.Diff([]string{""}, clean.Details); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestCheckMigrate(t *testing.T) {
+	ctx := context.Background()
+	legacy := `{"memorybox":{"file":"test","source":"<stdin>"},"data":{"title":"test"}}`
+	migrated := `{"meta":{"file":"test","import":{"source":"<stdin>"},"memorybox":true,"schemaVersion":2},"title":"test"}`
+	metaName := file.MetaNameFrom("test")
+	store := NewMemStore(file.List{})
+	if err := store.Put(ctx, strings.NewReader(legacy), metaName, time.Now()); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	report, err := archive.Check(ctx, store, 10, "metafiles", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{fmt.Sprintf("%s: not migrated to schema version %d", metaName, file.MetaSchemaVersion)}
+	if diff := cmp.Diff(expected, report.Details); diff != "" {
+		t.Fatal(diff)
+	}
+	fixed, fixErr := archive.Check(ctx, store, 10, "metafiles", true)
+	if fixErr != nil {
+		t.Fatal(fixErr)
+	}
+	if diff := cmp.Diff([]string{metaName}, fixed.FixedFiles); diff != "" {
+		t.Fatal(diff)
+	}
+	f, getErr := store.Get(ctx, metaName)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	actual, readErr := ioutil.ReadAll(f)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if diff := cmp.Diff(migrated, string(actual)); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,140 @@
+package archive
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/hash"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"io"
+	"sort"
+	"strings"
+)
+
+// CrossCheckReport describes how the content of several stores differs.
+type CrossCheckReport struct {
+	// MissingFromStores maps the name of every file that is not in all of
+	// the stores to the stores which are missing it.
+	MissingFromStores map[string][]string
+	// HashMismatches holds the name of every file whose content is not the
+	// same in all of the stores.
+	HashMismatches []string
+}
+
+func (r CrossCheckReport) String() string {
+	var output []string
+	names := make([]string, 0, len(r.MissingFromStores))
+	for name := range r.MissingFromStores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		output = append(output, fmt.Sprintf("%s missing from %s", name, strings.Join(r.MissingFromStores[name], ", ")))
+	}
+	for _, name := range r.HashMismatches {
+		output = append(output, fmt.Sprintf("%s differs between stores", name))
+	}
+	if len(output) == 0 {
+		return "stores are identical"
+	}
+	return strings.Join(output, "\n")
+}
+
+// CrossStoreCheck compares the content of several stores. Every store is
+// listed to find files that are missing from some of them. If verify is true,
+// the content of files present in every store is hashed to find those that
+// differ.
+func CrossStoreCheck(ctx context.Context, stores []Store, concurrency int, verify bool) (*CrossCheckReport, error) {
+	listings := make([]map[string]*file.File, len(stores))
+	eg, egCtx := errgroup.WithContext(ctx)
+	for index, store := range stores {
+		index, store := index, store // https://golang.org/doc/faq#closures_and_goroutines
+		eg.Go(func() error {
+			files, err := SearchAll(egCtx, store, "")
+			if err != nil {
+				return fmt.Errorf("%s: %w", store, err)
+			}
+			listings[index] = files.ByName()
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	report := &CrossCheckReport{
+		MissingFromStores: map[string][]string{},
+	}
+	all := map[string]struct{}{}
+	for _, listing := range listings {
+		for name := range listing {
+			all[name] = struct{}{}
+		}
+	}
+	var common []string
+	for name := range all {
+		for index, listing := range listings {
+			if _, ok := listing[name]; !ok {
+				report.MissingFromStores[name] = append(report.MissingFromStores[name], stores[index].String())
+			}
+		}
+		if _, missing := report.MissingFromStores[name]; !missing {
+			common = append(common, name)
+		}
+	}
+	sort.Strings(common)
+	if !verify {
+		return report, nil
+	}
+	mismatched := make([]bool, len(common))
+	eg, egCtx = errgroup.WithContext(ctx)
+	sem := semaphore.NewWeighted(int64(concurrency))
+	eg.Go(func() error {
+		for index, name := range common {
+			if err := sem.Acquire(egCtx, 1); err != nil {
+				return err
+			}
+			index, name := index, name // https://golang.org/doc/faq#closures_and_goroutines
+			eg.Go(func() error {
+				defer sem.Release(1)
+				var first string
+				for _, store := range stores {
+					digest, err := contentDigest(egCtx, store, name)
+					if err != nil {
+						return fmt.Errorf("%s: %s: %w", store, name, err)
+					}
+					if first == "" {
+						first = digest
+					} else if digest != first {
+						mismatched[index] = true
+					}
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	for index, name := range common {
+		if mismatched[index] {
+			report.HashMismatches = append(report.HashMismatches, name)
+		}
+	}
+	return report, nil
+}
+
+func contentDigest(ctx context.Context, store Store, name string) (string, error) {
+	f, err := store.Get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	digest := hash.NewSha256()
+	if _, err := io.Copy(digest, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
@@ -0,0 +1,113 @@
+package archive_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"io"
+	"testing"
+	"time"
+)
+
+// namedStore gives a MemStore a distinct identity in reports.
+type namedStore struct {
+	*MemStore
+	name string
+}
+
+func (s *namedStore) String() string {
+	return s.name
+}
+
+func TestCrossStoreCheck(t *testing.T) {
+	ctx := context.Background()
+	newFile := func(name string, content string) *file.File {
+		f, err := file.New(name, bytes.NewReader([]byte(content)), time.Now(), func(source io.Reader) (string, int64, error) {
+			return name, int64(len(content)), nil
+		})
+		if err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		return f
+	}
+	one := &namedStore{name: "one", MemStore: NewMemStore(file.List{
+		newFile("shared", "same"),
+		newFile("corrupted", "original"),
+		newFile("only-in-one", "content"),
+	})}
+	two := &namedStore{name: "two", MemStore: NewMemStore(file.List{
+		newFile("shared", "same"),
+		newFile("corrupted", "original"),
+		newFile("missing-from-one", "content"),
+	})}
+	three := &namedStore{name: "three", MemStore: NewMemStore(file.List{
+		newFile("shared", "same"),
+		newFile("corrupted", "changed"),
+		newFile("missing-from-one", "content"),
+	})}
+	stores := []archive.Store{one, two, three}
+	table := map[string]struct {
+		verify   bool
+		expected *archive.CrossCheckReport
+	}{
+		"listing only": {
+			verify: false,
+			expected: &archive.CrossCheckReport{
+				MissingFromStores: map[string][]string{
+					"only-in-one":      {"two", "three"},
+					"missing-from-one": {"one"},
+				},
+			},
+		},
+		"verify content": {
+			verify: true,
+			expected: &archive.CrossCheckReport{
+				MissingFromStores: map[string][]string{
+					"only-in-one":      {"two", "three"},
+					"missing-from-one": {"one"},
+				},
+				HashMismatches: []string{"corrupted"},
+			},
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			actual, err := archive.CrossStoreCheck(ctx, stores, 2, test.verify)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestCrossStoreCheckSearchError(t *testing.T) {
+	failing := NewMemStore(file.List{})
+	failing.SearchErrorWith = context.Canceled
+	stores := []archive.Store{NewMemStore(file.List{}), failing}
+	if _, err := archive.CrossStoreCheck(context.Background(), stores, 2, true); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCrossCheckReport_String(t *testing.T) {
+	report := archive.CrossCheckReport{
+		MissingFromStores: map[string][]string{
+			"b": {"one"},
+			"a": {"two", "three"},
+		},
+		HashMismatches: []string{"c"},
+	}
+	expected := "a missing from two, three\nb missing from one\nc differs between stores"
+	if diff := cmp.Diff(expected, report.String()); diff != "" {
+		t.Fatal(diff)
+	}
+	if actual := (archive.CrossCheckReport{}).String(); actual != "stores are identical" {
+		t.Fatalf("expected identical stores, got %s", actual)
+	}
+}
@@ -3,12 +3,20 @@ package archive
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/tidwall/sjson"
 	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/mimetype"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +26,31 @@ func GetDataByPrefix(ctx context.Context, store Store, prefix string) (*file.Fil
 	return findAndGet(ctx, store, prefix, false)
 }
 
+// ContentType detects the mime type of a datafile. Stores that implement
+// RangeGetter only have the bytes needed for detection fetched.
+func ContentType(ctx context.Context, store Store, name string) (string, error) {
+	var body io.ReadCloser
+	if ranger, ok := store.(RangeGetter); ok {
+		reader, err := ranger.GetRange(ctx, name, 0, mimetype.SniffLen-1)
+		if err != nil {
+			return "", err
+		}
+		body = reader
+	} else {
+		f, err := store.Get(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		body = f
+	}
+	defer body.Close()
+	head, err := ioutil.ReadAll(io.LimitReader(body, mimetype.SniffLen))
+	if err != nil {
+		return "", err
+	}
+	return mimetype.Detect(bytes.NewReader(head))
+}
+
 // GetMetaByPrefix retrieves a metafile from any backing store as long as there
 // is only one match.
 func GetMetaByPrefix(ctx context.Context, store Store, prefix string) (*file.File, error) {
@@ -25,51 +58,283 @@ func GetMetaByPrefix(ctx context.Context, store Store, prefix string) (*file.Fil
 }
 
 // Put persists a datafile/metafile pair for any backing store and returns the
-// meta information about the file.
-func Put(ctx context.Context, store Store, f *file.File, set string) (*file.File, error) {
+// meta information about the file. The options are applied to the metadata
+// only if the metafile does not already exist.
+func Put(ctx context.Context, store Store, f *file.File, set string, opts file.MetaFileOptions) (*file.File, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
 	if set == "" {
 		if set, _ = os.Hostname(); set == "" {
 			set = "unknown"
 		}
 	}
+	// Thumbnails are generated before the content is uploaded as both read
+	// the body of the file.
+	var thumbnail []byte
+	if opts.Thumbnail {
+		var err error
+		thumbnail, err = f.Thumbnail(file.ThumbnailSize)
+		if err != nil && !errors.Is(err, file.ErrThumbnailUnsupported) {
+			return nil, err
+		}
+	}
+	// Metadata is validated before anything is stored so a rejected put
+	// leaves no datafile behind.
+	if opts.Validator != nil {
+		preview := f.Clone()
+		if err := applyPutMeta(preview, set, opts, thumbnail); err != nil {
+			return nil, err
+		}
+		if err := opts.Validator.ValidateBytes(preview.MetaBytes()); err != nil {
+			return nil, err
+		}
+	}
+	if batcher, ok := store.(BatchPutter); ok {
+		return putBatch(ctx, batcher, store, f, set, opts, thumbnail)
+	}
 	eg, egCtx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
 		exist, err := store.Stat(egCtx, f.Name)
 		if err != nil {
 			if errors.Is(err, os.ErrNotExist) {
-				return store.Put(egCtx, f.Body, f.Name, f.LastModified)
+				return putData(egCtx, store, f)
 			}
 			return err
 		}
 		if !exist.CurrentWith(f) {
-			return store.Put(egCtx, f.Body, f.Name, f.LastModified)
+			return putData(egCtx, store, f)
 		}
 		return nil
 	})
+	var existing *file.File
 	eg.Go(func() error {
 		name := file.MetaNameFrom(f.Name)
 		meta, err := GetMetaByPrefix(egCtx, store, name)
 		// Persist metafile if one doesn't exist.
 		if errors.Is(err, os.ErrNotExist) {
-			f.Meta.Set(file.MetaKeyImportSet, set)
-			return store.Put(egCtx, bytes.NewReader(*f.Meta), name, time.Now())
+			if err := applyPutMeta(f, set, opts, thumbnail); err != nil {
+				return err
+			}
+			stored, putErr := putMetaIfAbsent(egCtx, store, name, f.MetaBytes())
+			if putErr != nil || stored {
+				return putErr
+			}
+			// Another put persisted the metafile first.
+			meta, err = GetMetaByPrefix(egCtx, store, name)
 		}
 		// If there was no error, the meta file existed already. If a consumer
 		// tries to store the same file twice, there is no error. This clause
 		// ensures the metadata that is output to the screen reflects what is
 		// already in the store.
-		if err == nil {
-			f = meta
-		}
+		existing = meta
 		// Return an error if there was one.
 		return err
 	})
 	if err := eg.Wait(); err != nil {
 		return nil, err
 	}
+	// The metadata of the file now matches what was stored.
+	f.Freeze()
+	if existing != nil {
+		return existing, nil
+	}
 	return f, nil
 }
 
+// putBatch persists whichever parts of a datafile/metafile pair are missing
+// from a BatchPutter with a single call to MultiPut. Stores which are also an
+// AtomicStore have the metafile persisted with PutIfAbsent instead, so a put
+// racing this one cannot have its metafile overwritten.
+func putBatch(ctx context.Context, batcher BatchPutter, store Store, f *file.File, set string, opts file.MetaFileOptions, thumbnail []byte) (*file.File, error) {
+	var needData bool
+	var existing *file.File
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		exist, err := store.Stat(egCtx, f.Name)
+		if errors.Is(err, os.ErrNotExist) {
+			needData = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		needData = !exist.CurrentWith(f)
+		return nil
+	})
+	eg.Go(func() error {
+		meta, err := GetMetaByPrefix(egCtx, store, file.MetaNameFrom(f.Name))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		existing = meta
+		return err
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	var files []*file.File
+	if needData {
+		files = append(files, f)
+	}
+	_, atomic := store.(AtomicStore)
+	if existing == nil {
+		if err := applyPutMeta(f, set, opts, thumbnail); err != nil {
+			return nil, err
+		}
+	}
+	if existing == nil && !atomic {
+		canonical, err := file.Meta(f.MetaBytes()).Canonical()
+		if err != nil {
+			return nil, err
+		}
+		meta, err := file.NewMetaFromBytes(f.Source, canonical)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, meta)
+	}
+	if len(files) > 0 {
+		if err := batcher.MultiPut(ctx, files); err != nil {
+			return nil, err
+		}
+	}
+	if existing == nil && atomic {
+		name := file.MetaNameFrom(f.Name)
+		stored, err := putMetaIfAbsent(ctx, store, name, f.MetaBytes())
+		if err != nil {
+			return nil, err
+		}
+		// Another put persisted the metafile first.
+		if !stored {
+			if existing, err = GetMetaByPrefix(ctx, store, name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	f.Freeze()
+	if existing != nil {
+		return existing, nil
+	}
+	return f, nil
+}
+
+// putMetaIfAbsent persists a metafile in canonical form. Stores which
+// implement AtomicStore only persist it if no other put has done so first,
+// which is reported by the return value. Other stores always persist it.
+func putMetaIfAbsent(ctx context.Context, store Store, name string, meta []byte) (bool, error) {
+	canonical, err := file.Meta(meta).Canonical()
+	if err != nil {
+		return false, err
+	}
+	if atomicStore, ok := store.(AtomicStore); ok {
+		return atomicStore.PutIfAbsent(ctx, bytes.NewReader(canonical), name, time.Now())
+	}
+	return true, store.Put(ctx, bytes.NewReader(canonical), name, time.Now())
+}
+
+// PutMeta persists a metafile in the canonical form Check expects, replacing
+// any which already exists.
+func PutMeta(ctx context.Context, store Store, name string, meta []byte) error {
+	canonical, err := file.Meta(meta).Canonical()
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, bytes.NewReader(canonical), name, time.Now())
+}
+
+// applyPutMeta adds the metadata recorded when a metafile is first persisted.
+func applyPutMeta(f *file.File, set string, opts file.MetaFileOptions, thumbnail []byte) error {
+	if err := f.MetaApply(opts); err != nil {
+		return err
+	}
+	if thumbnail != nil {
+		if err := f.MetaSet(file.ThumbnailKey(file.ThumbnailSize), base64.StdEncoding.EncodeToString(thumbnail)); err != nil {
+			return err
+		}
+	}
+	return f.MetaSet(file.MetaKeyImportSet, set)
+}
+
+// putData persists the content of a datafile. Stores that benefit from knowing
+// the size of content up front are given it when the content is seekable.
+func putData(ctx context.Context, store Store, f *file.File) error {
+	if seekable, ok := store.(SeekableStore); ok && f.Size > 0 {
+		if _, ok := f.Body.(io.Seeker); ok {
+			return seekable.PutSeekable(ctx, f, f.Name, f.LastModified, f.Size)
+		}
+	}
+	return store.Put(ctx, f, f.Name, f.LastModified)
+}
+
+// PutStreaming persists content which has not been hashed yet. The content is
+// hashed while it is copied to a temporary file in a single read pass, after
+// which it is named by the completed hash and persisted with Put.
+func PutStreaming(ctx context.Context, store Store, source string, hasher *file.StreamingHasher, set string) (*file.File, error) {
+	temp, tempErr := ioutil.TempFile("", "memorybox-stream-*")
+	if tempErr != nil {
+		return nil, tempErr
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	if _, err := io.Copy(temp, hasher); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	f, err := file.New(source, temp, time.Now(), func(_ io.Reader) (string, int64, error) {
+		name, size := hasher.Sum()
+		return name, size, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Put(ctx, store, f, set, file.MetaFileOptions{})
+}
+
+// GetOrPut returns the datafile for content on local disk from the store,
+// persisting it first only if the store does not have it. Failures to
+// determine if the store has the content are returned rather than risking an
+// unnecessary upload. The returned file always has a Body.
+func GetOrPut(ctx context.Context, store Store, source string, hash file.HashFn) (*file.File, error) {
+	body, openErr := os.Open(source)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer body.Close()
+	info, statErr := body.Stat()
+	if statErr != nil {
+		return nil, statErr
+	}
+	f, newErr := file.NewWithContext(ctx, source, body, info.ModTime(), hash)
+	if newErr != nil {
+		return nil, newErr
+	}
+	existing, getErr := store.Get(ctx, f.Name)
+	if getErr == nil {
+		return existing, nil
+	}
+	if !errors.Is(getErr, os.ErrNotExist) {
+		return nil, getErr
+	}
+	if _, err := Put(ctx, store, f, "", file.MetaFileOptions{}); err != nil {
+		return nil, err
+	}
+	return store.Get(ctx, f.Name)
+}
+
+// SignedURL produces a url granting access to the content of a file for the
+// duration of expiry, for stores which implement Presigner. Metafiles produce
+// a url for the datafile they describe.
+func SignedURL(ctx context.Context, store Store, f *file.File, expiry time.Duration) (string, error) {
+	presigner, ok := store.(Presigner)
+	if !ok {
+		return "", fmt.Errorf("%w: %s cannot produce signed urls", os.ErrInvalid, store)
+	}
+	return presigner.PreSignURL(ctx, file.DataNameFrom(f.Name), expiry)
+}
+
 // Delete removes a datafile/metafile pair for any backing store.
 func Delete(ctx context.Context, store Store, name string) error {
 	f, findErr := find(ctx, store, name, false)
@@ -86,6 +351,127 @@ func Delete(ctx context.Context, store Store, name string) error {
 	return eg.Wait()
 }
 
+// Rename moves a datafile/metafile pair to a new datafile name. The metafile
+// is rewritten to describe the new name and records the old one. Stores that
+// implement Renamer move the datafile directly; others have it copied.
+func Rename(ctx context.Context, store Store, oldRef string, newName string) error {
+	f, findErr := find(ctx, store, oldRef, false)
+	if findErr != nil {
+		return findErr
+	}
+	oldName := f.Name
+	if exists, err := store.Exists(ctx, newName); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("%w: %s", os.ErrExist, newName)
+	}
+	meta, metaErr := findAndGet(ctx, store, file.MetaNameFrom(oldName), true)
+	if metaErr != nil && !errors.Is(metaErr, os.ErrNotExist) {
+		return metaErr
+	}
+	if renamer, ok := store.(Renamer); ok {
+		if err := renamer.Rename(ctx, oldName, newName); err != nil {
+			return err
+		}
+	} else {
+		data, err := store.Get(ctx, oldName)
+		if err != nil {
+			return err
+		}
+		putErr := store.Put(ctx, data, newName, data.LastModified)
+		data.Close()
+		if putErr != nil {
+			return putErr
+		}
+		if err := store.Delete(ctx, oldName); err != nil {
+			return err
+		}
+	}
+	if meta == nil {
+		return nil
+	}
+	if err := meta.MetaSet(file.MetaKeyFileName, newName); err != nil {
+		return err
+	}
+	if err := meta.MetaSet(file.MetaKeyPreviousName, oldName); err != nil {
+		return err
+	}
+	if err := PutMeta(ctx, store, file.MetaNameFrom(newName), meta.MetaBytes()); err != nil {
+		return err
+	}
+	return store.Delete(ctx, file.MetaNameFrom(oldName))
+}
+
+// Errors collects failures from operations that continue past them.
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for index, err := range e {
+		messages[index] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// BulkDelete removes many datafile/metafile pairs concurrently. Failing to
+// delete one pair does not prevent the others from being removed; every
+// failure is returned together.
+func BulkDelete(ctx context.Context, logger *Logger, store Store, concurrency int, names []string) error {
+	var errs Errors
+	var mu sync.Mutex
+	var eg errgroup.Group
+	sem := semaphore.NewWeighted(int64(concurrency))
+	for _, name := range names {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+			break
+		}
+		name := name
+		eg.Go(func() error {
+			defer sem.Release(1)
+			if err := Delete(ctx, store, name); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return nil
+			}
+			logger.Verbose.Printf("%s deleted", name)
+			return nil
+		})
+	}
+	eg.Wait()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// AppendMeta records a metadata change for a datafile. Stores that implement
+// Appender have the change appended to the metafile as a single JSON line
+// which is folded into the metadata when it is read. Other stores have the
+// full metafile rewritten.
+func AppendMeta(ctx context.Context, store Store, name string, key string, value string) error {
+	f, err := findAndGet(ctx, store, name, true)
+	if err != nil {
+		return err
+	}
+	appender, ok := store.(Appender)
+	if !ok {
+		f.Meta.Set(key, value)
+		return PutMeta(ctx, store, f.Name, *f.Meta)
+	}
+	// Each line maps the full path of the key being set to its value so the
+	// change can be replayed without clobbering sibling keys.
+	raw, _ := json.Marshal(value)
+	if json.Valid([]byte(value)) {
+		raw = []byte(value)
+	}
+	line, _ := sjson.SetRawBytes([]byte("{}"), strings.ReplaceAll(key, ".", `\.`), raw)
+	return appender.Append(ctx, f.Name, append([]byte{'\n'}, line...))
+}
+
 func find(ctx context.Context, store Store, name string, meta bool) (*file.File, error) {
 	if meta {
 		name = file.MetaNameFrom(name)
@@ -114,7 +500,11 @@ func findAndGet(ctx context.Context, store Store, name string, meta bool) (*file
 		if readErr != nil {
 			return nil, readErr
 		}
-		meta := file.Meta(data)
+		migrated, migrateErr := file.MigrateMeta(file.ReplayMeta(data))
+		if migrateErr != nil {
+			return nil, fmt.Errorf("%s: %w", match.Name, migrateErr)
+		}
+		meta := file.Meta(migrated)
 		f.Body = nil
 		f.Meta = &meta
 	}
@@ -1,10 +1,20 @@
 package archive_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
 	"github.com/mattetti/filebuffer"
 	"github.com/tkellen/memorybox/pkg/archive"
 	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/localdiskstore"
+	"image"
+	"image/jpeg"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -28,9 +38,12 @@ func TestPut(t *testing.T) {
 	if _, err := testStore.Stat(ctx, file.MetaNameFrom(f.Name)); err == nil {
 		t.Fatal("store should not have metafile yet")
 	}
-	if _, err := archive.Put(ctx, testStore, f, ""); err != nil {
+	if _, err := archive.Put(ctx, testStore, f, "", file.MetaFileOptions{}); err != nil {
 		t.Fatal(err)
 	}
+	if err := f.MetaSet("key", "value"); !errors.Is(err, file.ErrFrozen) {
+		t.Fatalf("expected metadata to be frozen after put, got %v", err)
+	}
 	if _, err := testStore.Stat(ctx, f.Name); err != nil {
 		t.Fatal("expected to find datafile after put")
 	}
@@ -49,6 +62,395 @@ func TestPut(t *testing.T) {
 	}
 }
 
+func TestPutWithMetaFileOptions(t *testing.T) {
+	ctx := context.Background()
+	testStore := NewMemStore([]*file.File{})
+	opts := file.MetaFileOptions{
+		ExtraKeys: map[string]string{"title": "test", file.MetaKeyFileName: "ignored"},
+		Tags:      []string{"a", "b"},
+	}
+	f, err := file.NewSha256("test", filebuffer.New([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if _, err := archive.Put(ctx, testStore, f, "", opts); err != nil {
+		t.Fatal(err)
+	}
+	meta, getErr := archive.GetMetaByPrefix(ctx, testStore, f.Name)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if actual := meta.Meta.Get("title"); actual != "test" {
+		t.Fatalf("expected title to be test, got %v", actual)
+	}
+	if diff := cmp.Diff(opts.Tags, meta.Meta.Tags()); diff != "" {
+		t.Fatal(diff)
+	}
+	if actual := meta.Meta.DataFileName(); actual != f.Name {
+		t.Fatalf("expected managed keys to be left alone, got file name %s", actual)
+	}
+}
+
+func TestPutWithThumbnail(t *testing.T) {
+	ctx := context.Background()
+	var fixture bytes.Buffer
+	if err := jpeg.Encode(&fixture, image.NewGray(image.Rect(0, 0, 1, 1)), nil); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	table := map[string]struct {
+		content    []byte
+		unseekable bool
+		expected   bool
+	}{
+		"jpeg images get a thumbnail":                   {content: fixture.Bytes(), expected: true},
+		"other content has no thumbnail":                {content: []byte("test"), expected: false},
+		"jpeg images which cannot be rewound have none": {content: fixture.Bytes(), unseekable: true, expected: false},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			testStore := NewMemStore([]*file.File{})
+			f, err := file.NewSha256("test", filebuffer.New(test.content), time.Now())
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			if test.unseekable {
+				f.Body = ioutil.NopCloser(bytes.NewReader(test.content))
+			}
+			if _, err := archive.Put(ctx, testStore, f, "", file.MetaFileOptions{Thumbnail: true}); err != nil {
+				t.Fatal(err)
+			}
+			meta, getErr := archive.GetMetaByPrefix(ctx, testStore, f.Name)
+			if getErr != nil {
+				t.Fatal(getErr)
+			}
+			encoded, ok := meta.Meta.Get(file.ThumbnailKey(file.ThumbnailSize)).(string)
+			if ok != test.expected {
+				t.Fatalf("expected thumbnail: %v, got %v", test.expected, meta.Meta.Get(file.ThumbnailKey(file.ThumbnailSize)))
+			}
+			if !test.expected {
+				return
+			}
+			thumbnail, decodeErr := base64.StdEncoding.DecodeString(encoded)
+			if decodeErr != nil {
+				t.Fatal(decodeErr)
+			}
+			if _, err := jpeg.Decode(bytes.NewReader(thumbnail)); err != nil {
+				t.Fatal(err)
+			}
+			data, getDataErr := testStore.Get(ctx, f.Name)
+			if getDataErr != nil {
+				t.Fatal(getDataErr)
+			}
+			content, _ := ioutil.ReadAll(data)
+			if !bytes.Equal(test.content, content) {
+				t.Fatal("expected datafile content to be complete")
+			}
+		})
+	}
+}
+
+// seekableStore records the sizes supplied to PutSeekable.
+type seekableStore struct {
+	*MemStore
+	sizes map[string]int64
+}
+
+func (s *seekableStore) PutSeekable(ctx context.Context, reader io.ReadSeeker, name string, lastModified time.Time, size int64) error {
+	s.sizes[name] = size
+	return s.Put(ctx, reader, name, lastModified)
+}
+
+func TestPutSeekable(t *testing.T) {
+	ctx := context.Background()
+	store := &seekableStore{MemStore: NewMemStore(file.List{}), sizes: map[string]int64{}}
+	f, err := file.NewSha256("test", filebuffer.New([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if _, err := archive.Put(ctx, store, f, "", file.MetaFileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if size, ok := store.sizes[f.Name]; !ok || size != 4 {
+		t.Fatalf("expected datafile to be put with size 4, got %d (called: %v)", size, ok)
+	}
+	if _, ok := store.sizes[file.MetaNameFrom(f.Name)]; ok {
+		t.Fatal("expected metafile to be put normally")
+	}
+}
+
+// batchStore records the names of the files put through each call to MultiPut
+// on a MemStore.
+type batchStore struct {
+	*MemStore
+	batches [][]string
+}
+
+func (s *batchStore) MultiPut(ctx context.Context, files []*file.File) error {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+		if err := s.Put(ctx, f, f.Name, f.LastModified); err != nil {
+			return err
+		}
+	}
+	s.batches = append(s.batches, names)
+	return nil
+}
+
+// racingStore is a MemStore implementing AtomicStore where another writer
+// always stores an object just before PutIfAbsent is called.
+type racingStore struct {
+	*MemStore
+	winner *file.File
+}
+
+func (s *racingStore) PutIfAbsent(ctx context.Context, _ io.Reader, name string, lastModified time.Time) (bool, error) {
+	if err := s.Put(ctx, bytes.NewReader(s.winner.MetaBytes()), name, lastModified); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func TestPut_AtomicStore(t *testing.T) {
+	ctx := context.Background()
+	f, err := file.NewSha256("test", filebuffer.New([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	winner := f.Clone()
+	if err := winner.MetaSet("put", "winner"); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	store := &racingStore{MemStore: NewMemStore(file.List{}), winner: winner}
+	result, err := archive.Put(ctx, store, f, "", file.MetaFileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MetaGet("put") != "winner" {
+		t.Fatalf("expected the metafile stored first to be returned, got %s", result.Meta)
+	}
+}
+
+// racingBatchStore is a batchStore implementing AtomicStore where another
+// writer always stores an object just before PutIfAbsent is called.
+type racingBatchStore struct {
+	*batchStore
+	racing *racingStore
+}
+
+func (s *racingBatchStore) PutIfAbsent(ctx context.Context, source io.Reader, name string, lastModified time.Time) (bool, error) {
+	return s.racing.PutIfAbsent(ctx, source, name, lastModified)
+}
+
+func TestPut_AtomicBatchStore(t *testing.T) {
+	ctx := context.Background()
+	f, err := file.NewSha256("test", filebuffer.New([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	winner := f.Clone()
+	if err := winner.MetaSet("put", "winner"); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	mem := NewMemStore(file.List{})
+	store := &racingBatchStore{
+		batchStore: &batchStore{MemStore: mem},
+		racing:     &racingStore{MemStore: mem, winner: winner},
+	}
+	result, err := archive.Put(ctx, store, f, "", file.MetaFileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([][]string{{f.Name}}, store.batches); diff != "" {
+		t.Fatalf("expected only the datafile to be batched: %s", diff)
+	}
+	if result.MetaGet("put") != "winner" {
+		t.Fatalf("expected the metafile stored first to be returned, got %s", result.Meta)
+	}
+}
+
+// presignStore is a MemStore implementing Presigner which records the name it
+// was asked to sign.
+type presignStore struct {
+	*MemStore
+	signed string
+}
+
+func (s *presignStore) PreSignURL(_ context.Context, name string, expiry time.Duration) (string, error) {
+	s.signed = name
+	return fmt.Sprintf("https://example.com/%s?expires=%d", name, int(expiry.Seconds())), nil
+}
+
+func TestSignedURL(t *testing.T) {
+	ctx := context.Background()
+	f, err := file.NewSha256("test", filebuffer.New([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	meta := file.NewStub(file.MetaNameFrom(f.Name), 0, time.Now())
+	table := map[string]struct {
+		store        archive.Store
+		file         *file.File
+		expectedName string
+		expectedErr  error
+	}{
+		"datafiles are signed by name": {
+			store:        &presignStore{MemStore: NewMemStore(file.List{})},
+			file:         f,
+			expectedName: f.Name,
+		},
+		"metafiles sign the datafile they describe": {
+			store:        &presignStore{MemStore: NewMemStore(file.List{})},
+			file:         meta,
+			expectedName: f.Name,
+		},
+		"stores which cannot presign fail": {
+			store:       NewMemStore(file.List{}),
+			file:        f,
+			expectedErr: os.ErrInvalid,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			url, err := archive.SignedURL(ctx, test.store, test.file, time.Hour)
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+			if test.expectedErr != nil {
+				return
+			}
+			if signed := test.store.(*presignStore).signed; signed != test.expectedName {
+				t.Fatalf("expected %s to be signed, got %s", test.expectedName, signed)
+			}
+			expected := "https://example.com/" + test.expectedName + "?expires=3600"
+			if url != expected {
+				t.Fatalf("expected %s, got %s", expected, url)
+			}
+		})
+	}
+}
+
+func TestPutBatch(t *testing.T) {
+	ctx := context.Background()
+	store := &batchStore{MemStore: NewMemStore(file.List{})}
+	f, err := file.NewSha256("test", filebuffer.New([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	result, err := archive.Put(ctx, store, f, "set", file.MetaFileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([][]string{{f.Name, file.MetaNameFrom(f.Name)}}, store.batches); diff != "" {
+		t.Fatal(diff)
+	}
+	meta, err := archive.GetMetaByPrefix(ctx, store, f.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Meta.DataFileName() != f.Name || meta.MetaGet(file.MetaKeyImportSet) != "set" {
+		t.Fatalf("expected metafile describing %s in set, got %s", f.Name, meta.Meta)
+	}
+	if result != f {
+		t.Fatal("expected put file to be returned")
+	}
+	// Storing the same content again has nothing to put.
+	if _, err := archive.Put(ctx, store, f, "set", file.MetaFileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.batches) != 1 {
+		t.Fatalf("expected no further batches, got %v", store.batches)
+	}
+}
+
+// rangeStore records the ranges requested from a MemStore.
+type rangeStore struct {
+	*MemStore
+	ranges [][2]int64
+}
+
+func (s *rangeStore) GetRange(ctx context.Context, name string, start int64, end int64) (io.ReadCloser, error) {
+	s.ranges = append(s.ranges, [2]int64{start, end})
+	f, err := s.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	f.Seek(start, io.SeekStart)
+	return ioutil.NopCloser(io.LimitReader(f, end-start+1)), nil
+}
+
+func TestGetDecompressed(t *testing.T) {
+	ctx := context.Background()
+	original := []byte("some text worth compressing")
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(original)
+	writer.Close()
+	f, err := file.NewSha256("test.gz", filebuffer.New(compressed.Bytes()), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	store := NewMemStore(file.List{})
+	if _, err := archive.Put(ctx, store, f, "", file.MetaFileOptions{}); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	stored, err := archive.GetDataByPrefix(ctx, store, f.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stored.Close()
+	contentType, err := archive.ContentType(ctx, store, f.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := stored.Decompress(file.CompressionFromContentType(contentType))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decompressed.Close()
+	actual, err := ioutil.ReadAll(decompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(original, actual) {
+		t.Fatalf("expected %s, got %s", original, actual)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	ctx := context.Background()
+	content := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 1024)...)
+	newStore := func() *MemStore {
+		store := NewMemStore(file.List{})
+		if err := store.Put(ctx, bytes.NewReader(content), "image", time.Now()); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		return store
+	}
+	ranged := &rangeStore{MemStore: newStore()}
+	plain := newStore()
+	for _, store := range []archive.Store{ranged, plain} {
+		actual, err := archive.ContentType(ctx, store, "image")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != "image/png" {
+			t.Fatalf("expected image/png, got %s", actual)
+		}
+	}
+	if diff := cmp.Diff([][2]int64{{0, 511}}, ranged.ranges); diff != "" {
+		t.Fatal(diff)
+	}
+	if calls := ranged.Calls("Get"); calls != 1 {
+		t.Fatalf("expected range to be read through a single get, got %d", calls)
+	}
+	if _, err := archive.ContentType(ctx, plain, "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+}
+
 func TestPutWontOverwrite(t *testing.T) {
 	ctx := context.Background()
 	testStore := NewMemStore([]*file.File{})
@@ -64,7 +466,7 @@ func TestPutWontOverwrite(t *testing.T) {
 	if _, err := testStore.Stat(ctx, file.MetaNameFrom(f.Name)); err == nil {
 		t.Fatal("store should not have metafile yet")
 	}
-	if _, err := archive.Put(ctx, testStore, f, ""); err != nil {
+	if _, err := archive.Put(ctx, testStore, f, "", file.MetaFileOptions{}); err != nil {
 		t.Fatal(err)
 	}
 	if _, err := testStore.Stat(ctx, f.Name); err != nil {
@@ -97,3 +499,269 @@ func TestDelete(t *testing.T) {
 		t.Fatal("store should no longer have metafile")
 	}
 }
+
+func TestAppendMeta(t *testing.T) {
+	ctx := context.Background()
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	table := map[string]archive.Store{
+		"store supporting append": localdiskstore.New(tempDir),
+		"store without append":    NewMemStore(file.List{}),
+	}
+	for name, store := range table {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			f, err := file.NewSha256("test", filebuffer.New([]byte("test")), time.Now())
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			if _, err := archive.Put(ctx, store, f, "", file.MetaFileOptions{}); err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			if err := archive.AppendMeta(ctx, store, f.Name, "events.first", `["put"]`); err != nil {
+				t.Fatal(err)
+			}
+			if err := archive.AppendMeta(ctx, store, f.Name, "events.second", "done"); err != nil {
+				t.Fatal(err)
+			}
+			meta, getErr := archive.GetMetaByPrefix(ctx, store, f.Name)
+			if getErr != nil {
+				t.Fatal(getErr)
+			}
+			if err := file.ValidateMeta(*meta.Meta); err != nil {
+				t.Fatalf("expected valid metadata, got %s", err)
+			}
+			expected := `{"first":["put"],"second":"done"}`
+			if actual := fmt.Sprintf("%s", meta.Meta.Get("events")); actual != expected {
+				t.Fatalf("expected %s, got %s", expected, actual)
+			}
+		})
+	}
+}
+
+func TestPutInvalid(t *testing.T) {
+	f, err := file.NewSha256("test", filebuffer.New([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Meta.Set(file.MetaKeyFileName, "other")
+	if _, err := archive.Put(context.Background(), NewMemStore(file.List{}), f, "", file.MetaFileOptions{}); !errors.Is(err, file.ErrMetaMismatch) {
+		t.Fatalf("expected error %s, got %v", file.ErrMetaMismatch, err)
+	}
+}
+
+func TestBulkDelete(t *testing.T) {
+	ctx := context.Background()
+	testStore := NewMemStore(file.List{})
+	var names []string
+	for _, content := range []string{"foo", "bar", "baz"} {
+		f, err := file.NewSha256("test", filebuffer.New([]byte(content)), time.Now())
+		if err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		if _, err := archive.Put(ctx, testStore, f, "", file.MetaFileOptions{}); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		names = append(names, f.Name)
+	}
+	kept := names[2]
+	err := archive.BulkDelete(ctx, discardLogger(), testStore, 2, []string{names[0], "missing", names[1], "absent"})
+	var errs archive.Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected accumulated errors, got %v", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %d: %s", len(errs), errs)
+	}
+	for _, err := range errs {
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected %s, got %s", os.ErrNotExist, err)
+		}
+	}
+	for _, name := range names[:2] {
+		for _, f := range []string{name, file.MetaNameFrom(name)} {
+			if _, err := testStore.Stat(ctx, f); err == nil {
+				t.Fatalf("expected %s to be deleted", f)
+			}
+		}
+	}
+	for _, f := range []string{kept, file.MetaNameFrom(kept)} {
+		if _, err := testStore.Stat(ctx, f); err != nil {
+			t.Fatalf("expected %s to remain, got %s", f, err)
+		}
+	}
+	if err := archive.BulkDelete(ctx, discardLogger(), testStore, 2, []string{kept}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutStreaming(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("test")
+	expected, _, _ := file.Sha256(bytes.NewReader(content))
+	testStore := NewMemStore([]*file.File{})
+	f, err := archive.PutStreaming(ctx, testStore, "test", file.NewSha256StreamingHasher(bytes.NewReader(content)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Meta.DataFileName() != expected {
+		t.Fatalf("expected %s, got %s", expected, f.Meta.DataFileName())
+	}
+	stored, getErr := archive.GetDataByPrefix(ctx, testStore, expected)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	actual, readErr := ioutil.ReadAll(stored)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if !bytes.Equal(content, actual) {
+		t.Fatalf("expected %s, got %s", content, actual)
+	}
+	meta := []byte(`{"meta":{"file":"test","memorybox":true}}`)
+	if _, err := archive.PutStreaming(ctx, testStore, "test", file.NewSha256StreamingHasher(bytes.NewReader(meta)), ""); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected metadata content to be rejected, got %v", err)
+	}
+}
+
+// putCountingStore records how many times Put is called on a MemStore.
+type putCountingStore struct {
+	*MemStore
+	puts int
+}
+
+func (s *putCountingStore) Put(ctx context.Context, reader io.Reader, name string, lastModified time.Time) error {
+	s.puts++
+	return s.MemStore.Put(ctx, reader, name, lastModified)
+}
+
+func TestGetOrPut(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("test")
+	source, err := ioutil.TempFile("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.Remove(source.Name())
+	source.Write(content)
+	source.Close()
+	existing, err := file.NewSha256("test", filebuffer.New(content), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	table := map[string]struct {
+		store        *MemStore
+		expectedPuts int
+		expectedErr  error
+	}{
+		"already exists": {
+			store:        NewMemStore(file.List{existing}),
+			expectedPuts: 0,
+		},
+		"new file": {
+			store:        NewMemStore(file.List{}),
+			expectedPuts: 2,
+		},
+		"transient get failure": {
+			store: func() *MemStore {
+				store := NewMemStore(file.List{})
+				store.GetErrorWith = errors.New("transient")
+				return store
+			}(),
+			expectedPuts: 0,
+			expectedErr:  errors.New("transient"),
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			store := &putCountingStore{MemStore: test.store}
+			f, err := archive.GetOrPut(ctx, store, source.Name(), file.Sha256)
+			if err != nil && test.expectedErr == nil {
+				t.Fatal(err)
+			}
+			if test.expectedErr != nil && (err == nil || err.Error() != test.expectedErr.Error()) {
+				t.Fatalf("expected error: %s, got %v", test.expectedErr, err)
+			}
+			if store.puts != test.expectedPuts {
+				t.Fatalf("expected %d puts, got %d", test.expectedPuts, store.puts)
+			}
+			if err != nil {
+				return
+			}
+			if f.Name != existing.Name {
+				t.Fatalf("expected %s, got %s", existing.Name, f.Name)
+			}
+			actual, readErr := ioutil.ReadAll(f)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if !bytes.Equal(content, actual) {
+				t.Fatalf("expected %s, got %s", content, actual)
+			}
+		})
+	}
+}
+
+func TestRename(t *testing.T) {
+	ctx := context.Background()
+	tempDir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	table := map[string]archive.Store{
+		"store implementing renamer": localdiskstore.New(tempDir),
+		"store without renamer":      NewMemStore(file.List{}),
+	}
+	for name, store := range table {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			f, err := file.NewSha256("test", filebuffer.New([]byte("test")), time.Now())
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			if _, err := archive.Put(ctx, store, f, "", file.MetaFileOptions{}); err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			oldName := f.Name
+			newName := "renamed"
+			if err := archive.Rename(ctx, store, oldName, newName); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{oldName, file.MetaNameFrom(oldName)} {
+				if _, err := store.Get(ctx, name); !errors.Is(err, os.ErrNotExist) {
+					t.Fatalf("expected %s to be missing, got %v", name, err)
+				}
+			}
+			data, getErr := archive.GetDataByPrefix(ctx, store, newName)
+			if getErr != nil {
+				t.Fatal(getErr)
+			}
+			content, readErr := ioutil.ReadAll(data)
+			data.Close()
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if string(content) != "test" {
+				t.Fatalf("expected content test, got %s", content)
+			}
+			meta, metaErr := archive.GetMetaByPrefix(ctx, store, file.MetaNameFrom(newName))
+			if metaErr != nil {
+				t.Fatal(metaErr)
+			}
+			if actual := meta.Meta.DataFileName(); actual != newName {
+				t.Fatalf("expected metafile to describe %s, got %s", newName, actual)
+			}
+			if actual := meta.Meta.Get(file.MetaKeyPreviousName); actual != oldName {
+				t.Fatalf("expected previous name %s, got %v", oldName, actual)
+			}
+			if err := archive.Rename(ctx, store, oldName, "other"); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected renaming a missing file to fail with %s, got %v", os.ErrNotExist, err)
+			}
+		})
+	}
+}
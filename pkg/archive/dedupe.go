@@ -0,0 +1,201 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/hash"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"io"
+	"sort"
+	"sync"
+)
+
+// fingerprintSize is the number of bytes at the start of a datafile which are
+// hashed to find candidate duplicates.
+const fingerprintSize = 4096
+
+// Dedupe finds datafiles in a store which have identical content despite
+// having different names. This can happen when content is hashed with more
+// than one algorithm. Datafiles are grouped by size and a hash of their first
+// few kilobytes, after which the content of every candidate is compared byte
+// for byte. Each group returned holds the sorted names of datafiles with
+// identical content. Nothing is removed from the store.
+func Dedupe(ctx context.Context, store Store, concurrency int) ([][]string, error) {
+	files, err := SearchAll(ctx, store, "")
+	if err != nil {
+		return nil, err
+	}
+	bySize := map[int64][]string{}
+	for _, f := range files.Data() {
+		bySize[f.Size] = append(bySize[f.Size], f.Name)
+	}
+	var candidates []string
+	for _, names := range bySize {
+		if len(names) > 1 {
+			candidates = append(candidates, names...)
+		}
+	}
+	fingerprints := map[string]string{}
+	var mu sync.Mutex
+	eg, egCtx := errgroup.WithContext(ctx)
+	sem := semaphore.NewWeighted(int64(concurrency))
+	eg.Go(func() error {
+		for _, name := range candidates {
+			if err := sem.Acquire(egCtx, 1); err != nil {
+				return err
+			}
+			name := name // https://golang.org/doc/faq#closures_and_goroutines
+			eg.Go(func() error {
+				defer sem.Release(1)
+				fingerprint, err := dedupeFingerprint(egCtx, store, name)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				mu.Lock()
+				fingerprints[name] = fingerprint
+				mu.Unlock()
+				return nil
+			})
+		}
+		return nil
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	byFingerprint := map[string][]string{}
+	for size, names := range bySize {
+		for _, name := range names {
+			if fingerprint, ok := fingerprints[name]; ok {
+				key := fmt.Sprintf("%d-%s", size, fingerprint)
+				byFingerprint[key] = append(byFingerprint[key], name)
+			}
+		}
+	}
+	var groups [][]string
+	for _, names := range byFingerprint {
+		if len(names) < 2 {
+			continue
+		}
+		sort.Strings(names)
+		verified, err := dedupeVerify(ctx, store, names)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, verified...)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i][0] < groups[j][0]
+	})
+	return groups, nil
+}
+
+// dedupeFingerprint hashes the first few kilobytes of a datafile.
+func dedupeFingerprint(ctx context.Context, store Store, name string) (string, error) {
+	f, err := store.Get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	digest := hash.NewSha256()
+	if _, err := io.CopyN(digest, f, fingerprintSize); err != nil && err != io.EOF {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// dedupeVerify splits datafiles which are candidate duplicates into groups
+// whose content is identical, dropping any which have no duplicate.
+func dedupeVerify(ctx context.Context, store Store, names []string) ([][]string, error) {
+	var groups [][]string
+	for _, name := range names {
+		matched := false
+		for index, group := range groups {
+			same, err := sameContent(ctx, store, group[0], name)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				groups[index] = append(group, name)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			groups = append(groups, []string{name})
+		}
+	}
+	var result [][]string
+	for _, group := range groups {
+		if len(group) > 1 {
+			result = append(result, group)
+		}
+	}
+	return result, nil
+}
+
+// sameContent compares the content of two datafiles byte for byte.
+func sameContent(ctx context.Context, store Store, a string, b string) (bool, error) {
+	first, err := store.Get(ctx, a)
+	if err != nil {
+		return false, err
+	}
+	defer first.Close()
+	second, err := store.Get(ctx, b)
+	if err != nil {
+		return false, err
+	}
+	defer second.Close()
+	firstChunk := make([]byte, fingerprintSize)
+	secondChunk := make([]byte, fingerprintSize)
+	for {
+		firstRead, firstErr := io.ReadFull(first, firstChunk)
+		secondRead, secondErr := io.ReadFull(second, secondChunk)
+		if !bytes.Equal(firstChunk[:firstRead], secondChunk[:secondRead]) {
+			return false, nil
+		}
+		firstDone := firstErr == io.EOF || firstErr == io.ErrUnexpectedEOF
+		secondDone := secondErr == io.EOF || secondErr == io.ErrUnexpectedEOF
+		if firstErr != nil && !firstDone {
+			return false, firstErr
+		}
+		if secondErr != nil && !secondDone {
+			return false, secondErr
+		}
+		if firstDone || secondDone {
+			return firstDone && secondDone, nil
+		}
+	}
+}
+
+// DedupeEntry describes a datafile in a group of duplicates.
+type DedupeEntry struct {
+	Name   string
+	Size   int64
+	Source string
+}
+
+// DedupeDetails looks up the size of each datafile in the supplied groups and
+// the source recorded in its metafile, if it has one.
+func DedupeDetails(ctx context.Context, store Store, groups [][]string) ([][]DedupeEntry, error) {
+	var result [][]DedupeEntry
+	for _, group := range groups {
+		var entries []DedupeEntry
+		for _, name := range group {
+			stat, err := store.Stat(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			entry := DedupeEntry{Name: name, Size: stat.Size}
+			if meta, metaErr := GetMetaByPrefix(ctx, store, file.MetaNameFrom(name)); metaErr == nil {
+				entry.Source = meta.Meta.Source()
+			}
+			entries = append(entries, entry)
+		}
+		result = append(result, entries)
+	}
+	return result, nil
+}
@@ -0,0 +1,67 @@
+package archive_test
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/localdiskstore"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupe(t *testing.T) {
+	ctx := context.Background()
+	tempDir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := localdiskstore.New(tempDir)
+	large := strings.Repeat("a", 10000)
+	fixtures := map[string]string{
+		"one-sha256":   "duplicate",
+		"one-sha1":     "duplicate",
+		"one-md5":      "duplicate",
+		"same-size":    "duplicatf",
+		"unique":       "unique",
+		"large-sha256": large + "a",
+		"large-sha1":   large + "a",
+		"large-other":  large + "b",
+	}
+	for name, content := range fixtures {
+		if err := store.Put(ctx, strings.NewReader(content), name, time.Now()); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	meta := file.Meta(`{"meta":{"file":"one-sha1","import":{"source":"origin"}}}`)
+	if err := store.Put(ctx, strings.NewReader(meta.String()), file.MetaNameFrom("one-sha1"), time.Now()); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	groups, err := archive.Dedupe(ctx, store, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"large-sha1", "large-sha256"},
+		{"one-md5", "one-sha1", "one-sha256"},
+	}
+	if diff := cmp.Diff(expected, groups); diff != "" {
+		t.Fatal(diff)
+	}
+	details, err := archive.DedupeDetails(ctx, store, groups[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDetails := [][]archive.DedupeEntry{{
+		{Name: "one-md5", Size: 9},
+		{Name: "one-sha1", Size: 9, Source: "origin"},
+		{Name: "one-sha256", Size: 9},
+	}}
+	if diff := cmp.Diff(expectedDetails, details); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -5,47 +5,87 @@ import (
 	"errors"
 	"fmt"
 	"github.com/tkellen/memorybox/pkg/file"
+	"os"
 	"sort"
 	"strings"
 )
 
-// Diff shows the differences between two stores.
-func Diff(ctx context.Context, source Store, dest Store) error {
+// DiffResult describes the differences between two stores.
+type DiffResult struct {
+	// Mode is what was compared: "metafiles", "datafiles" or "all".
+	Mode string `json:"mode"`
+	// OnlyInSource holds the names of files missing in the destination.
+	OnlyInSource []string `json:"onlyInSource"`
+	// OnlyInDest holds the names of files missing in the source.
+	OnlyInDest []string `json:"onlyInDest"`
+	source     Store
+	dest       Store
+}
+
+// Err describes the differences in the result, one file per line. It is nil
+// if the stores are in sync.
+func (r *DiffResult) Err() error {
 	var diffs []string
+	for _, name := range r.OnlyInSource {
+		diffs = append(diffs, fmt.Sprintf("[%s]: %s [missing in %s]", r.source, name, r.dest))
+	}
+	for _, name := range r.OnlyInDest {
+		diffs = append(diffs, fmt.Sprintf("[%s]: %s [missing in %s]", r.dest, name, r.source))
+	}
+	if len(diffs) > 0 {
+		return errors.New(strings.Join(diffs, "\n"))
+	}
+	return nil
+}
+
+// Compare finds the differences between two stores. The mode controls what
+// is compared: "metafiles", "datafiles" or "all".
+func Compare(ctx context.Context, source Store, dest Store, mode string) (*DiffResult, error) {
+	if mode != "metafiles" && mode != "datafiles" && mode != "all" {
+		return nil, fmt.Errorf("%w: unknown diff mode %q", os.ErrInvalid, mode)
+	}
 	index := map[Store]map[string]*file.File{}
 	for _, store := range []Store{source, dest} {
 		files, err := store.Search(ctx, "")
 		if err != nil {
-			return err
+			return nil, err
 		}
-		index[store] = files.ByName()
-	}
-	compares := []error{
-		compare(index, source, dest),
-		compare(index, dest, source),
-	}
-	for _, err := range compares {
-		if err != nil {
-			diffs = append(diffs, err.Error())
+		switch mode {
+		case "metafiles":
+			files = files.Meta()
+		case "datafiles":
+			files = files.Data()
 		}
+		index[store] = files.ByName()
 	}
-	if len(diffs) > 0 {
-		return errors.New(strings.Join(diffs, "\n"))
+	return &DiffResult{
+		Mode:         mode,
+		OnlyInSource: missing(index[source], index[dest]),
+		OnlyInDest:   missing(index[dest], index[source]),
+		source:       source,
+		dest:         dest,
+	}, nil
+}
+
+// Diff shows the differences between two stores. The mode controls what is
+// compared: "metafiles", "datafiles" or "all".
+func Diff(ctx context.Context, source Store, dest Store, mode string) error {
+	result, err := Compare(ctx, source, dest, mode)
+	if err != nil {
+		return err
 	}
-	return nil
+	return result.Err()
 }
 
-func compare(index map[Store]map[string]*file.File, source Store, dest Store) error {
-	var diffs []string
-	for file := range index[source] {
-		if _, ok := index[dest][file]; !ok {
-			diffs = append(diffs, fmt.Sprintf("[%s]: %s [missing in %s]", source, file, dest))
+// missing finds the names present in one index but not another.
+func missing(present map[string]*file.File, other map[string]*file.File) []string {
+	names := []string{}
+	for name := range present {
+		if _, ok := other[name]; !ok {
+			names = append(names, name)
 		}
 	}
-	if len(diffs) > 0 {
-		// make results deterministic
-		sort.Strings(diffs)
-		return errors.New(strings.Join(diffs, "\n"))
-	}
-	return nil
+	// make results deterministic
+	sort.Strings(names)
+	return names
 }
@@ -3,33 +3,66 @@ package archive_test
 import (
 	"context"
 	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
 	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
 	"github.com/tkellen/memorybox/pkg/localdiskstore"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestDiff(t *testing.T) {
 	type testCase struct {
-		source      *localdiskstore.Store
-		dest        *localdiskstore.Store
+		source      archive.Store
+		dest        archive.Store
+		mode        string
 		expectedErr error
 	}
+	matchingData := func(names ...string) archive.Store {
+		var fixtures file.List
+		for _, name := range names {
+			fixtures = append(fixtures, file.NewStub(name, 1, time.Now()))
+		}
+		return NewMemStore(fixtures)
+	}
 	table := map[string]testCase{
+		"metafiles differ in metafiles mode": {
+			source:      matchingData("a", file.MetaNameFrom("a")),
+			dest:        matchingData("a"),
+			mode:        "metafiles",
+			expectedErr: errors.New("[MemStore]: " + file.MetaNameFrom("a") + " [missing in MemStore]"),
+		},
+		"metafiles ignored in datafiles mode": {
+			source:      matchingData("a", file.MetaNameFrom("a")),
+			dest:        matchingData("a"),
+			mode:        "datafiles",
+			expectedErr: nil,
+		},
+		"unknown mode": {
+			source:      matchingData(),
+			dest:        matchingData(),
+			mode:        "some",
+			expectedErr: fmt.Errorf("%w: unknown diff mode %q", os.ErrInvalid, "some"),
+		},
 		"perfect sync": {
 			source:      localdiskstore.New("../../testdata/valid"),
 			dest:        localdiskstore.New("../../testdata/valid"),
+			mode:        "all",
 			expectedErr: nil,
 		},
 		"diff between stores": {
 			source:      localdiskstore.New("../../testdata/valid"),
 			dest:        localdiskstore.New("../../testdata/valid-alternate"),
+			mode:        "all",
 			expectedErr: errors.New("[localDisk: ../../testdata/valid-alternate]: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08-sha256 [missing in localDisk: ../../testdata/valid]\n[localDisk: ../../testdata/valid-alternate]: meta-9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08-sha256 [missing in localDisk: ../../testdata/valid]"),
 		},
 	}
 	for name, test := range table {
 		test := test
 		t.Run(name, func(t *testing.T) {
-			err := archive.Diff(context.Background(), test.source, test.dest)
+			err := archive.Diff(context.Background(), test.source, test.dest, test.mode)
 			if err != nil && test.expectedErr == nil {
 				t.Fatalf("expected no error, got %s", err)
 			}
@@ -42,3 +75,38 @@ func TestDiff(t *testing.T) {
 		})
 	}
 }
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+	source := NewMemStore(file.List{
+		file.NewStub("a", 1, time.Now()),
+		file.NewStub(file.MetaNameFrom("a"), 1, time.Now()),
+	})
+	dest := NewMemStore(file.List{
+		file.NewStub("a", 1, time.Now()),
+		file.NewStub("b", 1, time.Now()),
+	})
+	table := map[string]*archive.DiffResult{
+		"metafiles": {Mode: "metafiles", OnlyInSource: []string{file.MetaNameFrom("a")}, OnlyInDest: []string{}},
+		"datafiles": {Mode: "datafiles", OnlyInSource: []string{}, OnlyInDest: []string{"b"}},
+		"all":       {Mode: "all", OnlyInSource: []string{file.MetaNameFrom("a")}, OnlyInDest: []string{"b"}},
+	}
+	for mode, expected := range table {
+		mode, expected := mode, expected
+		t.Run(mode, func(t *testing.T) {
+			actual, err := archive.Compare(ctx, source, dest, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual.Mode != expected.Mode {
+				t.Fatalf("expected mode %s, got %s", expected.Mode, actual.Mode)
+			}
+			if diff := cmp.Diff(expected.OnlyInSource, actual.OnlyInSource); diff != "" {
+				t.Fatal(diff)
+			}
+			if diff := cmp.Diff(expected.OnlyInDest, actual.OnlyInDest); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
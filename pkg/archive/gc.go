@@ -0,0 +1,114 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"github.com/tkellen/memorybox/pkg/file"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// GCReport describes the outcome of garbage collecting a store.
+type GCReport struct {
+	// Orphans holds the names of the files without a pair that were
+	// collected.
+	Orphans []string `json:"orphans"`
+	// TotalBytesFreeable is the combined size of the orphans.
+	TotalBytesFreeable int64 `json:"totalBytesFreeable"`
+	// DryRun is true if the orphans were left in place.
+	DryRun bool `json:"dryRun"`
+}
+
+// GCOptions controls what GarbageCollect removes.
+type GCOptions struct {
+	// DryRun reports the orphans without deleting them.
+	DryRun bool
+	// Metafiles collects metafiles without a datafile. Syncing metafiles
+	// alone, or syncing metafiles before datafiles, leaves stores where every
+	// metafile looks like an orphan; only enable this when nothing else is
+	// writing to the store. Stores which hold no datafiles at all are never
+	// collected.
+	Metafiles bool
+	// Datafiles collects datafiles without a metafile. Put writes a datafile
+	// and its metafile at the same time, so a put which is still in progress
+	// can look like an orphan and deleting its datafile loses content; only
+	// enable this when nothing else is writing to the store.
+	Datafiles bool
+}
+
+// objectName matches the names memorybox gives to datafiles and metafiles:
+// a lowercase hex digest suffixed with the algorithm that produced it.
+var objectName = regexp.MustCompile(`^(` + regexp.QuoteMeta(file.MetaFilePrefix) + `)?[0-9a-f]+-[a-z0-9]+$`)
+
+// GarbageCollect removes metafiles which lack a datafile from a store if
+// opts.Metafiles is set, and datafiles which lack a metafile if opts.Datafiles
+// is set. Files with names memorybox would not have produced are never touched.
+// A store with metafiles but no datafiles, such as one written by syncing only
+// metafiles, is refused rather than having every metafile collected. The size
+// of each orphan is found with Stat so the report can show how much space is
+// freed. Stores which are a DeletionPurger are purged first.
+func GarbageCollect(ctx context.Context, logger *Logger, store Store, concurrency int, opts GCOptions) (*GCReport, error) {
+	if purger, ok := store.(DeletionPurger); ok && !opts.DryRun {
+		if err := purger.PurgeDeletions(); err != nil {
+			return nil, err
+		}
+	}
+	files, err := SearchAll(ctx, store, "")
+	if err != nil {
+		return nil, err
+	}
+	objects := files.Filter(func(f *file.File) bool {
+		return objectName.MatchString(f.Name)
+	})
+	if opts.Metafiles && len(objects.Meta()) > 0 && len(objects.Data()) == 0 {
+		return nil, fmt.Errorf("%w: %s has metafiles but no datafiles, refusing to collect them", os.ErrInvalid, store)
+	}
+	orphans := objects.Invalid().Filter(func(f *file.File) bool {
+		if file.IsMetaFileName(f.Name) {
+			return opts.Metafiles
+		}
+		return opts.Datafiles
+	})
+	report := &GCReport{
+		Orphans: orphans.Names(),
+		DryRun:  opts.DryRun,
+	}
+	var mu sync.Mutex
+	eg, egCtx := errgroup.WithContext(ctx)
+	sem := semaphore.NewWeighted(int64(concurrency))
+	eg.Go(func() error {
+		for _, orphan := range orphans {
+			if err := sem.Acquire(egCtx, 1); err != nil {
+				return err
+			}
+			name := orphan.Name // https://golang.org/doc/faq#closures_and_goroutines
+			eg.Go(func() error {
+				defer sem.Release(1)
+				stat, err := store.Stat(egCtx, name)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				mu.Lock()
+				report.TotalBytesFreeable += stat.Size
+				mu.Unlock()
+				if opts.DryRun {
+					logger.Verbose.Printf("%s (would delete)", name)
+					return nil
+				}
+				if err := store.Delete(egCtx, name); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				logger.Verbose.Printf("%s deleted", name)
+				return nil
+			})
+		}
+		return nil
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
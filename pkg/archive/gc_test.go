@@ -0,0 +1,151 @@
+package archive_test
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/localdiskstore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGarbageCollect(t *testing.T) {
+	ctx := context.Background()
+	paired := "aaaa-sha256"
+	orphanData := "bbbb-sha256"
+	orphanMeta := file.MetaNameFrom("cccc-sha256")
+	newStore := func() *MemStore {
+		store := NewMemStore(file.List{})
+		fixtures := map[string]string{
+			paired:                     "content",
+			file.MetaNameFrom(paired):  "{}",
+			orphanData:                 "twelve bytes",
+			orphanMeta:                 "{}",
+			"notes.txt":                "not a memorybox object",
+			file.MetaNameFrom("draft"): "{}",
+		}
+		for name, content := range fixtures {
+			if err := store.Put(ctx, strings.NewReader(content), name, time.Now()); err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+		}
+		return store
+	}
+	table := map[string]struct {
+		opts      archive.GCOptions
+		expected  *archive.GCReport
+		remaining []string
+	}{
+		"dry run leaves orphans": {
+			opts: archive.GCOptions{DryRun: true, Metafiles: true},
+			expected: &archive.GCReport{
+				Orphans:            []string{orphanMeta},
+				TotalBytesFreeable: int64(len("{}")),
+				DryRun:             true,
+			},
+			remaining: []string{paired, orphanData, file.MetaNameFrom(paired), orphanMeta, file.MetaNameFrom("draft"), "notes.txt"},
+		},
+		"nothing is deleted by default": {
+			opts:      archive.GCOptions{},
+			expected:  &archive.GCReport{Orphans: []string{}},
+			remaining: []string{paired, orphanData, file.MetaNameFrom(paired), orphanMeta, file.MetaNameFrom("draft"), "notes.txt"},
+		},
+		"orphaned metafiles are deleted when included": {
+			opts: archive.GCOptions{Metafiles: true},
+			expected: &archive.GCReport{
+				Orphans:            []string{orphanMeta},
+				TotalBytesFreeable: int64(len("{}")),
+			},
+			remaining: []string{paired, orphanData, file.MetaNameFrom(paired), file.MetaNameFrom("draft"), "notes.txt"},
+		},
+		"orphaned datafiles are deleted when included": {
+			opts: archive.GCOptions{Datafiles: true},
+			expected: &archive.GCReport{
+				Orphans:            []string{orphanData},
+				TotalBytesFreeable: int64(len("twelve bytes")),
+			},
+			remaining: []string{paired, file.MetaNameFrom(paired), orphanMeta, file.MetaNameFrom("draft"), "notes.txt"},
+		},
+		"every orphan is deleted when both are included": {
+			opts: archive.GCOptions{Metafiles: true, Datafiles: true},
+			expected: &archive.GCReport{
+				Orphans:            []string{orphanData, orphanMeta},
+				TotalBytesFreeable: int64(len("twelve bytes") + len("{}")),
+			},
+			remaining: []string{paired, file.MetaNameFrom(paired), file.MetaNameFrom("draft"), "notes.txt"},
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+			report, err := archive.GarbageCollect(ctx, discardLogger(), store, 2, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.expected, report); diff != "" {
+				t.Fatal(diff)
+			}
+			files, searchErr := store.Search(ctx, "")
+			if searchErr != nil {
+				t.Fatal(searchErr)
+			}
+			if diff := cmp.Diff(test.remaining, files.Names()); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestGarbageCollect_MetafilesOnly(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore(file.List{})
+	// A store written by syncing only metafiles has no datafiles at all.
+	for _, name := range []string{file.MetaNameFrom("aaaa-sha256"), file.MetaNameFrom("bbbb-sha256")} {
+		if err := store.Put(ctx, strings.NewReader("{}"), name, time.Now()); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	if _, err := archive.GarbageCollect(ctx, discardLogger(), store, 2, archive.GCOptions{Metafiles: true}); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected collecting a store without datafiles to fail with %s, got %v", os.ErrInvalid, err)
+	}
+	if calls := store.Calls("Delete"); calls != 0 {
+		t.Fatalf("expected no metafiles to be deleted, got %d calls to Delete", calls)
+	}
+}
+
+func TestGarbageCollect_PurgesDeletions(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	leftover := filepath.Join(tempDir, ".deleted-test")
+	if err := ioutil.WriteFile(leftover, []byte("test"), 0644); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(leftover, old, old); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	store := localdiskstore.New(tempDir)
+	ctx := context.Background()
+	if _, err := archive.GarbageCollect(ctx, discardLogger(), store, 2, archive.GCOptions{DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); err != nil {
+		t.Fatalf("expected a dry run to leave deletions in place, got %s", err)
+	}
+	if _, err := archive.GarbageCollect(ctx, discardLogger(), store, 2, archive.GCOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected deletions to be purged, got %v", err)
+	}
+}
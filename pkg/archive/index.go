@@ -4,32 +4,247 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/tidwall/gjson"
 	"github.com/tkellen/memorybox/pkg/file"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 )
 
+// Sort orders supported by IndexOptions.
+const (
+	// IndexSortDate orders metafiles by the time their datafiles were
+	// imported, newest first.
+	IndexSortDate = "date"
+	// IndexSortName orders metafiles by the name of their datafiles.
+	IndexSortName = "name"
+	// IndexSortSize orders metafiles by the size of their datafiles, largest
+	// first.
+	IndexSortSize = "size"
+)
+
+// IndexOptions controls the output of Index.
+type IndexOptions struct {
+	// SortKey is one of IndexSortDate, IndexSortName or IndexSortSize.
+	// Defaults to IndexSortDate. Ties are broken by datafile name so the
+	// output is reproducible.
+	SortKey string
+}
+
 // Index concats all metafiles in the provided store, one per line.
-func Index(ctx context.Context, store Store, concurrency int) ([][]byte, error) {
-	files, searchErr := store.Search(ctx, "")
+func Index(ctx context.Context, store Store, concurrency int, opts IndexOptions) ([][]byte, error) {
+	return index(ctx, store, concurrency, opts, nil)
+}
+
+// IndexCache persists the raw content of metafiles to local disk as
+// newline-delimited json so repeated indexing of a store only needs to fetch
+// metafiles that have been modified since they were cached.
+type IndexCache struct {
+	Path    string
+	Hits    int
+	Misses  int
+	entries map[string]indexCacheEntry
+}
+
+type indexCacheEntry struct {
+	Name         string    `json:"name"`
+	LastModified time.Time `json:"lastModified"`
+	Content      string    `json:"content"`
+}
+
+// NewIndexCache loads a cache from the supplied path. A missing file produces
+// an empty cache.
+func NewIndexCache(path string) (*IndexCache, error) {
+	cache := &IndexCache{
+		Path:    path,
+		entries: map[string]indexCacheEntry{},
+	}
+	data, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	decoder := json.NewDecoder(data)
+	for {
+		var entry indexCacheEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		cache.entries[entry.Name] = entry
+	}
+	return cache, nil
+}
+
+// Index concats all metafiles in the provided store, one per line, using
+// cached content for any metafile whose last modified time is unchanged.
+func (c *IndexCache) Index(ctx context.Context, store Store, concurrency int, opts IndexOptions) ([][]byte, error) {
+	return index(ctx, store, concurrency, opts, c)
+}
+
+// Invalidate removes a metafile from the cache.
+func (c *IndexCache) Invalidate(name string) {
+	delete(c.entries, file.MetaNameFrom(name))
+}
+
+// Save persists the cache to disk.
+func (c *IndexCache) Save() error {
+	names := make([]string, 0, len(c.entries))
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var output bytes.Buffer
+	encoder := json.NewEncoder(&output)
+	for _, name := range names {
+		if err := encoder.Encode(c.entries[name]); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.Path, output.Bytes(), 0644)
+}
+
+func (c *IndexCache) get(f *file.File) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	if entry, ok := c.entries[f.Name]; ok && entry.LastModified.Equal(f.LastModified) {
+		c.Hits = c.Hits + 1
+		return []byte(entry.Content), true
+	}
+	c.Misses = c.Misses + 1
+	return nil, false
+}
+
+func (c *IndexCache) set(f *file.File, content []byte) {
+	if c == nil {
+		return
+	}
+	c.entries[f.Name] = indexCacheEntry{
+		Name:         f.Name,
+		LastModified: f.LastModified,
+		Content:      string(content),
+	}
+}
+
+func index(ctx context.Context, store Store, concurrency int, opts IndexOptions, cache *IndexCache) ([][]byte, error) {
+	less, err := indexOrder(opts.SortKey)
+	if err != nil {
+		return nil, err
+	}
+	files, searchErr := SearchAll(ctx, store, "")
 	if searchErr != nil {
 		return nil, searchErr
 	}
-	meta, concatErr := store.Concat(ctx, concurrency, files.Meta().Names())
-	if concatErr != nil {
-		return nil, concatErr
+	metafiles := files.Meta()
+	meta := make([][]byte, len(metafiles))
+	var stale file.List
+	var staleIndexes []int
+	for index, f := range metafiles {
+		if content, ok := cache.get(f); ok {
+			meta[index] = content
+			continue
+		}
+		stale = append(stale, f)
+		staleIndexes = append(staleIndexes, index)
+	}
+	if len(stale) > 0 {
+		fetched, concatErr := store.Concat(ctx, concurrency, stale.Names())
+		if concatErr != nil {
+			return nil, concatErr
+		}
+		for index, data := range fetched {
+			cache.set(stale[index], data)
+			meta[staleIndexes[index]] = data
+		}
+	}
+	for index, data := range meta {
+		migrated, err := file.MigrateMeta(file.ReplayMeta(data))
+		if err != nil {
+			return nil, err
+		}
+		meta[index] = migrated
+	}
+	sizes := map[string]int64{}
+	for _, f := range files.Data() {
+		sizes[f.Name] = f.Size
+	}
+	entries := make([]indexEntry, len(meta))
+	for index, data := range meta {
+		name := file.Meta(data).DataFileName()
+		entries[index] = indexEntry{
+			name:       name,
+			size:       sizes[name],
+			importedAt: gjson.GetBytes(data, file.MetaKeyImportAt).String(),
+			content:    data,
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if less(entries[i], entries[j]) {
+			return true
+		}
+		if less(entries[j], entries[i]) {
+			return false
+		}
+		return entries[i].name < entries[j].name
+	})
+	for index, entry := range entries {
+		meta[index] = entry.content
 	}
 	return meta, nil
 }
 
+// indexEntry holds the values metafiles can be sorted by.
+type indexEntry struct {
+	name       string
+	size       int64
+	importedAt string
+	content    []byte
+}
+
+// indexOrder finds the comparison used to sort metafiles for a sort key.
+func indexOrder(key string) (func(a indexEntry, b indexEntry) bool, error) {
+	switch key {
+	case "", IndexSortDate:
+		// Import times are RFC3339 in UTC so they sort lexically.
+		return func(a indexEntry, b indexEntry) bool { return a.importedAt > b.importedAt }, nil
+	case IndexSortName:
+		return func(a indexEntry, b indexEntry) bool { return a.name < b.name }, nil
+	case IndexSortSize:
+		return func(a indexEntry, b indexEntry) bool { return a.size > b.size }, nil
+	}
+	return nil, fmt.Errorf("%w: unknown index sort %q", os.ErrInvalid, key)
+}
+
 // IndexUpdate reads a provided reader line by line where each line is expected
-// to be the content of a metafile. The data within is persisted to the store
-func IndexUpdate(ctx context.Context, logger *Logger, store Store, concurrency int, updates io.Reader) error {
+// to be the content of a metafile. The data within is persisted to the store.
+// If merge is true, the metafile already in the store is kept and only the
+// keys outside of the memorybox managed section are merged into it using JSON
+// merge patch semantics (null values delete keys). Metafiles whose content
+// would not change are not written unless force is true.
+func IndexUpdate(ctx context.Context, logger *Logger, store Store, concurrency int, updates io.Reader, merge bool, force bool) (IndexUpdateStats, error) {
+	var stats IndexUpdateStats
+	var mu sync.Mutex
 	reader := bufio.NewReader(updates)
+	// Merging reads a metafile before writing it, so updates to the same
+	// metafile must not run at the same time.
+	var locks sync.Map
 	eg, egCtx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
 		sem := semaphore.NewWeighted(int64(concurrency))
@@ -49,18 +264,91 @@ func IndexUpdate(ctx context.Context, logger *Logger, store Store, concurrency i
 			currentLine := lineNo // https://golang.org/doc/faq#closures_and_goroutines
 			eg.Go(func() error {
 				defer sem.Release(1)
-				if err := file.ValidateMeta(data); err != nil {
-					return fmt.Errorf("line %d: %w", currentLine, err)
+				meta, err := file.NewMetaFromBytes(fmt.Sprintf("line %d", currentLine), data)
+				if err != nil {
+					return err
+				}
+				name := meta.Name
+				data = *meta.Meta
+				if merge {
+					lock, _ := locks.LoadOrStore(name, &sync.Mutex{})
+					lock.(*sync.Mutex).Lock()
+					defer lock.(*sync.Mutex).Unlock()
+					existing, err := GetMetaByPrefix(egCtx, store, name)
+					if err != nil {
+						return fmt.Errorf("line %d: %w", currentLine, err)
+					}
+					if err := existing.Meta.MergePatch(data); err != nil {
+						return fmt.Errorf("line %d: %w", currentLine, err)
+					}
+					data = *existing.Meta
 				}
-				name := file.MetaNameFrom(file.Meta(data).DataFileName())
 				if err := file.ValidateMeta(data); err != nil {
 					logger.Verbose.Printf("%s updated", name)
 				}
+				canonical, err := file.Meta(data).Canonical()
+				if err != nil {
+					return fmt.Errorf("line %d: %w", currentLine, err)
+				}
+				data = canonical
+				if !force {
+					unchanged, err := metaUnchanged(egCtx, store, name, data)
+					if err != nil {
+						return fmt.Errorf("line %d: %w", currentLine, err)
+					}
+					if unchanged {
+						logger.Verbose.Printf("%s unchanged (skipped)", name)
+						mu.Lock()
+						stats.Skipped = stats.Skipped + 1
+						mu.Unlock()
+						return nil
+					}
+				}
 				logger.Stdout.Printf("%s", data)
-				return store.Put(ctx, bytes.NewBuffer(data), name, time.Now())
+				if err := store.Put(ctx, bytes.NewBuffer(data), name, time.Now()); err != nil {
+					return err
+				}
+				mu.Lock()
+				stats.Updated = stats.Updated + 1
+				mu.Unlock()
+				return nil
 			})
 		}
 		return nil
 	})
-	return eg.Wait()
+	err := eg.Wait()
+	return stats, err
+}
+
+// IndexUpdateStats counts the metafiles an index update wrote and the ones it
+// skipped because their content was unchanged.
+type IndexUpdateStats struct {
+	Updated int
+	Skipped int
+}
+
+// metaUnchanged reports if a metafile in the store already has the supplied
+// content. The size reported by Stat is compared first so the content of most
+// changed metafiles is never read.
+func metaUnchanged(ctx context.Context, store Store, name string, data []byte) (bool, error) {
+	stat, err := store.Stat(ctx, name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if stat.Size != int64(len(data)) {
+		return false, nil
+	}
+	f, err := store.Get(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	existing, err := ioutil.ReadAll(f)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(existing, data), nil
 }
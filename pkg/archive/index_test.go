@@ -3,12 +3,19 @@ package archive_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/google/go-cmp/cmp"
 	"github.com/tkellen/memorybox/pkg/archive"
 	"github.com/tkellen/memorybox/pkg/file"
 	"github.com/tkellen/memorybox/pkg/localdiskstore"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestIndex(t *testing.T) {
@@ -35,7 +42,7 @@ func TestIndex(t *testing.T) {
 	for name, test := range table {
 		test := test
 		t.Run(name, func(t *testing.T) {
-			_, err := archive.Index(context.Background(), test.store, 10)
+			_, err := archive.Index(context.Background(), test.store, 10, archive.IndexOptions{})
 			if err != nil {
 				t.Fatalf("expected no error, got %s", err)
 			}
@@ -47,12 +54,278 @@ func TestIndex(t *testing.T) {
 	}
 }
 
+func TestIndexSort(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore(file.List{})
+	fixtures := []struct {
+		name       string
+		size       int
+		importedAt string
+	}{
+		{"b", 3, "2020-01-02T00:00:00Z"},
+		{"d", 1, "2020-01-01T00:00:00Z"},
+		{"a", 2, "2020-01-02T00:00:00Z"},
+		{"c", 3, "2020-01-03T00:00:00Z"},
+	}
+	for _, fixture := range fixtures {
+		content := fmt.Sprintf(`{"meta":{"file":"%s","memorybox":true,"import":{"at":"%s"}}}`, fixture.name, fixture.importedAt)
+		if err := store.Put(ctx, strings.NewReader(content), file.MetaNameFrom(fixture.name), time.Now()); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		if err := store.Put(ctx, bytes.NewReader(make([]byte, fixture.size)), fixture.name, time.Now()); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	table := map[string]struct {
+		sortKey  string
+		expected []string
+	}{
+		"date by default": {
+			sortKey:  "",
+			expected: []string{"c", "a", "b", "d"},
+		},
+		"date": {
+			sortKey:  archive.IndexSortDate,
+			expected: []string{"c", "a", "b", "d"},
+		},
+		"name": {
+			sortKey:  archive.IndexSortName,
+			expected: []string{"a", "b", "c", "d"},
+		},
+		"size": {
+			sortKey:  archive.IndexSortSize,
+			expected: []string{"b", "c", "a", "d"},
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			// Ordering must not depend on the order content arrives in.
+			for run := 0; run < 5; run++ {
+				index, err := archive.Index(ctx, store, 10, archive.IndexOptions{SortKey: test.sortKey})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var actual []string
+				for _, entry := range index {
+					actual = append(actual, file.Meta(entry).DataFileName())
+				}
+				if diff := cmp.Diff(test.expected, actual); diff != "" {
+					t.Fatal(diff)
+				}
+			}
+		})
+	}
+	if _, err := archive.Index(ctx, store, 10, archive.IndexOptions{SortKey: "color"}); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+	}
+}
+
 func TestIndexUpdateTooLarge(t *testing.T) {
 	ctx := context.Background()
 	store := NewMemStore(file.List{})
 	tooLarge := []byte(fmt.Sprintf(`{"memorybox":{"name":"%s"},"data":"%s"}`, "test", make([]byte, file.MetaFileMaxSize*20, file.MetaFileMaxSize*20)))
-	err := archive.IndexUpdate(ctx, discardLogger(), store, 10, bytes.NewReader(append(tooLarge, '\n')))
+	_, err := archive.IndexUpdate(ctx, discardLogger(), store, 10, bytes.NewReader(append(tooLarge, '\n')), false, false)
 	if err == nil {
 		t.Fatal("expected error on index item exceeding maximum allowable size")
 	}
 }
+
+func TestIndexUpdateInvalid(t *testing.T) {
+	ctx := context.Background()
+	table := map[string]string{
+		"invalid json":            `{"meta":`,
+		"not metadata":            `{"other":true}`,
+		"metadata without a name": `{"meta":{"memorybox":true}}`,
+	}
+	for name, update := range table {
+		update := update
+		t.Run(name, func(t *testing.T) {
+			store := NewMemStore(file.List{})
+			if _, err := archive.IndexUpdate(ctx, discardLogger(), store, 10, strings.NewReader(update+"\n"), false, false); !errors.Is(err, os.ErrInvalid) {
+				t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+			}
+			if files, _ := store.Search(ctx, ""); len(files) != 0 {
+				t.Fatalf("expected nothing to be stored, found %d files", len(files))
+			}
+		})
+	}
+}
+
+func TestIndexCache(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "cache")
+	stamp := time.Now().Add(-time.Hour)
+	store := NewMemStore(file.List{})
+	for _, name := range []string{"a", "b", "c"} {
+		content := fmt.Sprintf(`{"meta":{"file":"%s","memorybox":true}}`, name)
+		if err := store.Put(ctx, strings.NewReader(content), file.MetaNameFrom(name), stamp); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	run := func(expectedHits int, expectedMisses int) [][]byte {
+		cache, err := archive.NewIndexCache(cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := cache.Index(ctx, store, 10, archive.IndexOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cache.Hits != expectedHits || cache.Misses != expectedMisses {
+			t.Fatalf("expected %d hits and %d misses, got %d and %d", expectedHits, expectedMisses, cache.Hits, cache.Misses)
+		}
+		expected, err := archive.Index(ctx, store, 10, archive.IndexOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Fatal(diff)
+		}
+		if err := cache.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return actual
+	}
+	run(0, 3)
+	run(3, 0)
+	// modified metafiles are refetched.
+	modified := `{"meta":{"file":"b","memorybox":true},"key":"value"}`
+	if err := store.Put(ctx, strings.NewReader(modified), file.MetaNameFrom("b"), stamp.Add(time.Minute)); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if actual := run(2, 1); string(actual[1]) != modified {
+		t.Fatalf("expected modified content %s, got %s", modified, actual[1])
+	}
+	// invalidated metafiles are refetched.
+	cache, err := archive.NewIndexCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Invalidate("c")
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	run(2, 1)
+	// the cache is newline delimited json.
+	content, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(content), []byte("\n"))
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 cache lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if !json.Valid(line) {
+			t.Fatalf("expected json line, got %s", line)
+		}
+	}
+}
+
+func TestIndexUpdateMerge(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore(file.List{})
+	existing := `{"meta":{"file":"test","memorybox":true,"import":{"set":"original"}},"tag":"old","remove":true}`
+	if err := store.Put(ctx, strings.NewReader(existing), file.MetaNameFrom("test"), time.Now()); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	update := `{"meta":{"file":"test","memorybox":true,"import":{"set":"changed"}},"tag":"new","remove":null,"added":1}` + "\n"
+	if _, err := archive.IndexUpdate(ctx, discardLogger(), store, 10, strings.NewReader(update), true, false); err != nil {
+		t.Fatal(err)
+	}
+	f, err := archive.GetMetaByPrefix(ctx, store, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"added":1,"meta":{"file":"test","import":{"set":"original"},"memorybox":true},"tag":"new"}`
+	if diff := cmp.Diff(expected, string(*f.Meta)); diff != "" {
+		t.Fatal(diff)
+	}
+	missing := `{"meta":{"file":"missing","memorybox":true},"tag":"new"}` + "\n"
+	if _, err := archive.IndexUpdate(ctx, discardLogger(), store, 10, strings.NewReader(missing), true, false); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestIndexUpdateConcurrencyLimiting(t *testing.T) {
+	ctx := context.Background()
+	concurrency := 2
+	store := NewMemStore(file.List{})
+	store.DelayPut = 50 * time.Millisecond
+	var updates strings.Builder
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(&updates, "{\"meta\":{\"file\":\"%d\",\"memorybox\":true}}\n", i)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := archive.IndexUpdate(ctx, discardLogger(), store, concurrency, strings.NewReader(updates.String()), false, false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for index update")
+	}
+	if calls := store.Calls("Put"); calls != 6 {
+		t.Fatalf("expected 6 puts, got %d", calls)
+	}
+	if store.MaxConcurrentPuts != int64(concurrency) {
+		t.Fatalf("expected at most %d concurrent puts, saw %d", concurrency, store.MaxConcurrentPuts)
+	}
+}
+
+func TestIndexUpdateSkipsUnchanged(t *testing.T) {
+	ctx := context.Background()
+	unchanged := "{\"meta\":{\"file\":\"a\",\"memorybox\":true}}\n"
+	// Changed content of the same size must still be written.
+	sameSize := "{\"meta\":{\"file\":\"b\",\"memorybox\":true},\"key\":\"x\"}\n"
+	updates := unchanged + "{\"meta\":{\"file\":\"b\",\"memorybox\":true},\"key\":\"y\"}\n" + "{\"meta\":{\"file\":\"c\",\"memorybox\":true}}\n"
+	table := map[string]struct {
+		force            bool
+		expectedStats    archive.IndexUpdateStats
+		expectedPutCalls int64
+	}{
+		"unchanged metafiles are skipped": {
+			force:            false,
+			expectedStats:    archive.IndexUpdateStats{Updated: 2, Skipped: 1},
+			expectedPutCalls: 2,
+		},
+		"force writes every metafile": {
+			force:            true,
+			expectedStats:    archive.IndexUpdateStats{Updated: 3, Skipped: 0},
+			expectedPutCalls: 3,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			store := NewMemStore(file.List{})
+			// Metafiles are stored in canonical form, without a trailing newline.
+			for name, content := range map[string]string{"a": unchanged, "b": sameSize} {
+				if err := store.Put(ctx, strings.NewReader(strings.TrimSuffix(content, "\n")), file.MetaNameFrom(name), time.Now()); err != nil {
+					t.Fatalf("test setup: %s", err)
+				}
+			}
+			setupPuts := store.Calls("Put")
+			stats, err := archive.IndexUpdate(ctx, discardLogger(), store, 10, strings.NewReader(updates), false, test.force)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.expectedStats, stats); diff != "" {
+				t.Fatal(diff)
+			}
+			if calls := store.Calls("Put") - setupPuts; calls != test.expectedPutCalls {
+				t.Fatalf("expected %d puts, got %d", test.expectedPutCalls, calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tkellen/memorybox/pkg/file"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// RehashStore copies every datafile named with the from algorithm (or every
+// datafile if from is empty) from source to dest, renaming it by hashing its
+// content with hash. The metafile describing it is copied first, updated to
+// describe the new name and to record the previous one.
+func RehashStore(ctx context.Context, logger *Logger, source Store, dest Store, from string, hash file.HashFn, concurrency int) error {
+	files, searchErr := source.Search(ctx, "")
+	if searchErr != nil {
+		return fmt.Errorf("listing files: %w", searchErr)
+	}
+	eg, egCtx := errgroup.WithContext(ctx)
+	sem := semaphore.NewWeighted(int64(concurrency))
+	eg.Go(func() error {
+		for _, item := range files.Data() {
+			if from != "" && !strings.HasSuffix(item.Name, "-"+from) {
+				continue
+			}
+			if err := sem.Acquire(egCtx, 1); err != nil {
+				return err
+			}
+			name := item.Name // https://golang.org/doc/faq#closures_and_goroutines
+			eg.Go(func() error {
+				defer sem.Release(1)
+				rehashed, err := rehash(egCtx, source, dest, name, hash)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				logger.Verbose.Printf("%s (rehashed to %s)", name, rehashed)
+				return nil
+			})
+		}
+		return nil
+	})
+	return eg.Wait()
+}
+
+func rehash(ctx context.Context, source Store, dest Store, name string, hash file.HashFn) (string, error) {
+	original, getErr := source.Get(ctx, name)
+	if getErr != nil {
+		return "", getErr
+	}
+	defer original.Close()
+	// The content must be read twice: once to hash it and once to store it.
+	temp, tempErr := ioutil.TempFile("", "memorybox-rehash-*")
+	if tempErr != nil {
+		return "", tempErr
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	if _, err := io.Copy(temp, original); err != nil {
+		return "", err
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	f, newErr := file.NewWithContext(ctx, original.Source, temp, original.LastModified, hash)
+	if newErr != nil {
+		return "", newErr
+	}
+	meta := f.Meta
+	if existing, err := GetMetaByPrefix(ctx, source, file.MetaNameFrom(name)); err == nil {
+		meta = existing.Meta
+		meta.Set(file.MetaKeyFileName, f.Name)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	meta.Set(file.MetaKeyPreviousName, name)
+	if err := PutMeta(ctx, dest, file.MetaNameFrom(f.Name), *meta); err != nil {
+		return "", err
+	}
+	return f.Name, dest.Put(ctx, f, f.Name, f.LastModified)
+}
@@ -0,0 +1,96 @@
+package archive_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// orderedStore records the order objects are put into a MemStore.
+type orderedStore struct {
+	*MemStore
+	mu   sync.Mutex
+	puts []string
+}
+
+func (s *orderedStore) Put(ctx context.Context, reader io.Reader, name string, lastModified time.Time) error {
+	s.mu.Lock()
+	s.puts = append(s.puts, name)
+	s.mu.Unlock()
+	return s.MemStore.Put(ctx, reader, name, lastModified)
+}
+
+func sha1Hash(source io.Reader) (string, int64, error) {
+	digest := sha1.New()
+	size, err := io.Copy(digest, source)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(digest.Sum(nil)) + "-sha1", size, nil
+}
+
+func TestRehashStore(t *testing.T) {
+	ctx := context.Background()
+	source := NewMemStore(file.List{})
+	contents := map[string][]byte{}
+	for _, content := range []string{"one", "two"} {
+		f, err := file.NewSha256("test", bytes.NewReader([]byte(content)), time.Now())
+		if err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		f.Meta.Set("title", content)
+		if _, err := archive.Put(ctx, source, f, "", file.MetaFileOptions{}); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		contents[f.Name] = []byte(content)
+	}
+	dest := &orderedStore{MemStore: NewMemStore(file.List{})}
+	if err := archive.RehashStore(ctx, discardLogger(), source, dest, "sha256", sha1Hash, 2); err != nil {
+		t.Fatal(err)
+	}
+	for oldName, content := range contents {
+		newName, _, _ := sha1Hash(bytes.NewReader(content))
+		for name, store := range map[string]archive.Store{oldName: source, newName: dest} {
+			f, err := archive.GetDataByPrefix(ctx, store, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, readErr := ioutil.ReadAll(f)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if !bytes.Equal(content, actual) {
+				t.Fatalf("expected %s to contain %s, got %s", name, content, actual)
+			}
+		}
+		meta, err := archive.GetMetaByPrefix(ctx, dest, newName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := meta.Meta.DataFileName(); actual != newName {
+			t.Fatalf("expected metafile to describe %s, got %s", newName, actual)
+		}
+		if actual := meta.Meta.Get(file.MetaKeyPreviousName); actual != oldName {
+			t.Fatalf("expected previous name %s, got %v", oldName, actual)
+		}
+		if actual := meta.Meta.Get("title"); actual != string(content) {
+			t.Fatalf("expected title %s to be retained, got %v", content, actual)
+		}
+		for _, name := range dest.puts {
+			if name == newName {
+				t.Fatalf("expected metafile for %s to be put before the datafile", newName)
+			}
+			if name == file.MetaNameFrom(newName) {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// resumableReader reads the content of an object, reopening it from the last
+// byte successfully read when the underlying body fails part way through.
+type resumableReader struct {
+	ctx     context.Context
+	store   RangeGetter
+	name    string
+	size    int64
+	body    io.ReadCloser
+	pos     int64
+	retries int
+	max     int
+}
+
+// ResumeBody wraps the body of an object of a known size so reads which fail
+// with a transient error (timeouts, connection resets or content ending early)
+// are retried from the last byte read using GetRange, at most maxRetries
+// times. Callers see one uninterrupted stream.
+func ResumeBody(ctx context.Context, store RangeGetter, name string, size int64, body io.ReadCloser, maxRetries int) io.ReadCloser {
+	return &resumableReader{
+		ctx:   ctx,
+		store: store,
+		name:  name,
+		size:  size,
+		body:  body,
+		max:   maxRetries,
+	}
+}
+
+func (r *resumableReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.pos += int64(n)
+		if err == nil || (err == io.EOF && r.pos >= r.size) {
+			return n, err
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if !retriable(err) || r.retries >= r.max || r.ctx.Err() != nil {
+			return n, err
+		}
+		r.retries++
+		r.body.Close()
+		body, rangeErr := r.store.GetRange(r.ctx, r.name, r.pos, r.size-1)
+		if rangeErr != nil {
+			r.body = errReader{rangeErr}
+			return n, rangeErr
+		}
+		r.body = body
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumableReader) Close() error {
+	return r.body.Close()
+}
+
+// retriable reports if a read failed in a way that reading again might fix.
+func retriable(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// errReader fails every read with the same error.
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+func (e errReader) Close() error             { return nil }
@@ -0,0 +1,113 @@
+package archive_test
+
+import (
+	"context"
+	"errors"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingReader returns the first failAfter bytes of its content and then
+// fails with err.
+type failingReader struct {
+	content   io.Reader
+	failAfter int
+	err       error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.failAfter == 0 {
+		return 0, r.err
+	}
+	if len(p) > r.failAfter {
+		p = p[:r.failAfter]
+	}
+	n, err := r.content.Read(p)
+	r.failAfter -= n
+	return n, err
+}
+
+func TestResumeBody(t *testing.T) {
+	content := "the quick brown fox jumps over the lazy dog"
+	permanent := errors.New("permanent")
+	table := map[string]struct {
+		failAfter      int
+		err            error
+		maxRetries     int
+		expected       string
+		expectedErr    error
+		expectedRanges [][2]int64
+	}{
+		"unexpected eof resumes from the last byte read": {
+			failAfter:      10,
+			err:            io.ErrUnexpectedEOF,
+			maxRetries:     1,
+			expected:       content,
+			expectedRanges: [][2]int64{{10, int64(len(content) - 1)}},
+		},
+		"content ending early resumes": {
+			failAfter:      4,
+			err:            io.EOF,
+			maxRetries:     1,
+			expected:       content,
+			expectedRanges: [][2]int64{{4, int64(len(content) - 1)}},
+		},
+		"failures at the first byte resume": {
+			failAfter:      0,
+			err:            io.ErrUnexpectedEOF,
+			maxRetries:     1,
+			expected:       content,
+			expectedRanges: [][2]int64{{0, int64(len(content) - 1)}},
+		},
+		"failures beyond the retry limit are returned": {
+			failAfter:   10,
+			err:         io.ErrUnexpectedEOF,
+			maxRetries:  0,
+			expected:    content[:10],
+			expectedErr: io.ErrUnexpectedEOF,
+		},
+		"permanent failures are returned": {
+			failAfter:   10,
+			err:         permanent,
+			maxRetries:  3,
+			expected:    content[:10],
+			expectedErr: permanent,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			f := file.NewStub("test", int64(len(content)), time.Now())
+			f.Body = strings.NewReader(content)
+			store := &rangeStore{MemStore: NewMemStore(file.List{f})}
+			body := ioutil.NopCloser(&failingReader{
+				content:   strings.NewReader(content),
+				failAfter: test.failAfter,
+				err:       test.err,
+			})
+			reader := archive.ResumeBody(ctx, store, "test", int64(len(content)), body, test.maxRetries)
+			defer reader.Close()
+			actual, err := ioutil.ReadAll(reader)
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+			if string(actual) != test.expected {
+				t.Fatalf("expected %q, got %q", test.expected, actual)
+			}
+			if len(store.ranges) != len(test.expectedRanges) {
+				t.Fatalf("expected ranges %v, got %v", test.expectedRanges, store.ranges)
+			}
+			for index, expected := range test.expectedRanges {
+				if store.ranges[index] != expected {
+					t.Fatalf("expected ranges %v, got %v", test.expectedRanges, store.ranges)
+				}
+			}
+		})
+	}
+}
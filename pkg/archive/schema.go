@@ -0,0 +1,78 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tidwall/sjson"
+	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/xeipuuv/gojsonschema"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrSchemaMismatch is returned when metadata does not satisfy a schema.
+var ErrSchemaMismatch = errors.New("metadata does not match schema")
+
+// SchemaValidator checks the user controlled keys of metadata against a JSON
+// Schema which is parsed once and reused for every file validated. It
+// satisfies file.MetaValidator so it can be supplied to Put.
+type SchemaValidator struct {
+	// ReadFile reads the schema in LoadFile. It defaults to ioutil.ReadFile.
+	ReadFile func(path string) ([]byte, error)
+	schema   *gojsonschema.Schema
+}
+
+// LoadFile reads and parses the schema at path.
+func (v *SchemaValidator) LoadFile(path string) error {
+	readFile := v.ReadFile
+	if readFile == nil {
+		readFile = ioutil.ReadFile
+	}
+	data, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	v.schema = schema
+	return nil
+}
+
+// Validate checks the metadata of a file against the schema.
+func (v *SchemaValidator) Validate(f *file.File) error {
+	meta := f.MetaBytes()
+	if meta == nil {
+		meta = []byte("{}")
+	}
+	if err := v.ValidateBytes(meta); err != nil {
+		return fmt.Errorf("%s: %w", f.Name, err)
+	}
+	return nil
+}
+
+// ValidateBytes checks JSON encoded metadata against the schema. The keys
+// memorybox manages are removed first so schemas need only describe what
+// users control.
+func (v *SchemaValidator) ValidateBytes(meta []byte) error {
+	if v.schema == nil {
+		return fmt.Errorf("no schema loaded")
+	}
+	userMeta, err := sjson.DeleteBytes(meta, file.MetaKey)
+	if err != nil {
+		return fmt.Errorf("%w: %s", file.ErrInvalidMeta, err)
+	}
+	result, err := v.schema.Validate(gojsonschema.NewBytesLoader(userMeta))
+	if err != nil {
+		return fmt.Errorf("%w: %s", file.ErrInvalidMeta, err)
+	}
+	if result.Valid() {
+		return nil
+	}
+	var problems []string
+	for _, problem := range result.Errors() {
+		problems = append(problems, problem.String())
+	}
+	return fmt.Errorf("%w: %s", ErrSchemaMismatch, strings.Join(problems, "; "))
+}
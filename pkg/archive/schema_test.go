@@ -0,0 +1,125 @@
+package archive_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mattetti/filebuffer"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"testing"
+	"time"
+)
+
+const testSchema = `{
+	"type": "object",
+	"properties": {
+		"owner": {"type": "string"},
+		"rating": {"type": "integer", "minimum": 1, "maximum": 5}
+	},
+	"required": ["owner"],
+	"additionalProperties": false
+}`
+
+func newTestValidator(t *testing.T) (*archive.SchemaValidator, *int) {
+	reads := 0
+	validator := &archive.SchemaValidator{
+		ReadFile: func(path string) ([]byte, error) {
+			reads++
+			return []byte(testSchema), nil
+		},
+	}
+	if err := validator.LoadFile("schema.json"); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	return validator, &reads
+}
+
+func TestSchemaValidator(t *testing.T) {
+	validator, reads := newTestValidator(t)
+	for i := 0; i < 100; i++ {
+		f, err := file.NewSha256(fmt.Sprintf("%d", i), filebuffer.New([]byte(fmt.Sprintf("%d", i))), time.Now())
+		if err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		f.Meta = file.NewMetaFromFileWithOptions(f, file.MetaFileOptions{
+			ExtraKeys: map[string]string{"owner": "me", "rating": fmt.Sprintf("%d", i%5+1)},
+		})
+		if err := validator.Validate(f); err != nil {
+			t.Fatalf("expected file %d to be valid, got %s", i, err)
+		}
+	}
+	if *reads != 1 {
+		t.Fatalf("expected schema to be read once, read %d times", *reads)
+	}
+	table := map[string]struct {
+		meta        string
+		expectedErr error
+	}{
+		"managed keys are not validated": {
+			meta: `{"meta":{"memorybox":true},"owner":"me"}`,
+		},
+		"missing required keys fail": {
+			meta:        `{"meta":{"memorybox":true}}`,
+			expectedErr: archive.ErrSchemaMismatch,
+		},
+		"invalid values fail": {
+			meta:        `{"owner":"me","rating":9}`,
+			expectedErr: archive.ErrSchemaMismatch,
+		},
+		"unknown keys fail": {
+			meta:        `{"owner":"me","extra":true}`,
+			expectedErr: archive.ErrSchemaMismatch,
+		},
+		"invalid json fails": {
+			meta:        `{"owner":`,
+			expectedErr: file.ErrInvalidMeta,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			if err := validator.ValidateBytes([]byte(test.meta)); !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestSchemaValidator_LoadFile(t *testing.T) {
+	missing := errors.New("missing")
+	validator := &archive.SchemaValidator{
+		ReadFile: func(string) ([]byte, error) { return nil, missing },
+	}
+	if err := validator.LoadFile("schema.json"); !errors.Is(err, missing) {
+		t.Fatalf("expected %s, got %v", missing, err)
+	}
+	if err := validator.ValidateBytes([]byte(`{}`)); err == nil {
+		t.Fatal("expected validation without a schema to fail")
+	}
+	validator.ReadFile = func(string) ([]byte, error) { return []byte(`{"type": 1}`), nil }
+	if err := validator.LoadFile("schema.json"); err == nil {
+		t.Fatal("expected invalid schema to fail")
+	}
+}
+
+func TestPut_SchemaValidator(t *testing.T) {
+	ctx := context.Background()
+	validator, _ := newTestValidator(t)
+	store := NewMemStore(file.List{})
+	f, err := file.NewSha256("test", filebuffer.New([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	opts := file.MetaFileOptions{Validator: validator}
+	if _, err := archive.Put(ctx, store, f, "", opts); !errors.Is(err, archive.ErrSchemaMismatch) {
+		t.Fatalf("expected %s, got %v", archive.ErrSchemaMismatch, err)
+	}
+	if exists, _ := store.Exists(ctx, f.Name); exists {
+		t.Fatal("expected rejected put to store nothing")
+	}
+	opts.ExtraKeys = map[string]string{"owner": "me"}
+	if _, err := archive.Put(ctx, store, f, "", opts); err != nil {
+		t.Fatal(err)
+	}
+}
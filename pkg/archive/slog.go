@@ -0,0 +1,29 @@
+//go:build go1.21
+// +build go1.21
+
+package archive
+
+import (
+	"log/slog"
+)
+
+// NewSlogLogger produces a Logger whose output streams emit structured records
+// to the supplied handler. Verbose messages are logged at the debug level,
+// normal messages at the info level and errors at the error level.
+func NewSlogLogger(handler slog.Handler) *Logger {
+	return &Logger{
+		Stdout:     slog.NewLogLogger(handler, slog.LevelInfo),
+		Stderr:     slog.NewLogLogger(handler, slog.LevelError),
+		Verbose:    slog.NewLogLogger(handler, slog.LevelDebug),
+		structured: slog.New(handler),
+	}
+}
+
+// Slog provides direct access to structured logging. Loggers that were not
+// created by NewSlogLogger emit text records to their error stream.
+func (l *Logger) Slog() *slog.Logger {
+	if structured, ok := l.structured.(*slog.Logger); ok {
+		return structured
+	}
+	return slog.New(slog.NewTextHandler(l.Stderr.Writer(), nil))
+}
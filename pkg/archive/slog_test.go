@@ -0,0 +1,52 @@
+//go:build go1.21
+// +build go1.21
+
+package archive_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	ctx := context.Background()
+	f, err := file.NewSha256("test", bytes.NewReader([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	store := NewMemStore(file.List{f, file.NewStub(file.MetaNameFrom(f.Name), 0, time.Now())})
+	var output bytes.Buffer
+	logger := archive.NewSlogLogger(slog.NewJSONHandler(&output, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if err := archive.BulkDelete(ctx, logger, store, 1, []string{f.Name}); err != nil {
+		t.Fatal(err)
+	}
+	logger.Stdout.Print("info")
+	logger.Stderr.Print("error")
+	logger.Slog().Warn("direct", "key", "value")
+	var records []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(output.Bytes()), []byte("\n")) {
+		record := map[string]interface{}{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		delete(record, slog.TimeKey)
+		records = append(records, record)
+	}
+	expected := []map[string]interface{}{
+		{slog.LevelKey: "DEBUG", slog.MessageKey: fmt.Sprintf("%s deleted", f.Name)},
+		{slog.LevelKey: "INFO", slog.MessageKey: "info"},
+		{slog.LevelKey: "ERROR", slog.MessageKey: "error"},
+		{slog.LevelKey: "WARN", slog.MessageKey: "direct", "key": "value"},
+	}
+	if diff := cmp.Diff(expected, records); diff != "" {
+		t.Fatal(diff)
+	}
+}
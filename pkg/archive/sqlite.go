@@ -0,0 +1,101 @@
+package archive
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"github.com/tkellen/memorybox/pkg/file"
+	// Register the sqlite driver used by IndexToSQLite.
+	_ "modernc.org/sqlite"
+	"time"
+)
+
+// sqliteSchema creates the table IndexToSQLite writes to.
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS files (
+	name TEXT PRIMARY KEY,
+	size INTEGER,
+	imported_at TEXT,
+	source TEXT,
+	meta TEXT
+)`
+
+// IndexToSQLite writes the metafiles in the provided store to the files table
+// of a SQLite database at dbPath, one row per datafile, so their metadata can
+// be queried with SQL. The database and table are created if they do not
+// exist. Updates are incremental: only metafiles modified after the most
+// recent imported_at already in the table are fetched, and their rows are
+// replaced. Rows for files deleted from the store are not removed; delete the
+// database to rebuild it from scratch.
+func IndexToSQLite(ctx context.Context, store Store, concurrency int, dbPath string) error {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return indexToDB(ctx, store, concurrency, db)
+}
+
+func indexToDB(ctx context.Context, store Store, concurrency int, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		return err
+	}
+	var latest sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT MAX(imported_at) FROM files").Scan(&latest); err != nil {
+		return err
+	}
+	var since time.Time
+	if latest.Valid {
+		parsed, err := time.Parse(time.RFC3339, latest.String)
+		if err != nil {
+			return fmt.Errorf("files.imported_at: %w", err)
+		}
+		since = parsed
+	}
+	files, searchErr := SearchAll(ctx, store, "")
+	if searchErr != nil {
+		return searchErr
+	}
+	var stale file.List
+	for _, f := range files.Meta() {
+		if f.LastModified.After(since) {
+			stale = append(stale, f)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	fetched, concatErr := store.Concat(ctx, concurrency, stale.Names())
+	if concatErr != nil {
+		return concatErr
+	}
+	sizes := map[string]int64{}
+	for _, f := range files.Data() {
+		sizes[f.Name] = f.Size
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	insert, err := tx.PrepareContext(ctx, "INSERT OR REPLACE INTO files (name, size, imported_at, source, meta) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer insert.Close()
+	for index, data := range fetched {
+		migrated, err := file.MigrateMeta(file.ReplayMeta(data))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %w", stale[index].Name, err)
+		}
+		meta := file.Meta(migrated)
+		name := meta.DataFileName()
+		importedAt := gjson.GetBytes(migrated, file.MetaKeyImportAt).String()
+		if _, err := insert.ExecContext(ctx, name, sizes[name], importedAt, meta.Source(), string(migrated)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %w", stale[index].Name, err)
+		}
+	}
+	return tx.Commit()
+}
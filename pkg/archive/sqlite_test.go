@@ -0,0 +1,98 @@
+package archive_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sqliteRow struct {
+	Name       string
+	Size       int64
+	ImportedAt string
+	Source     string
+	Meta       string
+}
+
+func sqliteRows(t *testing.T, db *sql.DB) []sqliteRow {
+	rows, err := db.Query("SELECT name, size, imported_at, source, meta FROM files ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var actual []sqliteRow
+	for rows.Next() {
+		var row sqliteRow
+		if err := rows.Scan(&row.Name, &row.Size, &row.ImportedAt, &row.Source, &row.Meta); err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return actual
+}
+
+func TestIndexToSQLite(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore(file.List{})
+	put := func(name string, size int, importedAt string) string {
+		content := fmt.Sprintf(`{"meta":{"file":"%s","memorybox":true,"import":{"at":"%s","source":"%s.txt"}}}`, name, importedAt, name)
+		modified, err := time.Parse(time.RFC3339, importedAt)
+		if err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		if err := store.Put(ctx, strings.NewReader(content), file.MetaNameFrom(name), modified); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		if err := store.Put(ctx, bytes.NewReader(make([]byte, size)), name, modified); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		return content
+	}
+	metaA := put("a", 2, "2020-01-01T00:00:00Z")
+	metaB := put("b", 3, "2020-01-02T00:00:00Z")
+	// A shared in-memory database lives as long as one connection to it is
+	// open, so it outlives the connection IndexToSQLite opens.
+	dbPath := "file:TestIndexToSQLite?mode=memory&cache=shared"
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := archive.IndexToSQLite(ctx, store, 10, dbPath); err != nil {
+		t.Fatal(err)
+	}
+	expected := []sqliteRow{
+		{Name: "a", Size: 2, ImportedAt: "2020-01-01T00:00:00Z", Source: "a.txt", Meta: metaA},
+		{Name: "b", Size: 3, ImportedAt: "2020-01-02T00:00:00Z", Source: "b.txt", Meta: metaB},
+	}
+	if diff := cmp.Diff(expected, sqliteRows(t, db)); diff != "" {
+		t.Fatal(diff)
+	}
+	// Rows are only replaced for metafiles modified after the latest import
+	// already in the database.
+	if _, err := db.Exec("UPDATE files SET size = 0 WHERE name = 'a'"); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	metaC := put("c", 1, "2020-01-03T00:00:00Z")
+	if err := archive.IndexToSQLite(ctx, store, 10, dbPath); err != nil {
+		t.Fatal(err)
+	}
+	expected[0].Size = 0
+	expected = append(expected, sqliteRow{Name: "c", Size: 1, ImportedAt: "2020-01-03T00:00:00Z", Source: "c.txt", Meta: metaC})
+	if diff := cmp.Diff(expected, sqliteRows(t, db)); diff != "" {
+		t.Fatal(diff)
+	}
+}
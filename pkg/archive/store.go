@@ -16,15 +16,191 @@ type Logger struct {
 	Stdout  *log.Logger
 	Stderr  *log.Logger
 	Verbose *log.Logger
+	// structured holds the *slog.Logger of loggers made by NewSlogLogger. It
+	// is untyped so Logger can be used with versions of Go before log/slog.
+	structured interface{}
 }
 
-// Store defines a storage engine that can persist and retrieve content.
+// Store defines a storage engine that can persist and retrieve content. Stores
+// know nothing about memorybox; they map names to bytes. Every implementation
+// must be safe for concurrent use.
+//
+// Optional capabilities are described by the interfaces below (PaginatedStore,
+// SeekableStore, RangeGetter, Renamer, ServerCopier, BatchPutter, AtomicStore,
+// Tagger, Presigner, Watcher and Appender). Callers detect them with a type
+// assertion and fall back to the methods of Store when they are missing.
+// Implementations assert the capabilities they provide at compile time.
 type Store interface {
-	Get(context.Context, string) (*file.File, error)
-	Put(context.Context, io.Reader, string, time.Time) error
-	Delete(context.Context, string) error
-	Search(context.Context, string) (file.List, error)
-	Concat(context.Context, int, []string) ([][]byte, error)
-	Stat(context.Context, string) (*file.File, error)
+	// Get returns the named object with its content as the body of the file.
+	// The caller must close the file. Missing objects produce an error
+	// wrapping os.ErrNotExist.
+	Get(ctx context.Context, name string) (*file.File, error)
+	// Put persists the content read from source under name, replacing any
+	// existing object. The content is streamed, not buffered, where the
+	// backing service allows it.
+	Put(ctx context.Context, source io.Reader, name string, lastModified time.Time) error
+	// Delete removes the named object. Deleting a missing object may or may
+	// not produce an error depending on the backing service.
+	Delete(ctx context.Context, name string) error
+	// Search returns stubs (files without bodies) for every object whose name
+	// starts with prefix, sorted by name. Finding nothing is not an error.
+	// This lists the whole prefix in one call; see PaginatedStore.
+	Search(ctx context.Context, prefix string) (file.List, error)
+	// Concat reads the complete content of every named object, at most
+	// concurrency at a time, returning them in the order requested. A
+	// failure to read any object fails the whole call.
+	Concat(ctx context.Context, concurrency int, names []string) ([][]byte, error)
+	// Stat returns a stub describing the named object without reading its
+	// content. Missing objects produce an error wrapping os.ErrNotExist.
+	Stat(ctx context.Context, name string) (*file.File, error)
+	// Exists must only report false when an object is known to be missing;
+	// failures to determine that (e.g. network errors) are returned as
+	// errors.
+	Exists(ctx context.Context, name string) (bool, error)
+	// String describes the store for humans, e.g. in logs.
 	String() string
 }
+
+// PaginatedStore is implemented by stores that can list their content a page
+// at a time. The cursor is empty when requesting the first page and when no
+// pages remain. The limit must be at least 1; smaller limits produce an error
+// wrapping os.ErrInvalid.
+type PaginatedStore interface {
+	SearchPage(ctx context.Context, prefix string, cursor string, limit int) (file.List, string, error)
+}
+
+// SeekableStore is implemented by stores that can write content more
+// efficiently when its size is known up front and it can be read more than
+// once.
+type SeekableStore interface {
+	PutSeekable(ctx context.Context, reader io.ReadSeeker, name string, lastModified time.Time, size int64) error
+}
+
+// RangeGetter is implemented by stores that can read part of an object without
+// fetching all of it. The start and end offsets are inclusive.
+type RangeGetter interface {
+	GetRange(ctx context.Context, name string, start int64, end int64) (io.ReadCloser, error)
+}
+
+// Renamer is implemented by stores that can move an object to a new name
+// without the caller copying its content.
+type Renamer interface {
+	Rename(ctx context.Context, oldName string, newName string) error
+}
+
+// ServerCopier is implemented by stores which can copy objects between
+// locations on the service backing them without the caller transferring
+// their content. A copy which the service denies returns an error
+// wrapping os.ErrPermission.
+type ServerCopier interface {
+	ServerSideCopy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string) error
+}
+
+// BatchPutter is implemented by stores that can persist several files more
+// efficiently together than one at a time. Each file is stored under its name
+// with the content of its body. A failure to store one file does not prevent
+// the others from being stored; every failure is returned together.
+type BatchPutter interface {
+	MultiPut(ctx context.Context, files []*file.File) error
+}
+
+// AtomicStore is implemented by stores that can persist an object only if no
+// object with the same name exists, without another writer being able to
+// create one in between. Stored is false if the object already existed.
+type AtomicStore interface {
+	PutIfAbsent(ctx context.Context, source io.Reader, name string, lastModified time.Time) (stored bool, err error)
+}
+
+// Tagger is implemented by stores that can label objects with key/value tags
+// kept apart from their content.
+type Tagger interface {
+	Tag(ctx context.Context, name string, tags map[string]string) error
+	GetTags(ctx context.Context, name string) (map[string]string, error)
+}
+
+// Presigner is implemented by stores which can produce urls granting
+// temporary access to the content of an object without credentials.
+type Presigner interface {
+	PreSignURL(ctx context.Context, name string, expiry time.Duration) (string, error)
+}
+
+// Versioner is implemented by stores which keep every version of an object
+// written to the same name. Versions are identified by opaque ids assigned by
+// the store.
+type Versioner interface {
+	Snapshot(ctx context.Context, name string) (versionID string, err error)
+	ListVersions(ctx context.Context, name string) ([]string, error)
+	RestoreVersion(ctx context.Context, name string, versionID string) error
+}
+
+// Compactor is implemented by stores which can reclaim space wasted by
+// abandoned writes.
+type Compactor interface {
+	Compact(ctx context.Context) (*CompactReport, error)
+}
+
+// DeletionPurger is implemented by stores which may leave the content of
+// deleted objects behind to be removed later, e.g. because it was in use.
+// PurgeDeletions removes whatever is no longer needed.
+type DeletionPurger interface {
+	PurgeDeletions() error
+}
+
+// CompactReport describes what was reclaimed by Compact.
+type CompactReport struct {
+	// AbortedUploads is the number of incomplete uploads discarded.
+	AbortedUploads int `json:"abortedUploads"`
+	// FreedBytes is the combined size of the content discarded.
+	FreedBytes int64 `json:"freedBytes"`
+}
+
+// Types of StoreEvent.
+const (
+	StoreEventPut    = "put"
+	StoreEventDelete = "delete"
+)
+
+// StoreEvent describes an object being put into or deleted from a store.
+type StoreEvent struct {
+	Type string
+	Name string
+}
+
+// Watcher is implemented by stores that can report changes to objects whose
+// names start with a prefix as they happen. Watch sends events until the
+// context is cancelled, then returns nil. It does not close the channel.
+type Watcher interface {
+	Watch(ctx context.Context, prefix string, events chan<- StoreEvent) error
+}
+
+// DefaultPageSize is the number of results requested per page when listing
+// the content of a PaginatedStore.
+const DefaultPageSize = 1000
+
+// SearchAll finds every object in a store matching a prefix. Stores that
+// implement PaginatedStore are listed a page at a time.
+func SearchAll(ctx context.Context, store Store, prefix string) (file.List, error) {
+	paginated, ok := store.(PaginatedStore)
+	if !ok {
+		return store.Search(ctx, prefix)
+	}
+	var results file.List
+	cursor := ""
+	for {
+		page, next, err := paginated.SearchPage(ctx, prefix, cursor, DefaultPageSize)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, page...)
+		if next == "" {
+			return results, nil
+		}
+		cursor = next
+	}
+}
+
+// Appender is implemented by stores that can add bytes to the end of an
+// existing object, creating it if needed.
+type Appender interface {
+	Append(context.Context, string, []byte) error
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/google/go-cmp/cmp"
 	"github.com/tkellen/memorybox/internal/test"
 	"github.com/tkellen/memorybox/pkg/archive"
 	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/localdiskstore"
 	"io"
 	"io/ioutil"
 	"log"
@@ -17,6 +19,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -60,6 +63,31 @@ type MemStore struct {
 	GetErrorWith           error
 	SearchErrorWith        error
 	GetReturnsClosedReader bool
+	// DelayGet and DelayPut make the corresponding methods sleep before
+	// doing anything to simulate latency.
+	DelayGet time.Duration
+	DelayPut time.Duration
+	// CallCounts maps method names to a *int64 counting calls to them.
+	CallCounts sync.Map
+	// MaxConcurrentPuts records the most calls to Put that were in progress
+	// at the same time.
+	MaxConcurrentPuts int64
+	activePuts        int64
+}
+
+// count records a call to the named method.
+func (s *MemStore) count(method string) {
+	counter, _ := s.CallCounts.LoadOrStore(method, new(int64))
+	atomic.AddInt64(counter.(*int64), 1)
+}
+
+// Calls reports how many times the named method has been called.
+func (s *MemStore) Calls(method string) int64 {
+	counter, ok := s.CallCounts.Load(method)
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(counter.(*int64))
 }
 
 // NewMemStore returns a MemStore pre-filled with supplied fixtures.
@@ -81,6 +109,16 @@ func (s *MemStore) String() string {
 // Put assigns the content of an io.Reader to a string keyed in-memory map using
 // the hash as a key.
 func (s *MemStore) Put(_ context.Context, reader io.Reader, name string, lastModified time.Time) error {
+	s.count("Put")
+	active := atomic.AddInt64(&s.activePuts, 1)
+	defer atomic.AddInt64(&s.activePuts, -1)
+	for {
+		max := atomic.LoadInt64(&s.MaxConcurrentPuts)
+		if active <= max || atomic.CompareAndSwapInt64(&s.MaxConcurrentPuts, max, active) {
+			break
+		}
+	}
+	time.Sleep(s.DelayPut)
 	data, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return err
@@ -93,6 +131,7 @@ func (s *MemStore) Put(_ context.Context, reader io.Reader, name string, lastMod
 
 // Search finds matching items in storage by prefix.
 func (s *MemStore) Search(_ context.Context, search string) (file.List, error) {
+	s.count("Search")
 	if s.SearchErrorWith != nil {
 		return nil, s.SearchErrorWith
 	}
@@ -109,17 +148,34 @@ func (s *MemStore) Search(_ context.Context, search string) (file.List, error) {
 
 // Get finds an object in storage by name and returns an io.ReadCloser for it.
 func (s *MemStore) Get(ctx context.Context, name string) (*file.File, error) {
+	s.count("Get")
+	time.Sleep(s.DelayGet)
 	if s.GetErrorWith != nil {
 		return nil, s.GetErrorWith
 	}
 	if data, ok := s.Data.Load(name); ok {
-		return data.(*file.File), nil
+		f := data.(*file.File)
+		if f.Body == nil {
+			return f, nil
+		}
+		content, _ := ioutil.ReadAll(f)
+		// make sure body of file can be read again.
+		f.Body = bytes.NewReader(content)
+		return &file.File{
+			Name:         f.Name,
+			Source:       f.Source,
+			Size:         f.Size,
+			LastModified: f.LastModified,
+			Body:         bytes.NewReader(content),
+			Meta:         f.Meta,
+		}, nil
 	}
 	return nil, fmt.Errorf("%w: not in store", os.ErrNotExist)
 }
 
 // Delete removes an object in archive.
 func (s *MemStore) Delete(_ context.Context, request string) error {
+	s.count("Delete")
 	s.Data.Delete(request)
 	return nil
 }
@@ -127,6 +183,7 @@ func (s *MemStore) Delete(_ context.Context, request string) error {
 // Concat an array of byte arrays ordered identically with the input files
 // supplied. Note that this loads the entire dataset into memory.
 func (s *MemStore) Concat(_ context.Context, _ int, files []string) ([][]byte, error) {
+	s.count("Concat")
 	sort.Strings(files)
 	result := make([][]byte, len(files))
 	for index, item := range files {
@@ -143,8 +200,9 @@ func (s *MemStore) Concat(_ context.Context, _ int, files []string) ([][]byte, e
 	return result, nil
 }
 
-// Exists determines if a requested object exists in the MemStore.
+// Stat gets details about an object in the MemStore.
 func (s *MemStore) Stat(_ context.Context, name string) (*file.File, error) {
+	s.count("Stat")
 	var result *file.File
 	s.Data.Range(func(key interface{}, value interface{}) bool {
 		if key.(string) == name {
@@ -159,7 +217,47 @@ func (s *MemStore) Stat(_ context.Context, name string) (*file.File, error) {
 	return nil, os.ErrNotExist
 }
 
+// Exists determines if a requested object exists in the MemStore.
+func (s *MemStore) Exists(_ context.Context, name string) (bool, error) {
+	s.count("Exists")
+	_, ok := s.Data.Load(name)
+	return ok, nil
+}
+
 // Ensure MemStore satisfies same basic interactions as "real" stores.
 func TestMemStore(t *testing.T) {
 	test.StoreSuite(t, NewMemStore(file.List{}))
 }
+
+func TestSearchAll(t *testing.T) {
+	ctx := context.Background()
+	tempDir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	for i := 0; i < 2500; i++ {
+		if err := ioutil.WriteFile(path.Join(tempDir, fmt.Sprintf("%04d", i)), []byte("test"), 0644); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	for name, store := range map[string]archive.Store{
+		"paginated store":     localdiskstore.New(tempDir),
+		"non-paginated store": NewMemStore(file.List{}),
+	} {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			expected, err := store.Search(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := archive.SearchAll(ctx, store, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(expected.Names(), actual.Names()); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
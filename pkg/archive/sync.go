@@ -2,56 +2,142 @@ package archive
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
+	"os"
+	"sync"
+	"time"
 )
 
+// SyncReport describes the outcome of syncing two stores.
+type SyncReport struct {
+	// FilesCopied is the number of files written to the destination.
+	FilesCopied int `json:"filesCopied"`
+	// FilesSkipped is the number of files already current in the
+	// destination.
+	FilesSkipped int `json:"filesSkipped"`
+	// BytesTransferred is the combined size of the files copied, including
+	// those copied by the service without passing through memorybox.
+	BytesTransferred int64 `json:"bytesTransferred"`
+	// Duration is how long the sync took.
+	Duration time.Duration `json:"duration"`
+	// Errors holds any failures to copy files.
+	Errors []string `json:"errors"`
+}
+
 // Sync converges the content of two provided stores so they are identical.
-func Sync(ctx context.Context, logger *Logger, source Store, dest Store, mode string, concurrency int) error {
+// The mode controls what is copied: "metafiles", "datafiles" or "all". When
+// copying all files, metafiles are sent first. A file which fails to copy does
+// not stop the others; its failure is recorded in the report and an error
+// summarising every failure is returned once the rest are done. The report
+// describes whatever was done, even if the sync failed part way through.
+func Sync(ctx context.Context, logger *Logger, source Store, dest Store, mode string, concurrency int) (*SyncReport, error) {
+	report := &SyncReport{}
+	if mode != "metafiles" && mode != "datafiles" && mode != "all" {
+		return report, fmt.Errorf("%w: unknown sync mode %q", os.ErrInvalid, mode)
+	}
+	start := time.Now()
+	defer func() { report.Duration = time.Since(start) }()
 	sourceFiles, sourceErr := source.Search(ctx, "")
 	if sourceErr != nil {
-		return sourceErr
+		return report, sourceErr
 	}
-	destFiles, destErr := dest.Search(ctx, "")
-	if destErr != nil {
-		return destErr
+	var mu sync.Mutex
+	record := func(name string, size int64, err error) error {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err != nil:
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", name, err))
+		case size < 0:
+			report.FilesSkipped++
+		default:
+			report.FilesCopied++
+			report.BytesTransferred += size
+		}
+		return nil
 	}
-	destIndex := destFiles.ByName()
 	eg, egCtx := errgroup.WithContext(ctx)
 	sem := semaphore.NewWeighted(int64(concurrency))
-	if mode == "metafiles" {
+	switch mode {
+	case "metafiles":
 		sourceFiles = sourceFiles.Meta()
-	}
-	if mode == "datafiles" {
+	case "datafiles":
 		sourceFiles = sourceFiles.Data()
+	case "all":
+		sourceFiles = append(sourceFiles.Meta(), sourceFiles.Data()...)
 	}
 	eg.Go(func() error {
 		for _, src := range sourceFiles {
-			// Skip incoming files that are up-to-date in the destination store.
-			if dest, ok := destIndex[src.Name]; ok {
-				if dest.CurrentWith(src) {
-					logger.Verbose.Printf("%s (skipped)\n", src.Name)
-					continue
-				}
-			}
 			if err := sem.Acquire(egCtx, 1); err != nil {
 				return err
 			}
 			src := src
 			eg.Go(func() error {
+				defer sem.Release(1)
+				// Skip incoming files that are up-to-date in the destination
+				// store. Stat reports the size and modification time without
+				// fetching any content.
+				current, statErr := dest.Stat(egCtx, src.Name)
+				if statErr != nil && !errors.Is(statErr, os.ErrNotExist) {
+					return record(src.Name, 0, statErr)
+				}
+				if statErr == nil && current.CurrentWith(src) {
+					logger.Verbose.Printf("%s (skipped)\n", src.Name)
+					return record(src.Name, -1, nil)
+				}
+				// Object stores on the same service can copy files without
+				// their content passing through memorybox. If the copy is
+				// denied the content is streamed instead, using the
+				// credentials of each store.
+				if from, to, ok := sameObjectService(source, dest); ok {
+					err := to.ServerSideCopy(egCtx, from.BucketName(), src.Name, to.BucketName(), src.Name)
+					if !errors.Is(err, os.ErrPermission) {
+						logger.Verbose.Printf("%s (copied)\n", src.Name)
+						return record(src.Name, src.Size, err)
+					}
+					logger.Verbose.Printf("%s (copy denied, streaming)\n", src.Name)
+				}
 				f, err := source.Get(egCtx, src.Name)
 				if err != nil {
-					return err
+					return record(src.Name, 0, err)
 				}
 				defer func() {
 					logger.Verbose.Printf("%s (synced)\n", src.Name)
 					f.Close()
-					sem.Release(1)
 				}()
-				return dest.Put(egCtx, f, f.Name, f.LastModified)
+				return record(src.Name, f.Size, dest.Put(egCtx, f, f.Name, f.LastModified))
 			})
 		}
 		return nil
 	})
-	return eg.Wait()
+	if err := eg.Wait(); err != nil {
+		return report, err
+	}
+	if len(report.Errors) > 0 {
+		return report, fmt.Errorf("failed to sync %d of %d files", len(report.Errors), len(sourceFiles))
+	}
+	return report, nil
+}
+
+// objectService is implemented by stores which keep objects in a bucket on an
+// object storage service. Service identifies the service so stores sharing
+// one can copy objects between their buckets.
+type objectService interface {
+	ServerCopier
+	BucketName() string
+	Service() string
+}
+
+// sameObjectService reports if two stores are object stores on the same
+// service, returning them if so.
+func sameObjectService(source Store, dest Store) (objectService, objectService, bool) {
+	from, fromOk := source.(objectService)
+	to, toOk := dest.(objectService)
+	if !fromOk || !toOk || from.Service() != to.Service() {
+		return nil, nil, false
+	}
+	return from, to, true
 }
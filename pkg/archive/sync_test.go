@@ -0,0 +1,172 @@
+package archive_test
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	newSource := func() *MemStore {
+		store := NewMemStore(file.List{})
+		for _, name := range []string{"a", "b"} {
+			if err := store.Put(ctx, strings.NewReader(name), name, time.Now()); err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			meta := file.NewMetaFromFile(file.NewStub(name, 1, time.Now()))
+			if err := store.Put(ctx, strings.NewReader(meta.String()), file.MetaNameFrom(name), time.Now()); err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+		}
+		return store
+	}
+	table := map[string]struct {
+		mode        string
+		expected    []string
+		expectedErr error
+	}{
+		"metafiles": {
+			mode:     "metafiles",
+			expected: []string{file.MetaNameFrom("a"), file.MetaNameFrom("b")},
+		},
+		"datafiles": {
+			mode:     "datafiles",
+			expected: []string{"a", "b"},
+		},
+		"all": {
+			mode:     "all",
+			expected: []string{"a", "b", file.MetaNameFrom("a"), file.MetaNameFrom("b")},
+		},
+		"invalid mode": {
+			mode:        "some",
+			expectedErr: os.ErrInvalid,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			source := newSource()
+			dest := NewMemStore(file.List{})
+			_, err := archive.Sync(ctx, discardLogger(), source, dest, test.mode, 1)
+			if test.expectedErr != nil {
+				if !errors.Is(err, test.expectedErr) {
+					t.Fatalf("expected error: %s, got %v", test.expectedErr, err)
+				}
+				if calls := source.Calls("Search"); calls != 0 {
+					t.Fatalf("expected no searches for invalid mode, got %d", calls)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, searchErr := dest.Search(ctx, "")
+			if searchErr != nil {
+				t.Fatal(searchErr)
+			}
+			var actual []string
+			for _, f := range files {
+				actual = append(actual, f.Name)
+			}
+			sort.Strings(actual)
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestSyncReport(t *testing.T) {
+	ctx := context.Background()
+	source := NewMemStore(file.List{})
+	dest := NewMemStore(file.List{})
+	content := map[string]string{"a": "alpha", "b": "beta", "c": "gamma ray"}
+	for name, data := range content {
+		if err := source.Put(ctx, strings.NewReader(data), name, time.Now()); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	report, err := archive.Sync(ctx, discardLogger(), source, dest, "datafiles", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &archive.SyncReport{
+		FilesCopied:      3,
+		BytesTransferred: int64(len("alpha") + len("beta") + len("gamma ray")),
+		Duration:         report.Duration,
+	}
+	if diff := cmp.Diff(expected, report); diff != "" {
+		t.Fatal(diff)
+	}
+	if report.Duration <= 0 {
+		t.Fatalf("expected duration to be recorded, got %s", report.Duration)
+	}
+	again, err := archive.Sync(ctx, discardLogger(), source, dest, "datafiles", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.FilesCopied != 0 || again.FilesSkipped != 3 || again.BytesTransferred != 0 {
+		t.Fatalf("expected every file to be skipped, got %+v", again)
+	}
+}
+
+func TestSyncSkipsCurrentFiles(t *testing.T) {
+	ctx := context.Background()
+	source := NewMemStore(file.List{})
+	dest := NewMemStore(file.List{})
+	for _, name := range []string{"a", "b"} {
+		if err := source.Put(ctx, strings.NewReader(name), name, time.Now()); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	if err := dest.Put(ctx, strings.NewReader("a"), "a", time.Now()); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	report, err := archive.Sync(ctx, discardLogger(), source, dest, "datafiles", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FilesCopied != 1 || report.FilesSkipped != 1 || report.BytesTransferred != 1 {
+		t.Fatalf("expected 1 file copied, 1 skipped and 1 byte transferred, got %+v", report)
+	}
+	if calls := dest.Calls("Search"); calls != 0 {
+		t.Fatalf("expected destination not to be searched, got %d searches", calls)
+	}
+	if calls := dest.Calls("Stat"); calls != 2 {
+		t.Fatalf("expected 2 stats of destination, got %d", calls)
+	}
+	if calls := source.Calls("Get"); calls != 1 {
+		t.Fatalf("expected only the missing file to be fetched, got %d gets", calls)
+	}
+}
+
+func TestSyncContinuesPastFailures(t *testing.T) {
+	ctx := context.Background()
+	source := NewMemStore(file.List{})
+	dest := NewMemStore(file.List{})
+	names := []string{"a", "b", "c"}
+	for _, name := range names {
+		if err := source.Put(ctx, strings.NewReader(name), name, time.Now()); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	source.GetErrorWith = errors.New("bad time")
+	report, err := archive.Sync(ctx, discardLogger(), source, dest, "datafiles", 1)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if calls := source.Calls("Get"); calls != int64(len(names)) {
+		t.Fatalf("expected every file to be attempted, got %d gets", calls)
+	}
+	if len(report.Errors) != len(names) {
+		t.Fatalf("expected %d errors in report, got %v", len(names), report.Errors)
+	}
+}
@@ -0,0 +1,122 @@
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// binaryVersion identifies the layout written by MarshalBinary.
+const binaryVersion = 1
+
+// MarshalBinary encodes everything about a file except its content, so it can
+// be cached in binary stores. The encoding is a version byte followed by the
+// name, source, a byte that is 1 for metafiles, the metadata, the size and the
+// last modified time. Strings and byte slices are prefixed with their length
+// as a big-endian uint32; the size is a big-endian int64.
+func (f *File) MarshalBinary() ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	modified, err := f.LastModified.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(binaryVersion)
+	writeBinaryBytes(&buf, []byte(f.Name))
+	writeBinaryBytes(&buf, []byte(f.Source))
+	if IsMetaFileName(f.Name) {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	var meta []byte
+	if f.Meta != nil {
+		meta = *f.Meta
+	}
+	writeBinaryBytes(&buf, meta)
+	binary.Write(&buf, binary.BigEndian, f.Size)
+	writeBinaryBytes(&buf, modified)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces a file with one encoded by MarshalBinary. The
+// result is a stub; it has no body.
+func (f *File) UnmarshalBinary(data []byte) error {
+	reader := bytes.NewReader(data)
+	version, err := reader.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%w: %s", os.ErrInvalid, err)
+	}
+	if version != binaryVersion {
+		return fmt.Errorf("%w: unsupported binary version %d", os.ErrInvalid, version)
+	}
+	name, err := readBinaryBytes(reader)
+	if err != nil {
+		return err
+	}
+	source, err := readBinaryBytes(reader)
+	if err != nil {
+		return err
+	}
+	isMeta, err := reader.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%w: %s", os.ErrInvalid, err)
+	}
+	if (isMeta == 1) != IsMetaFileName(string(name)) {
+		return fmt.Errorf("%w: %s is not named like its kind", os.ErrInvalid, name)
+	}
+	meta, err := readBinaryBytes(reader)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+		return fmt.Errorf("%w: %s", os.ErrInvalid, err)
+	}
+	modified, err := readBinaryBytes(reader)
+	if err != nil {
+		return err
+	}
+	var lastModified time.Time
+	if err := lastModified.UnmarshalBinary(modified); err != nil {
+		return fmt.Errorf("%w: %s", os.ErrInvalid, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Name = string(name)
+	f.Source = string(source)
+	f.Size = size
+	f.LastModified = lastModified
+	f.Body = nil
+	f.Meta = nil
+	if meta != nil {
+		decoded := Meta(meta)
+		f.Meta = &decoded
+	}
+	return nil
+}
+
+func writeBinaryBytes(buf *bytes.Buffer, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+}
+
+func readBinaryBytes(reader *bytes.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("%w: %s", os.ErrInvalid, err)
+	}
+	if int64(length) > int64(reader.Len()) {
+		return nil, fmt.Errorf("%w: %s", os.ErrInvalid, io.ErrUnexpectedEOF)
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	data := make([]byte, length)
+	reader.Read(data)
+	return data, nil
+}
@@ -0,0 +1,80 @@
+package file_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/tkellen/memorybox/pkg/file"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFile_MarshalBinary(t *testing.T) {
+	lastModified := time.Date(2020, 5, 24, 21, 14, 42, 5, time.UTC)
+	data, err := file.NewSha256("source.txt", bytes.NewReader([]byte("test")), lastModified)
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	data.Meta = file.NewMetaFromFile(data)
+	meta, err := file.NewMetaFromBytes("source.txt", data.MetaBytes())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	table := map[string]*file.File{
+		"datafiles": data,
+		"metafiles": meta,
+		"stubs":     file.NewStub("stub", 10, lastModified),
+	}
+	for name, original := range table {
+		original := original
+		t.Run(name, func(t *testing.T) {
+			encoded, err := original.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := &file.File{Body: bytes.NewReader([]byte("replaced"))}
+			if err := decoded.UnmarshalBinary(encoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Body != nil {
+				t.Fatal("expected decoded file to be a stub")
+			}
+			if decoded.Name != original.Name || decoded.Source != original.Source || decoded.Size != original.Size {
+				t.Fatalf("expected %s/%s/%d, got %s/%s/%d", original.Name, original.Source, original.Size, decoded.Name, decoded.Source, decoded.Size)
+			}
+			if !decoded.LastModified.Equal(original.LastModified) {
+				t.Fatalf("expected %s, got %s", original.LastModified, decoded.LastModified)
+			}
+			if decoded.IsMetaFile() != original.IsMetaFile() {
+				t.Fatalf("expected IsMetaFile %t, got %t", original.IsMetaFile(), decoded.IsMetaFile())
+			}
+			if diff := cmp.Diff(original.MetaBytes(), decoded.MetaBytes()); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestFile_UnmarshalBinary_Invalid(t *testing.T) {
+	encoded, err := file.NewStub("test", 1, time.Now()).MarshalBinary()
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	mislabeled := append([]byte(nil), encoded...)
+	mislabeled[1+4+len("test")+4] = 1
+	table := map[string][]byte{
+		"empty":                {},
+		"unknown version":      append([]byte{99}, encoded[1:]...),
+		"truncated":            encoded[:len(encoded)-3],
+		"kind mismatches name": mislabeled,
+	}
+	for name, data := range table {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			if err := (&file.File{}).UnmarshalBinary(data); !errors.Is(err, os.ErrInvalid) {
+				t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package file
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/tkellen/memorybox/pkg/mimetype"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// decompressors maps the algorithms supported by Decompress to a function
+// wrapping compressed content with a reader producing the original content.
+var decompressors = map[string]func(io.Reader) (io.ReadCloser, error){
+	"gzip": func(source io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(source)
+	},
+	"bzip2": func(source io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(source)), nil
+	},
+	"zstd": func(source io.Reader) (io.ReadCloser, error) {
+		decoder, err := zstd.NewReader(source)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	},
+}
+
+// compressedContentTypes maps the mime types of compressed content to the
+// algorithm that produced it.
+var compressedContentTypes = map[string]string{
+	"application/gzip":    "gzip",
+	"application/x-gzip":  "gzip",
+	"application/x-bzip2": "bzip2",
+	"application/zstd":    "zstd",
+}
+
+// CompressionFromContentType finds the algorithm Decompress should be given
+// for content of the supplied mime type. It returns an empty string for
+// content which is not compressed with a supported algorithm.
+func CompressionFromContentType(contentType string) string {
+	return compressedContentTypes[contentType]
+}
+
+// compressionMagic maps the bytes compressed content starts with to the
+// algorithm that produced it.
+var compressionMagic = []struct {
+	magic []byte
+	algo  string
+}{
+	{magic: []byte("\x1f\x8b"), algo: "gzip"},
+	{magic: []byte("\x28\xb5\x2f\xfd"), algo: "zstd"},
+	{magic: []byte("BZh"), algo: "bzip2"},
+}
+
+// IsCompressed reports if the content of the file is compressed with an
+// algorithm Decompress supports. See CompressedAlgo.
+func (f *File) IsCompressed() bool {
+	return f.CompressedAlgo() != ""
+}
+
+// CompressedAlgo finds the algorithm Decompress should be given for the
+// content of the file: "gzip", "zstd", "bzip2" or an empty string if it is
+// not compressed (or cannot be read). The leading bytes of the content are
+// compared with the magic numbers of each algorithm before falling back to
+// the detected mime type. Seekable bodies are left where they were; other
+// bodies are replaced with one producing the same content. The result is
+// cached.
+func (f *File) CompressedAlgo() string {
+	f.mu.RLock()
+	algo, known := f.compression, f.compressionKnown
+	f.mu.RUnlock()
+	if known {
+		return algo
+	}
+	head, err := f.head(mimetype.SniffLen)
+	if err != nil {
+		return ""
+	}
+	for _, candidate := range compressionMagic {
+		if bytes.HasPrefix(head, candidate.magic) {
+			algo = candidate.algo
+			break
+		}
+	}
+	if algo == "" {
+		contentType, err := mimetype.Detect(bytes.NewReader(head))
+		if err != nil {
+			return ""
+		}
+		algo = CompressionFromContentType(contentType)
+	}
+	f.mu.Lock()
+	f.compression = algo
+	f.compressionKnown = true
+	f.mu.Unlock()
+	return algo
+}
+
+// head reads up to size bytes from the start of the content. Bodies which
+// cannot be read from an offset are consumed and replaced with a reader
+// producing what was read followed by the rest of the original body, which is
+// still closed by Close.
+func (f *File) head(size int) ([]byte, error) {
+	if f.Body == nil {
+		return nil, ErrMissingContent
+	}
+	buf := make([]byte, size)
+	_, isReaderAt := f.Body.(io.ReaderAt)
+	_, isSeeker := f.Body.(io.ReadSeeker)
+	if isReaderAt || isSeeker {
+		n, err := f.ReadAt(buf, 0)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	n, err := io.ReadFull(f.Body, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	buf = buf[:n]
+	rest := io.MultiReader(bytes.NewReader(buf), f.Body)
+	if closer, ok := f.Body.(io.Closer); ok {
+		f.Body = struct {
+			io.Reader
+			io.Closer
+		}{rest, closer}
+	} else {
+		f.Body = rest
+	}
+	return buf, nil
+}
+
+// Decompress produces a new file holding the decompressed content of the file
+// using one of "gzip", "zstd" or "bzip2". The content of the file is read to
+// the end but it is not closed. The decompressed content is buffered to a
+// temporary file so it is seekable (ContentType detects what was compressed);
+// it is removed when the new file is closed. The new file keeps the name of
+// the compressed content and a copy of its metadata.
+func (f *File) Decompress(algo string) (*File, error) {
+	newReader, ok := decompressors[algo]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported compression %q", os.ErrInvalid, algo)
+	}
+	reader, err := newReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name, err)
+	}
+	defer reader.Close()
+	temp, err := ioutil.TempFile(os.TempDir(), "memorybox-decompress-*")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func(err error) (*File, error) {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, fmt.Errorf("%s: %w", f.Name, err)
+	}
+	size, err := io.Copy(temp, reader)
+	if err != nil {
+		return cleanup(err)
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return cleanup(err)
+	}
+	decompressed := f.Clone()
+	decompressed.Size = size
+	decompressed.Body = temp
+	decompressed.tempPath = temp.Name()
+	return decompressed, nil
+}
@@ -0,0 +1,168 @@
+package file_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/tkellen/memorybox/pkg/file"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFile_Decompress(t *testing.T) {
+	original := []byte("<html><body>compressed</body></html>")
+	gzipped := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(gzipped)
+	gzipWriter.Write(original)
+	gzipWriter.Close()
+	zstded := &bytes.Buffer{}
+	zstdWriter, err := zstd.NewWriter(zstded)
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	zstdWriter.Write(original)
+	zstdWriter.Close()
+	// The standard library cannot write bzip2; this is "original" compressed
+	// with `bzip2 -9`.
+	bzipped := []byte("BZh91AY&SYd$\xcdZ\x00\x00\x02\x99\x80\x00\x00\x80\x05\x1eF\xdc  \x00!\xa9\xa3i\x1a\x1az\x850\x00M\x18\x1cYHb_\x5c\x1e\xf1\x8a\x08GE:\x9d\xa0\x87\xc5\xdc\x91N\x14$\x19\x093V\x80")
+	table := map[string]struct {
+		algo        string
+		content     []byte
+		expectedErr error
+	}{
+		"gzip": {
+			algo:    "gzip",
+			content: gzipped.Bytes(),
+		},
+		"zstd": {
+			algo:    "zstd",
+			content: zstded.Bytes(),
+		},
+		"bzip2": {
+			algo:    "bzip2",
+			content: bzipped,
+		},
+		"unknown algorithms fail": {
+			algo:        "lz4",
+			content:     gzipped.Bytes(),
+			expectedErr: os.ErrInvalid,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			compressed, err := file.NewSha256("test", bytes.NewReader(test.content), time.Now())
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			contentType, err := compressed.ContentType()
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			if test.expectedErr == nil && file.CompressionFromContentType(contentType) != test.algo {
+				t.Fatalf("expected %s to be detected from %s", test.algo, contentType)
+			}
+			decompressed, err := compressed.Decompress(test.algo)
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+			if test.expectedErr != nil {
+				return
+			}
+			if decompressed.Name != compressed.Name {
+				t.Fatalf("expected name %s to be kept, got %s", compressed.Name, decompressed.Name)
+			}
+			if decompressed.Size != int64(len(original)) {
+				t.Fatalf("expected size %d, got %d", len(original), decompressed.Size)
+			}
+			if contentType, err := decompressed.ContentType(); err != nil || contentType != "text/html; charset=utf-8" {
+				t.Fatalf("expected decompressed content to be detected as text/html, got %s (%v)", contentType, err)
+			}
+			actual, err := ioutil.ReadAll(decompressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(original, actual) {
+				t.Fatalf("expected %s, got %s", original, actual)
+			}
+			temp := decompressed.LocalPath()
+			decompressed.Close()
+			if _, err := os.Stat(temp); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected %s to be removed on close, got %v", temp, err)
+			}
+		})
+	}
+	corrupt, err := file.NewSha256("test", bytes.NewReader([]byte("not gzip")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if _, err := corrupt.Decompress("gzip"); err == nil {
+		t.Fatal("expected corrupt content to fail")
+	}
+}
+
+func TestFile_CompressedAlgo(t *testing.T) {
+	table := map[string]struct {
+		content      []byte
+		seekable     bool
+		expectedAlgo string
+	}{
+		"gzip": {
+			content:      []byte("\x1f\x8b\x08\x00rest"),
+			seekable:     true,
+			expectedAlgo: "gzip",
+		},
+		"zstd": {
+			content:      []byte("\x28\xb5\x2f\xfdrest"),
+			seekable:     true,
+			expectedAlgo: "zstd",
+		},
+		"bzip2": {
+			content:      []byte("BZh9rest"),
+			seekable:     true,
+			expectedAlgo: "bzip2",
+		},
+		"gzip without seeking": {
+			content:      []byte("\x1f\x8b\x08\x00rest"),
+			expectedAlgo: "gzip",
+		},
+		"uncompressed": {
+			content:  []byte("text"),
+			seekable: true,
+		},
+		"uncompressed without seeking": {
+			content: []byte("text"),
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var body io.Reader = bytes.NewReader(test.content)
+			if !test.seekable {
+				body = ioutil.NopCloser(body)
+			}
+			f := file.NewStub("test", int64(len(test.content)), time.Now())
+			f.Body = body
+			if actual := f.CompressedAlgo(); actual != test.expectedAlgo {
+				t.Fatalf("expected %q, got %q", test.expectedAlgo, actual)
+			}
+			if actual := f.IsCompressed(); actual != (test.expectedAlgo != "") {
+				t.Fatalf("expected IsCompressed to be %v", !actual)
+			}
+			content, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, test.content) {
+				t.Fatalf("expected content to be unchanged, got %q", content)
+			}
+			if actual := f.CompressedAlgo(); actual != test.expectedAlgo {
+				t.Fatalf("expected cached %q, got %q", test.expectedAlgo, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ErrHTTPStatus is returned when content is requested from a url which does
+// not respond successfully.
+var ErrHTTPStatus = errors.New("unsuccessful http response")
+
+// NewSha256FromPath creates a new instance of a file from a path on local disk,
+// named by the sha256 digest of its content. The last modified time is read
+// from the filesystem. The source defaults to the path if it is empty. The
+// file is left open as the body; it is closed when the file is closed.
+func NewSha256FromPath(source string, path string) (*File, error) {
+	if source == "" {
+		source = path
+	}
+	body, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := body.Stat()
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	f, err := NewSha256(source, body, info.ModTime())
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewSha256FromURL creates a new instance of a file from the content at a url,
+// named by the sha256 digest of its content. The content is buffered to a
+// temporary file as described by NewFromHTTP. If client is nil,
+// http.DefaultClient is used.
+func NewSha256FromURL(ctx context.Context, rawURL string, client *http.Client) (*File, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w: %s", rawURL, ErrHTTPStatus, resp.Status)
+	}
+	return NewFromHTTP(ctx, resp, Sha256)
+}
@@ -0,0 +1,100 @@
+package file_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/tkellen/memorybox/pkg/file"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewSha256FromPath(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "test")
+	if err := ioutil.WriteFile(path, []byte("test"), 0644); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	expectedName, _, _ := file.Sha256(bytes.NewReader([]byte("test")))
+	table := map[string]struct {
+		source         string
+		path           string
+		expectedSource string
+		expectedErr    error
+	}{
+		"source defaults to path": {
+			path:           path,
+			expectedSource: path,
+		},
+		"source supplied": {
+			source:         "elsewhere",
+			path:           path,
+			expectedSource: "elsewhere",
+		},
+		"path not found": {
+			path:        filepath.Join(tempDir, "missing"),
+			expectedErr: os.ErrNotExist,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			f, err := file.NewSha256FromPath(test.source, test.path)
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+			defer f.Close()
+			if f.Name != expectedName {
+				t.Fatalf("expected name %s, got %s", expectedName, f.Name)
+			}
+			if f.Source != test.expectedSource {
+				t.Fatalf("expected source %s, got %s", test.expectedSource, f.Source)
+			}
+			if !f.LastModified.Equal(modified) {
+				t.Fatalf("expected last modified %s, got %s", modified, f.LastModified)
+			}
+		})
+	}
+}
+
+func TestNewSha256FromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("test"))
+	}))
+	defer server.Close()
+	expectedName, _, _ := file.Sha256(bytes.NewReader([]byte("test")))
+	f, err := file.NewSha256FromURL(context.Background(), server.URL+"/found", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Name != expectedName {
+		t.Fatalf("expected name %s, got %s", expectedName, f.Name)
+	}
+	if f.Source != server.URL+"/found" {
+		t.Fatalf("expected source %s, got %s", server.URL+"/found", f.Source)
+	}
+	if _, err := file.NewSha256FromURL(context.Background(), server.URL+"/missing", server.Client()); !errors.Is(err, file.ErrHTTPStatus) {
+		t.Fatalf("expected %s, got %v", file.ErrHTTPStatus, err)
+	}
+}
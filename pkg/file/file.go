@@ -1,18 +1,59 @@
 package file
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	hash "github.com/minio/sha256-simd"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tkellen/memorybox/pkg/hash"
+	"github.com/tkellen/memorybox/pkg/mimetype"
+	stdhash "hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 type HashFn func(io.Reader) (string, int64, error)
 
-// File is an OS and storage system agnostic representation of a file.
+// Errors returned by Validate when a file is internally inconsistent.
+var (
+	ErrMissingName    = errors.New("file has no name")
+	ErrMissingContent = errors.New("file content is not readable")
+	ErrMetaMismatch   = errors.New("metadata does not describe file")
+	ErrInvalidMeta    = errors.New("metadata is not valid json")
+)
+
+// ErrHashMismatch is returned by HashVerify when the content of a datafile does
+// not hash to its name.
+var ErrHashMismatch = errors.New("content does not match name")
+
+// ErrPartialRead indicates some, but not all, of the content of a file was
+// read before it was closed.
+var ErrPartialRead = errors.New("file was partially read")
+
+// ErrFrozen is returned when modifying the metadata of a file after Freeze.
+var ErrFrozen = errors.New("file metadata is frozen")
+
+// ErrManagedPath is returned when modifying metadata under MetaKey by path.
+var ErrManagedPath = errors.New("metadata path is managed by memorybox")
+
+// ErrNotAnArray is returned when appending to metadata which is not an array.
+var ErrNotAnArray = errors.New("metadata value is not an array")
+
+// File is an OS and storage system agnostic representation of a file. The
+// Meta* methods and Read may be called from multiple goroutines at once.
 type File struct {
 	Name         string
 	Source       string
@@ -20,6 +61,24 @@ type File struct {
 	LastModified time.Time
 	Body         io.Reader
 	Meta         *Meta
+	// OnPartialRead is called by Close if some, but not all, of the content
+	// of a datafile was consumed through Read.
+	OnPartialRead func(name string, read int64, total int64)
+	bytesRead     int64
+	checksums     map[string]string
+	// closed is set by the first call to Close.
+	closed bool
+	// compression caches the result of CompressedAlgo once compressionKnown.
+	compression      string
+	compressionKnown bool
+	frozen           bool
+	mu               sync.RWMutex
+	// readAtMu serializes ReadAt calls which must move the position of the
+	// body.
+	readAtMu sync.Mutex
+	// tempPath is the location of a temporary file holding the content, which
+	// is removed by Close.
+	tempPath string
 }
 
 // NewStub produces a file that can be instantiated with details from a stat
@@ -32,6 +91,8 @@ func NewStub(name string, size int64, lastModified time.Time) *File {
 	}
 }
 
+// NewSha256 creates a new instance of a file named by the sha256 digest of its
+// content.
 func NewSha256(source string, body io.ReadSeeker, lastModified time.Time) (*File, error) {
 	return New(source, body, lastModified, Sha256)
 }
@@ -39,17 +100,33 @@ func NewSha256(source string, body io.ReadSeeker, lastModified time.Time) (*File
 // New creates a new instance of a file and names it by hashing the content of
 // the supplied reader.
 func New(source string, body io.ReadSeeker, lastModified time.Time, hash HashFn) (*File, error) {
-	digest, size, hashErr := hash(body)
+	return NewWithContext(context.Background(), source, body, lastModified, hash)
+}
+
+// NewWithContext creates a new instance of a file like New. Hashing stops
+// with the error of the context, checked every ContextCheckInterval bytes, if
+// it is cancelled.
+func NewWithContext(ctx context.Context, source string, body io.ReadSeeker, lastModified time.Time, hash HashFn) (*File, error) {
+	digest, size, hashErr := hash(newContextAwareReader(ctx, body))
 	if hashErr != nil {
-		return nil, hashErr
+		return nil, fmt.Errorf("source %s: %w", source, hashErr)
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("source %s: %w", source, err)
+	}
+	return newHashed(source, body, lastModified, digest, size)
+}
+
+// newHashed creates a new instance of a file from content which has already
+// been hashed.
+func newHashed(source string, body io.ReadSeeker, lastModified time.Time, digest string, size int64) (*File, error) {
 	// Prevent creating a file from a source containing metadata.
 	if size < MetaFileMaxSize {
 		body.Seek(0, io.SeekStart)
 		if meta, err := ioutil.ReadAll(body); err != nil {
-			return nil, err
+			return nil, fmt.Errorf("source %s: %w", source, err)
 		} else if ValidateMeta(meta) == nil {
-			return nil, fmt.Errorf("%w: use sync to interact with metafiles directly", os.ErrInvalid)
+			return nil, fmt.Errorf("source %s: %w: use sync to interact with metafiles directly", source, os.ErrInvalid)
 		}
 	}
 	body.Seek(0, io.SeekStart)
@@ -64,14 +141,665 @@ func New(source string, body io.ReadSeeker, lastModified time.Time, hash HashFn)
 	return file, nil
 }
 
+// Validate ensures the file is internally consistent: it must be named, any
+// datafile must have readable content and any metadata must be valid json that
+// describes the datafile.
+func (f *File) Validate() error {
+	if f.Name == "" {
+		return ErrMissingName
+	}
+	if !IsMetaFileName(f.Name) {
+		if f.Body == nil {
+			return fmt.Errorf("%w: %s has no body", ErrMissingContent, f.Name)
+		}
+		if backing, ok := f.Body.(*os.File); ok {
+			if _, err := os.Stat(backing.Name()); err != nil {
+				return fmt.Errorf("%w: %s", ErrMissingContent, err)
+			}
+		}
+	}
+	if f.Meta == nil {
+		if IsMetaFileName(f.Name) {
+			return fmt.Errorf("%w: %s has no metadata", ErrMetaMismatch, f.Name)
+		}
+		return nil
+	}
+	if !json.Valid(*f.Meta) {
+		return fmt.Errorf("%w: %s", ErrInvalidMeta, f.Name)
+	}
+	if described := f.Meta.DataFileName(); described == "" || described != DataNameFrom(f.Name) {
+		return fmt.Errorf("%w: %s key is %q, expected %q", ErrMetaMismatch, MetaKeyFileName, described, DataNameFrom(f.Name))
+	}
+	return nil
+}
+
+// NewFromBytes creates a new instance of a datafile from content held in
+// memory. The source defaults to "memory" if none is supplied.
+func NewFromBytes(source string, data []byte, hash HashFn) (*File, error) {
+	if source == "" {
+		source = "memory"
+	}
+	return New(source, bytes.NewReader(data), time.Now(), hash)
+}
+
+// NewMetaFromBytes creates a new instance of a metafile from raw memorybox
+// metadata. The source defaults to "memory" if none is supplied.
+func NewMetaFromBytes(source string, data []byte) (*File, error) {
+	if source == "" {
+		source = "memory"
+	}
+	data, migrateErr := MigrateMeta(data)
+	if migrateErr != nil {
+		return nil, fmt.Errorf("source %s: %w: %s", source, os.ErrInvalid, migrateErr)
+	}
+	if err := ValidateMeta(data); err != nil {
+		return nil, fmt.Errorf("source %s: %w: %s", source, os.ErrInvalid, err)
+	}
+	meta := Meta(data)
+	dataName := meta.DataFileName()
+	if dataName == "" {
+		return nil, fmt.Errorf("source %s: %w: missing %s", source, os.ErrInvalid, MetaKeyFileName)
+	}
+	return &File{
+		Name:         MetaNameFrom(dataName),
+		Source:       source,
+		Size:         int64(len(data)),
+		LastModified: time.Now(),
+		Body:         bytes.NewReader(data),
+		Meta:         &meta,
+	}, nil
+}
+
+// ContentType detects the mime type of the file from its content. The body
+// must be seekable as it is rewound after being inspected.
+func (f *File) ContentType() (string, error) {
+	seeker, ok := f.Body.(io.ReadSeeker)
+	if !ok {
+		return "", fmt.Errorf("%w: %s is not seekable", os.ErrInvalid, f.Name)
+	}
+	return mimetype.Detect(seeker)
+}
+
+// checksumAlgorithms maps the algorithms supported by Checksum to a function
+// producing a new digest for them.
+var checksumAlgorithms = map[string]func() stdhash.Hash{
+	"md5":                func() stdhash.Hash { return md5.New() },
+	"sha1":               func() stdhash.Hash { return sha1.New() },
+	hash.Sha256Algorithm: hash.NewSha256,
+	"crc32":              func() stdhash.Hash { return crc32.NewIEEE() },
+}
+
+// Checksum computes a hex encoded digest of the file using one of "md5",
+// "sha1", "sha256" or "crc32". Datafiles are read from the start of their
+// content and rewound afterwards. Metafiles are digested in canonical form.
+// Results are cached.
+func (f *File) Checksum(algo string) (string, error) {
+	f.mu.RLock()
+	checksum, ok := f.checksums[algo]
+	f.mu.RUnlock()
+	if ok {
+		return checksum, nil
+	}
+	newDigest, ok := checksumAlgorithms[algo]
+	if !ok {
+		return "", fmt.Errorf("%w: unsupported checksum algorithm %s", os.ErrInvalid, algo)
+	}
+	digest := newDigest()
+	if f.IsMetaFile() {
+		if f.Meta == nil {
+			return "", fmt.Errorf("%w: %s has no metadata", ErrMetaMismatch, f.Name)
+		}
+		canonical, err := f.Meta.Canonical()
+		if err != nil {
+			return "", err
+		}
+		digest.Write(canonical)
+	} else {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(digest, f.Body); err != nil {
+			return "", err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	checksum = hex.EncodeToString(digest.Sum(nil))
+	f.mu.Lock()
+	if f.checksums == nil {
+		f.checksums = map[string]string{}
+	}
+	f.checksums[algo] = checksum
+	f.mu.Unlock()
+	return checksum, nil
+}
+
+// HashVerify re-hashes the content of the file, using the algorithm its name
+// was produced with, and ensures the result matches its name. The body is read
+// from the start and rewound afterwards, so it must be seekable. Metafiles are
+// not named by a hash of their content; their metadata is decoded in canonical
+// form and must describe the datafile the name refers to.
+func (f *File) HashVerify() error {
+	if f.IsMetaFile() {
+		return f.metaVerify()
+	}
+	hasher, err := HasherFromFileName(f.Name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	actual, _, hashErr := hasher(f.Body)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if hashErr != nil {
+		return hashErr
+	}
+	if actual != f.Name {
+		return fmt.Errorf("%w: expected %s, got %s", ErrHashMismatch, f.Name, actual)
+	}
+	return nil
+}
+
+// metaVerify checks the metadata of a metafile, reading it from the body if it
+// has not been decoded already.
+func (f *File) metaVerify() error {
+	f.mu.RLock()
+	var meta Meta
+	if f.Meta != nil {
+		meta = append(meta, *f.Meta...)
+	}
+	f.mu.RUnlock()
+	if meta == nil {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		data, readErr := ioutil.ReadAll(f.Body)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if readErr != nil {
+			return readErr
+		}
+		meta = data
+	}
+	canonical, err := meta.Canonical()
+	if err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrInvalidMeta, f.Name, err)
+	}
+	if described := canonical.DataFileName(); described != DataNameFrom(f.Name) {
+		return fmt.Errorf("%w: %s key is %q, expected %q", ErrMetaMismatch, MetaKeyFileName, described, DataNameFrom(f.Name))
+	}
+	return nil
+}
+
+// Freeze prevents further changes to the metadata of the file. The Meta*
+// methods which modify it return ErrFrozen afterwards. Use Clone to get a copy
+// which can be modified.
+func (f *File) Freeze() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.frozen = true
+}
+
+// Clone returns a copy of the file with its own, unfrozen, metadata. The body
+// is shared with the original and is not closed by closing the copy.
+func (f *File) Clone() *File {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	clone := &File{
+		Name:          f.Name,
+		Source:        f.Source,
+		Size:          f.Size,
+		LastModified:  f.LastModified,
+		Body:          f.Body,
+		OnPartialRead: f.OnPartialRead,
+	}
+	if f.Meta != nil {
+		meta := append(Meta(nil), *f.Meta...)
+		clone.Meta = &meta
+	}
+	return clone
+}
+
+// MetaSet assigns a value to a key in the metadata of the file.
+func (f *File) MetaSet(key string, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.frozen {
+		return fmt.Errorf("%w: %s", ErrFrozen, f.Name)
+	}
+	if f.Meta == nil {
+		f.Meta = &Meta{}
+	}
+	f.Meta.Set(key, value)
+	return nil
+}
+
+// ExpiresIn records that the file expires once d has elapsed. It returns the
+// file so calls can be chained.
+func (f *File) ExpiresIn(d time.Duration) *File {
+	return f.ExpiresAt(time.Now().Add(d))
+}
+
+// ExpiresAt records the time at which the file expires. It returns the file
+// so calls can be chained. Expiry is recorded in the metadata of datafiles
+// only, so this does nothing for metafiles or files which are frozen.
+func (f *File) ExpiresAt(t time.Time) *File {
+	if f.IsMetaFile() {
+		return f
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.frozen {
+		return f
+	}
+	if f.Meta == nil {
+		f.Meta = &Meta{}
+	}
+	*f.Meta, _ = sjson.SetBytes(*f.Meta, MetaKeyExpiresAt, t.UTC().Format(time.RFC3339))
+	return f
+}
+
+// MetaGet retrieves the value of a key in the metadata of the file.
+func (f *File) MetaGet(key string) interface{} {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.Meta == nil {
+		return nil
+	}
+	return f.Meta.Get(key)
+}
+
+// MetaDelete removes a key from the metadata of the file.
+func (f *File) MetaDelete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.frozen {
+		return fmt.Errorf("%w: %s", ErrFrozen, f.Name)
+	}
+	if f.Meta != nil {
+		f.Meta.Delete(key)
+	}
+	return nil
+}
+
+// MetaSetPath assigns a value to a nested location in the metadata of the
+// file using gjson dot-notation (e.g. "labels.env" or "list.0"). Intermediate
+// objects are created as needed. Paths under MetaKey cannot be set.
+func (f *File) MetaSetPath(path string, value interface{}) error {
+	if isManagedPath(path) {
+		return fmt.Errorf("%w: %s", ErrManagedPath, path)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.frozen {
+		return fmt.Errorf("%w: %s", ErrFrozen, f.Name)
+	}
+	if f.Meta == nil {
+		f.Meta = &Meta{}
+	}
+	data, err := sjson.SetBytes(*f.Meta, path, value)
+	if err != nil {
+		return err
+	}
+	*f.Meta = data
+	return nil
+}
+
+// MetaGetPath retrieves the decoded value at a nested location in the
+// metadata of the file using gjson dot-notation. Missing paths produce nil.
+func (f *File) MetaGetPath(path string) interface{} {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.Meta == nil {
+		return nil
+	}
+	return gjson.GetBytes(*f.Meta, path).Value()
+}
+
+// MetaDeletePath removes a nested location from the metadata of the file
+// using gjson dot-notation. Paths under MetaKey cannot be deleted.
+func (f *File) MetaDeletePath(path string) error {
+	if isManagedPath(path) {
+		return fmt.Errorf("%w: %s", ErrManagedPath, path)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.frozen {
+		return fmt.Errorf("%w: %s", ErrFrozen, f.Name)
+	}
+	if f.Meta == nil {
+		return nil
+	}
+	data, err := sjson.DeleteBytes(*f.Meta, path)
+	if err != nil {
+		return err
+	}
+	*f.Meta = data
+	return nil
+}
+
+// MetaAppend adds a value to the end of the array at a location in the
+// metadata of the file using gjson dot-notation. Missing locations become a
+// single element array. Paths under MetaKey cannot be appended to.
+func (f *File) MetaAppend(key string, value interface{}) error {
+	if isManagedPath(key) {
+		return fmt.Errorf("%w: %s", ErrManagedPath, key)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.frozen {
+		return fmt.Errorf("%w: %s", ErrFrozen, f.Name)
+	}
+	if f.Meta == nil {
+		f.Meta = &Meta{}
+	}
+	var data []byte
+	var err error
+	current := gjson.GetBytes(*f.Meta, key)
+	switch {
+	case !current.Exists():
+		data, err = sjson.SetBytes(*f.Meta, key, []interface{}{value})
+	case current.IsArray():
+		data, err = sjson.SetBytes(*f.Meta, key+".-1", value)
+	default:
+		return fmt.Errorf("%w: %s", ErrNotAnArray, key)
+	}
+	if err != nil {
+		return err
+	}
+	*f.Meta = data
+	return nil
+}
+
+// isManagedPath reports if a dot-notation path points into the metadata
+// memorybox controls.
+func isManagedPath(path string) bool {
+	return path == MetaKey || strings.HasPrefix(path, MetaKey+".")
+}
+
+// MetaApply adds the metadata described by the options to the file.
+func (f *File) MetaApply(opts MetaFileOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.frozen {
+		return fmt.Errorf("%w: %s", ErrFrozen, f.Name)
+	}
+	if f.Meta == nil {
+		f.Meta = &Meta{}
+	}
+	opts.Apply(f.Meta)
+	return nil
+}
+
+// MetaSetFromStruct encodes v as JSON and assigns every top level key of the
+// result to the metadata of the file. Keys managed by memorybox are ignored.
+// The encoded value must be a JSON object.
+func (f *File) MetaSetFromStruct(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.frozen {
+		return fmt.Errorf("%w: %s", ErrFrozen, f.Name)
+	}
+	if f.Meta == nil {
+		f.Meta = &Meta{}
+	}
+	return f.Meta.Merge(string(data))
+}
+
+// MetaGetInto decodes the value of a key in the metadata of the file into
+// dest using json.Unmarshal.
+func (f *File) MetaGetInto(key string, dest interface{}) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var value gjson.Result
+	if f.Meta != nil {
+		value = gjson.GetBytes(*f.Meta, key)
+	}
+	if !value.Exists() {
+		return fmt.Errorf("%w: %s", os.ErrNotExist, key)
+	}
+	return json.Unmarshal([]byte(value.Raw), dest)
+}
+
+// MetaRange calls fn for every top level key in the metadata of the file until
+// fn returns false. The metadata is read without being decoded into a map. It
+// must not be modified by fn.
+func (f *File) MetaRange(fn func(key string, value gjson.Result) bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.Meta != nil {
+		f.Meta.Range(fn)
+	}
+}
+
+// MetaGetAll decodes every top level key in the metadata of the file.
+func (f *File) MetaGetAll() map[string]interface{} {
+	result := map[string]interface{}{}
+	f.MetaRange(func(key string, value gjson.Result) bool {
+		result[key] = value.Value()
+		return true
+	})
+	return result
+}
+
+// MetaBytes returns a copy of the metadata of the file.
+func (f *File) MetaBytes() []byte {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.Meta == nil {
+		return nil
+	}
+	return append([]byte(nil), *f.Meta...)
+}
+
+// WriteMetaStream writes the metadata of the file to w as a JSON object with
+// its keys in sorted order, followed by a newline. The metadata is parsed once
+// and the raw bytes of each value are written straight from it, so it is never
+// decoded into a map or marshalled again.
+func (f *File) WriteMetaStream(w io.Writer) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	meta := []byte("{}")
+	if f.Meta != nil && len(bytes.TrimSpace(*f.Meta)) > 0 {
+		meta = *f.Meta
+	}
+	parsed := gjson.ParseBytes(meta)
+	if !parsed.IsObject() {
+		return fmt.Errorf("%w: %s", ErrInvalidMeta, f.Name)
+	}
+	type member struct {
+		key string
+		raw string
+	}
+	var members []member
+	parsed.ForEach(func(key, value gjson.Result) bool {
+		members = append(members, member{key: key.String(), raw: value.Raw})
+		return true
+	})
+	sort.Slice(members, func(i, j int) bool { return members[i].key < members[j].key })
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if _, err := io.WriteString(w, "{"); err != nil {
+		return err
+	}
+	for index, m := range members {
+		encoded.Reset()
+		if index > 0 {
+			encoded.WriteByte(',')
+		}
+		if err := encoder.Encode(m.key); err != nil {
+			return err
+		}
+		// Encode terminates every value with a newline.
+		encoded.Truncate(encoded.Len() - 1)
+		encoded.WriteByte(':')
+		if _, err := encoded.WriteTo(w); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, m.raw); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
+
+// UnknownAlgorithm is reported by Algorithm for files whose names do not end
+// with the hashing algorithm used to produce them.
+const UnknownAlgorithm = "unknown"
+
+// Digest returns the hash of the content of the file without the algorithm
+// suffix, e.g. "abc123" for "abc123-sha256". Names without a suffix are
+// returned in full. Metafiles report the digest of the datafile they describe.
+func (f *File) Digest() string {
+	name := DataNameFrom(f.Name)
+	if index := strings.LastIndex(name, "-"); index != -1 {
+		return name[:index]
+	}
+	return name
+}
+
+// Algorithm returns the hashing algorithm suffix of the name of the file, e.g.
+// "sha256" for "abc123-sha256", or UnknownAlgorithm if it has none.
+func (f *File) Algorithm() string {
+	name := DataNameFrom(f.Name)
+	if index := strings.LastIndex(name, "-"); index != -1 {
+		return name[index+1:]
+	}
+	return UnknownAlgorithm
+}
+
+// LocalPath returns the location on local disk of the content of the file so
+// it can be inspected by other programs. Files opened from local disk give
+// their original path and content buffered from elsewhere (urls, stdin,
+// decompression) gives the temporary file holding it. Metafiles and content
+// held in memory give an empty string. Temporary files are removed by Close,
+// so the path must not be used after the file is closed.
+func (f *File) LocalPath() string {
+	if f.IsMetaFile() {
+		return ""
+	}
+	if f.tempPath != "" {
+		return f.tempPath
+	}
+	if named, ok := f.Body.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return ""
+}
+
+// Filepath returns the location on local disk of the content of the file.
+//
+// Deprecated: Use LocalPath instead.
+func (f *File) Filepath() string {
+	return f.LocalPath()
+}
+
+// contentPollInterval is how often WaitForContent checks the content of a
+// file and contentStableAfter is how long its size must remain unchanged for
+// it to be considered completely written.
+const (
+	contentPollInterval = 100 * time.Millisecond
+	contentStableAfter  = 200 * time.Millisecond
+)
+
+// WaitForContent blocks until the content of the file exists on local disk and
+// its size has stopped changing. This allows a file to be created before the
+// content backing it has been completely written. It fails if the file has no
+// content on local disk, the context is cancelled or the timeout elapses.
+func (f *File) WaitForContent(ctx context.Context, timeout time.Duration) error {
+	path := f.LocalPath()
+	if path == "" {
+		return fmt.Errorf("%s: %w: content is not on local disk", f.Name, os.ErrInvalid)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(contentPollInterval)
+	defer ticker.Stop()
+	lastSize := int64(-1)
+	var stableSince time.Time
+	for {
+		if info, err := os.Stat(path); err == nil {
+			now := time.Now()
+			if info.Size() != lastSize {
+				lastSize = info.Size()
+				stableSince = now
+			} else if now.Sub(stableSince) >= contentStableAfter {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: waiting for content: %w", path, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// IsMetaFile reports if the file is a metafile.
+func (f *File) IsMetaFile() bool {
+	return IsMetaFileName(f.Name)
+}
+
+// partialReadLogger receives a warning whenever a datafile is closed after
+// only part of its content was read.
+var partialReadLogger = struct {
+	sync.RWMutex
+	logger *log.Logger
+}{}
+
+// SetPartialReadLogger controls where Close warns about datafiles which were
+// only partially read. A nil logger disables the warnings.
+func SetPartialReadLogger(logger *log.Logger) {
+	partialReadLogger.Lock()
+	defer partialReadLogger.Unlock()
+	partialReadLogger.logger = logger
+}
+
 // Close calls close on the underlying Body (if there is one and it is needed).
+// Datafiles which were partially read are logged to the logger supplied to
+// SetPartialReadLogger and reported to OnPartialRead first. Calls after the
+// first do nothing.
 func (f *File) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	bytesRead := f.bytesRead
+	f.mu.Unlock()
+	if !f.IsMetaFile() && bytesRead > 0 && bytesRead < f.Size {
+		partialReadLogger.RLock()
+		logger := partialReadLogger.logger
+		partialReadLogger.RUnlock()
+		if logger != nil {
+			logger.Printf("warning: %s closed after reading %d of %d bytes", f.Name, bytesRead, f.Size)
+		}
+		if f.OnPartialRead != nil {
+			f.OnPartialRead(f.Name, bytesRead, f.Size)
+		}
+	}
+	var err error
 	if f.Body != nil {
 		if asCloser, ok := f.Body.(io.ReadCloser); ok {
-			return asCloser.Close()
+			err = asCloser.Close()
 		}
 	}
-	return nil
+	if f.tempPath != "" {
+		os.Remove(f.tempPath)
+	}
+	return err
 }
 
 // Read calls read on the underlying Body (if there is one).
@@ -79,7 +807,61 @@ func (f *File) Read(p []byte) (int, error) {
 	if f.Body == nil {
 		return 0, io.ErrUnexpectedEOF
 	}
-	return f.Body.Read(p)
+	n, err := f.Body.Read(p)
+	f.mu.Lock()
+	f.bytesRead = f.bytesRead + int64(n)
+	f.mu.Unlock()
+	return n, err
+}
+
+// Seek calls seek on the underlying Body (if it supports it).
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := f.Body.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s is not seekable", os.ErrInvalid, f.Name)
+	}
+	position, err := seeker.Seek(offset, whence)
+	if err == nil {
+		f.mu.Lock()
+		f.bytesRead = position
+		f.mu.Unlock()
+	}
+	return position, err
+}
+
+// ReadAt reads len(p) bytes of content starting at off, as described by
+// io.ReaderAt. Bodies which implement io.ReaderAt, like the *os.File returned
+// by stores on local disk, are read directly. Other seekable bodies are read by
+// seeking to off and back again afterwards; concurrent calls to ReadAt wait
+// for each other but must not be mixed with calls to Read or Seek.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("%w: %s: negative offset %d", os.ErrInvalid, f.Name, off)
+	}
+	if readerAt, ok := f.Body.(io.ReaderAt); ok {
+		return readerAt.ReadAt(p, off)
+	}
+	seeker, ok := f.Body.(io.ReadSeeker)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s is not seekable", os.ErrInvalid, f.Name)
+	}
+	f.readAtMu.Lock()
+	defer f.readAtMu.Unlock()
+	position, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := seeker.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, readErr := io.ReadFull(seeker, p)
+	if readErr == io.ErrUnexpectedEOF {
+		readErr = io.EOF
+	}
+	if _, err := seeker.Seek(position, io.SeekStart); err != nil {
+		return n, err
+	}
+	return n, readErr
 }
 
 // CurrentWith calculates if an alternative file is considered to be "current"
@@ -94,12 +876,8 @@ func (f *File) CurrentWith(other *File) bool {
 	return f.Size == other.Size
 }
 
-// Sha256 computes a sha256 message digest for a provided io.Reader.
+// Sha256 computes a sha256 message digest for a provided io.Reader. It is
+// hash.Sha256, kept here so it can be passed wherever a HashFn is needed.
 func Sha256(source io.Reader) (string, int64, error) {
-	hash := hash.New()
-	size, err := io.Copy(hash, source)
-	if err != nil {
-		return "", 0, err
-	}
-	return hex.EncodeToString(hash.Sum(nil)) + "-sha256", size, nil
+	return hash.Sha256(source)
 }
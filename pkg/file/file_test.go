@@ -2,12 +2,23 @@ package file_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"github.com/mattetti/filebuffer"
+	"github.com/tidwall/gjson"
 	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/hash"
 	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -81,6 +92,117 @@ func TestNew(t *testing.T) {
 	}
 }
 
+// cancellingReader cancels a context once a number of bytes have been read.
+type cancellingReader struct {
+	*bytes.Reader
+	read   int64
+	after  int64
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read = r.read + int64(n)
+	if r.read >= r.after {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestNewWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := &cancellingReader{
+		Reader: bytes.NewReader(make([]byte, 64*1024*1024)),
+		after:  1024 * 1024,
+		cancel: cancel,
+	}
+	if _, err := file.NewWithContext(ctx, "test", body, time.Now(), file.Sha256); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %s, got %v", context.Canceled, err)
+	}
+	if limit := body.after + file.ContextCheckInterval; body.read > limit {
+		t.Fatalf("expected hashing to stop within %d bytes, read %d", limit, body.read)
+	}
+	f, err := file.NewWithContext(context.Background(), "test", bytes.NewReader([]byte("test")), time.Now(), file.Sha256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := file.NewSha256("test", bytes.NewReader([]byte("test")), time.Now())
+	if f.Name != expected.Name {
+		t.Fatalf("expected %s, got %s", expected.Name, f.Name)
+	}
+}
+
+// seekOnly hides every method of a body except Read and Seek.
+type seekOnly struct {
+	io.ReadSeeker
+}
+
+func TestFile_ReadAt(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	temp, err := ioutil.TempFile("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	if _, err := temp.Write(content); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	table := map[string]io.ReadSeeker{
+		"body implementing io.ReaderAt": temp,
+		"seekable body":                 seekOnly{bytes.NewReader(content)},
+	}
+	for name, body := range table {
+		body := body
+		t.Run(name, func(t *testing.T) {
+			f, err := file.NewSha256("test", body, time.Now())
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			first := make([]byte, 2)
+			if _, err := f.Read(first); err != nil {
+				t.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			for i := 0; i < 100; i++ {
+				off := int64(i % len(content))
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					actual := make([]byte, 4)
+					n, err := f.ReadAt(actual, off)
+					end := off + 4
+					if end > int64(len(content)) {
+						end = int64(len(content))
+					}
+					expected := content[off:end]
+					if int64(len(expected)) < 4 && err != io.EOF {
+						t.Errorf("expected %s reading past the end, got %v", io.EOF, err)
+					}
+					if int64(len(expected)) == 4 && err != nil {
+						t.Error(err)
+					}
+					if !bytes.Equal(expected, actual[:n]) {
+						t.Errorf("expected %s at %d, got %s", expected, off, actual[:n])
+					}
+				}()
+			}
+			wg.Wait()
+			rest, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content[2:], rest) {
+				t.Fatalf("expected ReadAt to leave the read position alone, got %s", rest)
+			}
+			if _, err := f.ReadAt(first, -1); !errors.Is(err, os.ErrInvalid) {
+				t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+			}
+		})
+	}
+}
+
 func TestFile_Read(t *testing.T) {
 	type testCase struct {
 		file          *file.File
@@ -165,3 +287,1077 @@ func TestDataNameFrom(t *testing.T) {
 		})
 	}
 }
+
+func TestFile_Validate(t *testing.T) {
+	valid := func() *file.File {
+		f, err := file.NewSha256("test", filebuffer.New([]byte("test")), time.Now())
+		if err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		return f
+	}
+	table := map[string]struct {
+		file        *file.File
+		expectedErr error
+	}{
+		"valid datafile": {
+			file: valid(),
+		},
+		"valid metafile": {
+			file: func() *file.File {
+				f := valid()
+				meta := file.NewStub(file.MetaNameFrom(f.Name), 0, time.Now())
+				meta.Meta = f.Meta
+				return meta
+			}(),
+		},
+		"missing name": {
+			file: func() *file.File {
+				f := valid()
+				f.Name = ""
+				return f
+			}(),
+			expectedErr: file.ErrMissingName,
+		},
+		"datafile without content": {
+			file:        file.NewStub("test", 0, time.Now()),
+			expectedErr: file.ErrMissingContent,
+		},
+		"datafile whose backing file was removed": {
+			file: func() *file.File {
+				temp, err := ioutil.TempFile("", "*")
+				if err != nil {
+					t.Fatalf("test setup: %s", err)
+				}
+				temp.Write([]byte("test"))
+				temp.Seek(0, io.SeekStart)
+				f, newErr := file.NewSha256("test", temp, time.Now())
+				if newErr != nil {
+					t.Fatalf("test setup: %s", newErr)
+				}
+				temp.Close()
+				os.Remove(temp.Name())
+				return f
+			}(),
+			expectedErr: file.ErrMissingContent,
+		},
+		"metadata describing another file": {
+			file: func() *file.File {
+				f := valid()
+				f.Meta.Set(file.MetaKeyFileName, "other")
+				return f
+			}(),
+			expectedErr: file.ErrMetaMismatch,
+		},
+		"metafile without metadata": {
+			file:        file.NewStub(file.MetaNameFrom("test"), 0, time.Now()),
+			expectedErr: file.ErrMetaMismatch,
+		},
+		"invalid metadata": {
+			file: func() *file.File {
+				f := valid()
+				meta := file.Meta(`{"meta":`)
+				f.Meta = &meta
+				return f
+			}(),
+			expectedErr: file.ErrInvalidMeta,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			err := test.file.Validate()
+			if err != nil && test.expectedErr == nil {
+				t.Fatal(err)
+			}
+			if test.expectedErr != nil && !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error: %s, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestNewFromBytes(t *testing.T) {
+	content := []byte("test")
+	expectedName, _, _ := file.Sha256(bytes.NewReader(content))
+	table := map[string]struct {
+		source         string
+		expectedSource string
+	}{
+		"source is retained": {
+			source:         "test",
+			expectedSource: "test",
+		},
+		"source defaults to memory": {
+			source:         "",
+			expectedSource: "memory",
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			f, err := file.NewFromBytes(test.source, content, file.Sha256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Name != expectedName {
+				t.Fatalf("expected name %s, got %s", expectedName, f.Name)
+			}
+			if f.Source != test.expectedSource {
+				t.Fatalf("expected source %s, got %s", test.expectedSource, f.Source)
+			}
+			if f.IsMetaFile() {
+				t.Fatal("expected datafile")
+			}
+			actual, readErr := ioutil.ReadAll(f)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if !bytes.Equal(content, actual) {
+				t.Fatalf("expected %s, got %s", content, actual)
+			}
+		})
+	}
+	if _, err := file.NewFromBytes("", []byte(`{"meta":{"file":"test"}}`), file.Sha256); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected metadata content to be rejected, got %v", err)
+	}
+}
+
+func TestNewMetaFromBytes(t *testing.T) {
+	table := map[string]struct {
+		input        []byte
+		expected     []byte
+		expectedName string
+		expectedErr  error
+	}{
+		"valid metadata": {
+			input:        []byte(`{"meta":{"file":"test","memorybox":true}}`),
+			expectedName: file.MetaNameFrom("test"),
+		},
+		"version 1 metadata is migrated": {
+			input:        []byte(`{"memorybox":{"file":"test","source":"<stdin>"},"data":{"title":"test"}}`),
+			expected:     []byte(`{"title":"test","meta":{"file":"test","import":{"source":"<stdin>"},"memorybox":true,"schemaVersion":2}}`),
+			expectedName: file.MetaNameFrom("test"),
+		},
+		"metadata without file name": {
+			input:       []byte(`{"meta":{"memorybox":true}}`),
+			expectedErr: os.ErrInvalid,
+		},
+		"not metadata": {
+			input:       []byte(`{"other":true}`),
+			expectedErr: os.ErrInvalid,
+		},
+		"invalid json": {
+			input:       []byte(`{"meta":`),
+			expectedErr: os.ErrInvalid,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			f, err := file.NewMetaFromBytes("", test.input)
+			if err != nil && test.expectedErr == nil {
+				t.Fatal(err)
+			}
+			if test.expectedErr != nil && !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error: %s, got %v", test.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if f.Name != test.expectedName {
+				t.Fatalf("expected name %s, got %s", test.expectedName, f.Name)
+			}
+			if !f.IsMetaFile() {
+				t.Fatal("expected metafile")
+			}
+			actual, readErr := ioutil.ReadAll(f)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			expected := test.expected
+			if expected == nil {
+				expected = test.input
+			}
+			if !bytes.Equal(expected, actual) {
+				t.Fatalf("expected %s, got %s", expected, actual)
+			}
+			if err := f.Validate(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFile_OnPartialRead(t *testing.T) {
+	type call struct {
+		name  string
+		read  int64
+		total int64
+	}
+	table := map[string]struct {
+		name     string
+		read     int
+		seek     bool
+		expected []call
+	}{
+		"partial reads of datafiles are reported": {
+			name:     "test",
+			read:     2,
+			expected: []call{{"test", 2, 4}},
+		},
+		"complete reads are not reported": {
+			name: "test",
+			read: 4,
+		},
+		"unread files are not reported": {
+			name: "test",
+			read: 0,
+		},
+		"seeking back to the start resets the position": {
+			name: "test",
+			read: 4,
+			seek: true,
+		},
+		"partial reads of metafiles are not reported": {
+			name: file.MetaNameFrom("test"),
+			read: 2,
+		},
+	}
+	var logged bytes.Buffer
+	file.SetPartialReadLogger(log.New(&logged, "", 0))
+	t.Cleanup(func() { file.SetPartialReadLogger(nil) })
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			logged.Reset()
+			var calls []call
+			f := &file.File{
+				Name: test.name,
+				Size: 4,
+				Body: bytes.NewReader([]byte("test")),
+				OnPartialRead: func(name string, read int64, total int64) {
+					calls = append(calls, call{name, read, total})
+				},
+			}
+			if _, err := io.ReadFull(f, make([]byte, test.read)); err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			if test.seek {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Only the first close may report the read.
+			f.Close()
+			f.Close()
+			if diff := cmp.Diff(test.expected, calls, cmp.AllowUnexported(call{})); diff != "" {
+				t.Fatal(diff)
+			}
+			var expectedLog string
+			for _, call := range test.expected {
+				expectedLog += fmt.Sprintf("warning: %s closed after reading %d of %d bytes\n", call.name, call.read, call.total)
+			}
+			if diff := cmp.Diff(expectedLog, logged.String()); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestFile_ContentType(t *testing.T) {
+	f, err := file.NewSha256("test", filebuffer.New([]byte("\x89PNG\r\n\x1a\n\x00\x00")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	actual, err := f.ContentType()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != "image/png" {
+		t.Fatalf("expected image/png, got %s", actual)
+	}
+	if _, err := file.NewStub("test", 0, time.Now()).ContentType(); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected %s for file without seekable body, got %v", os.ErrInvalid, err)
+	}
+}
+
+func TestNewErrorsIncludeSource(t *testing.T) {
+	source := "path/to/source"
+	closed := filebuffer.New([]byte("test"))
+	closed.Close()
+	table := map[string]func() error{
+		"hashing failure": func() error {
+			_, err := file.New(source, closed, time.Now(), file.Sha256)
+			return err
+		},
+		"metadata content": func() error {
+			_, err := file.NewFromBytes(source, []byte(`{"meta":{"file":"test"}}`), file.Sha256)
+			return err
+		},
+		"invalid metafile": func() error {
+			_, err := file.NewMetaFromBytes(source, []byte(`{"other":true}`))
+			return err
+		},
+		"metafile without file name": func() error {
+			_, err := file.NewMetaFromBytes(source, []byte(`{"meta":{"memorybox":true}}`))
+			return err
+		},
+	}
+	for name, fn := range table {
+		fn := fn
+		t.Run(name, func(t *testing.T) {
+			err := fn()
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), "source "+source+":") {
+				t.Fatalf("expected error to include source, got %s", err)
+			}
+		})
+	}
+}
+
+func TestFile_Checksum(t *testing.T) {
+	content := []byte("test")
+	table := map[string]string{
+		"md5":    "098f6bcd4621d373cade4e832627b4f6",
+		"sha1":   "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3",
+		"sha256": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		"crc32":  "d87f7e0c",
+	}
+	for algo, expected := range table {
+		algo, expected := algo, expected
+		t.Run(algo, func(t *testing.T) {
+			f, err := file.NewSha256("test", filebuffer.New(content), time.Now())
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			actual, err := f.Checksum(algo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != expected {
+				t.Fatalf("expected %s, got %s", expected, actual)
+			}
+		})
+	}
+	t.Run("sha256 matches the name of a datafile", func(t *testing.T) {
+		f, err := file.NewSha256("test", filebuffer.New(content), time.Now())
+		if err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		actual, err := f.Checksum("sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := strings.TrimSuffix(f.Name, hash.Sha256Suffix); actual != expected {
+			t.Fatalf("expected %s, got %s", expected, actual)
+		}
+		// The body is rewound so it can still be read in full.
+		data, readErr := ioutil.ReadAll(f)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if !bytes.Equal(content, data) {
+			t.Fatalf("expected %s, got %s", content, data)
+		}
+	})
+	t.Run("results are cached", func(t *testing.T) {
+		body := filebuffer.New(content)
+		f, err := file.NewSha256("test", body, time.Now())
+		if err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		first, err := f.Checksum("md5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+		second, err := f.Checksum("md5")
+		if err != nil {
+			t.Fatalf("expected cached result without reading, got %s", err)
+		}
+		if first != second {
+			t.Fatalf("expected %s, got %s", first, second)
+		}
+	})
+	t.Run("metafiles use canonical metadata", func(t *testing.T) {
+		f, err := file.NewMetaFromBytes("", []byte(`{"meta":{"memorybox":true,"file":"test"}}`))
+		if err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		canonical, _ := f.Meta.Canonical()
+		expected, _, _ := file.Sha256(bytes.NewReader(canonical))
+		actual, err := f.Checksum("sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != strings.TrimSuffix(expected, hash.Sha256Suffix) {
+			t.Fatalf("expected %s, got %s", expected, actual)
+		}
+	})
+	t.Run("unsupported algorithm", func(t *testing.T) {
+		if _, err := file.NewStub("test", 0, time.Now()).Checksum("md4"); !errors.Is(err, os.ErrInvalid) {
+			t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+		}
+	})
+}
+
+func TestFile_ConcurrentMeta(t *testing.T) {
+	f, err := file.NewSha256("test", bytes.NewReader(bytes.Repeat([]byte("test"), 1024)), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			f.MetaSet(key, "value")
+		}()
+		go func() {
+			defer wg.Done()
+			f.MetaGet(key)
+			f.MetaBytes()
+		}()
+		go func() {
+			defer wg.Done()
+			f.MetaDelete("missing")
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ioutil.ReadAll(f)
+		f.Close()
+	}()
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		if actual := f.MetaGet(fmt.Sprintf("key%d", i)); actual != "value" {
+			t.Fatalf("expected key%d to be value, got %v", i, actual)
+		}
+	}
+}
+
+func TestFile_Freeze(t *testing.T) {
+	f := file.NewStub("test", 0, time.Now())
+	if err := f.MetaSet("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	f.Freeze()
+	if err := f.MetaSet("key", "changed"); !errors.Is(err, file.ErrFrozen) {
+		t.Fatalf("expected %s, got %v", file.ErrFrozen, err)
+	}
+	if err := f.MetaDelete("key"); !errors.Is(err, file.ErrFrozen) {
+		t.Fatalf("expected %s, got %v", file.ErrFrozen, err)
+	}
+	if err := f.MetaApply(file.MetaFileOptions{Tags: []string{"tag"}}); !errors.Is(err, file.ErrFrozen) {
+		t.Fatalf("expected %s, got %v", file.ErrFrozen, err)
+	}
+	if err := f.MetaSetFromStruct(map[string]string{"key": "changed"}); !errors.Is(err, file.ErrFrozen) {
+		t.Fatalf("expected %s, got %v", file.ErrFrozen, err)
+	}
+	if actual := f.MetaGet("key"); actual != "value" {
+		t.Fatalf("expected frozen metadata to be readable and unchanged, got %v", actual)
+	}
+	if diff := cmp.Diff(map[string]interface{}{"key": "value"}, f.MetaGetAll()); diff != "" {
+		t.Fatal(diff)
+	}
+	clone := f.Clone()
+	if err := clone.MetaSet("key", "changed"); err != nil {
+		t.Fatalf("expected clone to be editable, got %s", err)
+	}
+	if actual := f.MetaGet("key"); actual != "value" {
+		t.Fatalf("expected editing a clone to leave the original alone, got %v", actual)
+	}
+}
+
+func TestFile_MetaSetPath(t *testing.T) {
+	f := file.NewStub("test", 0, time.Now())
+	if err := f.MetaSetPath("labels.env.region", "us-east"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.MetaSetPath("list", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.MetaSetPath("list.0", "first"); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"labels":{"env":{"region":"us-east"}},"list":["first","b"]}`
+	if actual := string(f.MetaBytes()); actual != expected {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+	if actual := f.MetaGetPath("labels.env.region"); actual != "us-east" {
+		t.Fatalf("expected us-east, got %v", actual)
+	}
+	if actual := f.MetaGetPath("list.1"); actual != "b" {
+		t.Fatalf("expected b, got %v", actual)
+	}
+	if actual := f.MetaGetPath("labels.missing"); actual != nil {
+		t.Fatalf("expected missing path to be nil, got %v", actual)
+	}
+	if err := f.MetaDeletePath("labels.env.region"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.MetaDeletePath("list.0"); err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"labels":{"env":{}},"list":["b"]}`
+	if actual := string(f.MetaBytes()); actual != expected {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+	for _, path := range []string{file.MetaKey, file.MetaKeyFileName, file.MetaKeyImportSource} {
+		if err := f.MetaSetPath(path, "changed"); !errors.Is(err, file.ErrManagedPath) {
+			t.Fatalf("expected setting %s to fail with %s, got %v", path, file.ErrManagedPath, err)
+		}
+		if err := f.MetaDeletePath(path); !errors.Is(err, file.ErrManagedPath) {
+			t.Fatalf("expected deleting %s to fail with %s, got %v", path, file.ErrManagedPath, err)
+		}
+	}
+	if err := f.MetaSetPath("metadata.note", "users own this"); err != nil {
+		t.Fatalf("expected keys only sharing a prefix with %s to be settable, got %s", file.MetaKey, err)
+	}
+	f.Freeze()
+	if err := f.MetaSetPath("labels.env", "prod"); !errors.Is(err, file.ErrFrozen) {
+		t.Fatalf("expected %s, got %v", file.ErrFrozen, err)
+	}
+	if err := f.MetaDeletePath("list"); !errors.Is(err, file.ErrFrozen) {
+		t.Fatalf("expected %s, got %v", file.ErrFrozen, err)
+	}
+}
+
+func TestFile_MetaAppend(t *testing.T) {
+	table := map[string]struct {
+		meta        string
+		value       interface{}
+		expected    string
+		expectedErr error
+	}{
+		"missing key becomes an array": {
+			meta:     `{}`,
+			value:    "fetch",
+			expected: `{"pipeline":["fetch"]}`,
+		},
+		"single element array": {
+			meta:     `{"pipeline":["fetch"]}`,
+			value:    "resize",
+			expected: `{"pipeline":["fetch","resize"]}`,
+		},
+		"multiple element array": {
+			meta:     `{"pipeline":["fetch","resize"]}`,
+			value:    map[string]int{"step": 3},
+			expected: `{"pipeline":["fetch","resize",{"step":3}]}`,
+		},
+		"non-array value": {
+			meta:        `{"pipeline":"fetch"}`,
+			value:       "resize",
+			expected:    `{"pipeline":"fetch"}`,
+			expectedErr: file.ErrNotAnArray,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			f := file.NewStub("test", 0, time.Now())
+			meta := file.Meta(test.meta)
+			f.Meta = &meta
+			if err := f.MetaAppend("pipeline", test.value); !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+			if actual := string(f.MetaBytes()); actual != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, actual)
+			}
+		})
+	}
+	f := file.NewStub("test", 0, time.Now())
+	if err := f.MetaAppend(file.MetaKeyImportSource, "source"); !errors.Is(err, file.ErrManagedPath) {
+		t.Fatalf("expected %s, got %v", file.ErrManagedPath, err)
+	}
+	f.Freeze()
+	if err := f.MetaAppend("pipeline", "fetch"); !errors.Is(err, file.ErrFrozen) {
+		t.Fatalf("expected %s, got %v", file.ErrFrozen, err)
+	}
+}
+
+func TestFile_ExpiresIn(t *testing.T) {
+	f, err := file.NewSha256("test", bytes.NewReader([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	expected := time.Now().Add(24 * time.Hour)
+	if f.ExpiresIn(24*time.Hour) != f {
+		t.Fatal("expected ExpiresIn to return the file")
+	}
+	value, ok := f.MetaGet(file.MetaKeyExpiresAt).(string)
+	if !ok {
+		t.Fatalf("expected %s to be set, got %v", file.MetaKeyExpiresAt, f.MetaGet(file.MetaKeyExpiresAt))
+	}
+	actual, parseErr := time.Parse(time.RFC3339, value)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	if diff := actual.Sub(expected); diff < -time.Minute || diff > time.Minute {
+		t.Fatalf("expected expiry near %s, got %s", expected, actual)
+	}
+	at := time.Date(2030, 1, 1, 0, 0, 0, 0, time.FixedZone("test", 3600))
+	f.ExpiresAt(at)
+	if actual := f.MetaGet(file.MetaKeyExpiresAt); actual != "2029-12-31T23:00:00Z" {
+		t.Fatalf("expected expiry in UTC, got %v", actual)
+	}
+	meta, metaErr := file.NewMetaFromBytes("test", f.MetaBytes())
+	if metaErr != nil {
+		t.Fatalf("test setup: %s", metaErr)
+	}
+	before := string(meta.MetaBytes())
+	meta.ExpiresIn(time.Hour)
+	if after := string(meta.MetaBytes()); before != after {
+		t.Fatalf("expected metafile to be unchanged, got %s", after)
+	}
+}
+
+func TestFile_MetaRange(t *testing.T) {
+	f := file.NewStub("test", 0, time.Now())
+	f.Meta = &file.Meta{}
+	f.MetaSet("first", "1")
+	f.MetaSet("second", `{"nested":true}`)
+	f.MetaSet("third", "value")
+	var keys []string
+	f.MetaRange(func(key string, _ gjson.Result) bool {
+		keys = append(keys, key)
+		return key != "second"
+	})
+	if diff := cmp.Diff([]string{"first", "second"}, keys); diff != "" {
+		t.Fatal(diff)
+	}
+	expected := map[string]interface{}{
+		"first":  float64(1),
+		"second": map[string]interface{}{"nested": true},
+		"third":  "value",
+	}
+	if diff := cmp.Diff(expected, f.MetaGetAll()); diff != "" {
+		t.Fatal(diff)
+	}
+	if actual := file.NewStub("empty", 0, time.Now()).MetaGetAll(); len(actual) != 0 {
+		t.Fatalf("expected no keys, got %v", actual)
+	}
+}
+
+func TestFile_HashVerify(t *testing.T) {
+	content := []byte("test content")
+	f, err := file.NewSha256("test", bytes.NewReader(content), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := f.HashVerify(); err != nil {
+		t.Fatalf("expected content to match name: %s", err)
+	}
+	if actual, _ := ioutil.ReadAll(f); !bytes.Equal(content, actual) {
+		t.Fatalf("expected body to be rewound, got %s", actual)
+	}
+	content[0] = 'X'
+	if err := f.HashVerify(); !errors.Is(err, file.ErrHashMismatch) {
+		t.Fatalf("expected %s, got %v", file.ErrHashMismatch, err)
+	}
+	unseekable := &file.File{Name: f.Name, Body: io.MultiReader(strings.NewReader("test content"))}
+	if err := unseekable.HashVerify(); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+	}
+	unnamed := &file.File{Name: "test", Body: strings.NewReader("test")}
+	if err := unnamed.HashVerify(); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+	}
+}
+
+func TestFile_HashVerify_MetaFile(t *testing.T) {
+	data := file.NewStub("abc-sha256", 0, time.Now())
+	meta := file.NewMetaFromFile(data)
+	table := map[string]struct {
+		f           *file.File
+		expectedErr error
+	}{
+		"decoded metadata describing datafile": {
+			f: &file.File{Name: file.MetaNameFrom(data.Name), Meta: meta},
+		},
+		"metadata read from body": {
+			f: &file.File{Name: file.MetaNameFrom(data.Name), Body: bytes.NewReader(*meta)},
+		},
+		"metadata describing another datafile": {
+			f:           &file.File{Name: file.MetaNameFrom("other-sha256"), Meta: meta},
+			expectedErr: file.ErrMetaMismatch,
+		},
+		"invalid metadata": {
+			f:           &file.File{Name: file.MetaNameFrom(data.Name), Body: strings.NewReader("{")},
+			expectedErr: file.ErrInvalidMeta,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			if err := test.f.HashVerify(); !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestFile_MetaSetFromStruct(t *testing.T) {
+	type dimensions struct {
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	}
+	type imageMeta struct {
+		Title      string     `json:"title"`
+		Dimensions dimensions `json:"dimensions"`
+		Managed    string     `json:"meta"`
+	}
+	f := file.NewStub("test", 0, time.Now())
+	f.Meta = file.NewMetaFromFile(f)
+	expected := imageMeta{Title: "test", Dimensions: dimensions{Width: 640, Height: 480}, Managed: "ignored"}
+	if err := f.MetaSetFromStruct(expected); err != nil {
+		t.Fatal(err)
+	}
+	var title string
+	if err := f.MetaGetInto("title", &title); err != nil {
+		t.Fatal(err)
+	}
+	var actual dimensions
+	if err := f.MetaGetInto("dimensions", &actual); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(expected.Dimensions, actual); diff != "" || title != expected.Title {
+		t.Fatalf("expected %s and %v, got %s and %v", expected.Title, expected.Dimensions, title, actual)
+	}
+	if f.Meta.DataFileName() != f.Name {
+		t.Fatalf("expected managed keys to be left alone, got %s", f.Meta)
+	}
+	if err := f.MetaSetFromStruct([]string{"not", "an", "object"}); err == nil {
+		t.Fatal("expected error setting metadata from a non-object")
+	}
+	if err := f.MetaSetFromStruct(func() {}); err == nil {
+		t.Fatal("expected error setting metadata from an unmarshalable value")
+	}
+	if err := f.MetaGetInto("missing", &title); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+	if err := f.MetaGetInto("title", &actual); err == nil {
+		t.Fatal("expected error decoding into mismatched type")
+	}
+}
+
+func TestFile_WriteMetaStream(t *testing.T) {
+	table := map[string]struct {
+		meta        *file.Meta
+		expected    string
+		expectedErr error
+	}{
+		"empty metadata": {
+			meta:     &file.Meta{},
+			expected: "{}\n",
+		},
+		"no metadata": {
+			meta:     nil,
+			expected: "{}\n",
+		},
+		"sorted": {
+			meta:     metaFrom(`{"b": [1, 2], "a": "<x>", "c": {"d": true}}`),
+			expected: `{"a":"<x>","b":[1, 2],"c":{"d": true}}` + "\n",
+		},
+		"keys needing escapes": {
+			meta:     metaFrom(`{"quote\"d":1,"caf\u00e9":2}`),
+			expected: `{"café":2,"quote\"d":1}` + "\n",
+		},
+		"not an object": {
+			meta:        metaFrom(`[1,2]`),
+			expectedErr: file.ErrInvalidMeta,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			f := file.NewStub("test", 0, time.Now())
+			f.Meta = test.meta
+			var actual bytes.Buffer
+			err := f.WriteMetaStream(&actual)
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if actual.String() != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, actual.String())
+			}
+			if !json.Valid(actual.Bytes()) {
+				t.Fatalf("expected valid json, got %s", actual.String())
+			}
+		})
+	}
+}
+
+func metaFrom(data string) *file.Meta {
+	meta := file.Meta(data)
+	return &meta
+}
+
+// newLargeMetaFile produces a file whose metadata holds a vector of floats
+// encoding to roughly size bytes, like an embedding.
+func newLargeMetaFile(size int) *file.File {
+	f := file.NewStub("test", 0, time.Now())
+	vector := make([]float64, size/20)
+	for i := range vector {
+		vector[i] = float64(i) / 3
+	}
+	f.Meta = &file.Meta{}
+	f.MetaSetPath("embedding", vector)
+	f.MetaSetPath("title", "test")
+	return f
+}
+
+func TestFile_WriteMetaStream_Allocations(t *testing.T) {
+	f := newLargeMetaFile(1 << 20)
+	metaSize := int64(len(f.MetaBytes()))
+	result := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := f.WriteMetaStream(ioutil.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	// Parsing copies the metadata once; anything near a second copy means
+	// the object is being decoded or re-encoded.
+	if limit := metaSize + metaSize/2; result.AllocedBytesPerOp() > limit {
+		t.Fatalf("expected at most %d bytes allocated for %d bytes of metadata, got %d", limit, metaSize, result.AllocedBytesPerOp())
+	}
+}
+
+func BenchmarkFile_WriteMetaStream(b *testing.B) {
+	for _, size := range []int{1 << 10, 1 << 20} {
+		f := newLargeMetaFile(size)
+		b.Run(fmt.Sprintf("WriteMetaStream/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(f.MetaBytes())))
+			for i := 0; i < b.N; i++ {
+				if err := f.WriteMetaStream(ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("json.Marshal/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(f.MetaBytes())))
+			for i := 0; i < b.N; i++ {
+				encoded, err := json.Marshal(f.MetaGetAll())
+				if err != nil {
+					b.Fatal(err)
+				}
+				ioutil.Discard.Write(encoded)
+			}
+		})
+	}
+}
+
+func BenchmarkFile_MetaGetAll(b *testing.B) {
+	f := file.NewStub("test", 0, time.Now())
+	f.Meta = &file.Meta{}
+	for i := 0; i < 20; i++ {
+		f.MetaSet(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	b.Run("MetaRange", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f.MetaGetAll()
+		}
+	})
+	b.Run("json.Unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var result map[string]interface{}
+			if err := json.Unmarshal(f.MetaBytes(), &result); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestFile_LocalPath(t *testing.T) {
+	temp, err := ioutil.TempFile("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write([]byte("test")); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	temp.Close()
+	table := map[string]struct {
+		input     func() (*file.File, error)
+		temporary bool
+		expected  string
+	}{
+		"local disk": {
+			input: func() (*file.File, error) {
+				body, err := os.Open(temp.Name())
+				if err != nil {
+					return nil, err
+				}
+				return file.NewSha256(temp.Name(), body, time.Now())
+			},
+			expected: temp.Name(),
+		},
+		"buffered to a temporary file": {
+			input: func() (*file.File, error) {
+				return file.NewFromHTTP(context.Background(), &http.Response{
+					Header: http.Header{},
+					Body:   ioutil.NopCloser(strings.NewReader("test")),
+				}, file.Sha256)
+			},
+			temporary: true,
+		},
+		"in memory": {
+			input: func() (*file.File, error) {
+				return file.NewFromBytes("test", []byte("test"), file.Sha256)
+			},
+		},
+		"metafile": {
+			input: func() (*file.File, error) {
+				body, err := os.Open(temp.Name())
+				if err != nil {
+					return nil, err
+				}
+				f := file.NewStub(file.MetaNameFrom("test-sha256"), 4, time.Now())
+				f.Body = body
+				return f, nil
+			},
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			f, err := test.input()
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			path := f.LocalPath()
+			if f.Filepath() != path {
+				t.Fatalf("expected Filepath to match LocalPath %q, got %q", path, f.Filepath())
+			}
+			if test.temporary {
+				if _, err := os.Stat(path); err != nil {
+					t.Fatalf("expected temporary file to exist, got %s", err)
+				}
+			} else if path != test.expected {
+				t.Fatalf("expected local path %q, got %q", test.expected, path)
+			}
+			f.Close()
+			if _, err := os.Stat(path); test.temporary && !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected temporary file to be removed by close, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFile_WaitForContent(t *testing.T) {
+	temp, err := ioutil.TempFile("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	f := file.NewStub("test", 0, time.Now())
+	f.Body = temp
+	if f.LocalPath() != temp.Name() {
+		t.Fatalf("expected local path %s, got %s", temp.Name(), f.LocalPath())
+	}
+	var written int32
+	go func() {
+		writer, err := os.OpenFile(temp.Name(), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return
+		}
+		defer writer.Close()
+		for i := 0; i < 5; i++ {
+			writer.Write([]byte("test"))
+			time.Sleep(50 * time.Millisecond)
+		}
+		atomic.StoreInt32(&written, 1)
+	}()
+	if err := f.WaitForContent(context.Background(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&written) != 1 {
+		t.Fatal("expected WaitForContent to return after content was written")
+	}
+	info, statErr := os.Stat(temp.Name())
+	if statErr != nil {
+		t.Fatal(statErr)
+	}
+	if info.Size() != 20 {
+		t.Fatalf("expected 20 bytes, got %d", info.Size())
+	}
+}
+
+func TestFile_WaitForContentFailures(t *testing.T) {
+	if err := file.NewStub("test", 0, time.Now()).WaitForContent(context.Background(), time.Second); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+	}
+	temp, err := ioutil.TempFile("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	temp.Close()
+	os.Remove(temp.Name())
+	f := file.NewStub("test", 0, time.Now())
+	f.Body = temp
+	if err := f.WaitForContent(context.Background(), 300*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestFile_DigestAndAlgorithm(t *testing.T) {
+	table := map[string]struct {
+		name              string
+		expectedDigest    string
+		expectedAlgorithm string
+	}{
+		"sha256": {
+			name:              "abc123-sha256",
+			expectedDigest:    "abc123",
+			expectedAlgorithm: "sha256",
+		},
+		"custom suffix": {
+			name:              "abc123-blake3",
+			expectedDigest:    "abc123",
+			expectedAlgorithm: "blake3",
+		},
+		"multiple dashes": {
+			name:              "abc-123-sha3-512",
+			expectedDigest:    "abc-123-sha3",
+			expectedAlgorithm: "512",
+		},
+		"no suffix": {
+			name:              "abc123",
+			expectedDigest:    "abc123",
+			expectedAlgorithm: file.UnknownAlgorithm,
+		},
+		"metafile": {
+			name:              file.MetaNameFrom("abc123-sha256"),
+			expectedDigest:    "abc123",
+			expectedAlgorithm: "sha256",
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			f := file.NewStub(test.name, 0, time.Now())
+			if actual := f.Digest(); actual != test.expectedDigest {
+				t.Fatalf("expected digest %s, got %s", test.expectedDigest, actual)
+			}
+			if actual := f.Algorithm(); actual != test.expectedAlgorithm {
+				t.Fatalf("expected algorithm %s, got %s", test.expectedAlgorithm, actual)
+			}
+		})
+	}
+}
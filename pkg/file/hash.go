@@ -0,0 +1,314 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/tkellen/memorybox/pkg/hash"
+	stdhash "hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// HasherPluginPrefix is the prefix of executables that can be used to hash
+// content with algorithms memorybox does not support natively. A plugin for an
+// algorithm named "foo" must be named "memorybox-hasher-foo". It receives the
+// content to hash on stdin and must emit "<hash>-foo" on stdout.
+const HasherPluginPrefix = "memorybox-hasher-"
+
+var hashers = struct {
+	sync.RWMutex
+	byName      map[string]HashFn
+	digestLen   map[string]int
+	trustedDirs []string
+}{
+	byName: map[string]HashFn{
+		hash.Sha256Algorithm: Sha256,
+	},
+	digestLen: map[string]int{},
+}
+
+// algorithmName matches the names hashing algorithms may have. As the name of
+// an algorithm is taken from the name of an object and used to find a plugin
+// on disk, anything that could escape the trusted directories is refused.
+var algorithmName = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// ErrCorruptName is returned by ValidateDataName for datafile names whose hash
+// cannot have been produced by the algorithm they are named with.
+var ErrCorruptName = errors.New("name is not a valid hash")
+
+// RegisterHasher makes a hashing function available for files named with the
+// supplied algorithm suffix (e.g. "sha256" for "<hash>-sha256").
+func RegisterHasher(name string, fn HashFn) {
+	hashers.Lock()
+	defer hashers.Unlock()
+	hashers.byName[name] = fn
+	delete(hashers.digestLen, name)
+}
+
+// UnregisterHasher removes a hashing function added by RegisterHasher.
+func UnregisterHasher(name string) {
+	hashers.Lock()
+	defer hashers.Unlock()
+	delete(hashers.byName, name)
+	delete(hashers.digestLen, name)
+}
+
+// SetTrustedHasherDirs controls which directories hasher plugins may be loaded
+// from. Plugins are never loaded from anywhere else.
+func SetTrustedHasherDirs(dirs []string) {
+	hashers.Lock()
+	defer hashers.Unlock()
+	hashers.trustedDirs = dirs
+}
+
+// HasherFromFileName finds the hashing function that was used to produce the
+// supplied file name.
+func HasherFromFileName(name string) (HashFn, error) {
+	algo := (&File{Name: name}).Algorithm()
+	if algo == UnknownAlgorithm {
+		return nil, fmt.Errorf("%w: %s has no hash algorithm suffix", os.ErrInvalid, DataNameFrom(name))
+	}
+	return HasherByName(algo)
+}
+
+// knownDigestLen holds the number of hex characters in digests produced by
+// common algorithms, so names using them can be validated without a hasher.
+var knownDigestLen = map[string]int{
+	"md5":                32,
+	"sha1":               40,
+	"sha224":             56,
+	hash.Sha256Algorithm: 64,
+	"sha384":             96,
+	"sha512":             128,
+}
+
+// ValidateDataName determines if the name of a datafile is a hash which could
+// have been produced by the algorithm it is suffixed with: lowercase hex of
+// the length that algorithm produces. No content is read, so this is much
+// faster than rehashing, though it cannot detect content that has changed.
+// The length is taken from knownDigestLen or learned from a registered
+// hasher; plugins are never run, as the algorithm comes from the name being
+// validated.
+func ValidateDataName(name string) error {
+	f := &File{Name: name}
+	algo := f.Algorithm()
+	if algo == UnknownAlgorithm {
+		return fmt.Errorf("%w: %s has no hash algorithm suffix", os.ErrInvalid, DataNameFrom(name))
+	}
+	if !algorithmName.MatchString(algo) {
+		return fmt.Errorf("%w: invalid hash algorithm %q", os.ErrInvalid, algo)
+	}
+	digest := f.Digest()
+	if _, err := hex.DecodeString(digest); err != nil || strings.ToLower(digest) != digest {
+		return fmt.Errorf("%w: %s is not lowercase hex", ErrCorruptName, name)
+	}
+	length, err := digestLen(algo)
+	if err != nil {
+		return err
+	}
+	if len(digest) != length {
+		return fmt.Errorf("%w: %s has %d characters, %s produces %d", ErrCorruptName, name, len(digest), algo, length)
+	}
+	return nil
+}
+
+// digestLen finds the number of characters in digests produced by an
+// algorithm. The length of a registered hasher is learned by hashing nothing.
+func digestLen(algo string) (int, error) {
+	if length, ok := knownDigestLen[algo]; ok {
+		return length, nil
+	}
+	hashers.RLock()
+	length, learned := hashers.digestLen[algo]
+	hasher, registered := hashers.byName[algo]
+	hashers.RUnlock()
+	if learned {
+		return length, nil
+	}
+	if !registered {
+		return 0, fmt.Errorf("%w: no registered hasher for %s", os.ErrNotExist, algo)
+	}
+	empty, _, err := hasher(bytes.NewReader(nil))
+	if err != nil {
+		return 0, err
+	}
+	length = len((&File{Name: empty}).Digest())
+	hashers.Lock()
+	hashers.digestLen[algo] = length
+	hashers.Unlock()
+	return length, nil
+}
+
+// HasherByName finds the hashing function for an algorithm. Algorithms which
+// have not been registered are looked up as plugins in the trusted hasher
+// directories. Only names of lowercase letters and digits are accepted.
+func HasherByName(algo string) (HashFn, error) {
+	return HasherByNameWithContext(context.Background(), algo)
+}
+
+// HasherByNameWithContext finds the hashing function for an algorithm like
+// HasherByName. Plugins it finds are killed if the context is cancelled while
+// they are running.
+func HasherByNameWithContext(ctx context.Context, algo string) (HashFn, error) {
+	if !algorithmName.MatchString(algo) {
+		return nil, fmt.Errorf("%w: invalid hash algorithm %q", os.ErrInvalid, algo)
+	}
+	hashers.RLock()
+	fn, ok := hashers.byName[algo]
+	dirs := hashers.trustedDirs
+	hashers.RUnlock()
+	if ok {
+		return fn, nil
+	}
+	return NewPluginHasherWithContext(ctx, algo, dirs)
+}
+
+// NewPluginHasher produces a hashing function that invokes an external
+// executable named HasherPluginPrefix+name found in one of the supplied
+// directories. Only names of lowercase letters and digits are accepted.
+func NewPluginHasher(name string, dirs []string) (HashFn, error) {
+	return NewPluginHasherWithContext(context.Background(), name, dirs)
+}
+
+// NewPluginHasherWithContext produces a hashing function like NewPluginHasher
+// whose executable is killed if the context is cancelled while it is running.
+func NewPluginHasherWithContext(ctx context.Context, name string, dirs []string) (HashFn, error) {
+	if !algorithmName.MatchString(name) {
+		return nil, fmt.Errorf("%w: invalid hash algorithm %q", os.ErrInvalid, name)
+	}
+	executable := HasherPluginPrefix + name
+	if runtime.GOOS == "windows" {
+		executable = executable + ".exe"
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, executable)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return pluginHasher(ctx, path, name), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no hasher for %s found in trusted directories", os.ErrNotExist, name)
+}
+
+func pluginHasher(ctx context.Context, path string, name string) HashFn {
+	return func(source io.Reader) (string, int64, error) {
+		var stdout, stderr bytes.Buffer
+		input := &countingReader{Reader: source}
+		cmd := exec.CommandContext(ctx, path)
+		cmd.Stdin = input
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return "", 0, fmt.Errorf("%s: %w", path, ctxErr)
+			}
+			return "", 0, fmt.Errorf("%s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+		}
+		digest := strings.TrimSpace(stdout.String())
+		if !strings.HasSuffix(digest, "-"+name) {
+			return "", 0, fmt.Errorf("%s: output %q is missing -%s suffix", path, digest, name)
+		}
+		return digest, input.count, nil
+	}
+}
+
+// countingReader tracks how many bytes have been read through it.
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count = r.count + int64(n)
+	return n, err
+}
+
+// ContextCheckInterval is the number of bytes read by NewWithContext between
+// checks for cancellation of its context.
+var ContextCheckInterval int64 = 4 * 1024
+
+// contextAwareReader stops reading with the error of a context once it is
+// cancelled. The context is checked before the first read and again after
+// every interval bytes; reads are shortened so no more than that are read
+// between checks.
+type contextAwareReader struct {
+	ctx       context.Context
+	reader    io.Reader
+	interval  int64
+	unchecked int64
+}
+
+func newContextAwareReader(ctx context.Context, reader io.Reader) *contextAwareReader {
+	interval := ContextCheckInterval
+	if interval < 1 {
+		interval = 1
+	}
+	return &contextAwareReader{
+		ctx:       ctx,
+		reader:    reader,
+		interval:  interval,
+		unchecked: interval,
+	}
+}
+
+func (r *contextAwareReader) Read(p []byte) (int, error) {
+	if r.unchecked >= r.interval {
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		r.unchecked = 0
+	}
+	if remaining := r.interval - r.unchecked; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.unchecked = r.unchecked + int64(n)
+	return n, err
+}
+
+// StreamingHasher computes a message digest of everything read through it.
+// This allows content to be hashed and consumed in a single pass.
+type StreamingHasher struct {
+	reader    io.Reader
+	digest    stdhash.Hash
+	algorithm string
+	size      int64
+}
+
+// NewStreamingHasher wraps source so everything read from it is also written
+// to digest. The algorithm is used as the suffix of the resulting name.
+func NewStreamingHasher(source io.Reader, digest stdhash.Hash, algorithm string) *StreamingHasher {
+	return &StreamingHasher{
+		reader:    io.TeeReader(source, digest),
+		digest:    digest,
+		algorithm: algorithm,
+	}
+}
+
+// NewSha256StreamingHasher wraps source so it is hashed with sha256 as it is
+// read. The result matches what Sha256 produces for the same content.
+func NewSha256StreamingHasher(source io.Reader) *StreamingHasher {
+	return NewStreamingHasher(source, hash.NewSha256(), hash.Sha256Algorithm)
+}
+
+// Read reads from the underlying source, hashing everything it returns.
+func (h *StreamingHasher) Read(p []byte) (int, error) {
+	n, err := h.reader.Read(p)
+	h.size = h.size + int64(n)
+	return n, err
+}
+
+// Sum returns the digest and size of everything read so far. It must only be
+// called once the source is exhausted to describe its full content.
+func (h *StreamingHasher) Sum() (string, int64) {
+	return hex.EncodeToString(h.digest.Sum(nil)) + "-" + h.algorithm, h.size
+}
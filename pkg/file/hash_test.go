@@ -0,0 +1,281 @@
+package file_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/mattetti/filebuffer"
+	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain allows the test binary to act as a hasher plugin when it is invoked
+// under a plugin name.
+func TestMain(m *testing.M) {
+	base := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	if strings.HasPrefix(base, file.HasherPluginPrefix) {
+		digest := hash.NewSha256()
+		if _, err := io.Copy(digest, os.Stdin); err != nil {
+			fmt.Fprint(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s-%s\n", hex.EncodeToString(digest.Sum(nil)), strings.TrimPrefix(base, file.HasherPluginPrefix))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// installPlugin copies the test binary into a temporary directory under the
+// name of a hasher plugin.
+func installPlugin(t *testing.T, name string) string {
+	dir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	content, err := ioutil.ReadFile(self)
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	executable := file.HasherPluginPrefix + name
+	if runtime.GOOS == "windows" {
+		executable = executable + ".exe"
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, executable), content, 0755); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	return dir
+}
+
+func TestHasherFromFileName(t *testing.T) {
+	pluginDir := installPlugin(t, "fake")
+	defer os.RemoveAll(pluginDir)
+	content := []byte("test")
+	sha256Digest, _, _ := file.Sha256(bytes.NewReader(content))
+	fakeDigest := strings.TrimSuffix(sha256Digest, hash.Sha256Suffix) + "-fake"
+	file.RegisterHasher("registered", func(source io.Reader) (string, int64, error) {
+		return "static-registered", 0, nil
+	})
+	t.Cleanup(func() { file.UnregisterHasher("registered") })
+	table := map[string]struct {
+		name        string
+		trustedDirs []string
+		expected    string
+		expectedErr error
+	}{
+		"builtin sha256": {
+			name:     sha256Digest,
+			expected: sha256Digest,
+		},
+		"metafile names resolve to the hasher of their datafile": {
+			name:     file.MetaNameFrom(sha256Digest),
+			expected: sha256Digest,
+		},
+		"programmatically registered hasher": {
+			name:     "whatever-registered",
+			expected: "static-registered",
+		},
+		"plugin in trusted directory": {
+			name:        fakeDigest,
+			trustedDirs: []string{pluginDir},
+			expected:    fakeDigest,
+		},
+		"plugin outside trusted directories is not loaded": {
+			name:        fakeDigest,
+			trustedDirs: []string{os.TempDir()},
+			expectedErr: os.ErrNotExist,
+		},
+		"names without an algorithm suffix fail": {
+			name:        "nosuffix",
+			expectedErr: os.ErrInvalid,
+		},
+		"algorithms escaping trusted directories fail": {
+			name:        "x-/../../../usr/bin/env",
+			trustedDirs: []string{pluginDir},
+			expectedErr: os.ErrInvalid,
+		},
+		"algorithms naming a relative path fail": {
+			name:        "x-fake/../fake",
+			trustedDirs: []string{pluginDir},
+			expectedErr: os.ErrInvalid,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			file.SetTrustedHasherDirs(test.trustedDirs)
+			defer file.SetTrustedHasherDirs(nil)
+			fn, err := file.HasherFromFileName(test.name)
+			if err != nil && test.expectedErr == nil {
+				t.Fatal(err)
+			}
+			if err != nil && test.expectedErr != nil && !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error: %s, got %s", test.expectedErr, err)
+			}
+			if err == nil {
+				actual, _, hashErr := fn(bytes.NewReader(content))
+				if hashErr != nil {
+					t.Fatal(hashErr)
+				}
+				if diff := cmp.Diff(test.expected, actual); diff != "" {
+					t.Fatal(diff)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateDataName(t *testing.T) {
+	digest := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	file.RegisterHasher("short", func(source io.Reader) (string, int64, error) {
+		return "0123abcd-short", 0, nil
+	})
+	t.Cleanup(func() { file.UnregisterHasher("short") })
+	// A plugin in a trusted directory must not be run to validate a name, as
+	// the name chooses which plugin that would be.
+	pluginDir := installPlugin(t, "fake")
+	t.Cleanup(func() { os.RemoveAll(pluginDir) })
+	file.SetTrustedHasherDirs([]string{pluginDir})
+	t.Cleanup(func() { file.SetTrustedHasherDirs(nil) })
+	table := map[string]struct {
+		name        string
+		expectedErr error
+	}{
+		"valid sha256 names are accepted": {
+			name: digest + hash.Sha256Suffix,
+		},
+		"metafile names are validated by their datafile name": {
+			name: file.MetaNameFrom(digest + hash.Sha256Suffix),
+		},
+		"lengths come from the algorithm": {
+			name: "89abcdef-short",
+		},
+		"truncated hashes are corrupt": {
+			name:        digest[:40] + hash.Sha256Suffix,
+			expectedErr: file.ErrCorruptName,
+		},
+		"overly long hashes are corrupt": {
+			name:        digest + "00-sha256",
+			expectedErr: file.ErrCorruptName,
+		},
+		"hashes of the length of another algorithm are corrupt": {
+			name:        digest + "-short",
+			expectedErr: file.ErrCorruptName,
+		},
+		"non hex hashes are corrupt": {
+			name:        strings.Replace(digest, "b", "z", 1) + hash.Sha256Suffix,
+			expectedErr: file.ErrCorruptName,
+		},
+		"uppercase hashes are corrupt": {
+			name:        strings.ToUpper(digest) + hash.Sha256Suffix,
+			expectedErr: file.ErrCorruptName,
+		},
+		"unknown algorithms fail": {
+			name:        digest + "-nope",
+			expectedErr: os.ErrNotExist,
+		},
+		"known algorithms are validated without a hasher": {
+			name: digest[:40] + "-sha1",
+		},
+		"plugins are not run": {
+			name:        digest + "-fake",
+			expectedErr: os.ErrNotExist,
+		},
+		"invalid algorithms fail": {
+			name:        digest + "-FAKE",
+			expectedErr: os.ErrInvalid,
+		},
+		"names without an algorithm fail": {
+			name:        digest,
+			expectedErr: os.ErrInvalid,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			if err := file.ValidateDataName(test.name); !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestNewPluginHasher(t *testing.T) {
+	pluginDir := installPlugin(t, "fake")
+	defer os.RemoveAll(pluginDir)
+	content := []byte("plugin content")
+	hasher, err := file.NewPluginHasher("fake", []string{pluginDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, newErr := file.New("test", filebuffer.New(content), time.Now(), hasher)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	if !strings.HasSuffix(f.Name, "-fake") {
+		t.Fatalf("expected name hashed by plugin, got %s", f.Name)
+	}
+	if f.Size != int64(len(content)) {
+		t.Fatalf("expected size %d, got %d", len(content), f.Size)
+	}
+	for _, name := range []string{"../fake", "FAKE", ""} {
+		if _, err := file.NewPluginHasher(name, []string{pluginDir}); !errors.Is(err, os.ErrInvalid) {
+			t.Fatalf("expected %q to fail with %s, got %v", name, os.ErrInvalid, err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled, err := file.NewPluginHasherWithContext(ctx, "fake", []string{pluginDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cancelled(bytes.NewReader(content)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %s, got %v", context.Canceled, err)
+	}
+}
+
+func TestStreamingHasher(t *testing.T) {
+	table := map[string][]byte{
+		"empty": {},
+		"small": []byte("test"),
+		"large": bytes.Repeat([]byte("test"), 1<<16),
+	}
+	for name, content := range table {
+		content := content
+		t.Run(name, func(t *testing.T) {
+			expectedName, expectedSize, err := file.Sha256(bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			hasher := file.NewSha256StreamingHasher(bytes.NewReader(content))
+			actual, readErr := ioutil.ReadAll(hasher)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if !bytes.Equal(content, actual) {
+				t.Fatal("expected content to pass through unchanged")
+			}
+			actualName, actualSize := hasher.Sum()
+			if diff := cmp.Diff(expectedName, actualName); diff != "" {
+				t.Fatal(diff)
+			}
+			if diff := cmp.Diff(expectedSize, actualSize); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/tkellen/memorybox/pkg/mimetype"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// NewFromHTTP creates a new instance of a file from the body of a http
+// response. The body is hashed while it is buffered to a temporary file, which
+// is removed when the file is closed. The response body is always closed. The
+// source is the url of the request and the last modified time is taken from
+// the response headers, falling back to the current time.
+func NewFromHTTP(ctx context.Context, resp *http.Response, hash HashFn) (*File, error) {
+	defer resp.Body.Close()
+	source := ""
+	if resp.Request != nil && resp.Request.URL != nil {
+		source = resp.Request.URL.String()
+	}
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		lastModified = time.Now()
+	}
+	temp, tempErr := ioutil.TempFile(os.TempDir(), "memorybox-http-*")
+	if tempErr != nil {
+		return nil, fmt.Errorf("source %s: %w", source, tempErr)
+	}
+	cleanup := func(err error) (*File, error) {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, fmt.Errorf("source %s: %w", source, err)
+	}
+	digest, size, hashErr := hash(io.TeeReader(resp.Body, temp))
+	if hashErr != nil {
+		return cleanup(hashErr)
+	}
+	if err := ctx.Err(); err != nil {
+		return cleanup(err)
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return cleanup(err)
+	}
+	f, err := newHashed(source, temp, lastModified, digest, size)
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, err
+	}
+	f.tempPath = temp.Name()
+	return f, nil
+}
+
+// ToHTTPResponse writes the file as the body of a http response after setting
+// its Content-Type, Content-Length, ETag and Last-Modified headers. Datafiles
+// stream their content from the start, rewinding seekable bodies first, and use
+// their name, the digest of their content, as the ETag. Bodies which cannot be
+// rewound must not have been read from already. Metafiles are written as JSON
+// and use the sha256 checksum of their canonical form as the ETag.
+func (f *File) ToHTTPResponse(w http.ResponseWriter) error {
+	var contentType, etag string
+	var body io.Reader
+	var size int64
+	if f.IsMetaFile() {
+		checksum, err := f.Checksum("sha256")
+		if err != nil {
+			return err
+		}
+		meta := f.MetaBytes()
+		contentType = "application/json"
+		etag = checksum
+		body = bytes.NewReader(meta)
+		size = int64(len(meta))
+	} else {
+		var err error
+		if _, ok := f.Body.(io.Seeker); ok {
+			if _, err = f.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+			contentType, err = f.ContentType()
+		} else {
+			contentType, err = f.sniffUnread()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		etag = f.Name
+		body = f
+		size = f.Size
+	}
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+	header.Set("ETag", `"`+etag+`"`)
+	header.Set("Last-Modified", f.LastModified.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	_, err := io.Copy(w, body)
+	return err
+}
+
+// sniffUnread detects the mime type of a body which cannot be seeked, keeping
+// what was read to do so at the front of the body. It fails if any of the
+// body was read before as that content cannot be recovered.
+func (f *File) sniffUnread() (string, error) {
+	f.mu.RLock()
+	read := f.bytesRead
+	f.mu.RUnlock()
+	if read > 0 {
+		return "", fmt.Errorf("%w: %d bytes were read from a body which cannot be rewound", os.ErrInvalid, read)
+	}
+	head, err := f.head(mimetype.SniffLen)
+	if err != nil {
+		return "", err
+	}
+	return mimetype.Detect(bytes.NewReader(head))
+}
@@ -0,0 +1,171 @@
+package file_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/tkellen/memorybox/pkg/file"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewFromHTTP(t *testing.T) {
+	content := []byte("test")
+	lastModified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dated" {
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+	expectedName, _, _ := file.Sha256(bytes.NewReader(content))
+	table := map[string]struct {
+		path             string
+		expectedModified func(time.Time) bool
+	}{
+		"last modified from headers": {
+			path:             "/dated",
+			expectedModified: func(actual time.Time) bool { return actual.Equal(lastModified) },
+		},
+		"last modified defaults to now": {
+			path:             "/undated",
+			expectedModified: func(actual time.Time) bool { return time.Since(actual) < time.Minute },
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + test.path)
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			f, err := file.NewFromHTTP(context.Background(), resp, file.Sha256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Name != expectedName {
+				t.Fatalf("expected name %s, got %s", expectedName, f.Name)
+			}
+			if expected := server.URL + test.path; f.Source != expected {
+				t.Fatalf("expected source %s, got %s", expected, f.Source)
+			}
+			if !test.expectedModified(f.LastModified) {
+				t.Fatalf("unexpected last modified time %s", f.LastModified)
+			}
+			actual, readErr := ioutil.ReadAll(f)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if !bytes.Equal(content, actual) {
+				t.Fatalf("expected %s, got %s", content, actual)
+			}
+			temp := f.Body.(*os.File).Name()
+			f.Close()
+			if _, err := os.Stat(temp); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected temp file to be removed on close, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewFromHTTPHashError(t *testing.T) {
+	expected := errors.New("hash failed")
+	resp := &http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte("test")))}
+	_, err := file.NewFromHTTP(context.Background(), resp, func(io.Reader) (string, int64, error) {
+		return "", 0, expected
+	})
+	if !errors.Is(err, expected) {
+		t.Fatalf("expected %s, got %v", expected, err)
+	}
+}
+
+func TestFile_ToHTTPResponse(t *testing.T) {
+	lastModified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	content := []byte("<html><body>test</body></html>")
+	data, err := file.NewSha256("test", bytes.NewReader(content), lastModified)
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	meta := file.NewStub(file.MetaNameFrom(data.Name), 0, lastModified)
+	meta.Meta = file.NewMetaFromFile(data)
+	metaChecksum, err := meta.Checksum("sha256")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	table := map[string]struct {
+		f               *file.File
+		expectedHeaders map[string]string
+		expectedBody    []byte
+	}{
+		"datafile": {
+			f: data,
+			expectedHeaders: map[string]string{
+				"Content-Type":   "text/html; charset=utf-8",
+				"Content-Length": strconv.Itoa(len(content)),
+				"ETag":           `"` + data.Name + `"`,
+				"Last-Modified":  "Wed, 01 Jan 2020 00:00:00 GMT",
+			},
+			expectedBody: content,
+		},
+		"metafile": {
+			f: meta,
+			expectedHeaders: map[string]string{
+				"Content-Type":   "application/json",
+				"Content-Length": strconv.Itoa(len(meta.MetaBytes())),
+				"ETag":           `"` + metaChecksum + `"`,
+				"Last-Modified":  "Wed, 01 Jan 2020 00:00:00 GMT",
+			},
+			expectedBody: meta.MetaBytes(),
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			if err := test.f.ToHTTPResponse(recorder); err != nil {
+				t.Fatal(err)
+			}
+			for header, expected := range test.expectedHeaders {
+				if actual := recorder.Header().Get(header); actual != expected {
+					t.Fatalf("expected %s %q, got %q", header, expected, actual)
+				}
+			}
+			if !bytes.Equal(recorder.Body.Bytes(), test.expectedBody) {
+				t.Fatalf("expected body %q, got %q", test.expectedBody, recorder.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestFile_ToHTTPResponse_PartlyRead(t *testing.T) {
+	content := []byte("<html><body>test</body></html>")
+	seekable, err := file.NewSha256("test", bytes.NewReader(content), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if _, err := seekable.Read(make([]byte, 5)); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	recorder := httptest.NewRecorder()
+	if err := seekable.ToHTTPResponse(recorder); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recorder.Body.Bytes(), content) {
+		t.Fatalf("expected body %q, got %q", content, recorder.Body.Bytes())
+	}
+	unseekable := file.NewStub("test", int64(len(content)), time.Now())
+	unseekable.Body = ioutil.NopCloser(bytes.NewReader(content))
+	if _, err := unseekable.Read(make([]byte, 5)); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := unseekable.ToHTTPResponse(httptest.NewRecorder()); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+	}
+}
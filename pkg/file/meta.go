@@ -1,10 +1,12 @@
 package file
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
+	"io"
 	"strings"
 	"time"
 )
@@ -40,18 +42,52 @@ const MetaKeyImport = MetaKey + ".import"
 // into the store.
 const MetaKeyImportSource = MetaKeyImport + ".source"
 
+// MetaKeyImportAt refers to the location where memorybox stores the RFC3339
+// time at which a file was imported.
+const MetaKeyImportAt = MetaKeyImport + ".at"
+
 // MetaKeyImportSet refers to the location where memorybox stores details about
 // what grouping of files a given file was imported with.
 const MetaKeyImportSet = MetaKeyImport + ".set"
 
+// MetaKeySchemaVersion refers to the location where memorybox stores the
+// version of the metadata format a metafile was written with. Metafiles that
+// lack it are considered to be version 1.
+const MetaKeySchemaVersion = MetaKey + ".schemaVersion"
+
+// MetaKeyPreviousName refers to the location where memorybox stores the name a
+// datafile had before it was rehashed with a different algorithm.
+const MetaKeyPreviousName = MetaKey + ".previousName"
+
+// MetaKeyExpiresAt refers to the location where memorybox stores the RFC3339
+// time after which a datafile is no longer needed.
+const MetaKeyExpiresAt = MetaKey + ".expiresAt"
+
+// MetaKeyTags refers to the location where tags classifying a datafile are
+// stored. Unlike the other keys, it is controlled by users.
+const MetaKeyTags = "tags"
+
+// MetaSchemaVersion is the version of the metadata format this version of
+// memorybox understands.
+const MetaSchemaVersion = 2
+
+// metaMigrations upgrade metadata from one schema version to the next. The
+// migration at index i upgrades version i+1 to version i+2. Migrations must
+// return their input unchanged if there is nothing to do.
+var metaMigrations = []func([]byte) ([]byte, error){
+	migrateMetaV1,
+}
+
 // Meta holds JSON encoded metadata.
 type Meta []byte
 
 // NewMetaFromFile produces memorybox formatted metadata from a supplied file.
+// It is always written using the current schema version.
 func NewMetaFromFile(file *File) *Meta {
 	data, _ := sjson.SetBytes([]byte{}, MetaKey, map[string]interface{}{
-		"memorybox": true,
-		"file":      file.Name,
+		"memorybox":     true,
+		"schemaVersion": MetaSchemaVersion,
+		"file":          file.Name,
 		"import": map[string]interface{}{
 			"at":     time.Now().UTC().Format(time.RFC3339),
 			"source": file.Source,
@@ -61,6 +97,141 @@ func NewMetaFromFile(file *File) *Meta {
 	return &meta
 }
 
+// MetaFileOptions describes metadata supplied by a user that is added to a
+// metafile when it is created.
+type MetaFileOptions struct {
+	// ExtraKeys are set in the metadata. Keys managed by memorybox are
+	// ignored.
+	ExtraKeys map[string]string
+	// Tags replace the tags of the metadata, if supplied.
+	Tags []string
+	// Thumbnail adds a base64 encoded thumbnail of jpeg images to the
+	// metadata under ThumbnailKey(ThumbnailSize). It has no effect on
+	// other content.
+	Thumbnail bool
+	// Validator, if set, must accept the metadata before a metafile is
+	// created with it.
+	Validator MetaValidator
+}
+
+// MetaValidator determines if metadata is acceptable, e.g. by checking it
+// against a schema.
+type MetaValidator interface {
+	ValidateBytes(meta []byte) error
+}
+
+// Apply adds the options to the supplied metadata.
+func (o MetaFileOptions) Apply(m *Meta) {
+	for key, value := range o.ExtraKeys {
+		if isManagedPath(key) {
+			continue
+		}
+		m.Set(key, value)
+	}
+	if len(o.Tags) > 0 {
+		m.SetTags(o.Tags)
+	}
+}
+
+// NewMetaFromFileWithOptions produces memorybox formatted metadata from a
+// supplied file, including the metadata described by the options.
+func NewMetaFromFileWithOptions(file *File, opts MetaFileOptions) *Meta {
+	meta := NewMetaFromFile(file)
+	opts.Apply(meta)
+	return meta
+}
+
+// ReplayMeta folds the content of a log-structured metafile into a single
+// document. The first JSON document holds the original metadata and every
+// subsequent document is an object whose keys are applied to it in order.
+// Content that cannot be decoded is returned unchanged.
+func ReplayMeta(data []byte) Meta {
+	var documents []json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var document json.RawMessage
+		if err := decoder.Decode(&document); err == io.EOF {
+			break
+		} else if err != nil {
+			return data
+		}
+		documents = append(documents, document)
+	}
+	if len(documents) < 2 {
+		return data
+	}
+	meta := Meta(documents[0])
+	for _, patch := range documents[1:] {
+		gjson.ParseBytes(patch).ForEach(func(key, value gjson.Result) bool {
+			meta, _ = sjson.SetRawBytes(meta, key.String(), []byte(value.Raw))
+			return true
+		})
+	}
+	return meta
+}
+
+// MigrateMeta upgrades metadata written by older versions of memorybox to the
+// current schema version. Metadata that needs no changes is returned as-is.
+func MigrateMeta(data []byte) ([]byte, error) {
+	version := 1
+	if recorded := gjson.GetBytes(data, MetaKeySchemaVersion); recorded.Exists() {
+		version = int(recorded.Int())
+	}
+	if version < 1 {
+		return nil, fmt.Errorf("%w: schema version %d is not supported", ErrInvalidMeta, version)
+	}
+	if version > MetaSchemaVersion {
+		return nil, fmt.Errorf("schema version %d is newer than supported version %d", version, MetaSchemaVersion)
+	}
+	migrated := data
+	for _, migrate := range metaMigrations[version-1:] {
+		var err error
+		if migrated, err = migrate(migrated); err != nil {
+			return nil, err
+		}
+	}
+	if bytes.Equal(migrated, data) {
+		return data, nil
+	}
+	return sjson.SetBytes(migrated, MetaKeySchemaVersion, MetaSchemaVersion)
+}
+
+// migrateMetaV1 converts metadata from the legacy layout, where memorybox
+// details were held under a top level "memorybox" object and user supplied
+// values were nested under "data", to the layout used since.
+func migrateMetaV1(data []byte) ([]byte, error) {
+	legacy := gjson.GetBytes(data, "memorybox")
+	if !legacy.IsObject() || gjson.GetBytes(data, MetaKey).Exists() {
+		return data, nil
+	}
+	escape := strings.NewReplacer(".", `\.`, "*", `\*`, "?", `\?`)
+	migrated := []byte("{}")
+	var err error
+	gjson.GetBytes(data, "data").ForEach(func(key, value gjson.Result) bool {
+		migrated, err = sjson.SetRawBytes(migrated, escape.Replace(key.String()), []byte(value.Raw))
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	legacy.ForEach(func(key, value gjson.Result) bool {
+		if key.String() == "source" {
+			return true
+		}
+		migrated, err = sjson.SetRawBytes(migrated, MetaKey+"."+escape.Replace(key.String()), []byte(value.Raw))
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if source := legacy.Get("source"); source.Exists() {
+		if migrated, err = sjson.SetRawBytes(migrated, MetaKeyImportSource, []byte(source.Raw)); err != nil {
+			return nil, err
+		}
+	}
+	return sjson.SetBytes(migrated, MetaMemoryboxKey, true)
+}
+
 // IsMetaFileName determines if a given source string is named like a metafile.
 func IsMetaFileName(source string) bool {
 	return strings.HasPrefix(source, MetaFilePrefix)
@@ -93,6 +264,24 @@ func ValidateMeta(bytes []byte) error {
 	return nil
 }
 
+// Canonical produces the canonical encoding of the metadata: compact JSON with
+// the keys of every object sorted alphabetically. Values are left untouched.
+func (m Meta) Canonical() (Meta, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(m))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	var result bytes.Buffer
+	encoder := json.NewEncoder(&result)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(result.Bytes(), "\n"), nil
+}
+
 // String converts the underlying byte array string form.
 func (m *Meta) String() string { return fmt.Sprintf("%s", *m) }
 
@@ -141,15 +330,150 @@ func (m *Meta) Delete(key string) {
 // Merge takes an object and assigns every key into the meta field except
 // managed ones.
 func (m *Meta) Merge(data string) error {
-	jsonData, ok := gjson.Parse(data).Value().(map[string]interface{})
-	if !ok {
+	if !gjson.Valid(data) || !gjson.Parse(data).IsObject() {
 		return fmt.Errorf("%s is not valid json", data)
 	}
-	for key, value := range jsonData {
-		if strings.HasPrefix(key, MetaKey) {
+	Meta(data).Range(func(key string, value gjson.Result) bool {
+		if !strings.HasPrefix(key, MetaKey) {
+			*m, _ = sjson.SetRawBytes(*m, key, []byte(value.Raw))
+		}
+		return true
+	})
+	return nil
+}
+
+// Range calls fn for every top level key of the metadata, in the order they
+// appear, until fn returns false. Values are read in place without decoding
+// the whole document.
+func (m Meta) Range(fn func(key string, value gjson.Result) bool) {
+	gjson.ParseBytes(m).ForEach(func(key gjson.Result, value gjson.Result) bool {
+		return fn(key.String(), value)
+	})
+}
+
+// MergePatch applies a JSON merge patch (RFC 7386) to every key of the
+// metadata except managed ones, which are left untouched. Null values in the
+// patch delete the keys they name.
+func (m *Meta) MergePatch(patch []byte) error {
+	var current, changes map[string]interface{}
+	if err := decodeNumbers(*m, &current); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMeta, err)
+	}
+	if err := decodeNumbers(patch, &changes); err != nil {
+		return fmt.Errorf("%s is not a valid json object: %w", patch, err)
+	}
+	for key, value := range changes {
+		if key == MetaKey {
+			continue
+		}
+		if value == nil {
+			delete(current, key)
 			continue
 		}
-		*m, _ = sjson.SetBytes(*m, key, value)
+		current[key] = mergePatch(current[key], value)
+	}
+	merged, err := json.Marshal(current)
+	if err != nil {
+		return err
 	}
+	*m = merged
 	return nil
 }
+
+// decodeNumbers unmarshals data into v, keeping numbers as json.Number so
+// integers too large for a float64 survive being encoded again.
+func decodeNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after json value")
+	}
+	return nil
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// Tags returns the tags in the metadata. Missing or malformed tags produce
+// nil.
+func (m *Meta) Tags() []string {
+	value := gjson.GetBytes(*m, MetaKeyTags)
+	if !value.IsArray() {
+		return nil
+	}
+	var tags []string
+	for _, tag := range value.Array() {
+		if tag.Type != gjson.String {
+			return nil
+		}
+		tags = append(tags, tag.String())
+	}
+	return tags
+}
+
+// SetTags replaces the tags in the metadata.
+func (m *Meta) SetTags(tags []string) {
+	if tags == nil {
+		tags = []string{}
+	}
+	encoded, _ := json.Marshal(tags)
+	m.Set(MetaKeyTags, string(encoded))
+}
+
+// AddTag adds a tag to the metadata if it is not already present.
+func (m *Meta) AddTag(tag string) {
+	tags := m.Tags()
+	for _, existing := range tags {
+		if existing == tag {
+			return
+		}
+	}
+	m.SetTags(append(tags, tag))
+}
+
+// RemoveTag removes a tag from the metadata if it is present.
+func (m *Meta) RemoveTag(tag string) {
+	var tags []string
+	for _, existing := range m.Tags() {
+		if existing != tag {
+			tags = append(tags, existing)
+		}
+	}
+	m.SetTags(tags)
+}
+
+// ParseTags interprets a value supplied for tags at the command line. A json
+// array is used as is; anything else is treated as a comma separated list.
+func ParseTags(value string) []string {
+	var tags []string
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		if err := json.Unmarshal([]byte(value), &tags); err == nil {
+			return tags
+		}
+	}
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
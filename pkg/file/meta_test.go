@@ -2,6 +2,7 @@ package file_test
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"github.com/mattetti/filebuffer"
@@ -11,6 +12,42 @@ import (
 	"time"
 )
 
+func TestNewMetaFromFile(t *testing.T) {
+	meta := file.NewMetaFromFile(&file.File{Name: "test", Source: "source"})
+	if actual := fmt.Sprintf("%s", meta.Get(file.MetaKeySchemaVersion)); actual != fmt.Sprint(file.MetaSchemaVersion) {
+		t.Fatalf("expected schema version %d, got %s", file.MetaSchemaVersion, actual)
+	}
+	if actual := meta.DataFileName(); actual != "test" {
+		t.Fatalf("expected file name test, got %s", actual)
+	}
+	migrated, err := file.MigrateMeta(*meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(*meta), string(migrated)); diff != "" {
+		t.Fatalf("expected new metadata to need no migration: %s", diff)
+	}
+}
+
+func TestNewMetaFromFileWithOptions(t *testing.T) {
+	meta := file.NewMetaFromFileWithOptions(&file.File{Name: "test"}, file.MetaFileOptions{
+		ExtraKeys: map[string]string{"title": "test", "count": "1", file.MetaKey + "ed": "kept", file.MetaKeyFileName: "ignored"},
+		Tags:      []string{"a"},
+	})
+	expected := map[string]string{
+		"title":              "test",
+		"count":              "1",
+		file.MetaKey + "ed":  "kept",
+		"tags":               `["a"]`,
+		file.MetaKeyFileName: "test",
+	}
+	for key, value := range expected {
+		if actual := fmt.Sprintf("%s", meta.Get(key)); actual != value {
+			t.Fatalf("expected %s to be %s, got %s", key, value, actual)
+		}
+	}
+}
+
 func TestMetaNameFrom(t *testing.T) {
 	table := map[string]struct {
 		input    string
@@ -252,3 +289,278 @@ func TestMeta_Merge(t *testing.T) {
 		})
 	}
 }
+
+func TestMeta_MergePatch(t *testing.T) {
+	table := map[string]struct {
+		input       string
+		expected    string
+		expectedErr bool
+	}{
+		"user keys are merged": {
+			input:    `{"tag":"new","nested":{"b":2}}`,
+			expected: `{"meta":{"file":"test","memorybox":true},"nested":{"a":1,"b":2},"tag":"new"}`,
+		},
+		"null values delete keys": {
+			input:    `{"tag":null,"nested":{"a":null}}`,
+			expected: `{"meta":{"file":"test","memorybox":true},"nested":{}}`,
+		},
+		"managed keys are ignored": {
+			input:    `{"meta":{"file":"other","memorybox":null}}`,
+			expected: `{"meta":{"file":"test","memorybox":true},"nested":{"a":1},"tag":"old"}`,
+		},
+		"integers beyond float64 precision are kept": {
+			input:    `{"id":9007199254740993,"nested":{"b":12345678901234567890}}`,
+			expected: `{"id":9007199254740993,"meta":{"file":"test","memorybox":true},"nested":{"a":1,"b":12345678901234567890},"tag":"old"}`,
+		},
+		"invalid json errors": {
+			input:       `[ar":"baz"}`,
+			expectedErr: true,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			meta := file.Meta(`{"meta":{"file":"test","memorybox":true},"tag":"old","nested":{"a":1}}`)
+			err := meta.MergePatch([]byte(test.input))
+			if err != nil && !test.expectedErr {
+				t.Fatal(err)
+			}
+			if err == nil && test.expectedErr {
+				t.Fatalf("expected error, got %s", meta)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(test.expected, string(meta)); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestMeta_Canonical(t *testing.T) {
+	table := map[string]struct {
+		input       file.Meta
+		expected    file.Meta
+		expectedErr bool
+	}{
+		"keys are sorted and whitespace is removed": {
+			input:    file.Meta("{\"b\": 1, \"a\": {\"d\": [1, 2], \"c\": \"<value>\"}}"),
+			expected: file.Meta(`{"a":{"c":"<value>","d":[1,2]},"b":1}`),
+		},
+		"numbers are not reformatted": {
+			input:    file.Meta(`{"a":1.50,"b":12345678901234567890}`),
+			expected: file.Meta(`{"a":1.50,"b":12345678901234567890}`),
+		},
+		"invalid json fails": {
+			input:       file.Meta(`{"a":`),
+			expectedErr: true,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			actual, err := test.input.Canonical()
+			if test.expectedErr && err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if !test.expectedErr && err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.expected, actual); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestReplayMeta(t *testing.T) {
+	table := map[string]struct {
+		input    []byte
+		expected file.Meta
+	}{
+		"single documents are unchanged": {
+			input:    []byte(`{"meta":{"file":"test"}}`),
+			expected: file.Meta(`{"meta":{"file":"test"}}`),
+		},
+		"appended documents are applied in order": {
+			input:    []byte("{\"meta\":{\"file\":\"test\"}}\n{\"a\":1}\n{\"a\":2,\"b.c\":true}"),
+			expected: file.Meta(`{"meta":{"file":"test"},"a":2,"b":{"c":true}}`),
+		},
+		"pretty printed documents are supported": {
+			input:    []byte("{\n  \"meta\": {\"file\": \"test\"}\n}\n{\"meta.set\":\"x\"}"),
+			expected: file.Meta("{\n  \"meta\": {\"file\": \"test\",\"set\":\"x\"}\n}"),
+		},
+		"invalid content is unchanged": {
+			input:    []byte(`{"meta":`),
+			expected: file.Meta(`{"meta":`),
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(test.expected, file.ReplayMeta(test.input)); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestMigrateMeta(t *testing.T) {
+	table := map[string]struct {
+		input       []byte
+		expected    []byte
+		expectedErr bool
+		invalid     bool
+	}{
+		"legacy layout is migrated to version 2": {
+			input:    []byte(`{"memorybox":{"file":"test","source":"<stdin>","import":{"at":"2020-05-24T21:14:42Z"}},"data":{"title":"test","a.b":1}}`),
+			expected: []byte(`{"title":"test","a.b":1,"meta":{"file":"test","import":{"at":"2020-05-24T21:14:42Z","source":"<stdin>"},"memorybox":true,"schemaVersion":2}}`),
+		},
+		"current layout without a version is unchanged": {
+			input:    []byte(`{"meta":{"file":"test","memorybox":true},"title":"test"}`),
+			expected: []byte(`{"meta":{"file":"test","memorybox":true},"title":"test"}`),
+		},
+		"current version is unchanged": {
+			input:    []byte(`{"meta":{"file":"test","memorybox":true,"schemaVersion":2}}`),
+			expected: []byte(`{"meta":{"file":"test","memorybox":true,"schemaVersion":2}}`),
+		},
+		"newer versions fail": {
+			input:       []byte(`{"meta":{"file":"test","memorybox":true,"schemaVersion":99}}`),
+			expectedErr: true,
+		},
+		"version 0 is invalid": {
+			input:       []byte(`{"meta":{"file":"test","memorybox":true,"schemaVersion":0}}`),
+			expectedErr: true,
+			invalid:     true,
+		},
+		"negative versions are invalid": {
+			input:       []byte(`{"meta":{"file":"test","memorybox":true,"schemaVersion":-1}}`),
+			expectedErr: true,
+			invalid:     true,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			actual, err := file.MigrateMeta(test.input)
+			if test.expectedErr && err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if !test.expectedErr && err != nil {
+				t.Fatal(err)
+			}
+			if test.invalid && !errors.Is(err, file.ErrInvalidMeta) {
+				t.Fatalf("expected %s, got %v", file.ErrInvalidMeta, err)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(string(test.expected), string(actual)); diff != "" {
+				t.Fatal(diff)
+			}
+			again, againErr := file.MigrateMeta(actual)
+			if againErr != nil {
+				t.Fatal(againErr)
+			}
+			if diff := cmp.Diff(string(actual), string(again)); diff != "" {
+				t.Fatalf("expected migration to be idempotent: %s", diff)
+			}
+		})
+	}
+}
+
+func TestMeta_Tags(t *testing.T) {
+	table := map[string]struct {
+		meta     file.Meta
+		change   func(*file.Meta)
+		expected []string
+	}{
+		"empty tags": {
+			meta:     file.Meta(`{"meta":{"file":"test"}}`),
+			expected: nil,
+		},
+		"invalid tags": {
+			meta:     file.Meta(`{"meta":{"file":"test"},"tags":[1,"a"]}`),
+			expected: nil,
+		},
+		"set tags": {
+			meta: file.Meta(`{"meta":{"file":"test"}}`),
+			change: func(m *file.Meta) {
+				m.SetTags([]string{"a", "b"})
+			},
+			expected: []string{"a", "b"},
+		},
+		"adding a tag": {
+			meta: file.Meta(`{"meta":{"file":"test"},"tags":["a"]}`),
+			change: func(m *file.Meta) {
+				m.AddTag("b")
+			},
+			expected: []string{"a", "b"},
+		},
+		"adding a duplicate tag": {
+			meta: file.Meta(`{"meta":{"file":"test"},"tags":["a"]}`),
+			change: func(m *file.Meta) {
+				m.AddTag("a")
+			},
+			expected: []string{"a"},
+		},
+		"removing a tag": {
+			meta: file.Meta(`{"meta":{"file":"test"},"tags":["a","b"]}`),
+			change: func(m *file.Meta) {
+				m.RemoveTag("a")
+			},
+			expected: []string{"b"},
+		},
+		"removing a tag that does not exist": {
+			meta: file.Meta(`{"meta":{"file":"test"},"tags":["a"]}`),
+			change: func(m *file.Meta) {
+				m.RemoveTag("b")
+			},
+			expected: []string{"a"},
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			if test.change != nil {
+				test.change(&test.meta)
+			}
+			if diff := cmp.Diff(test.expected, test.meta.Tags()); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	table := map[string]struct {
+		input    string
+		expected []string
+	}{
+		"comma separated": {
+			input:    "a, b,c",
+			expected: []string{"a", "b", "c"},
+		},
+		"single tag": {
+			input:    "a",
+			expected: []string{"a"},
+		},
+		"json array": {
+			input:    `["a","b,c"]`,
+			expected: []string{"a", "b,c"},
+		},
+		"empty": {
+			input:    "",
+			expected: nil,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(test.expected, file.ParseTags(test.input)); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package file
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+)
+
+// ToMultipart wraps the content of the file in a multipart form with a single
+// part named "file", for uploading to http apis which expect form data. The
+// content type returned includes the boundary and is suitable for use as a
+// Content-Type header. Metafiles are encoded as their json metadata. The
+// content of datafiles is streamed as the returned body is read.
+func (f *File) ToMultipart() (string, io.Reader, error) {
+	var content io.Reader
+	if f.IsMetaFile() {
+		meta := f.MetaBytes()
+		if meta == nil {
+			return "", nil, ErrMetaMismatch
+		}
+		content = bytes.NewReader(meta)
+	} else {
+		if f.Body == nil {
+			return "", nil, ErrMissingContent
+		}
+		content = f
+	}
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("file", f.Name)
+		if err == nil {
+			_, err = io.Copy(part, content)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return form.FormDataContentType(), reader, nil
+}
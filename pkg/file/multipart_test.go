@@ -0,0 +1,79 @@
+package file_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/tkellen/memorybox/pkg/file"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"testing"
+	"time"
+)
+
+func TestFile_ToMultipart(t *testing.T) {
+	datafile, err := file.NewSha256("test", bytes.NewReader([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	metafile, err := file.NewMetaFromBytes("test", []byte(`{"meta":{"file":"test","memorybox":true}}`))
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	table := map[string]struct {
+		file     *file.File
+		expected []byte
+	}{
+		"datafile": {
+			file:     datafile,
+			expected: []byte("test"),
+		},
+		"metafile": {
+			file:     metafile,
+			expected: []byte(`{"meta":{"file":"test","memorybox":true}}`),
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			contentType, body, err := test.file.ToMultipart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			mediaType, params, parseErr := mime.ParseMediaType(contentType)
+			if parseErr != nil {
+				t.Fatal(parseErr)
+			}
+			if mediaType != "multipart/form-data" {
+				t.Fatalf("expected multipart/form-data, got %s", mediaType)
+			}
+			reader := multipart.NewReader(body, params["boundary"])
+			part, partErr := reader.NextPart()
+			if partErr != nil {
+				t.Fatal(partErr)
+			}
+			if part.FormName() != "file" {
+				t.Fatalf("expected part named file, got %s", part.FormName())
+			}
+			if part.FileName() != test.file.Name {
+				t.Fatalf("expected filename %s, got %s", test.file.Name, part.FileName())
+			}
+			actual, readErr := ioutil.ReadAll(part)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if !bytes.Equal(test.expected, actual) {
+				t.Fatalf("expected %s, got %s", test.expected, actual)
+			}
+			if _, err := reader.NextPart(); err == nil {
+				t.Fatal("expected a single part")
+			}
+		})
+	}
+}
+
+func TestFile_ToMultipartMissingContent(t *testing.T) {
+	if _, _, err := file.NewStub("test", 4, time.Now()).ToMultipart(); !errors.Is(err, file.ErrMissingContent) {
+		t.Fatalf("expected %s, got %v", file.ErrMissingContent, err)
+	}
+}
@@ -0,0 +1,73 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+// ThumbnailSize is the width and height of the box thumbnails generated when
+// putting files are scaled to fit.
+const ThumbnailSize = 128
+
+// ErrThumbnailUnsupported is returned when generating a thumbnail for content
+// that is not a jpeg image or cannot be rewound.
+var ErrThumbnailUnsupported = errors.New("thumbnails can only be generated for jpeg images")
+
+// ThumbnailKey names the metadata key a thumbnail of the supplied size is
+// stored under.
+func ThumbnailKey(size int) string {
+	return fmt.Sprintf("thumbnail_%d", size)
+}
+
+// Thumbnail produces a jpeg encoded copy of a jpeg image scaled to fit within
+// a square of the supplied size, preserving its aspect ratio. Images smaller
+// than the square are not enlarged. The body must be seekable as it is rewound
+// after reading it.
+func (f *File) Thumbnail(size int) ([]byte, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("%w: invalid thumbnail size %d", ErrThumbnailUnsupported, size)
+	}
+	body, ok := f.Body.(io.ReadSeeker)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w: body is not seekable", f.Name, ErrThumbnailUnsupported)
+	}
+	contentType, err := f.ContentType()
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "image/jpeg" {
+		return nil, fmt.Errorf("%s: %w: %s", f.Name, ErrThumbnailUnsupported, contentType)
+	}
+	defer body.Seek(0, io.SeekStart)
+	source, err := jpeg.Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", f.Name, ErrThumbnailUnsupported, err)
+	}
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, height*size/width
+		} else {
+			width, height = width*size/height, size
+		}
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), source, bounds, draw.Src, nil)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaled, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,79 @@
+package file_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/tkellen/memorybox/pkg/file"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+// jpegFixture encodes a blank jpeg image of the supplied dimensions.
+func jpegFixture(t *testing.T, width int, height int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestFile_Thumbnail(t *testing.T) {
+	table := map[string]struct {
+		input          []byte
+		expectedWidth  int
+		expectedHeight int
+		expectedErr    error
+	}{
+		"single pixel": {
+			input:          jpegFixture(t, 1, 1),
+			expectedWidth:  1,
+			expectedHeight: 1,
+		},
+		"wide image is scaled to fit": {
+			input:          jpegFixture(t, 512, 256),
+			expectedWidth:  128,
+			expectedHeight: 64,
+		},
+		"tall image is scaled to fit": {
+			input:          jpegFixture(t, 100, 400),
+			expectedWidth:  32,
+			expectedHeight: 128,
+		},
+		"content that is not a jpeg": {
+			input:       []byte("test"),
+			expectedErr: file.ErrThumbnailUnsupported,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			f, err := file.NewSha256("test", bytes.NewReader(test.input), time.Now())
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			thumbnail, err := f.Thumbnail(file.ThumbnailSize)
+			if test.expectedErr != nil {
+				if !errors.Is(err, test.expectedErr) {
+					t.Fatalf("expected %s, got %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			config, err := jpeg.DecodeConfig(bytes.NewReader(thumbnail))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Width != test.expectedWidth || config.Height != test.expectedHeight {
+				t.Fatalf("expected %dx%d, got %dx%d", test.expectedWidth, test.expectedHeight, config.Width, config.Height)
+			}
+			content := make([]byte, len(test.input))
+			if _, err := f.Body.Read(content); err != nil || !bytes.Equal(test.input, content) {
+				t.Fatal("expected body to be rewound")
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package grpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+)
+
+// TokenEnv is the environment variable the memorybox cli reads the token a
+// server requires from.
+const TokenEnv = "MEMORYBOX_GRPC_TOKEN"
+
+// ErrInsecure is returned by Serve when asked to accept connections from
+// other hosts without TLS, and by NewFromConfig when asked to send a token to
+// another host without TLS.
+var ErrInsecure = errors.New("refusing to communicate beyond loopback without TLS")
+
+// ServeOptions secure the connections a server accepts.
+type ServeOptions struct {
+	// Credentials, if set, make the server only accept TLS connections.
+	Credentials credentials.TransportCredentials
+	// Token, if set, must be sent by clients as a bearer token with every
+	// request. It does not replace Credentials for listeners beyond loopback
+	// as it would be sent in the clear.
+	Token string
+}
+
+// secure reports if the options allow a server to accept connections on the
+// address of a listener. Listeners which are not on a network, like those
+// used in tests, are always allowed.
+func (o ServeOptions) secure(addr net.Addr) bool {
+	if o.Credentials != nil {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return !ok || tcpAddr.IP.IsLoopback()
+}
+
+// loopback reports if an endpoint of the form host:port is on the local
+// machine.
+func loopback(endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serverOptions configures a grpc server to enforce the options.
+func (o ServeOptions) serverOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if o.Credentials != nil {
+		opts = append(opts, grpc.Creds(o.Credentials))
+	}
+	if o.Token != "" {
+		opts = append(opts,
+			grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				if err := o.authenticate(ctx); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := o.authenticate(stream.Context()); err != nil {
+					return err
+				}
+				return handler(srv, stream)
+			}),
+		)
+	}
+	return opts
+}
+
+// authenticate ensures a request carries the token.
+func (o ServeOptions) authenticate(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	expected := []byte("Bearer " + o.Token)
+	for _, value := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(value), expected) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid token")
+}
+
+// tokenCredentials sends a bearer token with every request made by a client.
+// Unless allowInsecure is set, grpc refuses to send it over a connection
+// without transport security.
+type tokenCredentials struct {
+	token         string
+	allowInsecure bool
+}
+
+func (t tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return !t.allowInsecure
+}
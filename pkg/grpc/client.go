@@ -0,0 +1,270 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Name is used in the memorybox configuration file to determine which type of
+// store to instantiate.
+const Name = "grpc"
+
+var _ archive.Store = (*Client)(nil)
+
+// Client implements archive.Store backed by a connection to a server.
+type Client struct {
+	Endpoint string
+	Service  MemoryboxServiceClient
+}
+
+// New returns a reference to a Client instance using an existing connection.
+func New(endpoint string, conn grpc.ClientConnInterface) *Client {
+	return &Client{
+		Endpoint: endpoint,
+		Service:  NewMemoryboxServiceClient(conn),
+	}
+}
+
+// NewFromConfig instantiates a Client using configuration values that were
+// likely sourced from a configuration file target. The connection is made
+// lazily, when the first request is sent. It uses TLS if tls is "true" or
+// tls_ca_path names a file of certificates to verify the server with, and
+// sends token with every request if it is set. A token is only sent without
+// TLS to endpoints on loopback, otherwise ErrInsecure is returned.
+func NewFromConfig(config map[string]string) (*Client, error) {
+	endpoint := config["endpoint"]
+	if endpoint == "" {
+		return nil, fmt.Errorf("%w: endpoint is required", os.ErrInvalid)
+	}
+	transport := grpc.WithInsecure()
+	var secure bool
+	if caPath := config["tls_ca_path"]; caPath != "" {
+		creds, err := credentials.NewClientTLSFromFile(caPath, "")
+		if err != nil {
+			return nil, fmt.Errorf("tls_ca_path: %w", err)
+		}
+		transport, secure = grpc.WithTransportCredentials(creds), true
+	} else if config["tls"] == "true" {
+		transport, secure = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})), true
+	}
+	opts := []grpc.DialOption{transport}
+	if token := config["token"]; token != "" {
+		allowInsecure := loopback(endpoint)
+		if !secure && !allowInsecure {
+			return nil, fmt.Errorf("%w: token would be sent to %s in the clear", ErrInsecure, endpoint)
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token: token, allowInsecure: allowInsecure}))
+	}
+	conn, err := grpc.Dial(endpoint, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return New(endpoint, conn), nil
+}
+
+// String returns a human friendly representation of the Client.
+func (c *Client) String() string {
+	return fmt.Sprintf("%s: %s", Name, c.Endpoint)
+}
+
+// Put streams the content of a supplied reader to the server. If the reader
+// fails, the server is told to discard what it has received.
+func (c *Client) Put(ctx context.Context, source io.Reader, name string, lastModified time.Time) error {
+	stream, err := c.Service.Put(ctx)
+	if err != nil {
+		return fromStatus(err)
+	}
+	req := &PutRequest{Name: name, LastModified: lastModified.UnixNano()}
+	buf := make([]byte, chunkSize)
+	for {
+		n, readErr := source.Read(buf)
+		req.Data = buf[:n]
+		if readErr != nil && readErr != io.EOF {
+			req.Data, req.Abort = nil, readErr.Error()
+		}
+		if err := stream.Send(req); err != nil {
+			// The server has stopped accepting content; the reason is
+			// reported when the stream is closed.
+			break
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			stream.CloseAndRecv()
+			return fmt.Errorf("put %s: %w", name, readErr)
+		}
+		req = &PutRequest{}
+	}
+	_, err = stream.CloseAndRecv()
+	return fromStatus(err)
+}
+
+// Get finds an object on the server by name. Its content is streamed as it is
+// read.
+func (c *Client) Get(ctx context.Context, name string) (*file.File, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.Service.Get(ctx, &GetRequest{Name: name})
+	if err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+	f := fromFileInfo(first.Info)
+	f.Body = &getReader{stream: stream, cancel: cancel, buf: first.Data}
+	return f, nil
+}
+
+// getReader reads the content of an object as it arrives from the server.
+type getReader struct {
+	stream MemoryboxService_GetClient
+	cancel context.CancelFunc
+	buf    []byte
+}
+
+func (r *getReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		resp, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, fromStatus(err)
+		}
+		r.buf = resp.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *getReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// Delete removes an object on the server.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	_, err := c.Service.Delete(ctx, &DeleteRequest{Name: name})
+	return fromStatus(err)
+}
+
+// Search finds objects on the server by prefix.
+func (c *Client) Search(ctx context.Context, prefix string) (file.List, error) {
+	stream, err := c.Service.Search(ctx, &SearchRequest{Prefix: prefix})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	var matches file.List
+	for {
+		info, err := stream.Recv()
+		if err == io.EOF {
+			return matches, nil
+		}
+		if err != nil {
+			return nil, fromStatus(err)
+		}
+		matches = append(matches, fromFileInfo(info))
+	}
+}
+
+// Concat gets the content of multiple objects in a single call.
+func (c *Client) Concat(ctx context.Context, concurrency int, files []string) ([][]byte, error) {
+	result := make([][]byte, len(files))
+	sem := semaphore.NewWeighted(int64(concurrency))
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		for index, item := range files {
+			index, item := index, item // https://golang.org/doc/faq#closures_and_goroutines
+			if err := sem.Acquire(egCtx, 1); err != nil {
+				return err
+			}
+			eg.Go(func() error {
+				defer sem.Release(1)
+				f, err := c.Get(egCtx, item)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				result[index], err = ioutil.ReadAll(f)
+				return err
+			})
+		}
+		return nil
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Stat gets details about an object on the server without reading its
+// content.
+func (c *Client) Stat(ctx context.Context, name string) (*file.File, error) {
+	info, err := c.Service.Stat(ctx, &StatRequest{Name: name})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return fromFileInfo(info), nil
+}
+
+// Exists reports if an object is present on the server.
+func (c *Client) Exists(ctx context.Context, name string) (bool, error) {
+	if _, err := c.Stat(ctx, name); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// MetaGet finds the metafile of a datafile on the server by a prefix of its
+// name.
+func (c *Client) MetaGet(ctx context.Context, name string) (*file.File, error) {
+	resp, err := c.Service.MetaGet(ctx, &MetaGetRequest{Name: name})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return file.NewMetaFromBytes(resp.Name, resp.Meta)
+}
+
+func fromFileInfo(info *FileInfo) *file.File {
+	return file.NewStub(info.Name, info.Size, time.Unix(0, info.LastModified))
+}
+
+// fromStatus restores the errors the server mapped to grpc status codes.
+func fromStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	code := status.Code(err)
+	// Requests refused for a missing or invalid token are denied as well.
+	if code == codes.Unauthenticated {
+		return fmt.Errorf("%w: %s", os.ErrPermission, status.Convert(err).Message())
+	}
+	for target, candidate := range statusCodes {
+		if code == candidate {
+			return fmt.Errorf("%w: %s", target, status.Convert(err).Message())
+		}
+	}
+	return err
+}
@@ -0,0 +1,267 @@
+package grpc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tkellen/memorybox/internal/test"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	memoryboxgrpc "github.com/tkellen/memorybox/pkg/grpc"
+	"github.com/tkellen/memorybox/pkg/localdiskstore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// serve starts a server backed by a store on local disk and returns a client
+// connected to it in process.
+func serve(t *testing.T) (*memoryboxgrpc.Client, archive.Store, func()) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	store := localdiskstore.New(tempDir)
+	listener := bufconn.Listen(1024 * 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	go memoryboxgrpc.Serve(ctx, listener, store, memoryboxgrpc.ServeOptions{})
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	return memoryboxgrpc.New("bufnet", conn), store, func() {
+		conn.Close()
+		cancel()
+		os.RemoveAll(tempDir)
+	}
+}
+
+func TestClientSuite(t *testing.T) {
+	client, _, shutdown := serve(t)
+	defer shutdown()
+	test.StoreSuite(t, client)
+}
+
+func TestClient_String(t *testing.T) {
+	client := memoryboxgrpc.New("localhost:9090", nil)
+	expected := memoryboxgrpc.Name + ": localhost:9090"
+	if client.String() != expected {
+		t.Fatalf("expected %s, got %s", expected, client.String())
+	}
+}
+
+func TestClient_GetLarge(t *testing.T) {
+	client, _, shutdown := serve(t)
+	defer shutdown()
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("test"), 100*1024)
+	lastModified := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := client.Put(ctx, bytes.NewReader(content), "large", lastModified); err != nil {
+		t.Fatal(err)
+	}
+	f, err := client.Get(ctx, "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	actual, readErr := ioutil.ReadAll(f)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if !bytes.Equal(content, actual) {
+		t.Fatalf("expected %d bytes to round trip, got %d", len(content), len(actual))
+	}
+	if f.Size != int64(len(content)) || !f.LastModified.Equal(lastModified) {
+		t.Fatalf("expected size %d and last modified %s, got %d and %s", len(content), lastModified, f.Size, f.LastModified)
+	}
+}
+
+func TestClient_MetaGet(t *testing.T) {
+	client, store, shutdown := serve(t)
+	defer shutdown()
+	ctx := context.Background()
+	f, err := file.NewSha256("test", bytes.NewReader([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if _, err := archive.Put(ctx, store, f, "", file.MetaFileOptions{}); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	meta, metaErr := client.MetaGet(ctx, f.Name[:8])
+	if metaErr != nil {
+		t.Fatal(metaErr)
+	}
+	if meta.Name != file.MetaNameFrom(f.Name) {
+		t.Fatalf("expected %s, got %s", file.MetaNameFrom(f.Name), meta.Name)
+	}
+	if meta.Meta.DataFileName() != f.Name {
+		t.Fatalf("expected metafile to describe %s, got %s", f.Name, meta.Meta.DataFileName())
+	}
+	if _, err := client.MetaGet(ctx, "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestClient_Delete_Missing(t *testing.T) {
+	client, _, shutdown := serve(t)
+	defer shutdown()
+	if err := client.Delete(context.Background(), "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestServer_InvalidNames(t *testing.T) {
+	client, _, shutdown := serve(t)
+	defer shutdown()
+	ctx := context.Background()
+	for _, name := range []string{"", "../outside", "a/b", `a\b`, ".."} {
+		if err := client.Put(ctx, bytes.NewReader([]byte("test")), name, time.Now()); !errors.Is(err, os.ErrInvalid) {
+			t.Fatalf("expected put of %q to fail with %s, got %v", name, os.ErrInvalid, err)
+		}
+		if _, err := client.Get(ctx, name); !errors.Is(err, os.ErrInvalid) {
+			t.Fatalf("expected get of %q to fail with %s, got %v", name, os.ErrInvalid, err)
+		}
+		if err := client.Delete(ctx, name); !errors.Is(err, os.ErrInvalid) {
+			t.Fatalf("expected delete of %q to fail with %s, got %v", name, os.ErrInvalid, err)
+		}
+		if _, err := client.Stat(ctx, name); !errors.Is(err, os.ErrInvalid) {
+			t.Fatalf("expected stat of %q to fail with %s, got %v", name, os.ErrInvalid, err)
+		}
+	}
+}
+
+// deniedStore refuses every request to stat an object.
+type deniedStore struct {
+	archive.Store
+}
+
+func (deniedStore) Stat(context.Context, string) (*file.File, error) {
+	return nil, fmt.Errorf("stat: %w", os.ErrPermission)
+}
+
+func TestServer_PermissionDenied(t *testing.T) {
+	server := memoryboxgrpc.NewServer(deniedStore{})
+	_, err := server.Stat(context.Background(), &memoryboxgrpc.StatRequest{Name: "test"})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Fatalf("expected %s, got %s", codes.PermissionDenied, code)
+	}
+}
+
+func TestServe_Insecure(t *testing.T) {
+	table := map[string]memoryboxgrpc.ServeOptions{
+		"no options": {},
+		"token only": {Token: "secret"},
+	}
+	for name, opts := range table {
+		opts := opts
+		t.Run(name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "0.0.0.0:0")
+			if err != nil {
+				t.Fatalf("test setup: %s", err)
+			}
+			defer listener.Close()
+			if err := memoryboxgrpc.Serve(context.Background(), listener, nil, opts); !errors.Is(err, memoryboxgrpc.ErrInsecure) {
+				t.Fatalf("expected %s, got %v", memoryboxgrpc.ErrInsecure, err)
+			}
+		})
+	}
+}
+
+func TestServe_Token(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go memoryboxgrpc.Serve(ctx, listener, localdiskstore.New(tempDir), memoryboxgrpc.ServeOptions{Token: "secret"})
+	table := map[string]struct {
+		token       string
+		expectedErr error
+	}{
+		"missing token": {token: "", expectedErr: os.ErrPermission},
+		"wrong token":   {token: "guess", expectedErr: os.ErrPermission},
+		"valid token":   {token: "secret", expectedErr: os.ErrNotExist},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			client, err := memoryboxgrpc.NewFromConfig(map[string]string{
+				"endpoint": listener.Addr().String(),
+				"token":    test.token,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.Stat(ctx, "missing"); !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %s, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	if _, err := memoryboxgrpc.NewFromConfig(map[string]string{}); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+	}
+	client, err := memoryboxgrpc.NewFromConfig(map[string]string{"endpoint": "localhost:9090"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Endpoint != "localhost:9090" {
+		t.Fatalf("expected endpoint localhost:9090, got %s", client.Endpoint)
+	}
+	if _, err := memoryboxgrpc.NewFromConfig(map[string]string{"endpoint": "localhost:9090", "tls_ca_path": "missing"}); err == nil {
+		t.Fatal("expected a missing tls_ca_path to fail")
+	}
+}
+
+func TestNewFromConfig_Token(t *testing.T) {
+	table := map[string]struct {
+		config      map[string]string
+		expectedErr error
+	}{
+		"token to loopback without tls": {
+			config: map[string]string{"endpoint": "127.0.0.1:9090", "token": "secret"},
+		},
+		"token to localhost without tls": {
+			config: map[string]string{"endpoint": "localhost:9090", "token": "secret"},
+		},
+		"token to another host with tls": {
+			config: map[string]string{"endpoint": "example.com:9090", "token": "secret", "tls": "true"},
+		},
+		"token to another host without tls": {
+			config:      map[string]string{"endpoint": "example.com:9090", "token": "secret"},
+			expectedErr: memoryboxgrpc.ErrInsecure,
+		},
+		"no token to another host without tls": {
+			config: map[string]string{"endpoint": "example.com:9090"},
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			_, err := memoryboxgrpc.NewFromConfig(test.config)
+			if test.expectedErr == nil && err != nil {
+				t.Fatal(err)
+			}
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+// Package grpc provides access to a memorybox store from other processes. The
+// Server exposes an archive.Store as a MemoryboxService and the Client is an
+// archive.Store backed by a connection to one.
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// chunkSize is the maximum number of bytes of content sent in one message.
+const chunkSize = 32 * 1024
+
+// Server implements MemoryboxServiceServer using an archive.Store.
+type Server struct {
+	store archive.Store
+}
+
+// NewServer returns a reference to a Server instance.
+func NewServer(store archive.Store) *Server {
+	return &Server{store: store}
+}
+
+// Serve accepts connections on the listener until the context is cancelled.
+// Listeners on an address other than loopback require TLS credentials in the
+// options, otherwise ErrInsecure is returned.
+func Serve(ctx context.Context, listener net.Listener, store archive.Store, opts ServeOptions) error {
+	if !opts.secure(listener.Addr()) {
+		return fmt.Errorf("%w: %s", ErrInsecure, listener.Addr())
+	}
+	server := grpc.NewServer(opts.serverOptions()...)
+	RegisterMemoryboxServiceServer(server, NewServer(store))
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+	return server.Serve(listener)
+}
+
+// Put writes the content streamed by the client to the store.
+func (s *Server) Put(stream MemoryboxService_PutServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if first.Abort != "" {
+		return status.Error(codes.Aborted, first.Abort)
+	}
+	if err := validName(first.Name); err != nil {
+		return err
+	}
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writer.CloseWithError(func() error {
+			if _, err := writer.Write(first.Data); err != nil {
+				return err
+			}
+			for {
+				req, err := stream.Recv()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if req.Abort != "" {
+					return fmt.Errorf("client aborted: %s", req.Abort)
+				}
+				if _, err := writer.Write(req.Data); err != nil {
+					return err
+				}
+			}
+		}())
+	}()
+	putErr := s.store.Put(stream.Context(), reader, first.Name, time.Unix(0, first.LastModified))
+	// Unblock the goroutine receiving content if the store stopped reading.
+	reader.CloseWithError(io.ErrClosedPipe)
+	<-done
+	if putErr != nil {
+		return toStatus(putErr)
+	}
+	return stream.SendAndClose(&PutResponse{})
+}
+
+// Get streams the content of an object to the client.
+func (s *Server) Get(req *GetRequest, stream MemoryboxService_GetServer) error {
+	if err := validName(req.Name); err != nil {
+		return err
+	}
+	f, err := s.store.Get(stream.Context(), req.Name)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer f.Close()
+	if err := stream.Send(&GetResponse{Info: fileInfo(f)}); err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&GetResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return toStatus(readErr)
+		}
+	}
+}
+
+// Search streams a description of every object matching a prefix.
+func (s *Server) Search(req *SearchRequest, stream MemoryboxService_SearchServer) error {
+	if req.Prefix != "" {
+		if err := validName(req.Prefix); err != nil {
+			return err
+		}
+	}
+	files, err := s.store.Search(stream.Context(), req.Prefix)
+	if err != nil {
+		return toStatus(err)
+	}
+	for _, f := range files {
+		if err := stream.Send(fileInfo(f)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes an object from the store.
+func (s *Server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	if err := validName(req.Name); err != nil {
+		return nil, err
+	}
+	if err := s.store.Delete(ctx, req.Name); err != nil {
+		return nil, toStatus(err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+// Stat describes an object in the store.
+func (s *Server) Stat(ctx context.Context, req *StatRequest) (*FileInfo, error) {
+	if err := validName(req.Name); err != nil {
+		return nil, err
+	}
+	f, err := s.store.Stat(ctx, req.Name)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return fileInfo(f), nil
+}
+
+// MetaGet finds the metafile of a datafile by a prefix of its name.
+func (s *Server) MetaGet(ctx context.Context, req *MetaGetRequest) (*MetaFile, error) {
+	if err := validName(req.Name); err != nil {
+		return nil, err
+	}
+	f, err := archive.GetMetaByPrefix(ctx, s.store, req.Name)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	defer f.Close()
+	return &MetaFile{Name: f.Name, Meta: f.MetaBytes()}, nil
+}
+
+// validName rejects names which could refer to a location outside of the
+// store, such as those containing a path separator or "..".
+func validName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return status.Errorf(codes.InvalidArgument, "invalid name %q", name)
+	}
+	return nil
+}
+
+func fileInfo(f *file.File) *FileInfo {
+	return &FileInfo{
+		Name:         f.Name,
+		Size:         f.Size,
+		LastModified: f.LastModified.UnixNano(),
+	}
+}
+
+// statusCodes maps errors returned by stores to grpc status codes so clients
+// can map them back.
+var statusCodes = map[error]codes.Code{
+	os.ErrNotExist:   codes.NotFound,
+	os.ErrExist:      codes.AlreadyExists,
+	os.ErrInvalid:    codes.InvalidArgument,
+	os.ErrPermission: codes.PermissionDenied,
+}
+
+func toStatus(err error) error {
+	for target, code := range statusCodes {
+		if errors.Is(err, target) {
+			return status.Error(code, err.Error())
+		}
+	}
+	return err
+}
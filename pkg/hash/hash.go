@@ -0,0 +1,34 @@
+// Package hash holds the hashing functions memorybox names content with. It
+// is the single implementation every other package defers to, so names
+// produced in different places cannot drift apart.
+package hash
+
+import (
+	"encoding/hex"
+	sha256 "github.com/minio/sha256-simd"
+	stdhash "hash"
+	"io"
+)
+
+// Sha256Algorithm is the name of the sha256 algorithm in content names.
+const Sha256Algorithm = "sha256"
+
+// Sha256Suffix ends the name of all content hashed with Sha256.
+const Sha256Suffix = "-" + Sha256Algorithm
+
+// NewSha256 returns a new hash.Hash computing the sha256 checksum used to name
+// content. Callers hashing content incrementally must use it rather than
+// another sha256 implementation.
+func NewSha256() stdhash.Hash {
+	return sha256.New()
+}
+
+// Sha256 computes a sha256 message digest for a provided io.Reader. The
+// digest is hex encoded and ends with Sha256Suffix.
+func Sha256(source io.Reader) (digest string, size int64, err error) {
+	hash := NewSha256()
+	if size, err = io.Copy(hash, source); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)) + Sha256Suffix, size, nil
+}
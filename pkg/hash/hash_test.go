@@ -0,0 +1,62 @@
+package hash_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/tkellen/memorybox/pkg/hash"
+	"strings"
+	"testing"
+)
+
+type failingReader struct {
+	err error
+}
+
+func (r failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestSha256(t *testing.T) {
+	table := map[string]struct {
+		input        string
+		expected     string
+		expectedSize int64
+	}{
+		"empty content": {
+			input:    "",
+			expected: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" + hash.Sha256Suffix,
+		},
+		"content": {
+			input:        "hello world",
+			expected:     "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" + hash.Sha256Suffix,
+			expectedSize: 11,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			digest, size, err := hash.Sha256(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if digest != test.expected || size != test.expectedSize {
+				t.Fatalf("expected %s with size %d, got %s with size %d", test.expected, test.expectedSize, digest, size)
+			}
+		})
+	}
+	failure := errors.New("failure")
+	if _, _, err := hash.Sha256(failingReader{failure}); !errors.Is(err, failure) {
+		t.Fatalf("expected %s, got %v", failure, err)
+	}
+}
+
+func TestNewSha256(t *testing.T) {
+	content := "hello world"
+	expected, _, err := hash.Sha256(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := hash.NewSha256()
+	digest.Write([]byte(content))
+	if actual := hex.EncodeToString(digest.Sum(nil)) + hash.Sha256Suffix; actual != expected {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package localdiskstore
+
+import "os"
+
+// allocated reports the size of a file where the filesystem does not report
+// how much of the disk it occupies.
+func allocated(info os.FileInfo) int64 {
+	return info.Size()
+}
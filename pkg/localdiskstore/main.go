@@ -4,8 +4,12 @@ package localdiskstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/xattr"
+	"github.com/tkellen/memorybox/pkg/archive"
 	"github.com/tkellen/memorybox/pkg/file"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
@@ -13,29 +17,89 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 // Store implements archive.Store backed by local disk.
 type Store struct {
 	RootPath string
+	// FileMode is applied to every file written by the store.
+	FileMode os.FileMode
+	// DirMode is used when creating the root directory of the store.
+	DirMode os.FileMode
+	// VerifyOnGet makes Get ensure the content of every object named by a
+	// hash matches its name before returning it.
+	VerifyOnGet bool
+	// rename moves files for Delete, using os.Rename if nil. It is replaced
+	// in tests to simulate files locked by another process.
+	rename func(oldPath string, newPath string) error
 }
 
 // Name is used in the memorybox configuration file to determine which type of
 // store to instantiate.
 const Name = "localDisk"
 
+// Defaults holds the configuration values used for any that are not set.
+var Defaults = map[string]string{
+	"path":      "~/memorybox",
+	"file_mode": "0644",
+	"dir_mode":  "0755",
+}
+
+// Capabilities of Store beyond archive.Store.
+var (
+	_ archive.Store          = (*Store)(nil)
+	_ archive.PaginatedStore = (*Store)(nil)
+	_ archive.SeekableStore  = (*Store)(nil)
+	_ archive.RangeGetter    = (*Store)(nil)
+	_ archive.Renamer        = (*Store)(nil)
+	_ archive.AtomicStore    = (*Store)(nil)
+	_ archive.Appender       = (*Store)(nil)
+	_ archive.Watcher        = (*Store)(nil)
+	_ archive.DeletionPurger = (*Store)(nil)
+)
+
+// Default permissions for files and directories created by a Store.
+const (
+	DefaultFileMode os.FileMode = 0644
+	DefaultDirMode  os.FileMode = 0755
+)
+
 // New returns a reference to a Store instance.
 func New(rootPath string) *Store {
 	expanded, _ := homedir.Expand(rootPath)
-	return &Store{RootPath: expanded}
+	return &Store{
+		RootPath: expanded,
+		FileMode: DefaultFileMode,
+		DirMode:  DefaultDirMode,
+	}
 }
 
 // NewFromConfig instantiates a Store using configuration values that were
-// likely sourced from a configuration file target.
-func NewFromConfig(config map[string]string) *Store {
-	return New(config["path"])
+// likely sourced from a configuration file target. Permissions are expressed
+// as octal strings (e.g. "0600").
+func NewFromConfig(config map[string]string) (*Store, error) {
+	store := New(config["path"])
+	for key, mode := range map[string]*os.FileMode{
+		"file_mode": &store.FileMode,
+		"dir_mode":  &store.DirMode,
+	} {
+		if config[key] == "" {
+			continue
+		}
+		value, err := strconv.ParseUint(config[key], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		*mode = os.FileMode(value)
+	}
+	store.VerifyOnGet = config["verify_on_get"] == "true"
+	return store, nil
 }
 
 // String returns a human friendly representation of the Store.
@@ -45,7 +109,7 @@ func (s *Store) String() string {
 
 // Put writes the content of a supplied reader to local disk.
 func (s *Store) Put(_ context.Context, source io.Reader, name string, lastModified time.Time) error {
-	if err := os.MkdirAll(s.RootPath, 0755); err != nil {
+	if err := os.MkdirAll(s.RootPath, s.DirMode); err != nil {
 		return fmt.Errorf("could not create %s: %w", s.RootPath, err)
 	}
 	fullPath := filepath.Join(s.RootPath, name)
@@ -60,6 +124,135 @@ func (s *Store) Put(_ context.Context, source io.Reader, name string, lastModifi
 	}
 	defer f.Close()
 	defer os.Chtimes(f.Name(), lastModified, lastModified)
+	if err := os.Chmod(f.Name(), s.FileMode); err != nil {
+		return fmt.Errorf("chmod file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	s.setImportXattrs(name, source)
+	return nil
+}
+
+// Extended attributes recorded on files written by Put.
+const (
+	XattrSource     = "user.memorybox.source"
+	XattrImportedAt = "user.memorybox.importedAt"
+)
+
+// setImportXattrs records when a file was written and, if the content came
+// from a file.File, where it originally came from. Filesystems which do not
+// support extended attributes are ignored; the metafile remains the primary
+// record of these details.
+func (s *Store) setImportXattrs(name string, source io.Reader) {
+	if f, ok := source.(*file.File); ok && f.Source != "" {
+		s.SetXattr(name, XattrSource, f.Source)
+	}
+	s.SetXattr(name, XattrImportedAt, time.Now().UTC().Format(time.RFC3339))
+}
+
+// SetXattr assigns an extended attribute to an object. Linux requires keys to
+// be namespaced, e.g. user.memorybox.hash.
+func (s *Store) SetXattr(name string, key string, value string) error {
+	return xattr.Set(filepath.Join(s.RootPath, name), key, []byte(value))
+}
+
+// GetXattr reads an extended attribute of an object.
+func (s *Store) GetXattr(name string, key string) (string, error) {
+	value, err := xattr.Get(filepath.Join(s.RootPath, name), key)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// copyXattrs copies the extended attributes in the user namespace, where
+// memorybox records its own, from one file to another. Filesystems which do
+// not support extended attributes have none to copy.
+func copyXattrs(source string, dest string) error {
+	keys, err := xattr.List(source)
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "user.") {
+			continue
+		}
+		value, err := xattr.Get(source, key)
+		if err != nil {
+			return err
+		}
+		if err := xattr.Set(dest, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutIfAbsent writes the content of an io.Reader to local disk unless a file
+// with the same name already exists. The content is written to a temporary
+// file which is published with a hard link, so the file never exists with
+// partial content and only one of several concurrent calls for the same name
+// stores its content.
+func (s *Store) PutIfAbsent(_ context.Context, source io.Reader, name string, lastModified time.Time) (bool, error) {
+	if err := os.MkdirAll(s.RootPath, s.DirMode); err != nil {
+		return false, fmt.Errorf("could not create %s: %w", s.RootPath, err)
+	}
+	temp, err := ioutil.TempFile(s.RootPath, putPrefix+"*")
+	if err != nil {
+		return false, fmt.Errorf("create file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := io.Copy(temp, source); err != nil {
+		temp.Close()
+		return false, fmt.Errorf("write file: %w", err)
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return false, err
+	}
+	if err := temp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(temp.Name(), s.FileMode); err != nil {
+		return false, fmt.Errorf("chmod file: %w", err)
+	}
+	if err := os.Chtimes(temp.Name(), lastModified, lastModified); err != nil {
+		return false, err
+	}
+	if err := os.Link(temp.Name(), filepath.Join(s.RootPath, name)); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("link file: %w", err)
+	}
+	return true, nil
+}
+
+// PutSeekable writes content of a known size to local disk. Knowing the size
+// provides no benefit here so it behaves exactly like Put.
+func (s *Store) PutSeekable(ctx context.Context, source io.ReadSeeker, name string, lastModified time.Time, _ int64) error {
+	return s.Put(ctx, source, name, lastModified)
+}
+
+// Append adds data to the end of an object, creating it if needed. Each call
+// results in a single write to a file opened with O_APPEND so concurrent
+// appends are not interleaved.
+func (s *Store) Append(_ context.Context, name string, data []byte) error {
+	if err := os.MkdirAll(s.RootPath, s.DirMode); err != nil {
+		return fmt.Errorf("could not create %s: %w", s.RootPath, err)
+	}
+	f, err := os.OpenFile(filepath.Join(s.RootPath, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, s.FileMode)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("append file: %w", err)
+	}
 	return f.Sync()
 }
 
@@ -74,12 +267,187 @@ func (s *Store) Get(ctx context.Context, name string) (*file.File, error) {
 		return nil, openErr
 	}
 	f.Body = body
+	if s.VerifyOnGet && (f.IsMetaFile() || f.Algorithm() != file.UnknownAlgorithm) {
+		if err := f.HashVerify(); err != nil {
+			body.Close()
+			return nil, err
+		}
+	}
 	return f, nil
 }
 
-// Delete removes an object in storage by name.
+// GetRange reads the bytes of an object between two inclusive offsets.
+func (s *Store) GetRange(_ context.Context, name string, start int64, end int64) (io.ReadCloser, error) {
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("%w: invalid range %d-%d", os.ErrInvalid, start, end)
+	}
+	f, err := os.Open(filepath.Join(s.RootPath, name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, end-start+1), f}, nil
+}
+
+// Rename moves an object to a new name.
+func (s *Store) Rename(_ context.Context, oldName string, newName string) error {
+	return os.Rename(filepath.Join(s.RootPath, oldName), filepath.Join(s.RootPath, newName))
+}
+
+// deletedPrefix is prepended to the name of objects being deleted.
+const deletedPrefix = ".deleted-"
+
+// putPrefix starts the name of the temporary files PutIfAbsent writes to.
+const putPrefix = ".put-"
+
+// defragPrefix starts the name of the temporary files Defrag writes to.
+const defragPrefix = ".defrag-"
+
+// hidden reports if a file is one the store uses internally rather than an
+// object.
+func hidden(name string) bool {
+	return strings.HasPrefix(name, deletedPrefix) ||
+		strings.HasPrefix(name, putPrefix) ||
+		strings.HasPrefix(name, defragPrefix)
+}
+
+// DeletionGracePeriod is how long an object which could not be removed after
+// being renamed by Delete is kept before PurgeDeletions removes it.
+var DeletionGracePeriod = time.Minute
+
+// Delete removes an object in storage by name. The object is renamed out of
+// the way before it is removed so it disappears at once on every platform,
+// even while it is being read elsewhere; if it cannot be removed (windows
+// refuses while the file is open) it is left for PurgeDeletions. If the
+// rename fails the object is removed directly.
 func (s *Store) Delete(_ context.Context, name string) error {
-	return os.Remove(filepath.Join(s.RootPath, name))
+	path := filepath.Join(s.RootPath, name)
+	deleted := filepath.Join(s.RootPath, deletedPrefix+name)
+	rename := s.rename
+	if rename == nil {
+		rename = os.Rename
+	}
+	if err := rename(path, deleted); err != nil {
+		return os.Remove(path)
+	}
+	if err := os.Remove(deleted); err != nil {
+		now := time.Now()
+		os.Chtimes(deleted, now, now)
+	}
+	return nil
+}
+
+// PurgeDeletions removes objects left behind by Delete once they have waited
+// longer than DeletionGracePeriod. It is run by archive.GarbageCollect.
+func (s *Store) PurgeDeletions() error {
+	matches, err := filepath.Glob(filepath.Join(s.RootPath, deletedPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if time.Since(info.ModTime()) < DeletionGracePeriod {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Defrag rewrites every file in the store so the filesystem can allocate it
+// compactly. It returns the total number of bytes of disk saved, comparing the
+// blocks allocated to each file before and after where the platform reports
+// them. It does nothing on windows.
+func (s *Store) Defrag() (int64, error) {
+	return s.DefragWithProgress(nil)
+}
+
+// DefragWithProgress works like Defrag, calling progress after each file is
+// rewritten with the number of bytes saved.
+func (s *Store) DefragWithProgress(progress func(name string, saved int64)) (int64, error) {
+	if runtime.GOOS == "windows" {
+		return 0, nil
+	}
+	entries, err := ioutil.ReadDir(s.RootPath)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || hidden(entry.Name()) {
+			continue
+		}
+		saved, err := s.defrag(entry)
+		if err != nil {
+			return total, fmt.Errorf("defrag %s: %w", entry.Name(), err)
+		}
+		total = total + saved
+		if progress != nil {
+			progress(entry.Name(), saved)
+		}
+	}
+	return total, nil
+}
+
+// defrag copies a file to a temporary file alongside it and renames the copy
+// over the original, preserving its permissions, modification time and
+// extended attributes.
+func (s *Store) defrag(info os.FileInfo) (int64, error) {
+	path := filepath.Join(s.RootPath, info.Name())
+	source, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+	temp, err := ioutil.TempFile(s.RootPath, defragPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	if err := func() error {
+		defer temp.Close()
+		if _, err := io.Copy(temp, source); err != nil {
+			return err
+		}
+		return temp.Sync()
+	}(); err != nil {
+		os.Remove(temp.Name())
+		return 0, err
+	}
+	if err := os.Chmod(temp.Name(), info.Mode().Perm()); err != nil {
+		os.Remove(temp.Name())
+		return 0, err
+	}
+	if err := os.Chtimes(temp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(temp.Name())
+		return 0, err
+	}
+	if err := copyXattrs(path, temp.Name()); err != nil {
+		os.Remove(temp.Name())
+		return 0, err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		os.Remove(temp.Name())
+		return 0, err
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return allocated(info) - allocated(after), nil
 }
 
 // Search finds matching files in storage by prefix.
@@ -90,6 +458,9 @@ func (s *Store) Search(ctx context.Context, search string) (file.List, error) {
 		return nil, fmt.Errorf("local store search: %s", err)
 	}
 	for _, entry := range results {
+		if hidden(filepath.Base(entry)) {
+			continue
+		}
 		if object, err := s.Stat(ctx, filepath.Base(entry)); err == nil {
 			matches = append(matches, object)
 		}
@@ -98,10 +469,61 @@ func (s *Store) Search(ctx context.Context, search string) (file.List, error) {
 	return matches, nil
 }
 
+// FindByContent finds the name of a datafile in storage whose content has the
+// supplied hash. The algorithm suffix of the hash is ignored, allowing content
+// stored under a name from one algorithm to be found by its digest alone.
+func (s *Store) FindByContent(ctx context.Context, hash string) (string, error) {
+	digest := (&file.File{Name: hash}).Digest()
+	if digest == "" {
+		return "", fmt.Errorf("%w: empty hash", os.ErrInvalid)
+	}
+	matches, err := s.Search(ctx, digest)
+	if err != nil {
+		return "", err
+	}
+	for _, match := range matches {
+		if !match.IsMetaFile() && match.Digest() == digest {
+			return match.Name, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no content with hash %s", os.ErrNotExist, hash)
+}
+
+// SearchPage finds up to limit objects in storage by prefix whose names sort
+// after the cursor. The returned cursor is the name of the last object in the
+// page, or empty if no objects remain.
+func (s *Store) SearchPage(ctx context.Context, prefix string, cursor string, limit int) (file.List, string, error) {
+	if limit < 1 {
+		return nil, "", fmt.Errorf("%w: page limit must be at least 1, got %d", os.ErrInvalid, limit)
+	}
+	results, err := filepath.Glob(filepath.Join(s.RootPath, prefix+"*"))
+	if err != nil {
+		return nil, "", fmt.Errorf("local store search: %s", err)
+	}
+	names := make([]string, 0, len(results))
+	for _, entry := range results {
+		if name := filepath.Base(entry); name > cursor && !hidden(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var matches file.List
+	next := ""
+	for index, name := range names {
+		if len(matches) == limit {
+			next = names[index-1]
+			break
+		}
+		if object, err := s.Stat(ctx, name); err == nil {
+			matches = append(matches, object)
+		}
+	}
+	return matches, next, nil
+}
+
 // Concat an array of byte arrays ordered identically with the input files
 // supplied. Note that this loads the entire dataset into memory.
 func (s *Store) Concat(ctx context.Context, concurrency int, files []string) ([][]byte, error) {
-	var err error
 	result := make([][]byte, len(files))
 	sem := semaphore.NewWeighted(int64(concurrency))
 	eg, egCtx := errgroup.WithContext(ctx)
@@ -113,6 +535,7 @@ func (s *Store) Concat(ctx context.Context, concurrency int, files []string) ([]
 			}
 			eg.Go(func() error {
 				defer sem.Release(1)
+				var err error
 				result[index], err = ioutil.ReadFile(filepath.Join(s.RootPath, item))
 				return err
 			})
@@ -131,5 +554,91 @@ func (s *Store) Stat(_ context.Context, search string) (*file.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return file.NewStub(filepath.Base(search), stat.Size(), stat.ModTime()), nil
+	f := file.NewStub(filepath.Base(search), stat.Size(), stat.ModTime())
+	if source, err := s.GetXattr(search, XattrSource); err == nil {
+		f.Source = source
+	}
+	return f, nil
+}
+
+// Exists determines if an object is in the store.
+func (s *Store) Exists(ctx context.Context, name string) (bool, error) {
+	if _, err := s.Stat(ctx, name); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchDebounce is how long an object must go without being written before a
+// put event is sent for it. Writing a single object produces several
+// filesystem events; they are reported as one.
+var WatchDebounce = 100 * time.Millisecond
+
+// Watch reports objects which are put into or deleted from the store until
+// the context is cancelled. Put events are sent once an object has not been
+// written to for WatchDebounce.
+func (s *Store) Watch(ctx context.Context, prefix string, events chan<- archive.StoreEvent) error {
+	if err := os.MkdirAll(s.RootPath, s.DirMode); err != nil {
+		return fmt.Errorf("could not create %s: %w", s.RootPath, err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(s.RootPath); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(WatchDebounce / 2)
+	defer ticker.Stop()
+	// pending holds the time each object that is being written was last
+	// written to.
+	pending := map[string]time.Time{}
+	send := func(event archive.StoreEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			return err
+		case event := <-watcher.Events:
+			name := filepath.Base(event.Name)
+			if !strings.HasPrefix(name, prefix) || hidden(name) {
+				continue
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+				pending[name] = time.Now()
+			}
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				delete(pending, name)
+				if !send(archive.StoreEvent{Type: archive.StoreEventDelete, Name: name}) {
+					return nil
+				}
+			}
+		case now := <-ticker.C:
+			var settled []string
+			for name, written := range pending {
+				if now.Sub(written) >= WatchDebounce {
+					settled = append(settled, name)
+				}
+			}
+			sort.Strings(settled)
+			for _, name := range settled {
+				delete(pending, name)
+				if !send(archive.StoreEvent{Type: archive.StoreEventPut, Name: name}) {
+					return nil
+				}
+			}
+		}
+	}
 }
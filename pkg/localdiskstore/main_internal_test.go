@@ -0,0 +1,43 @@
+package localdiskstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_Delete_RenameFails(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	if err := ioutil.WriteFile(filepath.Join(tempDir, "test"), []byte("test"), 0644); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	renames := 0
+	store := New(tempDir)
+	store.rename = func(string, string) error {
+		renames++
+		return errors.New("file is locked")
+	}
+	if err := store.Delete(context.Background(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if renames != 1 {
+		t.Fatalf("expected a rename to be attempted once, got %d", renames)
+	}
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected object to be removed directly, found %d files", len(entries))
+	}
+	if err := store.Delete(context.Background(), "test"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+}
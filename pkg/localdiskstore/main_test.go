@@ -7,13 +7,23 @@ package localdiskstore_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"github.com/google/go-cmp/cmp"
 	"github.com/tkellen/memorybox/internal/test"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
 	"github.com/tkellen/memorybox/pkg/localdiskstore"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -28,12 +38,220 @@ func TestStoreSuite(t *testing.T) {
 }
 
 func TestNewFromConfig(t *testing.T) {
-	expected := "test"
-	actual := localdiskstore.NewFromConfig(map[string]string{
-		"path": expected,
-	})
-	if expected != actual.RootPath {
-		t.Fatalf("expected rootPath of %s, got %s", expected, actual.RootPath)
+	table := map[string]struct {
+		config           map[string]string
+		expectedFileMode os.FileMode
+		expectedDirMode  os.FileMode
+		expectedVerify   bool
+		expectErr        bool
+	}{
+		"modes default when unset": {
+			config:           map[string]string{"path": "test"},
+			expectedFileMode: localdiskstore.DefaultFileMode,
+			expectedDirMode:  localdiskstore.DefaultDirMode,
+		},
+		"modes are parsed as octal": {
+			config:           map[string]string{"path": "test", "file_mode": "0600", "dir_mode": "0700"},
+			expectedFileMode: 0600,
+			expectedDirMode:  0700,
+		},
+		"verification on get": {
+			config:           map[string]string{"path": "test", "verify_on_get": "true"},
+			expectedFileMode: localdiskstore.DefaultFileMode,
+			expectedDirMode:  localdiskstore.DefaultDirMode,
+			expectedVerify:   true,
+		},
+		"invalid file mode": {
+			config:    map[string]string{"path": "test", "file_mode": "rw"},
+			expectErr: true,
+		},
+		"invalid dir mode": {
+			config:    map[string]string{"path": "test", "dir_mode": "0999"},
+			expectErr: true,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			actual, err := localdiskstore.NewFromConfig(test.config)
+			if test.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual.RootPath != "test" {
+				t.Fatalf("expected rootPath of %s, got %s", "test", actual.RootPath)
+			}
+			if actual.FileMode != test.expectedFileMode {
+				t.Fatalf("expected file mode %o, got %o", test.expectedFileMode, actual.FileMode)
+			}
+			if actual.DirMode != test.expectedDirMode {
+				t.Fatalf("expected dir mode %o, got %o", test.expectedDirMode, actual.DirMode)
+			}
+			if actual.VerifyOnGet != test.expectedVerify {
+				t.Fatalf("expected verify on get %v, got %v", test.expectedVerify, actual.VerifyOnGet)
+			}
+		})
+	}
+}
+
+func TestStore_Get_Verify(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	store := localdiskstore.New(tempDir)
+	store.VerifyOnGet = true
+	ctx := context.Background()
+	f, err := file.NewSha256("test", bytes.NewReader([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	for name, content := range map[string]string{
+		f.Name:       "test",
+		"bad-sha256": "test",
+		"unhashed":   "anything",
+	} {
+		if err := store.Put(ctx, strings.NewReader(content), name, time.Now()); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	for _, name := range []string{f.Name, "unhashed"} {
+		got, err := store.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("expected %s to be returned: %s", name, err)
+		}
+		got.Close()
+	}
+	if _, err := store.Get(ctx, "bad-sha256"); !errors.Is(err, file.ErrHashMismatch) {
+		t.Fatalf("expected %s, got %v", file.ErrHashMismatch, err)
+	}
+}
+
+func TestStore_FindByContent(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	store := localdiskstore.New(tempDir)
+	ctx := context.Background()
+	original, err := file.NewSha256("original", bytes.NewReader([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	renamed, err := file.NewSha256("renamed", bytes.NewReader([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := store.Put(ctx, original, original.Name, original.LastModified); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := store.Put(ctx, bytes.NewReader(*original.Meta), file.MetaNameFrom(original.Name), original.LastModified); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	for _, hash := range []string{renamed.Name, renamed.Digest(), renamed.Digest() + "-other"} {
+		match, err := store.FindByContent(ctx, hash)
+		if err != nil {
+			t.Fatalf("expected %s to be found: %s", hash, err)
+		}
+		if match != original.Name {
+			t.Fatalf("expected %s, got %s", original.Name, match)
+		}
+	}
+	if _, err := store.FindByContent(ctx, renamed.Digest()[:8]); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s for partial hash, got %v", os.ErrNotExist, err)
+	}
+	if _, err := store.FindByContent(ctx, "missing-sha256"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+	if _, err := store.FindByContent(ctx, ""); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+	}
+}
+
+func TestStore_Put_Permissions(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	store := localdiskstore.New(path.Join(tempDir, "store"))
+	store.FileMode = 0600
+	store.DirMode = 0700
+	if err := store.Put(context.Background(), bytes.NewReader([]byte("test")), "test", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Stat(path.Join(store.RootPath, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Mode().Perm() != store.FileMode {
+		t.Fatalf("expected file mode %o, got %o", store.FileMode, fileInfo.Mode().Perm())
+	}
+	dirInfo, err := os.Stat(store.RootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirInfo.Mode().Perm() != store.DirMode {
+		t.Fatalf("expected dir mode %o, got %o", store.DirMode, dirInfo.Mode().Perm())
+	}
+}
+
+func TestStore_Xattr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("extended attributes are not supported on windows")
+	}
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	ctx := context.Background()
+	store := localdiskstore.New(tempDir)
+	if err := store.Put(ctx, bytes.NewReader([]byte("probe")), "probe", time.Now()); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := store.SetXattr("probe", "user.probe", "probe"); err != nil {
+		t.Skipf("extended attributes are not supported by %s: %s", tempDir, err)
+	}
+	f, err := file.NewSha256("source.txt", bytes.NewReader([]byte("test")), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := store.Put(ctx, f, f.Name, f.LastModified); err != nil {
+		t.Fatal(err)
+	}
+	if source, err := store.GetXattr(f.Name, localdiskstore.XattrSource); err != nil || source != "source.txt" {
+		t.Fatalf("expected source.txt to be recorded, got %q (%v)", source, err)
+	}
+	importedAt, err := store.GetXattr(f.Name, localdiskstore.XattrImportedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse(time.RFC3339, importedAt); err != nil {
+		t.Fatalf("expected RFC3339 import time, got %s", importedAt)
+	}
+	stat, err := store.Stat(ctx, f.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Source != "source.txt" {
+		t.Fatalf("expected Stat to read source from xattr, got %q", stat.Source)
+	}
+	if err := store.SetXattr(f.Name, "user.memorybox.hash", f.Name); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := store.GetXattr(f.Name, "user.memorybox.hash"); err != nil || hash != f.Name {
+		t.Fatalf("expected %s, got %q (%v)", f.Name, hash, err)
+	}
+	if _, err := store.GetXattr(f.Name, "user.missing"); err == nil {
+		t.Fatal("expected missing attribute to fail")
 	}
 }
 
@@ -73,3 +291,457 @@ func TestStore_Put_CannotCreateFile(t *testing.T) {
 		t.Fatal("expected put error")
 	}
 }
+
+func TestStore_Append(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	store := localdiskstore.New(tempDir)
+	count := 100
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			line := []byte(fmt.Sprintf("%s-%03d\n", strings.Repeat("x", 512), i))
+			if err := store.Append(context.Background(), "log", line); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	content, err := ioutil.ReadFile(path.Join(tempDir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != count {
+		t.Fatalf("expected %d lines, got %d", count, len(lines))
+	}
+	seen := map[string]struct{}{}
+	for _, line := range lines {
+		if len(line) != 516 || !strings.HasPrefix(line, strings.Repeat("x", 512)) {
+			t.Fatalf("expected each append to be written intact, got %q", line)
+		}
+		seen[line] = struct{}{}
+	}
+	if len(seen) != count {
+		t.Fatalf("expected %d distinct lines, got %d", count, len(seen))
+	}
+}
+
+func TestStore_PutIfAbsent(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	store := localdiskstore.New(tempDir)
+	count := 2
+	results := make([]bool, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := strings.NewReader(fmt.Sprintf("writer %d", i))
+			stored, err := store.PutIfAbsent(context.Background(), content, "test", time.Now())
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = stored
+		}(i)
+	}
+	wg.Wait()
+	if results[0] == results[1] {
+		t.Fatalf("expected exactly one put to store content, got %v", results)
+	}
+	winner := 0
+	if results[1] {
+		winner = 1
+	}
+	content, err := ioutil.ReadFile(path.Join(tempDir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("writer %d", winner); string(content) != expected {
+		t.Fatalf("expected %s, got %s", expected, content)
+	}
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected temporary files to be removed, got %d files", len(entries))
+	}
+}
+
+func TestStore_PutIfAbsent_ReadFails(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	store := localdiskstore.New(tempDir)
+	if _, err := store.PutIfAbsent(context.Background(), iotest.TimeoutReader(strings.NewReader("test")), "test", time.Now()); err == nil {
+		t.Fatal("expected error")
+	}
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no partial file to be left, got %d files", len(entries))
+	}
+}
+
+func TestStore_SearchPage(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	for i := 0; i < 2500; i++ {
+		if err := ioutil.WriteFile(path.Join(tempDir, fmt.Sprintf("%04d", i)), []byte("test"), 0644); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	store := localdiskstore.New(tempDir)
+	expected, err := store.Search(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := map[string]struct {
+		limit         int
+		expectedPages int
+		expectedErr   error
+	}{
+		"pages of 1000": {limit: 1000, expectedPages: 3},
+		"limit of zero": {limit: 0, expectedErr: os.ErrInvalid},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var actual []string
+			pages := 0
+			cursor := ""
+			for {
+				page, next, err := store.SearchPage(context.Background(), "", cursor, test.limit)
+				if test.expectedErr != nil {
+					if !errors.Is(err, test.expectedErr) {
+						t.Fatalf("expected %v, got %v", test.expectedErr, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages++
+				actual = append(actual, page.Names()...)
+				if next == "" {
+					break
+				}
+				cursor = next
+			}
+			if pages != test.expectedPages {
+				t.Fatalf("expected %d pages, got %d", test.expectedPages, pages)
+			}
+			if !reflect.DeepEqual(expected.Names(), actual) {
+				t.Fatalf("expected paging to find the same %d files as searching, found %d", len(expected), len(actual))
+			}
+		})
+	}
+}
+
+func TestStore_GetRange(t *testing.T) {
+	ctx := context.Background()
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	store := localdiskstore.New(tempDir)
+	if err := store.Put(ctx, strings.NewReader("hello"), "test", time.Now()); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	table := map[string]struct {
+		name        string
+		start       int64
+		end         int64
+		expected    []byte
+		expectedErr error
+	}{
+		"start of file": {name: "test", start: 0, end: 3, expected: []byte("hell")},
+		"end of file":   {name: "test", start: 3, end: 4, expected: []byte("lo")},
+		"past the end":  {name: "test", start: 3, end: 100, expected: []byte("lo")},
+		"invalid range": {name: "test", start: 3, end: 1, expectedErr: os.ErrInvalid},
+		"missing file":  {name: "missing", start: 0, end: 3, expectedErr: os.ErrNotExist},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			body, err := store.GetRange(ctx, test.name, test.start, test.end)
+			if test.expectedErr != nil {
+				if !errors.Is(err, test.expectedErr) {
+					t.Fatalf("expected error %s, got %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+			actual, readErr := ioutil.ReadAll(body)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if !bytes.Equal(test.expected, actual) {
+				t.Fatalf("expected %s, got %s", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestStore_Delete(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	ctx := context.Background()
+	store := localdiskstore.New(tempDir)
+	if err := store.Put(ctx, strings.NewReader("test"), "test", time.Now()); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := store.Delete(ctx, "test"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no files to remain, found %d", len(entries))
+	}
+	if err := store.Delete(ctx, "test"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestStore_Rename(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	ctx := context.Background()
+	store := localdiskstore.New(tempDir)
+	if err := store.Put(ctx, strings.NewReader("test"), "old", time.Now()); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if err := store.Rename(ctx, "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := store.Exists(ctx, "old"); exists {
+		t.Fatal("expected old name to be absent")
+	}
+	f, err := store.Get(ctx, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, readErr := ioutil.ReadAll(f)
+	f.Close()
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if string(content) != "test" {
+		t.Fatalf("expected content test, got %s", content)
+	}
+	if err := store.Rename(ctx, "old", "other"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestStore_PurgeDeletions(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	old := time.Now().Add(-2 * localdiskstore.DeletionGracePeriod)
+	for name, modified := range map[string]time.Time{
+		".deleted-old":    old,
+		".deleted-recent": time.Now(),
+		"old":             old,
+	} {
+		path := filepath.Join(tempDir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	store := localdiskstore.New(tempDir)
+	list, err := store.Search(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "old" {
+		t.Fatalf("expected deletions to be hidden from search, got %v", list.Names())
+	}
+	if err := store.PurgeDeletions(); err != nil {
+		t.Fatal(err)
+	}
+	var remaining []string
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		remaining = append(remaining, entry.Name())
+	}
+	if diff := cmp.Diff([]string{".deleted-recent", "old"}, remaining); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestStore_Defrag(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	store := localdiskstore.New(tempDir)
+	content := bytes.Repeat([]byte("test"), 1024)
+	lastModified := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.Put(context.Background(), bytes.NewReader(content), "file", lastModified); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	// Extended attributes are only checked where the filesystem has them.
+	hasXattrs := store.SetXattr("file", localdiskstore.XattrSource, "source.txt") == nil
+	// Files left by a defrag which was interrupted are not objects.
+	if err := ioutil.WriteFile(path.Join(tempDir, ".defrag-interrupted"), content, 0644); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	var progressed []string
+	var progressSaved int64
+	saved, err := store.DefragWithProgress(func(name string, fileSaved int64) {
+		progressed = append(progressed, name)
+		progressSaved = progressSaved + fileSaved
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != progressSaved {
+		t.Fatalf("expected %d bytes saved in total, got %d", progressSaved, saved)
+	}
+	if !reflect.DeepEqual([]string{"file"}, progressed) {
+		t.Fatalf("expected progress for file, got %v", progressed)
+	}
+	actual, readErr := ioutil.ReadFile(path.Join(tempDir, "file"))
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if !bytes.Equal(content, actual) {
+		t.Fatal("expected content to be unchanged")
+	}
+	stat, statErr := store.Stat(context.Background(), "file")
+	if statErr != nil {
+		t.Fatal(statErr)
+	}
+	if !stat.LastModified.Equal(lastModified) {
+		t.Fatalf("expected last modified time %s, got %s", lastModified, stat.LastModified)
+	}
+	if hasXattrs {
+		if source, err := store.GetXattr("file", localdiskstore.XattrSource); err != nil || source != "source.txt" {
+			t.Fatalf("expected source.txt to survive defrag, got %q (%v)", source, err)
+		}
+		if stat.Source != "source.txt" {
+			t.Fatalf("expected Stat to read source from xattr after defrag, got %q", stat.Source)
+		}
+	}
+	entries, _ := ioutil.ReadDir(tempDir)
+	if len(entries) != 2 {
+		t.Fatalf("expected no new temporary files to remain, found %d files", len(entries))
+	}
+	files, searchErr := store.Search(context.Background(), "")
+	if searchErr != nil {
+		t.Fatal(searchErr)
+	}
+	if len(files) != 1 || files[0].Name != "file" {
+		t.Fatalf("expected only file to be found, got %v", files)
+	}
+}
+
+func TestStore_Watch(t *testing.T) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		t.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	store := localdiskstore.New(tempDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan archive.StoreEvent)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- store.Watch(ctx, "keep", events)
+	}()
+	// Give the watcher time to start before changing anything.
+	time.Sleep(50 * time.Millisecond)
+	for _, name := range []string{"ignored", "keep"} {
+		if err := store.Put(ctx, strings.NewReader("test"), name, time.Now()); err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+	}
+	next := func() archive.StoreEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+		return archive.StoreEvent{}
+	}
+	if diff := cmp.Diff(archive.StoreEvent{Type: archive.StoreEventPut, Name: "keep"}, next()); diff != "" {
+		t.Fatal(diff)
+	}
+	if err := store.Delete(ctx, "keep"); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	if diff := cmp.Diff(archive.StoreEvent{Type: archive.StoreEventDelete, Name: "keep"}, next()); diff != "" {
+		t.Fatal(diff)
+	}
+	cancel()
+	if err := <-watchErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkStore_Search(b *testing.B) {
+	tempDir, tempErr := ioutil.TempDir("", "*")
+	if tempErr != nil {
+		b.Fatalf("test setup: %s", tempErr)
+	}
+	defer os.RemoveAll(tempDir)
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("%02x%06d", i%256, i)
+		if err := ioutil.WriteFile(filepath.Join(tempDir, name), nil, 0644); err != nil {
+			b.Fatalf("test setup: %s", err)
+		}
+	}
+	ctx := context.Background()
+	store := localdiskstore.New(tempDir)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matches, err := store.Search(ctx, "ab")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(matches) == 0 {
+			b.Fatal("expected matches")
+		}
+	}
+}
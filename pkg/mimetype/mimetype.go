@@ -0,0 +1,139 @@
+// Package mimetype detects the type of content from the bytes at its start. It
+// builds on the detection provided by the golang standard library, using a
+// table of magic numbers for common formats the standard library reports
+// generically or misclassifies.
+package mimetype
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// SniffLen is the number of bytes inspected to determine the type of content.
+const SniffLen = 512
+
+// signature identifies a type of content by a sequence of magic bytes at an
+// offset. If contains is set, it must also appear in the inspected bytes.
+type signature struct {
+	offset   int
+	magic    []byte
+	contains []byte
+	mime     string
+}
+
+func (s signature) match(data []byte) bool {
+	end := s.offset + len(s.magic)
+	if end > len(data) || !bytes.Equal(data[s.offset:end], s.magic) {
+		return false
+	}
+	return s.contains == nil || bytes.Contains(data, s.contains)
+}
+
+// binarySignatures refine content the standard library could not identify.
+// They are checked in order; more specific entries must come first.
+var binarySignatures = []signature{
+	{magic: []byte("\x7fELF"), mime: "application/x-elf"},
+	{magic: []byte("\xfe\xed\xfa\xce"), mime: "application/x-mach-binary"},
+	{magic: []byte("\xfe\xed\xfa\xcf"), mime: "application/x-mach-binary"},
+	{magic: []byte("\xce\xfa\xed\xfe"), mime: "application/x-mach-binary"},
+	{magic: []byte("\xcf\xfa\xed\xfe"), mime: "application/x-mach-binary"},
+	{magic: []byte("\xca\xfe\xba\xbe"), mime: "application/java-vm"},
+	{magic: []byte("MZ"), mime: "application/vnd.microsoft.portable-executable"},
+	{magic: []byte("!<arch>\ndebian"), mime: "application/vnd.debian.binary-package"},
+	{magic: []byte("!<arch>\n"), mime: "application/x-archive"},
+	{magic: []byte("BZh"), mime: "application/x-bzip2"},
+	{magic: []byte("\xfd7zXZ\x00"), mime: "application/x-xz"},
+	{magic: []byte("7z\xbc\xaf\x27\x1c"), mime: "application/x-7z-compressed"},
+	{magic: []byte("\x28\xb5\x2f\xfd"), mime: "application/zstd"},
+	{offset: 257, magic: []byte("ustar"), mime: "application/x-tar"},
+	{magic: []byte("SQLite format 3\x00"), mime: "application/vnd.sqlite3"},
+	{offset: 4, magic: []byte("ftypqt  "), mime: "video/quicktime"},
+	{offset: 4, magic: []byte("ftypheic"), mime: "image/heic"},
+	{offset: 4, magic: []byte("ftypavif"), mime: "image/avif"},
+	{offset: 4, magic: []byte("ftypM4A "), mime: "audio/mp4"},
+	{offset: 4, magic: []byte("ftyp"), mime: "video/mp4"},
+	{magic: []byte("fLaC"), mime: "audio/flac"},
+	{magic: []byte("II*\x00"), mime: "image/tiff"},
+	{magic: []byte("MM\x00*"), mime: "image/tiff"},
+	{magic: []byte("8BPS"), mime: "image/vnd.adobe.photoshop"},
+}
+
+// textSignatures refine content the standard library reports as plain text.
+var textSignatures = []signature{
+	{magic: []byte("{\\rtf"), mime: "text/rtf"},
+}
+
+// refinements maps the generic results from the standard library to the
+// signatures used to refine them. Binary signatures are never applied to
+// content that sniffs as text, so text that happens to start with a short
+// magic number such as "MZ" or "BZh" is left alone.
+var refinements = map[string][]signature{
+	"application/octet-stream":  binarySignatures,
+	"text/plain; charset=utf-8": textSignatures,
+	"video/webm": {
+		{magic: []byte("\x1a\x45\xdf\xa3"), contains: []byte("matroska"), mime: "video/x-matroska"},
+	},
+}
+
+// svgResults holds the results from the standard library which may be SVG.
+var svgResults = map[string]bool{
+	"text/plain; charset=utf-8": true,
+	"text/xml; charset=utf-8":   true,
+}
+
+// isSVG reports if content starts with an svg element, optionally preceded by
+// an XML prolog: a declaration, comments and a doctype.
+func isSVG(data []byte) bool {
+	rest := bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	for {
+		rest = bytes.TrimLeft(rest, " \t\r\n")
+		var closing string
+		switch {
+		case bytes.HasPrefix(rest, []byte("<?xml")):
+			closing = "?>"
+		case bytes.HasPrefix(rest, []byte("<!--")):
+			closing = "-->"
+		case bytes.HasPrefix(rest, []byte("<!DOCTYPE")):
+			closing = ">"
+		default:
+			return bytes.HasPrefix(rest, []byte("<svg")) && len(rest) > 4 &&
+				bytes.IndexByte([]byte(" \t\r\n>/"), rest[4]) != -1
+		}
+		end := bytes.Index(rest, []byte(closing))
+		if end == -1 {
+			return false
+		}
+		rest = rest[end+len(closing):]
+	}
+}
+
+// Detect determines the mime type of the content of a reader. The reader is
+// rewound to the start after inspecting it.
+func Detect(reader io.ReadSeeker) (string, error) {
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	sniff := make([]byte, SniffLen)
+	n, err := io.ReadFull(reader, sniff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return detect(sniff[:n]), nil
+}
+
+func detect(data []byte) string {
+	detected := http.DetectContentType(data)
+	if svgResults[detected] && isSVG(data) {
+		return "image/svg+xml"
+	}
+	for _, candidate := range refinements[detected] {
+		if candidate.match(data) {
+			return candidate.mime
+		}
+	}
+	return detected
+}
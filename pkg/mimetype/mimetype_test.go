@@ -0,0 +1,101 @@
+package mimetype_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/mattetti/filebuffer"
+	"github.com/tkellen/memorybox/pkg/mimetype"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// fixture produces content starting with magic bytes at an offset, padded with
+// zeros.
+func fixture(offset int, magic string) []byte {
+	data := make([]byte, offset+len(magic)+16)
+	copy(data[offset:], magic)
+	return data
+}
+
+func TestDetect(t *testing.T) {
+	table := map[string]struct {
+		input    []byte
+		expected string
+	}{
+		"png":                    {input: fixture(0, "\x89PNG\r\n\x1a\n"), expected: "image/png"},
+		"jpeg":                   {input: fixture(0, "\xff\xd8\xff"), expected: "image/jpeg"},
+		"gif":                    {input: fixture(0, "GIF89a"), expected: "image/gif"},
+		"webp":                   {input: fixture(0, "RIFF\x00\x00\x00\x00WEBPVP"), expected: "image/webp"},
+		"bmp":                    {input: fixture(0, "BM"), expected: "image/bmp"},
+		"tiff":                   {input: fixture(0, "II*\x00"), expected: "image/tiff"},
+		"psd":                    {input: fixture(0, "8BPS"), expected: "image/vnd.adobe.photoshop"},
+		"heic":                   {input: fixture(0, "\x00\x00\x00\x18ftypheic"), expected: "image/heic"},
+		"avif":                   {input: fixture(0, "\x00\x00\x00\x18ftypavif"), expected: "image/avif"},
+		"svg":                    {input: []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`), expected: "image/svg+xml"},
+		"mp4":                    {input: fixture(0, "\x00\x00\x00\x18ftypmp42"), expected: "video/mp4"},
+		"quicktime":              {input: fixture(0, "\x00\x00\x00\x14ftypqt  "), expected: "video/quicktime"},
+		"m4a":                    {input: fixture(0, "\x00\x00\x00\x20ftypM4A "), expected: "audio/mp4"},
+		"mkv":                    {input: fixture(0, "\x1a\x45\xdf\xa3\x93\x42\x82\x88matroska"), expected: "video/x-matroska"},
+		"webm":                   {input: fixture(0, "\x1a\x45\xdf\xa3\x9f\x42\x82\x84webm"), expected: "video/webm"},
+		"flac":                   {input: fixture(0, "fLaC"), expected: "audio/flac"},
+		"mp3":                    {input: fixture(0, "ID3"), expected: "audio/mpeg"},
+		"ogg":                    {input: fixture(0, "OggS\x00"), expected: "application/ogg"},
+		"wav":                    {input: fixture(0, "RIFF\x00\x00\x00\x00WAVE"), expected: "audio/wave"},
+		"pdf":                    {input: fixture(0, "%PDF-"), expected: "application/pdf"},
+		"rtf":                    {input: []byte(`{\rtf1\ansi hello}`), expected: "text/rtf"},
+		"zip":                    {input: fixture(0, "PK\x03\x04"), expected: "application/zip"},
+		"gzip":                   {input: fixture(0, "\x1f\x8b\x08"), expected: "application/x-gzip"},
+		"bzip2":                  {input: fixture(0, "BZh91AY&SY"), expected: "application/x-bzip2"},
+		"xz":                     {input: fixture(0, "\xfd7zXZ\x00"), expected: "application/x-xz"},
+		"7z":                     {input: fixture(0, "7z\xbc\xaf\x27\x1c"), expected: "application/x-7z-compressed"},
+		"zstd":                   {input: fixture(0, "\x28\xb5\x2f\xfd"), expected: "application/zstd"},
+		"rar":                    {input: fixture(0, "Rar!\x1a\x07\x00"), expected: "application/x-rar-compressed"},
+		"tar":                    {input: fixture(257, "ustar\x0000"), expected: "application/x-tar"},
+		"deb":                    {input: fixture(0, "!<arch>\ndebian-binary"), expected: "application/vnd.debian.binary-package"},
+		"elf":                    {input: fixture(0, "\x7fELF\x02\x01\x01"), expected: "application/x-elf"},
+		"mach-o":                 {input: fixture(0, "\xcf\xfa\xed\xfe"), expected: "application/x-mach-binary"},
+		"java class":             {input: fixture(0, "\xca\xfe\xba\xbe"), expected: "application/java-vm"},
+		"pe":                     {input: fixture(0, "MZ\x90\x00"), expected: "application/vnd.microsoft.portable-executable"},
+		"wasm":                   {input: fixture(0, "\x00asm\x01\x00\x00\x00"), expected: "application/wasm"},
+		"sqlite":                 {input: fixture(0, "SQLite format 3\x00"), expected: "application/vnd.sqlite3"},
+		"html":                   {input: []byte("<!DOCTYPE html><html></html>"), expected: "text/html; charset=utf-8"},
+		"svg without prolog":     {input: []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), expected: "image/svg+xml"},
+		"svg after comment":      {input: []byte("<?xml version=\"1.0\"?>\n<!-- drawn by hand -->\n<svg></svg>"), expected: "image/svg+xml"},
+		"text mentioning svg":    {input: []byte("use an <svg> element"), expected: "text/plain; charset=utf-8"},
+		"xml containing svg":     {input: []byte(`<?xml version="1.0"?><doc><svg></svg></doc>`), expected: "text/xml; charset=utf-8"},
+		"text starting with MZ":  {input: []byte("MZ is a postal abbreviation"), expected: "text/plain; charset=utf-8"},
+		"text starting with BZh": {input: []byte("BZh is not bzip2 here"), expected: "text/plain; charset=utf-8"},
+		"plain text":             {input: []byte("hello"), expected: "text/plain; charset=utf-8"},
+		"unknown":                {input: fixture(0, "\x00\x01\x02\x03"), expected: "application/octet-stream"},
+		"empty":                  {input: []byte{}, expected: "text/plain; charset=utf-8"},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			reader := bytes.NewReader(test.input)
+			actual, err := mimetype.Detect(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, actual)
+			}
+			content, readErr := ioutil.ReadAll(reader)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if !bytes.Equal(test.input, content) {
+				t.Fatal("expected reader to be rewound")
+			}
+		})
+	}
+}
+
+func TestDetectReadError(t *testing.T) {
+	reader := filebuffer.New([]byte("test"))
+	reader.Close()
+	if _, err := mimetype.Detect(reader); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("expected %s, got %v", os.ErrClosed, err)
+	}
+}
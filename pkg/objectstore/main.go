@@ -1,37 +1,162 @@
 package objectstore
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/tkellen/memorybox/pkg/archive"
 	"github.com/tkellen/memorybox/pkg/file"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 )
 
+// Capabilities of Store beyond archive.Store.
+var (
+	_ archive.Store          = (*Store)(nil)
+	_ archive.PaginatedStore = (*Store)(nil)
+	_ archive.SeekableStore  = (*Store)(nil)
+	_ archive.RangeGetter    = (*Store)(nil)
+	_ archive.Renamer        = (*Store)(nil)
+	_ archive.ServerCopier   = (*Store)(nil)
+	_ archive.BatchPutter    = (*Store)(nil)
+	_ archive.AtomicStore    = (*Store)(nil)
+	_ archive.Tagger         = (*Store)(nil)
+	_ archive.Presigner      = (*Store)(nil)
+	_ archive.Versioner      = (*Store)(nil)
+	_ archive.Compactor      = (*Store)(nil)
+	_ archive.Appender       = (*Store)(nil)
+	_ archive.Watcher        = (*Store)(nil)
+)
+
 // Store implements archive.Store backed by s3-compatible object archive.
 type Store struct {
-	Bucket   string
-	S3       s3Backend
-	Uploader s3Uploader
-	Session  *session.Session
+	Bucket    string
+	S3        s3Backend
+	Uploader  s3Uploader
+	Session   *session.Session
+	Multipart Multipart
+	// VerifyOnGet makes Get ensure the content of every object named by a
+	// hash matches its name before returning it. Verified objects are
+	// buffered to a temporary file which is removed when they are closed.
+	VerifyOnGet bool
+	// ReadRetries is the number of times the content of an object returned
+	// by Get is reopened from the last byte read when reading it fails with
+	// a transient error. Zero disables resuming.
+	ReadRetries int
+	// CompactMaxAge is how old an incomplete multipart upload must be before
+	// Compact aborts it. Zero uses DefaultCompactMaxAge.
+	CompactMaxAge time.Duration
+	// ProgressFn, if set, is called with the number of bytes read so far each
+	// time the uploader reads the content of an object. Reporting progress
+	// stops the uploader reading parts of seekable content in parallel.
+	ProgressFn func(uploaded int64)
+	// Tags are applied to every object that is put.
+	Tags map[string]string
+	// SQSQueueURL is a queue receiving S3 event notifications for the bucket,
+	// read by Watch through SQS.
+	SQSQueueURL string
+	SQS         sqsBackend
+	// ExistsFallbackToSearch makes Exists list the bucket when HeadObject is
+	// forbidden, as it is when a bucket policy allows s3:ListBucket but not
+	// s3:GetObject. It is disabled by default as each fallback is an extra
+	// request.
+	ExistsFallbackToSearch bool
+	// Verbose, if set, receives details useful when debugging.
+	Verbose *log.Logger
+	// Account identifies the credentials the store uses, e.g. the name of a
+	// profile or an access key id. It is part of Service, so stores with
+	// different credentials never assume they can read each other's buckets.
+	Account string
+}
+
+// Multipart controls how objects are uploaded.
+type Multipart struct {
+	// Threshold is the size in bytes below which objects are uploaded with a
+	// single PutObject call. Zero sends every object through the uploader.
+	Threshold int64
+	// PartSize is the size in bytes of each part of a multipart upload.
+	PartSize int64
+	// Concurrency is the number of parts of a single object uploaded at once.
+	Concurrency int
+}
+
+// DefaultMultipart holds the upload settings used unless configured otherwise.
+var DefaultMultipart = Multipart{
+	Threshold:   5 * 1024 * 1024,
+	PartSize:    25 * 1024 * 1024,
+	Concurrency: s3manager.DefaultUploadConcurrency,
+}
+
+// MultipartFromConfig reads the multipart_threshold_mb, multipart_part_size_mb
+// and multipart_concurrency configuration values, using DefaultMultipart for
+// any that are not set.
+func MultipartFromConfig(config map[string]string) (Multipart, error) {
+	result := DefaultMultipart
+	for key, target := range map[string]*int64{
+		"multipart_threshold_mb": &result.Threshold,
+		"multipart_part_size_mb": &result.PartSize,
+	} {
+		if value, ok := config[key]; ok {
+			mb, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || mb < 0 {
+				return Multipart{}, fmt.Errorf("%s: invalid size %q", key, value)
+			}
+			*target = mb * 1024 * 1024
+		}
+	}
+	if value, ok := config["multipart_concurrency"]; ok {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency < 1 {
+			return Multipart{}, fmt.Errorf("multipart_concurrency: invalid value %q", value)
+		}
+		result.Concurrency = concurrency
+	}
+	if result.PartSize < s3manager.MinUploadPartSize {
+		return Multipart{}, fmt.Errorf("multipart_part_size_mb: must be at least %dmb", s3manager.MinUploadPartSize/1024/1024)
+	}
+	return result, nil
+}
+
+// Configure applies the multipart settings to an uploader.
+func (m Multipart) Configure(u *s3manager.Uploader) {
+	u.PartSize = m.PartSize
+	u.Concurrency = m.Concurrency
+	u.BufferProvider = s3manager.NewBufferedReadSeekerWriteToPool(int(m.PartSize))
 }
 
 // Name is used in the memorybox configuration file to determine which type of
 // store to instantiate.
 const Name = "objectStore"
 
+// Defaults holds the configuration values used for any that are not set.
+var Defaults = map[string]string{
+	"multipart_threshold_mb": "5",
+	"multipart_part_size_mb": "25",
+	"multipart_concurrency":  "5",
+}
+
 // S3 does not allow changing the last modified time of a file. This makes the
 // process of determining up-to-dated-ness when syncing to or from an object
 // store work the same as from local disk.
@@ -42,6 +167,19 @@ type s3Backend interface {
 	DeleteObjectWithContext(aws.Context, *s3.DeleteObjectInput, ...request.Option) (*s3.DeleteObjectOutput, error)
 	ListObjectsPagesWithContext(aws.Context, *s3.ListObjectsInput, func(*s3.ListObjectsOutput, bool) bool, ...request.Option) error
 	HeadObjectWithContext(aws.Context, *s3.HeadObjectInput, ...request.Option) (*s3.HeadObjectOutput, error)
+	PutObjectWithContext(aws.Context, *s3.PutObjectInput, ...request.Option) (*s3.PutObjectOutput, error)
+	CopyObjectWithContext(aws.Context, *s3.CopyObjectInput, ...request.Option) (*s3.CopyObjectOutput, error)
+	PutObjectTaggingWithContext(aws.Context, *s3.PutObjectTaggingInput, ...request.Option) (*s3.PutObjectTaggingOutput, error)
+	GetObjectTaggingWithContext(aws.Context, *s3.GetObjectTaggingInput, ...request.Option) (*s3.GetObjectTaggingOutput, error)
+	GetObjectRequest(*s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput)
+	ListObjectVersionsPagesWithContext(aws.Context, *s3.ListObjectVersionsInput, func(*s3.ListObjectVersionsOutput, bool) bool, ...request.Option) error
+	GetBucketVersioningWithContext(aws.Context, *s3.GetBucketVersioningInput, ...request.Option) (*s3.GetBucketVersioningOutput, error)
+	ListMultipartUploadsWithContext(aws.Context, *s3.ListMultipartUploadsInput, ...request.Option) (*s3.ListMultipartUploadsOutput, error)
+	ListPartsPagesWithContext(aws.Context, *s3.ListPartsInput, func(*s3.ListPartsOutput, bool) bool, ...request.Option) error
+	AbortMultipartUploadWithContext(aws.Context, *s3.AbortMultipartUploadInput, ...request.Option) (*s3.AbortMultipartUploadOutput, error)
+	CreateMultipartUploadWithContext(aws.Context, *s3.CreateMultipartUploadInput, ...request.Option) (*s3.CreateMultipartUploadOutput, error)
+	UploadPartCopyWithContext(aws.Context, *s3.UploadPartCopyInput, ...request.Option) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUploadWithContext(aws.Context, *s3.CompleteMultipartUploadInput, ...request.Option) (*s3.CompleteMultipartUploadOutput, error)
 }
 
 type s3Uploader interface {
@@ -53,22 +191,41 @@ func (s *Store) String() string {
 	return fmt.Sprintf("%s: %s", Name, s.Bucket)
 }
 
-// New returns a reference to a Store instance.
+// New returns a reference to a Store instance using DefaultMultipart.
 func New(bucket string, sess *session.Session) *Store {
+	return NewWithMultipart(bucket, sess, DefaultMultipart)
+}
+
+// NewWithMultipart returns a reference to a Store instance that uploads
+// objects using the supplied multipart settings.
+func NewWithMultipart(bucket string, sess *session.Session, multipart Multipart) *Store {
 	return &Store{
-		Bucket: bucket,
-		S3:     s3.New(sess),
-		Uploader: s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
-			u.BufferProvider = s3manager.NewBufferedReadSeekerWriteToPool(25 * 1024 * 1024)
-		}),
-		Session: sess,
+		Bucket:    bucket,
+		S3:        s3.New(sess),
+		Uploader:  s3manager.NewUploader(sess, multipart.Configure),
+		Session:   sess,
+		Multipart: multipart,
 	}
 }
 
+// WithProgress returns a shallow copy of the Store which reports the progress
+// of uploads to fn.
+func (s *Store) WithProgress(fn func(uploaded int64)) *Store {
+	copied := *s
+	copied.ProgressFn = fn
+	return &copied
+}
+
 // NewFromConfig produces a new instance of a store.
-func NewFromConfig(config map[string]string) *Store {
+func NewFromConfig(config map[string]string) (*Store, error) {
+	multipart, err := MultipartFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
 	var sess *session.Session
+	account := "key:" + config["access_key_id"]
 	if profile, ok := config["profile"]; ok {
+		account = "profile:" + profile
 		sess, _ = session.NewSessionWithOptions(session.Options{
 			Profile:           profile,
 			SharedConfigState: session.SharedConfigEnable,
@@ -84,22 +241,487 @@ func NewFromConfig(config map[string]string) *Store {
 			Region:   aws.String("us-east-1"),
 		})
 	}
-	return New(config["bucket"], sess)
+	store := NewWithMultipart(config["bucket"], sess, multipart)
+	store.Account = account
+	store.VerifyOnGet = config["verify_on_get"] == "true"
+	if value, ok := config["read_retries"]; ok {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("read_retries: invalid value %q", value)
+		}
+		store.ReadRetries = retries
+	}
+	if queueURL := config["sqs_queue_url"]; queueURL != "" {
+		store.SQSQueueURL = queueURL
+		store.SQS = sqs.New(sess)
+	}
+	if value, ok := config["compact_max_age_hours"]; ok {
+		hours, err := strconv.Atoi(value)
+		if err != nil || hours < 0 {
+			return nil, fmt.Errorf("compact_max_age_hours: invalid value %q", value)
+		}
+		store.CompactMaxAge = time.Duration(hours) * time.Hour
+	}
+	store.ExistsFallbackToSearch = config["exists_fallback_to_search"] == "true"
+	if config["versioning"] == "true" {
+		if err := store.VerifyVersioning(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	if tags := config["tags"]; tags != "" {
+		if err := json.Unmarshal([]byte(tags), &store.Tags); err != nil {
+			return nil, fmt.Errorf("%w: tags must be a json object of strings: %s", os.ErrInvalid, err)
+		}
+		if len(store.Tags) > MaxTags {
+			return nil, fmt.Errorf("%w: tags: at most %d are allowed", os.ErrInvalid, MaxTags)
+		}
+	}
+	return store, nil
 }
 
 // Put writes the content of an io.Reader to the backing object storage bucket.
 // It saves the actual lastModified time supplied as metadata because most s3
-// implementations do not allow modifying it.
+// implementations do not allow modifying it. Content smaller than the
+// multipart threshold is uploaded with a single request.
 func (s *Store) Put(ctx context.Context, reader io.Reader, name string, lastModified time.Time) error {
+	metadata := putMetadata(lastModified)
+	if s.Multipart.Threshold > 0 {
+		head, err := ioutil.ReadAll(io.LimitReader(reader, s.Multipart.Threshold))
+		if err != nil {
+			return err
+		}
+		if int64(len(head)) < s.Multipart.Threshold {
+			_, err := s.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+				Bucket:   aws.String(s.Bucket),
+				Key:      aws.String(name),
+				Body:     bytes.NewReader(head),
+				Metadata: metadata,
+				Tagging:  s.tagging(),
+			})
+			return err
+		}
+		reader = io.MultiReader(bytes.NewReader(head), reader)
+	}
 	_, err := s.Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(name),
+		Body:     s.uploadBody(reader),
+		Metadata: metadata,
+		Tagging:  s.tagging(),
+	})
+	return err
+}
+
+// PutSeekable writes content of a known size to the backing object storage
+// bucket. Content smaller than the multipart threshold is uploaded with a
+// single request carrying its length. Larger content is handed to the uploader
+// without buffering so it can determine the size itself and read parts in
+// parallel.
+func (s *Store) PutSeekable(ctx context.Context, reader io.ReadSeeker, name string, lastModified time.Time, size int64) error {
+	metadata := putMetadata(lastModified)
+	if size < s.Multipart.Threshold {
+		_, err := s.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(s.Bucket),
+			Key:           aws.String(name),
+			Body:          reader,
+			ContentLength: aws.Int64(size),
+			Metadata:      metadata,
+			Tagging:       s.tagging(),
+		})
+		return err
+	}
+	_, err := s.Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(name),
+		Body:     s.uploadBody(reader),
+		Metadata: metadata,
+		Tagging:  s.tagging(),
+	})
+	return err
+}
+
+// PutIfAbsent writes the content of an io.Reader to the backing object storage
+// bucket unless an object with the same name already exists. S3 has no
+// conditional writes so this is a best-effort check followed by a put; an
+// object created by another writer in between is overwritten.
+func (s *Store) PutIfAbsent(ctx context.Context, reader io.Reader, name string, lastModified time.Time) (bool, error) {
+	exists, err := s.Exists(ctx, name)
+	if err != nil || exists {
+		return false, err
+	}
+	return true, s.Put(ctx, reader, name, lastModified)
+}
+
+// MaxTags is the number of tags S3 allows on a single object.
+const MaxTags = 10
+
+// tagging encodes the tags applied to every object that is put in the form
+// S3 expects, or nil if there are none.
+func (s *Store) tagging() *string {
+	if len(s.Tags) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for key, value := range s.Tags {
+		values.Set(key, value)
+	}
+	return aws.String(values.Encode())
+}
+
+// Tag adds tags to an object, replacing the value of any it already has with
+// the same key. S3 replaces every tag of an object at once, so the existing
+// tags are read first.
+func (s *Store) Tag(ctx context.Context, name string, tags map[string]string) error {
+	merged, err := s.GetTags(ctx, name)
+	if err != nil {
+		return err
+	}
+	for key, value := range tags {
+		merged[key] = value
+	}
+	if len(merged) > MaxTags {
+		return fmt.Errorf("%w: %s: at most %d tags are allowed", os.ErrInvalid, name, MaxTags)
+	}
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tagSet := make([]*s3.Tag, len(keys))
+	for index, key := range keys {
+		tagSet[index] = &s3.Tag{Key: aws.String(key), Value: aws.String(merged[key])}
+	}
+	_, err = s.S3.PutObjectTaggingWithContext(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(s.Bucket),
+		Key:     aws.String(name),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	return notFound(err)
+}
+
+// GetTags retrieves the tags of an object.
+func (s *Store) GetTags(ctx context.Context, name string) (map[string]string, error) {
+	resp, err := s.S3.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(name),
-		Body:   reader,
-		Metadata: map[string]*string{
-			timeKey: aws.String(lastModified.UTC().Format(time.RFC3339)),
-		},
 	})
-	return err
+	if err != nil {
+		return nil, notFound(err)
+	}
+	tags := map[string]string{}
+	for _, tag := range resp.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
+
+// PreSignURL produces a url which can be used to get an object without
+// credentials until expiry has elapsed. S3 allows at most seven days. The
+// object is not checked for existence.
+func (s *Store) PreSignURL(ctx context.Context, name string, expiry time.Duration) (string, error) {
+	req, _ := s.S3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(name),
+	})
+	req.SetContext(ctx)
+	return req.Presign(expiry)
+}
+
+// VerifyVersioning ensures the bucket keeps every version of its objects, as
+// the methods of archive.Versioner require.
+func (s *Store) VerifyVersioning(ctx context.Context) error {
+	resp, err := s.S3.GetBucketVersioningWithContext(ctx, &s3.GetBucketVersioningInput{
+		Bucket: aws.String(s.Bucket),
+	})
+	if err != nil {
+		return fmt.Errorf("%s: versioning: %w", s.Bucket, err)
+	}
+	if aws.StringValue(resp.Status) != s3.BucketVersioningStatusEnabled {
+		return fmt.Errorf("%w: %s: versioning is not enabled", os.ErrInvalid, s.Bucket)
+	}
+	return nil
+}
+
+// Snapshot preserves the current content of an object as a version by copying
+// it to itself. S3 refuses to copy an object to itself unless its metadata is
+// replaced, so the existing metadata is read and supplied again.
+func (s *Store) Snapshot(ctx context.Context, name string) (string, error) {
+	head, err := s.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return "", notFound(err)
+	}
+	resp, err := s.S3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(s.Bucket),
+		Key:               aws.String(name),
+		CopySource:        aws.String(s.Bucket + "/" + url.PathEscape(name)),
+		ContentType:       head.ContentType,
+		Metadata:          head.Metadata,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	})
+	if err != nil {
+		return "", notFound(err)
+	}
+	return aws.StringValue(resp.VersionId), nil
+}
+
+// ListVersions finds the id of every version of an object, newest first.
+// Delete markers are not versions and are skipped.
+func (s *Store) ListVersions(ctx context.Context, name string) ([]string, error) {
+	var versions []string
+	if err := s.S3.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(name),
+	}, func(page *s3.ListObjectVersionsOutput, _ bool) bool {
+		for _, version := range page.Versions {
+			if aws.StringValue(version.Key) == name {
+				versions = append(versions, aws.StringValue(version.VersionId))
+			}
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return versions, nil
+}
+
+// RestoreVersion makes a previous version of an object current by copying it
+// over the same name. The version restored from is kept.
+func (s *Store) RestoreVersion(ctx context.Context, name string, versionID string) error {
+	if _, err := s.S3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(s.Bucket),
+		Key:               aws.String(name),
+		CopySource:        aws.String(s.Bucket + "/" + url.PathEscape(name) + "?versionId=" + url.QueryEscape(versionID)),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+	}); err != nil {
+		return notFound(err)
+	}
+	return nil
+}
+
+// DefaultCompactMaxAge is how old an incomplete multipart upload must be
+// before Compact aborts it, if the Store has no CompactMaxAge.
+const DefaultCompactMaxAge = 24 * time.Hour
+
+// CompactConcurrency is the number of uploads Compact aborts at once.
+const CompactConcurrency = 10
+
+// Compact aborts every incomplete multipart upload in the bucket started more
+// than CompactMaxAge ago, discarding the parts S3 keeps (and bills for) until
+// an upload is completed or aborted. The parts of each upload are listed
+// before it is aborted to learn how much space is freed.
+func (s *Store) Compact(ctx context.Context) (*archive.CompactReport, error) {
+	maxAge := s.CompactMaxAge
+	if maxAge == 0 {
+		maxAge = DefaultCompactMaxAge
+	}
+	cutoff := time.Now().Add(-maxAge)
+	var stale []*s3.MultipartUpload
+	input := &s3.ListMultipartUploadsInput{Bucket: aws.String(s.Bucket)}
+	for {
+		resp, err := s.S3.ListMultipartUploadsWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, upload := range resp.Uploads {
+			if upload.Initiated != nil && upload.Initiated.Before(cutoff) {
+				stale = append(stale, upload)
+			}
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		input.KeyMarker = resp.NextKeyMarker
+		input.UploadIdMarker = resp.NextUploadIdMarker
+	}
+	report := &archive.CompactReport{}
+	var mu sync.Mutex
+	eg, egCtx := errgroup.WithContext(ctx)
+	sem := semaphore.NewWeighted(CompactConcurrency)
+	for _, upload := range stale {
+		if err := sem.Acquire(egCtx, 1); err != nil {
+			break
+		}
+		upload := upload // https://golang.org/doc/faq#closures_and_goroutines
+		eg.Go(func() error {
+			defer sem.Release(1)
+			size, err := s.abortUpload(egCtx, upload)
+			if err != nil {
+				return fmt.Errorf("%s: %w", aws.StringValue(upload.Key), err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.AbortedUploads++
+			report.FreedBytes = report.FreedBytes + size
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return report, err
+	}
+	return report, ctx.Err()
+}
+
+// abortUpload aborts an incomplete multipart upload, returning the combined
+// size of the parts it discarded.
+func (s *Store) abortUpload(ctx context.Context, upload *s3.MultipartUpload) (int64, error) {
+	var size int64
+	if err := s.S3.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      upload.Key,
+		UploadId: upload.UploadId,
+	}, func(page *s3.ListPartsOutput, _ bool) bool {
+		for _, part := range page.Parts {
+			size = size + aws.Int64Value(part.Size)
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	if _, err := s.S3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      upload.Key,
+		UploadId: upload.UploadId,
+	}); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// uploadBody wraps content handed to the uploader so reading it reports
+// progress, if the Store has a ProgressFn.
+func (s *Store) uploadBody(reader io.Reader) io.Reader {
+	if s.ProgressFn == nil {
+		return reader
+	}
+	progress := &progressReader{Reader: reader, fn: s.ProgressFn}
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		return &progressReadSeeker{progressReader: progress, seeker: seeker}
+	}
+	return progress
+}
+
+// progressReader calls fn with the total number of bytes read after each read.
+type progressReader struct {
+	io.Reader
+	fn   func(int64)
+	read int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.read += int64(n)
+		r.fn(r.read)
+	}
+	return n, err
+}
+
+// progressReadSeeker is a progressReader which can be rewound, as the uploader
+// does when retrying. Progress restarts from the new offset.
+type progressReadSeeker struct {
+	*progressReader
+	seeker io.Seeker
+}
+
+func (r *progressReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	position, err := r.seeker.Seek(offset, whence)
+	if err == nil {
+		r.read = position
+	}
+	return position, err
+}
+
+// MultiPutConcurrency is the number of files MultiPut uploads at once.
+const MultiPutConcurrency = 10
+
+// putErrors collects the failures of MultiPut.
+type putErrors []error
+
+func (e putErrors) Error() string {
+	messages := make([]string, len(e))
+	for index, err := range e {
+		messages[index] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// MultiPut uploads several files concurrently. S3 has no native batch upload
+// so each file is sent with its own request, but the requests overlap rather
+// than paying the latency of each in turn. A failure to upload one file does
+// not prevent the others from being uploaded; every failure is returned
+// together.
+func (s *Store) MultiPut(ctx context.Context, files []*file.File) error {
+	var errs putErrors
+	var mu sync.Mutex
+	var eg errgroup.Group
+	sem := semaphore.NewWeighted(MultiPutConcurrency)
+	for _, f := range files {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+			break
+		}
+		f := f // https://golang.org/doc/faq#closures_and_goroutines
+		eg.Go(func() error {
+			defer sem.Release(1)
+			var err error
+			if _, ok := f.Body.(io.Seeker); ok && f.Size > 0 {
+				err = s.PutSeekable(ctx, f, f.Name, f.LastModified, f.Size)
+			} else {
+				err = s.Put(ctx, f, f.Name, f.LastModified)
+			}
+			if err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, fmt.Errorf("%s: %w", f.Name, err))
+			}
+			return nil
+		})
+	}
+	eg.Wait()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// putMetadata produces the object metadata recording when content was last
+// modified.
+func putMetadata(lastModified time.Time) map[string]*string {
+	return map[string]*string{
+		timeKey: aws.String(lastModified.UTC().Format(time.RFC3339)),
+	}
+}
+
+// Append adds data to the end of an object. S3 has no native append so this
+// reads the existing object, concatenates the new data and writes the result
+// back. It is not safe to append to the same object concurrently; the last
+// writer wins and earlier appends may be lost.
+func (s *Store) Append(ctx context.Context, name string, data []byte) error {
+	var existing []byte
+	exists, existsErr := s.Exists(ctx, name)
+	if existsErr != nil {
+		return existsErr
+	}
+	if exists {
+		f, getErr := s.Get(ctx, name)
+		if getErr != nil {
+			return getErr
+		}
+		defer f.Close()
+		var readErr error
+		if existing, readErr = ioutil.ReadAll(f); readErr != nil {
+			return readErr
+		}
+	}
+	return s.Put(ctx, bytes.NewReader(append(existing, data...)), name, time.Now())
 }
 
 func (s *Store) lastModified(meta map[string]*string, fallback time.Time) time.Time {
@@ -119,14 +741,73 @@ func (s *Store) Get(ctx context.Context, name string) (*file.File, error) {
 		Key:    aws.String(name),
 	})
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
+	}
+	size := *resp.ContentLength
+	body := resp.Body
+	if s.ReadRetries > 0 {
+		body = archive.ResumeBody(ctx, s, name, size, body, s.ReadRetries)
 	}
-	return &file.File{
+	f := &file.File{
 		Name:         name,
-		Size:         *resp.ContentLength,
+		Size:         size,
 		LastModified: s.lastModified(resp.Metadata, *resp.LastModified),
-		Body:         resp.Body,
-	}, nil
+		Body:         body,
+	}
+	if s.VerifyOnGet && (f.IsMetaFile() || f.Algorithm() != file.UnknownAlgorithm) {
+		return verify(f, body)
+	}
+	return f, nil
+}
+
+// tempBody is content buffered to a temporary file that is removed when it is
+// closed.
+type tempBody struct {
+	*os.File
+}
+
+func (t tempBody) Close() error {
+	err := t.File.Close()
+	os.Remove(t.Name())
+	return err
+}
+
+// verify buffers the content of an object to a temporary file so it can be
+// hashed and then read again by the caller.
+func verify(f *file.File, source io.ReadCloser) (*file.File, error) {
+	defer source.Close()
+	temp, err := ioutil.TempFile(os.TempDir(), "memorybox-verify-*")
+	if err != nil {
+		return nil, err
+	}
+	body := tempBody{temp}
+	if _, err := io.Copy(temp, source); err != nil {
+		body.Close()
+		return nil, err
+	}
+	f.Body = body
+	if err := f.HashVerify(); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// GetRange reads the bytes of an object between two inclusive offsets using a
+// range request.
+func (s *Store) GetRange(ctx context.Context, name string, start int64, end int64) (io.ReadCloser, error) {
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("%w: invalid range %d-%d", os.ErrInvalid, start, end)
+	}
+	resp, err := s.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(name),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	})
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return resp.Body, nil
 }
 
 // Delete removes an object from archive.
@@ -138,15 +819,179 @@ func (s *Store) Delete(ctx context.Context, key string) error {
 	return err
 }
 
-// Search finds an object in storage by prefix and returns an array of matches
+// Rename moves an object to a new key. S3 has no native rename so the object
+// is copied, with its metadata, and the original is deleted.
+func (s *Store) Rename(ctx context.Context, oldName string, newName string) error {
+	if err := s.ServerSideCopy(ctx, s.Bucket, oldName, s.Bucket, newName); err != nil {
+		return err
+	}
+	return s.Delete(ctx, oldName)
+}
+
+// maxCopySize is the largest object CopyObject accepts. Larger objects are
+// copied a part at a time with UploadPartCopy.
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// copyPartSize is the size of each part when copying an object larger than
+// maxCopySize.
+const copyPartSize = 1024 * 1024 * 1024
+
+// ServerSideCopy copies an object between keys and buckets of the same
+// service without transferring its content. Metadata, including the last
+// modified time memorybox records, is copied with it. Objects larger than
+// maxCopySize are copied in parts. If the credentials of the store are denied
+// access to either object the error wraps os.ErrPermission, so callers can
+// fall back to transferring the content themselves.
+func (s *Store) ServerSideCopy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string) error {
+	head, err := s.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(srcBucket),
+		Key:    aws.String(srcKey),
+	})
+	if err != nil {
+		return copyErr(err)
+	}
+	source := srcBucket + "/" + url.PathEscape(srcKey)
+	if aws.Int64Value(head.ContentLength) > maxCopySize {
+		return s.copyParts(ctx, source, head, dstBucket, dstKey)
+	}
+	if _, err := s.S3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(dstBucket),
+		Key:               aws.String(dstKey),
+		CopySource:        aws.String(source),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+	}); err != nil {
+		return copyErr(err)
+	}
+	return nil
+}
+
+// copyParts copies an object described by head with a multipart upload whose
+// parts are copied from ranges of the source. The upload is aborted if any
+// part fails.
+func (s *Store) copyParts(ctx context.Context, source string, head *s3.HeadObjectOutput, dstBucket string, dstKey string) error {
+	upload, err := s.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(dstBucket),
+		Key:         aws.String(dstKey),
+		ContentType: head.ContentType,
+		Metadata:    head.Metadata,
+	})
+	if err != nil {
+		return copyErr(err)
+	}
+	abort := func(err error) error {
+		s.S3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(dstBucket),
+			Key:      aws.String(dstKey),
+			UploadId: upload.UploadId,
+		})
+		return copyErr(err)
+	}
+	size := aws.Int64Value(head.ContentLength)
+	var parts []*s3.CompletedPart
+	for start := int64(0); start < size; start += copyPartSize {
+		end := start + copyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		number := aws.Int64(int64(len(parts) + 1))
+		part, err := s.S3.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(dstBucket),
+			Key:             aws.String(dstKey),
+			UploadId:        upload.UploadId,
+			PartNumber:      number,
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       part.CopyPartResult.ETag,
+			PartNumber: number,
+		})
+	}
+	if _, err := s.S3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(dstBucket),
+		Key:             aws.String(dstKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+// copyErr wraps errors from the s3 api while copying an object: missing
+// objects with os.ErrNotExist and denied access with os.ErrPermission.
+func copyErr(err error) error {
+	var awsErr awserr.Error
+	if forbidden(err) || (errors.As(err, &awsErr) && awsErr.Code() == "AccessDenied") {
+		return fmt.Errorf("%w: %s", os.ErrPermission, err)
+	}
+	return notFound(err)
+}
+
+// SameService reports if two stores use the same endpoint, region and
+// credentials, making it possible to copy objects between them with
+// ServerSideCopy.
+func (s *Store) SameService(other *Store) bool {
+	return s.Service() == other.Service()
+}
+
+// Service identifies the endpoint, region and account the store uses. Stores
+// without a session are identified by an empty string.
+func (s *Store) Service() string {
+	if s.Session == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s|%s|%s", aws.StringValue(s.Session.Config.Endpoint), aws.StringValue(s.Session.Config.Region), s.Account)
+}
+
+// BucketName returns the bucket the store keeps objects in.
+func (s *Store) BucketName() string {
+	return s.Bucket
+}
+
+// Search finds an object in storage by prefix and returns an array of matches.
+// The listing is requested a page at a time with SearchPage rather than by
+// relying on the SDK to paginate, as some services omit NextMarker from
+// truncated responses, which would otherwise end the listing early.
 func (s *Store) Search(ctx context.Context, prefix string) (file.List, error) {
 	var matches file.List
+	cursor := ""
+	for {
+		page, next, err := s.SearchPage(ctx, prefix, cursor, 1000)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	sort.Sort(matches)
+	return matches, nil
+}
+
+// SearchPage finds up to limit objects in storage by prefix whose keys sort
+// after the cursor, which is used as the marker for the listing. The returned
+// cursor is empty if no objects remain. It is the NextMarker of the response,
+// or the last key returned if the service did not supply one (DigitalOcean
+// Spaces does not).
+func (s *Store) SearchPage(ctx context.Context, prefix string, cursor string, limit int) (file.List, string, error) {
+	if limit < 1 {
+		return nil, "", fmt.Errorf("%w: page limit must be at least 1, got %d", os.ErrInvalid, limit)
+	}
+	var matches file.List
+	next := ""
 	// Not using v2 because digitalocean doesn't support it.
 	// https://developers.digitalocean.com/documentation/spaces/#list-bucket-contents
 	if err := s.S3.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
 		Bucket:  aws.String(s.Bucket),
 		Prefix:  aws.String(prefix),
-		MaxKeys: aws.Int64(1000),
+		Marker:  aws.String(cursor),
+		MaxKeys: aws.Int64(int64(limit)),
 	}, func(resp *s3.ListObjectsOutput, _ bool) bool {
 		for _, item := range resp.Contents {
 			matches = append(matches, &file.File{
@@ -156,16 +1001,23 @@ func (s *Store) Search(ctx context.Context, prefix string) (file.List, error) {
 				LastModified: *item.LastModified,
 			})
 		}
-		return true
+		if aws.BoolValue(resp.IsTruncated) && len(matches) > 0 {
+			next = aws.StringValue(resp.NextMarker)
+			if next == "" {
+				next = matches[len(matches)-1].Name
+			}
+		}
+		// Only the first page is needed.
+		return false
 	}); err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	sort.Sort(matches)
-	return matches, nil
+	return matches, next, nil
 }
 
 // Concat an array of byte arrays ordered identically with the input files
-// supplied. Note that this loads the entire dataset into memory.
+// supplied. Note that this loads the entire dataset into memory. A failure to
+// read any object fails the whole call.
 func (s *Store) Concat(ctx context.Context, concurrency int, files []string) ([][]byte, error) {
 	result := make([][]byte, len(files))
 	sem := semaphore.NewWeighted(int64(concurrency))
@@ -180,13 +1032,12 @@ func (s *Store) Concat(ctx context.Context, concurrency int, files []string) ([]
 				defer sem.Release(1)
 				resp, err := s.Get(egCtx, item)
 				if err != nil {
-					return nil
+					return fmt.Errorf("%s: %w", item, err)
 				}
-				result[index], err = ioutil.ReadAll(resp.Body)
-				if err != nil {
-					return nil
+				defer resp.Close()
+				if result[index], err = ioutil.ReadAll(resp.Body); err != nil {
+					return fmt.Errorf("%s: %w", item, err)
 				}
-				resp.Close()
 				return nil
 			})
 		}
@@ -205,9 +1056,212 @@ func (s *Store) Stat(ctx context.Context, name string) (*file.File, error) {
 		Key:    aws.String(name),
 	})
 	if err != nil {
-		// TODO: recognize network failure here vs file not existing.
-		return nil, fmt.Errorf("%w: %s", os.ErrNotExist, err)
+		return nil, notFound(err)
 	}
 	// TODO: find a way to get metadata for many objects fast.
 	return file.NewStub(name, *stat.ContentLength, *stat.LastModified), nil
 }
+
+// Exists determines if an object is in the store. If ExistsFallbackToSearch
+// is set and HeadObject is forbidden the bucket is listed instead.
+func (s *Store) Exists(ctx context.Context, name string) (bool, error) {
+	if _, err := s.Stat(ctx, name); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		if s.ExistsFallbackToSearch && forbidden(err) {
+			if s.Verbose != nil {
+				s.Verbose.Printf("%s: HeadObject 403, falling back to Search", name)
+			}
+			return s.existsBySearch(ctx, name)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// existsBySearch determines if an object is in the store by listing keys
+// starting with its name. An exact match sorts before every other key with
+// the same prefix, so only the first key needs to be requested.
+func (s *Store) existsBySearch(ctx context.Context, name string) (bool, error) {
+	matches, _, err := s.SearchPage(ctx, name, "", 1)
+	if err != nil {
+		return false, err
+	}
+	return len(matches) > 0 && matches[0].Name == name, nil
+}
+
+// forbidden reports if an error from the s3 api was caused by a lack of
+// permission.
+func forbidden(err error) bool {
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusForbidden
+}
+
+// notFound wraps errors from the s3 api which indicate an object is missing
+// with os.ErrNotExist. All other errors are returned unchanged.
+func notFound(err error) error {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return fmt.Errorf("%w: %s", os.ErrNotExist, err)
+		}
+	}
+	return err
+}
+
+type sqsBackend interface {
+	ReceiveMessageWithContext(aws.Context, *sqs.ReceiveMessageInput, ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageWithContext(aws.Context, *sqs.DeleteMessageInput, ...request.Option) (*sqs.DeleteMessageOutput, error)
+}
+
+// WatchPollInterval is how often Watch lists the bucket to find changes when
+// no queue of event notifications is configured.
+var WatchPollInterval = 30 * time.Second
+
+// Watch reports objects which are put into or deleted from the bucket until
+// the context is cancelled. If the store has an SQSQueueURL, changes are read
+// from the S3 event notifications delivered to that queue. Otherwise the
+// bucket is listed every WatchPollInterval and compared to the last listing;
+// objects replaced between listings with the same size and modification time
+// are missed.
+func (s *Store) Watch(ctx context.Context, prefix string, events chan<- archive.StoreEvent) error {
+	if s.SQSQueueURL != "" {
+		return s.watchQueue(ctx, prefix, events)
+	}
+	return s.watchPoll(ctx, prefix, events)
+}
+
+// s3Notification is the subset of an S3 event notification used by Watch.
+type s3Notification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// watchQueue sends events for the notifications in an SQS queue. Messages are
+// deleted from the queue once their events have been sent. Messages which are
+// not S3 event notifications, such as the test event sent when notifications
+// are configured, are deleted without sending anything.
+func (s *Store) watchQueue(ctx context.Context, prefix string, events chan<- archive.StoreEvent) error {
+	for {
+		resp, err := s.SQS.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(s.SQSQueueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, message := range resp.Messages {
+			var notification s3Notification
+			json.Unmarshal([]byte(aws.StringValue(message.Body)), &notification)
+			for _, record := range notification.Records {
+				if record.S3.Bucket.Name != s.Bucket {
+					continue
+				}
+				name, err := url.QueryUnescape(record.S3.Object.Key)
+				if err != nil || !strings.HasPrefix(name, prefix) {
+					continue
+				}
+				event := archive.StoreEvent{Name: name}
+				switch {
+				case strings.HasPrefix(record.EventName, "ObjectCreated:"):
+					event.Type = archive.StoreEventPut
+				case strings.HasPrefix(record.EventName, "ObjectRemoved:"):
+					event.Type = archive.StoreEventDelete
+				default:
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					// The message is left on the queue to be delivered again.
+					return nil
+				}
+			}
+			if _, err := s.SQS.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(s.SQSQueueURL),
+				ReceiptHandle: message.ReceiptHandle,
+			}); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+}
+
+// watchPoll sends events for the differences between successive listings of
+// the bucket.
+func (s *Store) watchPoll(ctx context.Context, prefix string, events chan<- archive.StoreEvent) error {
+	listing := func() (map[string]string, error) {
+		files, err := s.Search(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		result := make(map[string]string, len(files))
+		for _, f := range files {
+			result[f.Name] = fmt.Sprintf("%d-%d", f.Size, f.LastModified.UnixNano())
+		}
+		return result, nil
+	}
+	previous, err := listing()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	ticker := time.NewTicker(WatchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		current, err := listing()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var changes []archive.StoreEvent
+		for name, version := range current {
+			if previous[name] != version {
+				changes = append(changes, archive.StoreEvent{Type: archive.StoreEventPut, Name: name})
+			}
+		}
+		for name := range previous {
+			if _, ok := current[name]; !ok {
+				changes = append(changes, archive.StoreEvent{Type: archive.StoreEventDelete, Name: name})
+			}
+		}
+		sort.Slice(changes, func(i, j int) bool {
+			return changes[i].Name < changes[j].Name
+		})
+		for _, event := range changes {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		previous = current
+	}
+}
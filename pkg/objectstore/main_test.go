@@ -10,21 +10,47 @@ import (
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/google/go-cmp/cmp"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
 	"github.com/tkellen/memorybox/pkg/objectstore"
+	"io"
 	"io/ioutil"
+	"log"
+	"os"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 type s3mock struct {
-	getObjectWithContext        func(aws.Context, *s3.GetObjectInput, ...request.Option) (*s3.GetObjectOutput, error)
-	deleteObjectWithContext     func(aws.Context, *s3.DeleteObjectInput, ...request.Option) (*s3.DeleteObjectOutput, error)
-	listObjectsPagesWithContext func(aws.Context, *s3.ListObjectsInput, func(*s3.ListObjectsOutput, bool) bool, ...request.Option) error
-	headObjectWithContext       func(aws.Context, *s3.HeadObjectInput, ...request.Option) (*s3.HeadObjectOutput, error)
+	getObjectWithContext               func(aws.Context, *s3.GetObjectInput, ...request.Option) (*s3.GetObjectOutput, error)
+	deleteObjectWithContext            func(aws.Context, *s3.DeleteObjectInput, ...request.Option) (*s3.DeleteObjectOutput, error)
+	listObjectsPagesWithContext        func(aws.Context, *s3.ListObjectsInput, func(*s3.ListObjectsOutput, bool) bool, ...request.Option) error
+	headObjectWithContext              func(aws.Context, *s3.HeadObjectInput, ...request.Option) (*s3.HeadObjectOutput, error)
+	putObjectWithContext               func(aws.Context, *s3.PutObjectInput, ...request.Option) (*s3.PutObjectOutput, error)
+	copyObjectWithContext              func(aws.Context, *s3.CopyObjectInput, ...request.Option) (*s3.CopyObjectOutput, error)
+	putObjectTaggingWithContext        func(aws.Context, *s3.PutObjectTaggingInput, ...request.Option) (*s3.PutObjectTaggingOutput, error)
+	getObjectTaggingWithContext        func(aws.Context, *s3.GetObjectTaggingInput, ...request.Option) (*s3.GetObjectTaggingOutput, error)
+	getObjectRequest                   func(*s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput)
+	listObjectVersionsPagesWithContext func(aws.Context, *s3.ListObjectVersionsInput, func(*s3.ListObjectVersionsOutput, bool) bool, ...request.Option) error
+	getBucketVersioningWithContext     func(aws.Context, *s3.GetBucketVersioningInput, ...request.Option) (*s3.GetBucketVersioningOutput, error)
+	listMultipartUploadsWithContext    func(aws.Context, *s3.ListMultipartUploadsInput, ...request.Option) (*s3.ListMultipartUploadsOutput, error)
+	listPartsPagesWithContext          func(aws.Context, *s3.ListPartsInput, func(*s3.ListPartsOutput, bool) bool, ...request.Option) error
+	abortMultipartUploadWithContext    func(aws.Context, *s3.AbortMultipartUploadInput, ...request.Option) (*s3.AbortMultipartUploadOutput, error)
+	createMultipartUploadWithContext   func(aws.Context, *s3.CreateMultipartUploadInput, ...request.Option) (*s3.CreateMultipartUploadOutput, error)
+	uploadPartCopyWithContext          func(aws.Context, *s3.UploadPartCopyInput, ...request.Option) (*s3.UploadPartCopyOutput, error)
+	completeMultipartUploadWithContext func(aws.Context, *s3.CompleteMultipartUploadInput, ...request.Option) (*s3.CompleteMultipartUploadOutput, error)
 }
 
 func (s3 *s3mock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
@@ -36,9 +62,60 @@ func (s3 *s3mock) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInp
 func (s3 *s3mock) ListObjectsPagesWithContext(ctx aws.Context, input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, opts ...request.Option) error {
 	return s3.listObjectsPagesWithContext(ctx, input, fn, opts...)
 }
+func (s3 *s3mock) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	return s3.putObjectWithContext(ctx, input, opts...)
+}
+func (s3 *s3mock) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	return s3.copyObjectWithContext(ctx, input, opts...)
+}
 func (s3 *s3mock) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
 	return s3.deleteObjectWithContext(ctx, input, opts...)
 }
+func (s3 *s3mock) PutObjectTaggingWithContext(ctx aws.Context, input *s3.PutObjectTaggingInput, opts ...request.Option) (*s3.PutObjectTaggingOutput, error) {
+	return s3.putObjectTaggingWithContext(ctx, input, opts...)
+}
+func (s3 *s3mock) GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	return s3.getObjectRequest(input)
+}
+func (s3 *s3mock) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, opts ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	return s3.getObjectTaggingWithContext(ctx, input, opts...)
+}
+func (s3 *s3mock) ListObjectVersionsPagesWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool, opts ...request.Option) error {
+	return s3.listObjectVersionsPagesWithContext(ctx, input, fn, opts...)
+}
+func (s3 *s3mock) GetBucketVersioningWithContext(ctx aws.Context, input *s3.GetBucketVersioningInput, opts ...request.Option) (*s3.GetBucketVersioningOutput, error) {
+	return s3.getBucketVersioningWithContext(ctx, input, opts...)
+}
+func (s3 *s3mock) ListMultipartUploadsWithContext(ctx aws.Context, input *s3.ListMultipartUploadsInput, opts ...request.Option) (*s3.ListMultipartUploadsOutput, error) {
+	return s3.listMultipartUploadsWithContext(ctx, input, opts...)
+}
+func (s3 *s3mock) ListPartsPagesWithContext(ctx aws.Context, input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool, opts ...request.Option) error {
+	return s3.listPartsPagesWithContext(ctx, input, fn, opts...)
+}
+func (s3 *s3mock) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	return s3.abortMultipartUploadWithContext(ctx, input, opts...)
+}
+func (s3 *s3mock) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return s3.createMultipartUploadWithContext(ctx, input, opts...)
+}
+func (s3 *s3mock) UploadPartCopyWithContext(ctx aws.Context, input *s3.UploadPartCopyInput, opts ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	return s3.uploadPartCopyWithContext(ctx, input, opts...)
+}
+func (s3 *s3mock) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return s3.completeMultipartUploadWithContext(ctx, input, opts...)
+}
+
+type sqsMock struct {
+	receiveMessageWithContext func(aws.Context, *sqs.ReceiveMessageInput, ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	deleteMessageWithContext  func(aws.Context, *sqs.DeleteMessageInput, ...request.Option) (*sqs.DeleteMessageOutput, error)
+}
+
+func (q *sqsMock) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	return q.receiveMessageWithContext(ctx, input, opts...)
+}
+func (q *sqsMock) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	return q.deleteMessageWithContext(ctx, input, opts...)
+}
 
 type s3UploaderMock struct {
 	uploadWithContext func(aws.Context, *s3manager.UploadInput, ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error)
@@ -89,6 +166,44 @@ func TestStore_Get(t *testing.T) {
 	}
 }
 
+func TestStore_Get_Verify(t *testing.T) {
+	content := []byte("test")
+	f, err := file.NewSha256("test", bytes.NewReader(content), time.Now())
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	stored := map[string][]byte{
+		f.Name:       content,
+		"bad-sha256": content,
+	}
+	store := &objectstore.Store{
+		VerifyOnGet: true,
+		S3: &s3mock{
+			getObjectWithContext: func(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+				data := stored[*input.Key]
+				return &s3.GetObjectOutput{
+					ContentLength: aws.Int64(int64(len(data))),
+					LastModified:  aws.Time(time.Now()),
+					Body:          ioutil.NopCloser(bytes.NewReader(data)),
+					Metadata:      map[string]*string{},
+				}, nil
+			},
+		},
+	}
+	got, err := store.Get(context.Background(), f.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, _ := ioutil.ReadAll(got)
+	got.Close()
+	if !bytes.Equal(content, actual) {
+		t.Fatalf("expected %s, got %s", content, actual)
+	}
+	if _, err := store.Get(context.Background(), "bad-sha256"); !errors.Is(err, file.ErrHashMismatch) {
+		t.Fatalf("expected %s, got %v", file.ErrHashMismatch, err)
+	}
+}
+
 func TestStore_Stat(t *testing.T) {
 	called := false
 	expectedBucket := "bucket"
@@ -105,16 +220,22 @@ func TestStore_Stat(t *testing.T) {
 					t.Fatalf("expected %s as key, got %s", expectedFilename, *input.Key)
 				}
 				return &s3.HeadObjectOutput{
-					ContentLength: aws.Int64(0),
+					ContentLength: aws.Int64(4),
 					LastModified:  aws.Time(time.Time{}),
 				}, nil
 			},
 		},
 	}
-	store.Stat(context.Background(), expectedFilename)
+	f, err := store.Stat(context.Background(), expectedFilename)
 	if !called {
 		t.Fatalf("expected call did not occur")
 	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != expectedFilename || f.Size != 4 {
+		t.Fatalf("expected %s with size 4, got %s with size %d", expectedFilename, f.Name, f.Size)
+	}
 }
 
 func TestStore_Search(t *testing.T) {
@@ -148,6 +269,127 @@ func TestStore_Search(t *testing.T) {
 	}
 }
 
+// listObjectsMock simulates listing a bucket containing the supplied keys,
+// honouring the marker and maximum number of keys requested.
+func listObjectsMock(keys []string) func(aws.Context, *s3.ListObjectsInput, func(*s3.ListObjectsOutput, bool) bool, ...request.Option) error {
+	sort.Strings(keys)
+	return func(ctx aws.Context, input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, opts ...request.Option) error {
+		start := sort.SearchStrings(keys, aws.StringValue(input.Marker))
+		if start < len(keys) && keys[start] == aws.StringValue(input.Marker) {
+			start++
+		}
+		for {
+			end := start + int(aws.Int64Value(input.MaxKeys))
+			if end > len(keys) {
+				end = len(keys)
+			}
+			var contents []*s3.Object
+			for _, key := range keys[start:end] {
+				contents = append(contents, &s3.Object{Key: aws.String(key), LastModified: &time.Time{}, Size: aws.Int64(1)})
+			}
+			truncated := end < len(keys)
+			if !fn(&s3.ListObjectsOutput{Contents: contents, IsTruncated: aws.Bool(truncated)}, !truncated) || !truncated {
+				return nil
+			}
+			start = end
+		}
+	}
+}
+
+func TestStore_Search_MissingNextMarker(t *testing.T) {
+	var keys []string
+	for i := 0; i < 2500; i++ {
+		keys = append(keys, fmt.Sprintf("%04d", i))
+	}
+	var markers []string
+	list := listObjectsMock(keys)
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			// Like DigitalOcean Spaces, truncated responses have no
+			// NextMarker, so the SDK cannot request the next page itself.
+			listObjectsPagesWithContext: func(ctx aws.Context, input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, opts ...request.Option) error {
+				markers = append(markers, aws.StringValue(input.Marker))
+				return list(ctx, input, func(resp *s3.ListObjectsOutput, last bool) bool {
+					fn(resp, last)
+					return false
+				}, opts...)
+			},
+		},
+	}
+	actual, err := store.Search(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(keys, actual.Names()); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"", "0999", "1999"}, markers); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestStore_SearchPage_NextMarker(t *testing.T) {
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			listObjectsPagesWithContext: func(_ aws.Context, _ *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, _ ...request.Option) error {
+				fn(&s3.ListObjectsOutput{
+					Contents: []*s3.Object{
+						{Key: aws.String("a"), LastModified: &time.Time{}, Size: aws.Int64(1)},
+					},
+					IsTruncated: aws.Bool(true),
+					NextMarker:  aws.String("b"),
+				}, false)
+				return nil
+			},
+		},
+	}
+	_, next, err := store.SearchPage(context.Background(), "", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != "b" {
+		t.Fatalf("expected NextMarker to be used as the cursor, got %s", next)
+	}
+}
+
+func TestStore_SearchPage(t *testing.T) {
+	var keys []string
+	for i := 0; i < 2500; i++ {
+		keys = append(keys, fmt.Sprintf("%04d", i))
+	}
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3:     &s3mock{listObjectsPagesWithContext: listObjectsMock(keys)},
+	}
+	expected, err := store.Search(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual file.List
+	pages := 0
+	cursor := ""
+	for {
+		page, next, err := store.SearchPage(context.Background(), "", cursor, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		actual = append(actual, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if pages != 3 {
+		t.Fatalf("expected 3 pages, got %d", pages)
+	}
+	if diff := cmp.Diff(expected.Names(), actual.Names()); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
 func TestStore_Delete(t *testing.T) {
 	called := false
 	expectedBucket := "bucket"
@@ -231,6 +473,71 @@ func TestStore_Put_Failure(t *testing.T) {
 	}
 }
 
+func TestStore_WithProgress(t *testing.T) {
+	content := []byte("progress")
+	table := map[string]struct {
+		put      func(*objectstore.Store) error
+		seekable bool
+	}{
+		"put": {
+			put: func(store *objectstore.Store) error {
+				return store.Put(context.Background(), bytes.NewBuffer(content), "test", time.Now())
+			},
+		},
+		"put seekable": {
+			put: func(store *objectstore.Store) error {
+				return store.PutSeekable(context.Background(), bytes.NewReader(content), "test", time.Now(), int64(len(content)))
+			},
+			seekable: true,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var progress []int64
+			store := &objectstore.Store{
+				Uploader: &s3UploaderMock{
+					uploadWithContext: func(_ aws.Context, input *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+						buf := make([]byte, 4)
+						for {
+							if _, err := input.Body.Read(buf); err == io.EOF {
+								break
+							}
+						}
+						seeker, ok := input.Body.(io.Seeker)
+						if ok != test.seekable {
+							t.Fatalf("expected seekable body to be %v", test.seekable)
+						}
+						if ok {
+							if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+								t.Fatal(err)
+							}
+							input.Body.Read(buf)
+						}
+						return nil, nil
+					},
+				},
+			}
+			withProgress := store.WithProgress(func(uploaded int64) {
+				progress = append(progress, uploaded)
+			})
+			if store.ProgressFn != nil {
+				t.Fatal("expected original store to be unchanged")
+			}
+			if err := test.put(withProgress); err != nil {
+				t.Fatal(err)
+			}
+			expected := []int64{4, 8}
+			if test.seekable {
+				expected = append(expected, 4)
+			}
+			if diff := cmp.Diff(expected, progress); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
 func TestStore_Concat(t *testing.T) {
 	expected := [][]byte{[]byte("foo"), []byte("bar")}
 	var input []string
@@ -280,3 +587,1321 @@ func TestStore_ConcatFail(t *testing.T) {
 		t.Fatalf("expected error %s, got %s", err, expectedErr)
 	}
 }
+
+func TestStore_ConcatPartialFailure(t *testing.T) {
+	store := &objectstore.Store{
+		Bucket: "test",
+		S3: &s3mock{
+			getObjectWithContext: func(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+				if *input.Key == "bar" {
+					return nil, awserr.New(s3.ErrCodeNoSuchKey, "missing", nil)
+				}
+				return &s3.GetObjectOutput{
+					ContentLength: aws.Int64(3),
+					LastModified:  aws.Time(time.Now()),
+					Body:          ioutil.NopCloser(bytes.NewReader([]byte(*input.Key))),
+				}, nil
+			},
+		},
+	}
+	actual, err := store.Concat(context.Background(), 2, []string{"foo", "bar", "baz"})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected failing to read one object to fail with %s, got %v", os.ErrNotExist, err)
+	}
+	if actual != nil {
+		t.Fatalf("expected no content, got %s", actual)
+	}
+}
+
+func TestStore_Append(t *testing.T) {
+	existing := []byte("foo")
+	var uploaded []byte
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			headObjectWithContext: func(_ aws.Context, _ *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+				return &s3.HeadObjectOutput{
+					ContentLength: aws.Int64(int64(len(existing))),
+					LastModified:  aws.Time(time.Now()),
+				}, nil
+			},
+			getObjectWithContext: func(_ aws.Context, _ *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+				return &s3.GetObjectOutput{
+					ContentLength: aws.Int64(int64(len(existing))),
+					LastModified:  aws.Time(time.Now()),
+					Body:          ioutil.NopCloser(bytes.NewReader(existing)),
+					Metadata:      map[string]*string{},
+				}, nil
+			},
+		},
+		Uploader: &s3UploaderMock{
+			uploadWithContext: func(_ aws.Context, input *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+				uploaded, _ = ioutil.ReadAll(input.Body)
+				return &s3manager.UploadOutput{}, nil
+			},
+		},
+	}
+	if err := store.Append(context.Background(), "test", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte("foobar"), uploaded) {
+		t.Fatalf("expected foobar to be uploaded, got %s", uploaded)
+	}
+}
+
+func TestStore_Exists(t *testing.T) {
+	failure := errors.New("network failure")
+	table := map[string]struct {
+		headErr     error
+		expected    bool
+		expectedErr error
+	}{
+		"existing objects are found": {
+			expected: true,
+		},
+		"missing objects are not found": {
+			headErr:  awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "id"),
+			expected: false,
+		},
+		"other failures are returned": {
+			headErr:     failure,
+			expectedErr: failure,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			store := &objectstore.Store{
+				Bucket: "bucket",
+				S3: &s3mock{
+					headObjectWithContext: func(_ aws.Context, _ *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+						if test.headErr != nil {
+							return nil, test.headErr
+						}
+						return &s3.HeadObjectOutput{
+							ContentLength: aws.Int64(0),
+							LastModified:  aws.Time(time.Now()),
+						}, nil
+					},
+				},
+			}
+			actual, err := store.Exists(context.Background(), "test")
+			if test.expectedErr != nil && !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error %s, got %v", test.expectedErr, err)
+			}
+			if test.expectedErr == nil && err != nil {
+				t.Fatal(err)
+			}
+			if test.expected != actual {
+				t.Fatalf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestStore_Exists_FallbackToSearch(t *testing.T) {
+	forbidden := awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), 403, "id")
+	table := map[string]struct {
+		fallback       bool
+		keys           []string
+		expected       bool
+		expectedErr    error
+		expectedListed bool
+	}{
+		"forbidden errors are returned without the fallback": {
+			keys:        []string{"test"},
+			expectedErr: forbidden,
+		},
+		"existing objects are found by searching": {
+			fallback:       true,
+			keys:           []string{"other", "test", "test-longer"},
+			expected:       true,
+			expectedListed: true,
+		},
+		"only exact matches are found by searching": {
+			fallback:       true,
+			keys:           []string{"test-longer"},
+			expected:       false,
+			expectedListed: true,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			listed := false
+			var verbose bytes.Buffer
+			store := &objectstore.Store{
+				Bucket:                 "bucket",
+				ExistsFallbackToSearch: test.fallback,
+				Verbose:                log.New(&verbose, "", 0),
+				S3: &s3mock{
+					headObjectWithContext: func(_ aws.Context, _ *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+						return nil, forbidden
+					},
+					listObjectsPagesWithContext: func(ctx aws.Context, input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, opts ...request.Option) error {
+						listed = true
+						var matching []string
+						for _, key := range test.keys {
+							if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+								matching = append(matching, key)
+							}
+						}
+						// Listing honours the prefix, which listObjectsMock
+						// does not.
+						return listObjectsMock(matching)(ctx, input, fn, opts...)
+					},
+				},
+			}
+			actual, err := store.Exists(context.Background(), "test")
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error %v, got %v", test.expectedErr, err)
+			}
+			if test.expected != actual {
+				t.Fatalf("expected %v, got %v", test.expected, actual)
+			}
+			if test.expectedListed != listed {
+				t.Fatalf("expected listing to be %v, got %v", test.expectedListed, listed)
+			}
+			if logged := strings.Contains(verbose.String(), "HeadObject 403, falling back to Search"); logged != test.expectedListed {
+				t.Fatalf("expected fallback to be logged: %v, got %q", test.expectedListed, verbose.String())
+			}
+		})
+	}
+}
+
+func TestNewFromConfig_ExistsFallbackToSearch(t *testing.T) {
+	for value, expected := range map[string]bool{"": false, "false": false, "true": true} {
+		store, err := objectstore.NewFromConfig(map[string]string{"bucket": "test", "exists_fallback_to_search": value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if store.ExistsFallbackToSearch != expected {
+			t.Fatalf("expected %q to set fallback %v, got %v", value, expected, store.ExistsFallbackToSearch)
+		}
+	}
+}
+
+func TestStore_PutIfAbsent(t *testing.T) {
+	table := map[string]struct {
+		headErr  error
+		expected bool
+	}{
+		"existing objects are not overwritten": {
+			expected: false,
+		},
+		"missing objects are stored": {
+			headErr:  awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "id"),
+			expected: true,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			uploaded := false
+			store := &objectstore.Store{
+				Bucket: "bucket",
+				S3: &s3mock{
+					headObjectWithContext: func(_ aws.Context, _ *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+						if test.headErr != nil {
+							return nil, test.headErr
+						}
+						return &s3.HeadObjectOutput{
+							ContentLength: aws.Int64(0),
+							LastModified:  aws.Time(time.Now()),
+						}, nil
+					},
+				},
+				Uploader: &s3UploaderMock{
+					uploadWithContext: func(_ aws.Context, _ *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+						uploaded = true
+						return nil, nil
+					},
+				},
+			}
+			stored, err := store.PutIfAbsent(context.Background(), bytes.NewReader([]byte("test")), "test", time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored != test.expected || uploaded != test.expected {
+				t.Fatalf("expected stored and uploaded to be %v, got %v and %v", test.expected, stored, uploaded)
+			}
+		})
+	}
+}
+
+func TestStore_PreSignURL(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	client := s3.New(sess)
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			getObjectRequest: func(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+				if *input.Bucket != "bucket" || *input.Key != "test" {
+					t.Fatalf("expected bucket/test to be signed, got %s/%s", *input.Bucket, *input.Key)
+				}
+				return client.GetObjectRequest(input)
+			},
+		},
+	}
+	url, err := store.PreSignURL(context.Background(), "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"bucket.s3.amazonaws.com/test?", "X-Amz-Expires=3600", "X-Amz-Signature="} {
+		if !strings.Contains(url, expected) {
+			t.Fatalf("expected %s to contain %s", url, expected)
+		}
+	}
+}
+
+func TestStore_Tag(t *testing.T) {
+	var sent *s3.Tagging
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			getObjectTaggingWithContext: func(_ aws.Context, input *s3.GetObjectTaggingInput, _ ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+				if *input.Bucket != "bucket" || *input.Key != "test" {
+					t.Fatalf("expected tags of bucket/test to be read, got %s/%s", *input.Bucket, *input.Key)
+				}
+				return &s3.GetObjectTaggingOutput{TagSet: []*s3.Tag{
+					{Key: aws.String("owner"), Value: aws.String("me")},
+					{Key: aws.String("tier"), Value: aws.String("hot")},
+				}}, nil
+			},
+			putObjectTaggingWithContext: func(_ aws.Context, input *s3.PutObjectTaggingInput, _ ...request.Option) (*s3.PutObjectTaggingOutput, error) {
+				if *input.Bucket != "bucket" || *input.Key != "test" {
+					t.Fatalf("expected bucket/test to be tagged, got %s/%s", *input.Bucket, *input.Key)
+				}
+				sent = input.Tagging
+				return &s3.PutObjectTaggingOutput{}, nil
+			},
+		},
+	}
+	if err := store.Tag(context.Background(), "test", map[string]string{"tier": "cold", "project": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := &s3.Tagging{TagSet: []*s3.Tag{
+		{Key: aws.String("owner"), Value: aws.String("me")},
+		{Key: aws.String("project"), Value: aws.String("x")},
+		{Key: aws.String("tier"), Value: aws.String("cold")},
+	}}
+	if diff := cmp.Diff(expected, sent); diff != "" {
+		t.Fatal(diff)
+	}
+	tooMany := map[string]string{}
+	for i := 0; i < objectstore.MaxTags; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+	if err := store.Tag(context.Background(), "test", tooMany); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+	}
+	tags, err := store.GetTags(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]string{"owner": "me", "tier": "hot"}, tags); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestStore_Versioner(t *testing.T) {
+	var copies []*s3.CopyObjectInput
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			headObjectWithContext: func(_ aws.Context, input *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+				return &s3.HeadObjectOutput{
+					ContentType: aws.String("text/plain"),
+					Metadata:    map[string]*string{"Memorybox-Last-Modified": aws.String("1")},
+				}, nil
+			},
+			copyObjectWithContext: func(_ aws.Context, input *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+				copies = append(copies, input)
+				return &s3.CopyObjectOutput{VersionId: aws.String("v3")}, nil
+			},
+			listObjectVersionsPagesWithContext: func(_ aws.Context, input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool, _ ...request.Option) error {
+				if *input.Prefix != "test" {
+					return nil
+				}
+				fn(&s3.ListObjectVersionsOutput{Versions: []*s3.ObjectVersion{
+					{Key: aws.String("test"), VersionId: aws.String("v2")},
+					{Key: aws.String("test-other"), VersionId: aws.String("x")},
+				}}, false)
+				fn(&s3.ListObjectVersionsOutput{Versions: []*s3.ObjectVersion{
+					{Key: aws.String("test"), VersionId: aws.String("v1")},
+				}}, true)
+				return nil
+			},
+		},
+	}
+	ctx := context.Background()
+	versionID, err := store.Snapshot(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versionID != "v3" {
+		t.Fatalf("expected version v3, got %s", versionID)
+	}
+	versions, err := store.ListVersions(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"v2", "v1"}, versions); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := store.ListVersions(ctx, "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+	if err := store.RestoreVersion(ctx, "test", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []*s3.CopyObjectInput{
+		{
+			Bucket:            aws.String("bucket"),
+			Key:               aws.String("test"),
+			CopySource:        aws.String("bucket/test"),
+			ContentType:       aws.String("text/plain"),
+			Metadata:          map[string]*string{"Memorybox-Last-Modified": aws.String("1")},
+			MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		},
+		{
+			Bucket:            aws.String("bucket"),
+			Key:               aws.String("test"),
+			CopySource:        aws.String("bucket/test?versionId=v1"),
+			MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+		},
+	}
+	if diff := cmp.Diff(expected, copies); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestStore_VerifyVersioning(t *testing.T) {
+	denied := errors.New("denied")
+	table := map[string]struct {
+		status      *string
+		err         error
+		expectedErr error
+	}{
+		"enabled": {
+			status: aws.String(s3.BucketVersioningStatusEnabled),
+		},
+		"suspended": {
+			status:      aws.String(s3.BucketVersioningStatusSuspended),
+			expectedErr: os.ErrInvalid,
+		},
+		"never enabled": {
+			expectedErr: os.ErrInvalid,
+		},
+		"request failure": {
+			err:         denied,
+			expectedErr: denied,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			store := &objectstore.Store{
+				Bucket: "bucket",
+				S3: &s3mock{
+					getBucketVersioningWithContext: func(_ aws.Context, input *s3.GetBucketVersioningInput, _ ...request.Option) (*s3.GetBucketVersioningOutput, error) {
+						if *input.Bucket != "bucket" {
+							t.Fatalf("expected bucket to be checked, got %s", *input.Bucket)
+						}
+						return &s3.GetBucketVersioningOutput{Status: test.status}, test.err
+					},
+				},
+			}
+			if err := store.VerifyVersioning(context.Background()); !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestStore_Compact(t *testing.T) {
+	old := aws.Time(time.Now().Add(-48 * time.Hour))
+	recent := aws.Time(time.Now().Add(-time.Hour))
+	pages := []*s3.ListMultipartUploadsOutput{
+		{
+			Uploads: []*s3.MultipartUpload{
+				{Key: aws.String("a"), UploadId: aws.String("a1"), Initiated: old},
+				{Key: aws.String("b"), UploadId: aws.String("b1"), Initiated: recent},
+			},
+			IsTruncated:        aws.Bool(true),
+			NextKeyMarker:      aws.String("b"),
+			NextUploadIdMarker: aws.String("b1"),
+		},
+		{
+			Uploads: []*s3.MultipartUpload{
+				{Key: aws.String("c"), UploadId: aws.String("c1"), Initiated: old},
+			},
+			IsTruncated: aws.Bool(false),
+		},
+	}
+	var mu sync.Mutex
+	var aborted []string
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			listMultipartUploadsWithContext: func(_ aws.Context, input *s3.ListMultipartUploadsInput, _ ...request.Option) (*s3.ListMultipartUploadsOutput, error) {
+				if input.KeyMarker == nil {
+					return pages[0], nil
+				}
+				if *input.KeyMarker != "b" || *input.UploadIdMarker != "b1" {
+					t.Fatalf("expected listing to continue after b/b1, got %s/%s", *input.KeyMarker, *input.UploadIdMarker)
+				}
+				return pages[1], nil
+			},
+			listPartsPagesWithContext: func(_ aws.Context, input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool, _ ...request.Option) error {
+				fn(&s3.ListPartsOutput{Parts: []*s3.Part{{Size: aws.Int64(5)}, {Size: aws.Int64(10)}}}, true)
+				return nil
+			},
+			abortMultipartUploadWithContext: func(_ aws.Context, input *s3.AbortMultipartUploadInput, _ ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				aborted = append(aborted, *input.Key+"/"+*input.UploadId)
+				return &s3.AbortMultipartUploadOutput{}, nil
+			},
+		},
+	}
+	report, err := store.Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&archive.CompactReport{AbortedUploads: 2, FreedBytes: 30}, report); diff != "" {
+		t.Fatal(diff)
+	}
+	sort.Strings(aborted)
+	if diff := cmp.Diff([]string{"a/a1", "c/c1"}, aborted); diff != "" {
+		t.Fatal(diff)
+	}
+	aborted = nil
+	store.CompactMaxAge = 30 * time.Minute
+	if _, err := store.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(aborted) != 3 {
+		t.Fatalf("expected every upload older than the max age to be aborted, got %v", aborted)
+	}
+	configured, err := objectstore.NewFromConfig(map[string]string{"compact_max_age_hours": "72"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configured.CompactMaxAge != 72*time.Hour {
+		t.Fatalf("expected max age of 72h, got %s", configured.CompactMaxAge)
+	}
+	if _, err := objectstore.NewFromConfig(map[string]string{"compact_max_age_hours": "soon"}); err == nil {
+		t.Fatal("expected invalid compact_max_age_hours to fail")
+	}
+}
+
+func TestStore_Compact_Failure(t *testing.T) {
+	failure := errors.New("denied")
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			listMultipartUploadsWithContext: func(_ aws.Context, input *s3.ListMultipartUploadsInput, _ ...request.Option) (*s3.ListMultipartUploadsOutput, error) {
+				return &s3.ListMultipartUploadsOutput{Uploads: []*s3.MultipartUpload{
+					{Key: aws.String("a"), UploadId: aws.String("a1"), Initiated: aws.Time(time.Time{})},
+				}}, nil
+			},
+			listPartsPagesWithContext: func(aws.Context, *s3.ListPartsInput, func(*s3.ListPartsOutput, bool) bool, ...request.Option) error {
+				return nil
+			},
+			abortMultipartUploadWithContext: func(aws.Context, *s3.AbortMultipartUploadInput, ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+				return nil, failure
+			},
+		},
+	}
+	if _, err := store.Compact(context.Background()); !errors.Is(err, failure) {
+		t.Fatalf("expected %s, got %v", failure, err)
+	}
+	store.S3.(*s3mock).listMultipartUploadsWithContext = func(aws.Context, *s3.ListMultipartUploadsInput, ...request.Option) (*s3.ListMultipartUploadsOutput, error) {
+		return nil, failure
+	}
+	if _, err := store.Compact(context.Background()); !errors.Is(err, failure) {
+		t.Fatalf("expected %s, got %v", failure, err)
+	}
+}
+
+func TestNewFromConfig_Tags(t *testing.T) {
+	store, err := objectstore.NewFromConfig(map[string]string{"bucket": "test", "tags": `{"owner":"me"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]string{"owner": "me"}, store.Tags); diff != "" {
+		t.Fatal(diff)
+	}
+	for _, tags := range []string{`["owner"]`, `{"a":"1","b":"2","c":"3","d":"4","e":"5","f":"6","g":"7","h":"8","i":"9","j":"10","k":"11"}`} {
+		if _, err := objectstore.NewFromConfig(map[string]string{"bucket": "test", "tags": tags}); !errors.Is(err, os.ErrInvalid) {
+			t.Fatalf("expected %s for %s, got %v", os.ErrInvalid, tags, err)
+		}
+	}
+}
+
+func TestStore_Put_Tags(t *testing.T) {
+	expected := "owner=me&tier=hot"
+	tags := map[string]string{"tier": "hot", "owner": "me"}
+	var putTagging, uploadTagging string
+	store := &objectstore.Store{
+		Bucket:    "bucket",
+		Tags:      tags,
+		Multipart: objectstore.Multipart{Threshold: 8},
+		S3: &s3mock{
+			putObjectWithContext: func(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+				putTagging = aws.StringValue(input.Tagging)
+				return &s3.PutObjectOutput{}, nil
+			},
+		},
+		Uploader: &s3UploaderMock{
+			uploadWithContext: func(_ aws.Context, input *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+				uploadTagging = aws.StringValue(input.Tagging)
+				return &s3manager.UploadOutput{}, nil
+			},
+		},
+	}
+	if err := store.Put(context.Background(), strings.NewReader("small"), "small", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(context.Background(), strings.NewReader("larger than threshold"), "large", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if putTagging != expected || uploadTagging != expected {
+		t.Fatalf("expected %s to be applied to every put, got %q and %q", expected, putTagging, uploadTagging)
+	}
+}
+
+func TestMultipartFromConfig(t *testing.T) {
+	mb := int64(1024 * 1024)
+	table := map[string]struct {
+		config      map[string]string
+		expected    objectstore.Multipart
+		expectedErr bool
+	}{
+		"defaults are used when nothing is configured": {
+			config:   map[string]string{},
+			expected: objectstore.DefaultMultipart,
+		},
+		"package defaults match DefaultMultipart": {
+			config:   objectstore.Defaults,
+			expected: objectstore.DefaultMultipart,
+		},
+		"configured values are used": {
+			config: map[string]string{
+				"multipart_threshold_mb": "10",
+				"multipart_part_size_mb": "50",
+				"multipart_concurrency":  "3",
+			},
+			expected: objectstore.Multipart{Threshold: 10 * mb, PartSize: 50 * mb, Concurrency: 3},
+		},
+		"invalid sizes fail": {
+			config:      map[string]string{"multipart_threshold_mb": "big"},
+			expectedErr: true,
+		},
+		"part sizes below the s3 minimum fail": {
+			config:      map[string]string{"multipart_part_size_mb": "1"},
+			expectedErr: true,
+		},
+		"invalid concurrency fails": {
+			config:      map[string]string{"multipart_concurrency": "0"},
+			expectedErr: true,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			actual, err := objectstore.MultipartFromConfig(test.config)
+			if test.expectedErr && err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if !test.expectedErr && err != nil {
+				t.Fatal(err)
+			}
+			if err == nil && !reflect.DeepEqual(test.expected, actual) {
+				t.Fatalf("expected %#v, got %#v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMultipart_Configure(t *testing.T) {
+	multipart := objectstore.Multipart{Threshold: 1, PartSize: 10 * 1024 * 1024, Concurrency: 2}
+	uploader := &s3manager.Uploader{}
+	multipart.Configure(uploader)
+	if uploader.PartSize != multipart.PartSize {
+		t.Fatalf("expected part size %d, got %d", multipart.PartSize, uploader.PartSize)
+	}
+	if uploader.Concurrency != multipart.Concurrency {
+		t.Fatalf("expected concurrency %d, got %d", multipart.Concurrency, uploader.Concurrency)
+	}
+	if uploader.BufferProvider == nil {
+		t.Fatal("expected buffer provider to be set")
+	}
+}
+
+func TestStore_Put_Threshold(t *testing.T) {
+	table := map[string]struct {
+		content           []byte
+		expectedPutObject bool
+	}{
+		"content below the threshold is put in one request": {
+			content:           []byte("tiny"),
+			expectedPutObject: true,
+		},
+		"content at the threshold is uploaded": {
+			content:           []byte("large"),
+			expectedPutObject: false,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var putObject bool
+			var uploaded []byte
+			store := &objectstore.Store{
+				Bucket:    "bucket",
+				Multipart: objectstore.Multipart{Threshold: 5},
+				S3: &s3mock{
+					putObjectWithContext: func(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+						putObject = true
+						uploaded, _ = ioutil.ReadAll(input.Body)
+						return &s3.PutObjectOutput{}, nil
+					},
+				},
+				Uploader: &s3UploaderMock{
+					uploadWithContext: func(_ aws.Context, input *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+						uploaded, _ = ioutil.ReadAll(input.Body)
+						return &s3manager.UploadOutput{}, nil
+					},
+				},
+			}
+			if err := store.Put(context.Background(), bytes.NewReader(test.content), "test", time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			if putObject != test.expectedPutObject {
+				t.Fatalf("expected PutObject to be used: %v", test.expectedPutObject)
+			}
+			if !bytes.Equal(test.content, uploaded) {
+				t.Fatalf("expected %s to be uploaded, got %s", test.content, uploaded)
+			}
+		})
+	}
+}
+
+func TestStore_PutSeekable(t *testing.T) {
+	table := map[string]struct {
+		content           []byte
+		expectedPutObject bool
+	}{
+		"content below the threshold is put with its length": {
+			content:           []byte("tiny"),
+			expectedPutObject: true,
+		},
+		"content at the threshold is uploaded unbuffered": {
+			content:           []byte("large"),
+			expectedPutObject: false,
+		},
+	}
+	for name, test := range table {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var putObject bool
+			reader := bytes.NewReader(test.content)
+			store := &objectstore.Store{
+				Bucket:    "bucket",
+				Multipart: objectstore.Multipart{Threshold: 5},
+				S3: &s3mock{
+					putObjectWithContext: func(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+						putObject = true
+						if input.ContentLength == nil || *input.ContentLength != int64(len(test.content)) {
+							t.Fatalf("expected content length %d, got %v", len(test.content), input.ContentLength)
+						}
+						if input.Body != reader {
+							t.Fatal("expected seekable reader to be passed through")
+						}
+						return &s3.PutObjectOutput{}, nil
+					},
+				},
+				Uploader: &s3UploaderMock{
+					uploadWithContext: func(_ aws.Context, input *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+						if input.Body != reader {
+							t.Fatal("expected seekable reader to be passed through")
+						}
+						return &s3manager.UploadOutput{}, nil
+					},
+				},
+			}
+			if err := store.PutSeekable(context.Background(), reader, "test", time.Now(), int64(len(test.content))); err != nil {
+				t.Fatal(err)
+			}
+			if putObject != test.expectedPutObject {
+				t.Fatalf("expected PutObject to be used: %v", test.expectedPutObject)
+			}
+		})
+	}
+}
+
+func TestStore_MultiPut(t *testing.T) {
+	var files []*file.File
+	for i := 0; i < 5; i++ {
+		f, err := file.NewFromBytes("", []byte(fmt.Sprintf("content %d", i)), file.Sha256)
+		if err != nil {
+			t.Fatalf("test setup: %s", err)
+		}
+		files = append(files, f)
+	}
+	failing := map[string]bool{files[1].Name: true, files[3].Name: true}
+	var mu sync.Mutex
+	stored := map[string]string{}
+	store := &objectstore.Store{
+		Bucket:    "bucket",
+		Multipart: objectstore.Multipart{Threshold: 1024},
+		S3: &s3mock{
+			putObjectWithContext: func(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+				if failing[*input.Key] {
+					return nil, errors.New("put failed")
+				}
+				data, err := ioutil.ReadAll(input.Body)
+				if err != nil {
+					return nil, err
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				stored[*input.Key] = string(data)
+				return &s3.PutObjectOutput{}, nil
+			},
+		},
+	}
+	err := store.MultiPut(context.Background(), files)
+	if err == nil {
+		t.Fatal("expected failures to be returned")
+	}
+	for index, f := range files {
+		if failing[f.Name] {
+			if !strings.Contains(err.Error(), f.Name) {
+				t.Fatalf("expected failure of %s to be reported, got %s", f.Name, err)
+			}
+			continue
+		}
+		if expected := fmt.Sprintf("content %d", index); stored[f.Name] != expected {
+			t.Fatalf("expected %s to be stored as %q, got %q", f.Name, expected, stored[f.Name])
+		}
+	}
+	failing = map[string]bool{}
+	for _, f := range files {
+		f.Seek(0, io.SeekStart)
+	}
+	if err := store.MultiPut(context.Background(), files); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 5 {
+		t.Fatalf("expected 5 files to be stored, got %d", len(stored))
+	}
+}
+
+func TestStore_GetRange(t *testing.T) {
+	content := []byte("hello")
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			getObjectWithContext: func(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+				if input.Range == nil || *input.Range != "bytes=0-3" {
+					t.Fatalf("expected range bytes=0-3, got %v", input.Range)
+				}
+				return &s3.GetObjectOutput{
+					Body: ioutil.NopCloser(bytes.NewReader(content[0:4])),
+				}, nil
+			},
+		},
+	}
+	body, err := store.GetRange(context.Background(), "test", 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	actual, readErr := ioutil.ReadAll(body)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if !bytes.Equal([]byte("hell"), actual) {
+		t.Fatalf("expected hell, got %s", actual)
+	}
+	if _, err := store.GetRange(context.Background(), "test", 3, 0); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("expected %s, got %v", os.ErrInvalid, err)
+	}
+}
+
+// brokenBody returns its content and then fails as if the connection dropped.
+type brokenBody struct {
+	io.Reader
+}
+
+func (b brokenBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestStore_Get_ReadRetries(t *testing.T) {
+	content := []byte("hello world")
+	var ranges []string
+	store := &objectstore.Store{
+		Bucket:      "bucket",
+		ReadRetries: 1,
+		S3: &s3mock{
+			getObjectWithContext: func(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+				if input.Range == nil {
+					return &s3.GetObjectOutput{
+						ContentLength: aws.Int64(int64(len(content))),
+						LastModified:  aws.Time(time.Now()),
+						Body:          ioutil.NopCloser(brokenBody{bytes.NewReader(content[:5])}),
+					}, nil
+				}
+				ranges = append(ranges, *input.Range)
+				return &s3.GetObjectOutput{
+					Body: ioutil.NopCloser(bytes.NewReader(content[5:])),
+				}, nil
+			},
+		},
+	}
+	f, err := store.Get(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	actual, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, actual) {
+		t.Fatalf("expected %s, got %s", content, actual)
+	}
+	if diff := cmp.Diff([]string{"bytes=5-10"}, ranges); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := objectstore.NewFromConfig(map[string]string{"read_retries": "-1"}); err == nil {
+		t.Fatal("expected negative read_retries to fail")
+	}
+}
+
+func TestStore_Rename(t *testing.T) {
+	var calls []string
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			headObjectWithContext: func(_ aws.Context, _ *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+				return &s3.HeadObjectOutput{ContentLength: aws.Int64(1)}, nil
+			},
+			copyObjectWithContext: func(_ aws.Context, input *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+				calls = append(calls, fmt.Sprintf("copy %s to %s", *input.CopySource, *input.Key))
+				return &s3.CopyObjectOutput{}, nil
+			},
+			deleteObjectWithContext: func(_ aws.Context, input *s3.DeleteObjectInput, _ ...request.Option) (*s3.DeleteObjectOutput, error) {
+				calls = append(calls, fmt.Sprintf("delete %s", *input.Key))
+				return &s3.DeleteObjectOutput{}, nil
+			},
+		},
+	}
+	if err := store.Rename(context.Background(), "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"copy bucket/old to new", "delete old"}, calls); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestStore_Rename_Missing(t *testing.T) {
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			headObjectWithContext: func(_ aws.Context, _ *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+				return nil, awserr.New("NotFound", "missing", nil)
+			},
+		},
+	}
+	if err := store.Rename(context.Background(), "old", "new"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestStore_ServerSideCopy(t *testing.T) {
+	var inputs []*s3.CopyObjectInput
+	store := &objectstore.Store{
+		Bucket: "dest",
+		S3: &s3mock{
+			headObjectWithContext: func(_ aws.Context, _ *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+				return &s3.HeadObjectOutput{ContentLength: aws.Int64(1)}, nil
+			},
+			copyObjectWithContext: func(_ aws.Context, input *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+				inputs = append(inputs, input)
+				return &s3.CopyObjectOutput{}, nil
+			},
+		},
+	}
+	if err := store.ServerSideCopy(context.Background(), "source", "a b", "dest", "a b"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []*s3.CopyObjectInput{{
+		Bucket:            aws.String("dest"),
+		Key:               aws.String("a b"),
+		CopySource:        aws.String("source/a%20b"),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+	}}
+	if diff := cmp.Diff(expected, inputs); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestSync_ServerSideCopy(t *testing.T) {
+	var copied []string
+	source := &objectstore.Store{
+		Bucket: "source",
+		S3: &s3mock{
+			listObjectsPagesWithContext: func(_ aws.Context, _ *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, _ ...request.Option) error {
+				fn(&s3.ListObjectsOutput{
+					Contents: []*s3.Object{
+						{Key: aws.String("sha256-a"), Size: aws.Int64(1), LastModified: aws.Time(time.Now())},
+					},
+				}, true)
+				return nil
+			},
+			getObjectWithContext: func(_ aws.Context, _ *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+				t.Fatal("expected no content to be downloaded")
+				return nil, nil
+			},
+		},
+	}
+	dest := &objectstore.Store{
+		Bucket: "dest",
+		S3: &s3mock{
+			headObjectWithContext: func(_ aws.Context, input *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+				if *input.Bucket == "source" {
+					return &s3.HeadObjectOutput{ContentLength: aws.Int64(1)}, nil
+				}
+				return nil, awserr.New("NotFound", "missing", nil)
+			},
+			copyObjectWithContext: func(_ aws.Context, input *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+				copied = append(copied, fmt.Sprintf("%s to %s/%s", *input.CopySource, *input.Bucket, *input.Key))
+				return &s3.CopyObjectOutput{}, nil
+			},
+		},
+		Uploader: &s3UploaderMock{
+			uploadWithContext: func(_ aws.Context, _ *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+				t.Fatal("expected no content to be uploaded")
+				return nil, nil
+			},
+		},
+	}
+	logger := &archive.Logger{
+		Stdout:  log.New(ioutil.Discard, "", 0),
+		Stderr:  log.New(ioutil.Discard, "", 0),
+		Verbose: log.New(ioutil.Discard, "", 0),
+	}
+	if _, err := archive.Sync(context.Background(), logger, source, dest, "all", 1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"source/sha256-a to dest/sha256-a"}, copied); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestStore_ServerSideCopy_Parts(t *testing.T) {
+	const gb = 1024 * 1024 * 1024
+	var ranges []string
+	var completed []*s3.CompletedPart
+	store := &objectstore.Store{
+		Bucket: "dest",
+		S3: &s3mock{
+			headObjectWithContext: func(_ aws.Context, _ *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+				return &s3.HeadObjectOutput{
+					ContentLength: aws.Int64(5*gb + 1),
+					Metadata:      map[string]*string{"Memorybox-Last-Modified": aws.String("1")},
+				}, nil
+			},
+			copyObjectWithContext: func(_ aws.Context, _ *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+				t.Fatal("expected objects over 5GB to be copied in parts")
+				return nil, nil
+			},
+			createMultipartUploadWithContext: func(_ aws.Context, input *s3.CreateMultipartUploadInput, _ ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+				if diff := cmp.Diff(map[string]*string{"Memorybox-Last-Modified": aws.String("1")}, input.Metadata); diff != "" {
+					t.Fatalf("expected metadata to be copied: %s", diff)
+				}
+				return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+			},
+			uploadPartCopyWithContext: func(_ aws.Context, input *s3.UploadPartCopyInput, _ ...request.Option) (*s3.UploadPartCopyOutput, error) {
+				ranges = append(ranges, fmt.Sprintf("%d %s %s", *input.PartNumber, *input.CopySource, *input.CopySourceRange))
+				return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String(fmt.Sprintf("etag%d", *input.PartNumber))}}, nil
+			},
+			completeMultipartUploadWithContext: func(_ aws.Context, input *s3.CompleteMultipartUploadInput, _ ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+				completed = input.MultipartUpload.Parts
+				return &s3.CompleteMultipartUploadOutput{}, nil
+			},
+		},
+	}
+	if err := store.ServerSideCopy(context.Background(), "source", "big", "dest", "big"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		fmt.Sprintf("1 source/big bytes=0-%d", gb-1),
+		fmt.Sprintf("2 source/big bytes=%d-%d", gb, 2*gb-1),
+		fmt.Sprintf("3 source/big bytes=%d-%d", 2*gb, 3*gb-1),
+		fmt.Sprintf("4 source/big bytes=%d-%d", 3*gb, 4*gb-1),
+		fmt.Sprintf("5 source/big bytes=%d-%d", 4*gb, 5*gb-1),
+		fmt.Sprintf("6 source/big bytes=%d-%d", 5*gb, 5*gb),
+	}
+	if diff := cmp.Diff(expected, ranges); diff != "" {
+		t.Fatal(diff)
+	}
+	if len(completed) != 6 || *completed[5].ETag != "etag6" || *completed[5].PartNumber != 6 {
+		t.Fatalf("expected six completed parts, got %v", completed)
+	}
+}
+
+func TestStore_ServerSideCopy_PartFails(t *testing.T) {
+	aborted := false
+	store := &objectstore.Store{
+		Bucket: "dest",
+		S3: &s3mock{
+			headObjectWithContext: func(_ aws.Context, _ *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+				return &s3.HeadObjectOutput{ContentLength: aws.Int64(6 * 1024 * 1024 * 1024)}, nil
+			},
+			createMultipartUploadWithContext: func(_ aws.Context, _ *s3.CreateMultipartUploadInput, _ ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+				return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+			},
+			uploadPartCopyWithContext: func(_ aws.Context, _ *s3.UploadPartCopyInput, _ ...request.Option) (*s3.UploadPartCopyOutput, error) {
+				return nil, awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id")
+			},
+			abortMultipartUploadWithContext: func(_ aws.Context, input *s3.AbortMultipartUploadInput, _ ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+				aborted = *input.UploadId == "upload"
+				return &s3.AbortMultipartUploadOutput{}, nil
+			},
+		},
+	}
+	if err := store.ServerSideCopy(context.Background(), "source", "big", "dest", "big"); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected %s, got %v", os.ErrPermission, err)
+	}
+	if !aborted {
+		t.Fatal("expected the upload to be aborted")
+	}
+}
+
+func TestSync_ServerSideCopy_Denied(t *testing.T) {
+	var uploaded []string
+	source := &objectstore.Store{
+		Bucket: "source",
+		S3: &s3mock{
+			listObjectsPagesWithContext: func(_ aws.Context, _ *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, _ ...request.Option) error {
+				fn(&s3.ListObjectsOutput{
+					Contents: []*s3.Object{
+						{Key: aws.String("sha256-a"), Size: aws.Int64(1), LastModified: aws.Time(time.Now())},
+					},
+				}, true)
+				return nil
+			},
+			getObjectWithContext: func(_ aws.Context, _ *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+				return &s3.GetObjectOutput{
+					Body:          ioutil.NopCloser(strings.NewReader("a")),
+					ContentLength: aws.Int64(1),
+					LastModified:  aws.Time(time.Now()),
+				}, nil
+			},
+		},
+	}
+	dest := &objectstore.Store{
+		Bucket: "dest",
+		S3: &s3mock{
+			headObjectWithContext: func(_ aws.Context, input *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+				if *input.Bucket == "source" {
+					return nil, awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), 403, "id")
+				}
+				return nil, awserr.New("NotFound", "missing", nil)
+			},
+		},
+		Uploader: &s3UploaderMock{
+			uploadWithContext: func(_ aws.Context, input *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+				uploaded = append(uploaded, *input.Key)
+				return &s3manager.UploadOutput{}, nil
+			},
+		},
+	}
+	logger := &archive.Logger{
+		Stdout:  log.New(ioutil.Discard, "", 0),
+		Stderr:  log.New(ioutil.Discard, "", 0),
+		Verbose: log.New(ioutil.Discard, "", 0),
+	}
+	if _, err := archive.Sync(context.Background(), logger, source, dest, "all", 1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"sha256-a"}, uploaded); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestStore_Service(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	a := &objectstore.Store{Session: sess, Account: "profile:a"}
+	b := &objectstore.Store{Session: sess, Account: "profile:b"}
+	if a.SameService(b) {
+		t.Fatal("expected stores with different accounts to be different services")
+	}
+	if !a.SameService(&objectstore.Store{Session: sess, Account: "profile:a"}) {
+		t.Fatal("expected stores with the same account to be the same service")
+	}
+	for expected, config := range map[string]map[string]string{
+		"profile:backup": {"profile": "backup"},
+		"key:key":        {"access_key_id": "key"},
+	} {
+		store, err := objectstore.NewFromConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if store.Account != expected {
+			t.Fatalf("expected account %s, got %s", expected, store.Account)
+		}
+	}
+}
+
+// collect receives events until count have arrived, then stops the watch.
+func collect(t *testing.T, watch func(context.Context, chan<- archive.StoreEvent) error, count int) []archive.StoreEvent {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan archive.StoreEvent)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- watch(ctx, events)
+	}()
+	var actual []archive.StoreEvent
+	for len(actual) < count {
+		select {
+		case event := <-events:
+			actual = append(actual, event)
+		case err := <-watchErr:
+			t.Fatalf("expected watch to continue, got %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for events")
+		}
+	}
+	cancel()
+	if err := <-watchErr; err != nil {
+		t.Fatal(err)
+	}
+	return actual
+}
+
+func TestStore_Watch_Queue(t *testing.T) {
+	notification := func(bucket string, eventName string, key string) *string {
+		return aws.String(fmt.Sprintf(`{"Records":[{"eventName":%q,"s3":{"bucket":{"name":%q},"object":{"key":%q}}}]}`, eventName, bucket, key))
+	}
+	var mu sync.Mutex
+	messages := []*sqs.Message{
+		{Body: aws.String(`{"Event":"s3:TestEvent"}`), ReceiptHandle: aws.String("0")},
+		{Body: notification("bucket", "ObjectCreated:Put", "test+file"), ReceiptHandle: aws.String("1")},
+		{Body: notification("other", "ObjectCreated:Put", "test"), ReceiptHandle: aws.String("2")},
+		{Body: notification("bucket", "ObjectCreated:Put", "ignored"), ReceiptHandle: aws.String("3")},
+		{Body: notification("bucket", "ObjectRemoved:Delete", "test"), ReceiptHandle: aws.String("4")},
+	}
+	var deleted []string
+	store := &objectstore.Store{
+		Bucket:      "bucket",
+		SQSQueueURL: "queue",
+		SQS: &sqsMock{
+			receiveMessageWithContext: func(ctx aws.Context, input *sqs.ReceiveMessageInput, _ ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+				if *input.QueueUrl != "queue" {
+					t.Errorf("expected queue to be read, got %s", *input.QueueUrl)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if len(messages) == 0 {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				received := messages
+				messages = nil
+				return &sqs.ReceiveMessageOutput{Messages: received}, nil
+			},
+			deleteMessageWithContext: func(_ aws.Context, input *sqs.DeleteMessageInput, _ ...request.Option) (*sqs.DeleteMessageOutput, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				deleted = append(deleted, *input.ReceiptHandle)
+				return &sqs.DeleteMessageOutput{}, nil
+			},
+		},
+	}
+	actual := collect(t, func(ctx context.Context, events chan<- archive.StoreEvent) error {
+		return store.Watch(ctx, "test", events)
+	}, 2)
+	expected := []archive.StoreEvent{
+		{Type: archive.StoreEventPut, Name: "test file"},
+		{Type: archive.StoreEventDelete, Name: "test"},
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Fatal(diff)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(deleted) < 4 {
+		t.Fatalf("expected handled messages to be deleted, got %v", deleted)
+	}
+}
+
+func TestStore_Watch_Poll(t *testing.T) {
+	defer func(interval time.Duration) {
+		objectstore.WatchPollInterval = interval
+	}(objectstore.WatchPollInterval)
+	objectstore.WatchPollInterval = 10 * time.Millisecond
+	older := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	listings := [][]*s3.Object{
+		{
+			{Key: aws.String("changed"), LastModified: aws.Time(older), Size: aws.Int64(1)},
+			{Key: aws.String("removed"), LastModified: aws.Time(older), Size: aws.Int64(1)},
+			{Key: aws.String("same"), LastModified: aws.Time(older), Size: aws.Int64(1)},
+		},
+		{
+			{Key: aws.String("added"), LastModified: aws.Time(newer), Size: aws.Int64(1)},
+			{Key: aws.String("changed"), LastModified: aws.Time(newer), Size: aws.Int64(1)},
+			{Key: aws.String("same"), LastModified: aws.Time(older), Size: aws.Int64(1)},
+		},
+	}
+	var mu sync.Mutex
+	calls := 0
+	store := &objectstore.Store{
+		Bucket: "bucket",
+		S3: &s3mock{
+			listObjectsPagesWithContext: func(_ aws.Context, _ *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, _ ...request.Option) error {
+				mu.Lock()
+				defer mu.Unlock()
+				listing := listings[len(listings)-1]
+				if calls < len(listings) {
+					listing = listings[calls]
+				}
+				calls++
+				fn(&s3.ListObjectsOutput{Contents: listing}, true)
+				return nil
+			},
+		},
+	}
+	actual := collect(t, func(ctx context.Context, events chan<- archive.StoreEvent) error {
+		return store.Watch(ctx, "", events)
+	}, 3)
+	expected := []archive.StoreEvent{
+		{Type: archive.StoreEventPut, Name: "added"},
+		{Type: archive.StoreEventPut, Name: "changed"},
+		{Type: archive.StoreEventDelete, Name: "removed"},
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,157 @@
+// Package watch continuously puts files into an archive as they appear in a
+// directory.
+package watch
+
+import (
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultDebounce is how long a file must go without filesystem events before
+// it is considered for putting.
+const DefaultDebounce = 500 * time.Millisecond
+
+// Watcher puts new or modified files from a directory into a store.
+type Watcher struct {
+	Logger *archive.Logger
+	// Debounce controls how long to wait after the last event for a file
+	// before putting it. Defaults to DefaultDebounce.
+	Debounce time.Duration
+	// Set is recorded as the import set of every file put.
+	Set string
+	// OnPut is called with the metadata of every file that is put.
+	OnPut  func(*file.File)
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+	sizes  map[string]int64
+	puts   sync.WaitGroup
+}
+
+// Start watches dir until the supplied context is cancelled. Files still
+// being written, detected by their size changing between two checks, are
+// deferred until they stop changing. Puts that are in progress when the
+// context is cancelled are allowed to finish before Start returns.
+func (w *Watcher) Start(ctx context.Context, dir string, store archive.Store) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(dir); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.timers = map[string]*time.Timer{}
+	w.sizes = map[string]int64{}
+	w.mu.Unlock()
+	defer w.stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			w.Logger.Stderr.Printf("watch: %s", err)
+		case event := <-watcher.Events:
+			if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+				w.schedule(store, event.Name)
+			}
+		}
+	}
+}
+
+// stop cancels pending puts and waits for those in progress to finish.
+func (w *Watcher) stop() {
+	w.mu.Lock()
+	for path, timer := range w.timers {
+		if timer.Stop() {
+			w.puts.Done()
+		}
+		delete(w.timers, path)
+	}
+	w.timers = nil
+	w.mu.Unlock()
+	w.puts.Wait()
+}
+
+// schedule (re)starts the debounce timer for a path.
+func (w *Watcher) schedule(store archive.Store, path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timers == nil {
+		return
+	}
+	if timer, ok := w.timers[path]; ok && timer.Stop() {
+		w.puts.Done()
+	}
+	w.puts.Add(1)
+	w.timers[path] = time.AfterFunc(w.debounce(), func() {
+		defer w.puts.Done()
+		w.check(store, path)
+	})
+}
+
+// check puts a file if its size is unchanged since the last check, otherwise
+// it is checked again after another debounce period.
+func (w *Watcher) check(store archive.Store, path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		w.forget(path)
+		return
+	}
+	w.mu.Lock()
+	previous, seen := w.sizes[path]
+	w.sizes[path] = info.Size()
+	w.mu.Unlock()
+	if !seen || previous != info.Size() {
+		w.schedule(store, path)
+		return
+	}
+	w.forget(path)
+	if err := w.put(store, path, info.ModTime()); err != nil {
+		w.Logger.Stderr.Printf("%s: %s", path, err)
+	}
+}
+
+func (w *Watcher) forget(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.sizes, path)
+	if w.timers != nil {
+		delete(w.timers, path)
+	}
+}
+
+func (w *Watcher) put(store archive.Store, path string, lastModified time.Time) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	f, err := file.NewSha256(path, source, lastModified)
+	if err != nil {
+		return err
+	}
+	// Puts are not tied to the watch context so they complete during
+	// shutdown.
+	result, err := archive.Put(context.Background(), store, f, w.Set, file.MetaFileOptions{})
+	if err != nil {
+		return err
+	}
+	w.Logger.Verbose.Printf("%s put as %s", path, result.Name)
+	if w.OnPut != nil {
+		w.OnPut(result)
+	}
+	return nil
+}
+
+func (w *Watcher) debounce() time.Duration {
+	if w.Debounce == 0 {
+		return DefaultDebounce
+	}
+	return w.Debounce
+}
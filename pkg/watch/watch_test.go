@@ -0,0 +1,99 @@
+package watch_test
+
+import (
+	"context"
+	"github.com/tkellen/memorybox/pkg/archive"
+	"github.com/tkellen/memorybox/pkg/file"
+	"github.com/tkellen/memorybox/pkg/localdiskstore"
+	"github.com/tkellen/memorybox/pkg/watch"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatcher_Start(t *testing.T) {
+	dir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	storeDir, err := ioutil.TempDir("", "*")
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	defer os.RemoveAll(storeDir)
+	store := localdiskstore.New(storeDir)
+	put := make(chan *file.File, 10)
+	watcher := &watch.Watcher{
+		Logger: &archive.Logger{
+			Stdout:  log.New(ioutil.Discard, "", 0),
+			Stderr:  log.New(ioutil.Discard, "", 0),
+			Verbose: log.New(ioutil.Discard, "", 0),
+		},
+		Debounce: 50 * time.Millisecond,
+		OnPut: func(f *file.File) {
+			put <- f
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- watcher.Start(ctx, dir, store)
+	}()
+	// Give the watcher a moment to begin listening.
+	time.Sleep(100 * time.Millisecond)
+	// Write a file in pieces to simulate one still being written.
+	path := filepath.Join(dir, "file")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	for _, chunk := range []string{"first", "second", "third"} {
+		f.WriteString(chunk)
+		time.Sleep(30 * time.Millisecond)
+	}
+	f.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0644); err != nil {
+		t.Fatalf("test setup: %s", err)
+	}
+	expected := map[string]bool{}
+	for _, content := range []string{"firstsecondthird", "other"} {
+		name, _, _ := file.Sha256(strings.NewReader(content))
+		expected[name] = true
+	}
+	for len(expected) > 0 {
+		select {
+		case f := <-put:
+			if !expected[f.Name] {
+				t.Fatalf("unexpected or duplicate put of %s", f.Name)
+			}
+			delete(expected, f.Name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for puts, still expecting %v", expected)
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"firstsecondthird", "other"} {
+		name, _, _ := file.Sha256(strings.NewReader(content))
+		if _, err := store.Stat(context.Background(), name); err != nil {
+			t.Fatalf("expected %s in store, got %s", name, err)
+		}
+		if _, err := store.Stat(context.Background(), file.MetaNameFrom(name)); err != nil {
+			t.Fatalf("expected metafile for %s in store, got %s", name, err)
+		}
+	}
+}
+
+func TestWatcher_StartMissingDirectory(t *testing.T) {
+	watcher := &watch.Watcher{}
+	if err := watcher.Start(context.Background(), "/does/not/exist", localdiskstore.New(os.TempDir())); err == nil {
+		t.Fatal("expected error watching missing directory")
+	}
+}